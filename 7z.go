@@ -2,7 +2,6 @@ package xtractr
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"github.com/bodgit/sevenzip"
 )
@@ -24,13 +23,14 @@ func Extract7z(xFile *XFile) (size uint64, filesList, archiveList []string, err
 	for idx, password := range passwords {
 		// Copy the input so the retry keeps the logger, progress callbacks,
 		// SquashRoot and the rest of the caller-provided configuration.
-		attempt := *xFile
-		attempt.Password = password
+		attempt := xFile.retry(password)
 
-		size, files, archives, err := extract7z(&attempt)
+		size, files, archives, err := extract7z(attempt)
 		if err != nil && idx == len(passwords)-1 {
+			xFile.Warnings, xFile.ManifestEntries = attempt.Warnings, attempt.ManifestEntries
 			return size, files, archives, fmt.Errorf("used password %d of %d: %w", idx+1, len(passwords), err)
 		} else if err == nil {
+			xFile.Warnings, xFile.ManifestEntries = attempt.Warnings, attempt.ManifestEntries
 			return size, files, archives, nil
 		}
 	}
@@ -68,7 +68,7 @@ func extract7z(xFile *XFile) (uint64, []string, []string, error) {
 				fmt.Errorf("%s: %w", xFile.FilePath, err)
 		}
 
-		files = append(files, filepath.Join(xFile.OutputDir, zipFile.Name))
+		files = append(files, xFile.clean(zipFile.Name))
 		xFile.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
 			wfile, fSize, xFile.prog.Files, xFile.prog.Wrote)
 	}
@@ -128,10 +128,10 @@ func (x *XFile) sevenZipPrepareEntries(sevenZip *sevenzip.ReadCloser) ([]sevenZi
 				x.FilePath, zipFile.FileInfo().Name(), ErrInvalidPath, cleanPath, zipFile.Name)
 		}
 
-		files = append(files, filepath.Join(x.OutputDir, zipFile.Name))
+		files = append(files, cleanPath)
 
 		if zipFile.FileInfo().IsDir() {
-			err := x.mkDir(cleanPath, zipFile.Mode(), zipFile.Modified)
+			err := x.mkDirEntry(cleanPath, zipFile.Mode(), zipFile.Modified)
 			if err != nil {
 				return nil, files, fmt.Errorf("%s: making 7z dir: %w", x.FilePath, err)
 			}
@@ -155,6 +155,7 @@ func (x *XFile) extract7zEntry(entry sevenZipEntry) error {
 
 	fileInfo := &file{
 		Path:     x.clean(entry.sevenZipFile.Name),
+		Member:   entry.sevenZipFile.Name,
 		Data:     zFile,
 		FileMode: entry.sevenZipFile.Mode(),
 		DirMode:  x.DirMode,
@@ -180,6 +181,7 @@ func (x *XFile) un7zip(zipFile *sevenzip.File) (uint64, string, error) {
 
 	file := &file{
 		Path:     x.clean(zipFile.Name),
+		Member:   zipFile.Name,
 		Data:     zFile,
 		FileMode: zipFile.Mode(),
 		DirMode:  x.DirMode,
@@ -196,7 +198,7 @@ func (x *XFile) un7zip(zipFile *sevenzip.File) (uint64, string, error) {
 	if zipFile.FileInfo().IsDir() {
 		x.Debugf("Writing archived directory: %s", file.Path)
 
-		err := x.mkDir(file.Path, zipFile.Mode(), zipFile.Modified)
+		err := x.mkDirEntry(file.Path, zipFile.Mode(), zipFile.Modified)
 		if err != nil {
 			return 0, file.Path, fmt.Errorf("making zipFile dir: %w", err)
 		}
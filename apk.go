@@ -0,0 +1,126 @@
+package xtractr
+
+/* Alpine package (.apk) extraction: the data segment as a tree, the signature and control segments in APK/. */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// apkControlDir is the folder the signature and control segments are extracted into.
+const apkControlDir = "APK"
+
+// ExtractAPK extracts an Alpine Linux package. These are two or three gzip members,
+// each a tar segment: an optional signature (.SIGN.*), the control files (.PKGINFO
+// and install scripts), and the package data. Signature and control files are written
+// into an APK folder and the data is written as the filesystem tree. Android packages
+// share the extension; those are zip files and get passed to ExtractZIP.
+func ExtractAPK(xFile *XFile) (size uint64, filesList []string, err error) {
+	apkFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer apkFile.Close()
+
+	magic := make([]byte, 4) //nolint:mnd
+	if _, err = io.ReadFull(apkFile, magic); err == nil && bytes.Equal(magic, []byte("PK\x03\x04")) {
+		return ExtractZIP(xFile)
+	}
+
+	if _, err = apkFile.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, fmt.Errorf("%s: seeking: %w", xFile.FilePath, err)
+	}
+
+	defer xFile.newProgress(0, uint64(stat.Size()), 0).done()
+
+	files, err := xFile.unAPK(bufio.NewReader(xFile.prog.reader(apkFile)))
+
+	return xFile.prog.Wrote, files, err
+}
+
+// unAPK reads the gzip members one at a time, so each segment can go to its own folder.
+func (x *XFile) unAPK(reader *bufio.Reader) ([]string, error) {
+	zipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %w", x.FilePath, ErrInvalidAPK, err)
+	}
+	defer zipReader.Close()
+
+	files := []string{}
+
+	for {
+		zipReader.Multistream(false)
+
+		written, err := x.unAPKSegment(zipReader)
+		files = append(files, written...)
+
+		if err != nil {
+			return files, err
+		}
+
+		// The data segment ends with tar padding the tar reader leaves behind.
+		if _, err = io.Copy(io.Discard, zipReader); err != nil {
+			return files, fmt.Errorf("%s: reading gzip member: %w", x.FilePath, err)
+		}
+
+		err = zipReader.Reset(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return files, fmt.Errorf("%s: %w: %w", x.FilePath, ErrInvalidAPK, err)
+		}
+	}
+
+	return x.cleanup(files)
+}
+
+// unAPKSegment extracts one tar segment. The first file name tells which segment it is.
+// Signature and control segments are cut: they have no end-of-archive blocks.
+func (x *XFile) unAPKSegment(reader io.Reader) ([]string, error) {
+	tarReader := newTarStream(reader)
+	files := []string{}
+	prefix := ""
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		} else if err != nil {
+			return files, fmt.Errorf("%s: tarReader.Next: %w", x.FilePath, err)
+		}
+
+		if len(files) == 0 && (strings.HasPrefix(header.Name, ".SIGN.") || header.Name == ".PKGINFO") {
+			prefix = apkControlDir
+		}
+
+		member := header.Name
+		if prefix != "" {
+			if !filepath.IsLocal(member) {
+				return files, fmt.Errorf("%s: %w: %s is outside %s", x.FilePath, ErrInvalidPath, member, prefix)
+			}
+
+			header.Name = path.Join(prefix, member)
+		}
+
+		file := x.tarFile(header, tarReader)
+		file.Member = member
+
+		fSize, err := x.writeTarFile(header, file)
+		if errors.Is(err, errSkipEntry) {
+			continue
+		} else if err != nil {
+			return files, err
+		}
+
+		files = append(files, filepath.Join(prefix, member))
+		x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+			header.Name, fSize, x.prog.Files, x.prog.Wrote)
+	}
+}
@@ -0,0 +1,79 @@
+package xtractr_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestExtractAPK(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hello-2.12-r1.apk")
+
+	apk := testCompress(t, "gz", testAPKSegment(t, ".SIGN.RSA.builder.rsa.pub", "signature", true))
+	apk = append(apk, testCompress(t, "gz", testAPKSegment(t, ".PKGINFO", "pkgname = hello\n", true))...)
+	apk = append(apk, testCompress(t, "gz", testAPKSegment(t, "usr/bin/hello", "#!/bin/sh\n", false))...)
+	require.NoError(t, os.WriteFile(archive, apk, 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, files, _, err := xtractr.ExtractFile(&xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join("APK", ".SIGN.RSA.builder.rsa.pub"),
+		filepath.Join("APK", ".PKGINFO"),
+		"usr/bin/hello",
+	}, files)
+
+	for name, want := range map[string]string{
+		"APK/.PKGINFO":                  "pkgname = hello\n",
+		"APK/.SIGN.RSA.builder.rsa.pub": "signature",
+		"usr/bin/hello":                 "#!/bin/sh\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
+
+func TestExtractAPKAndroid(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "app.apk")
+
+	var buf bytes.Buffer
+
+	zipWriter := zip.NewWriter(&buf)
+	fileWriter, err := zipWriter.Create("AndroidManifest.xml")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte("<manifest/>"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(archive, buf.Bytes(), 0o600))
+
+	_, files, err := xtractr.ExtractAPK(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmp, "out", "AndroidManifest.xml")}, files)
+}
+
+// testAPKSegment writes a one-file tar segment. Cut segments have no end-of-archive blocks, as abuild writes them.
+func testAPKSegment(t *testing.T, name, content string, cut bool) []byte {
+	t.Helper()
+
+	segment := testTar(t, testTarEntry{name: name, data: content, header: tar.Header{ModTime: time.Now()}})
+	if cut {
+		return segment[:len(segment)-1024] // the two zero blocks.
+	}
+
+	return segment
+}
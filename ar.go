@@ -33,6 +33,7 @@ func ExtractAr(xFile *XFile) (size uint64, filesList []string, err error) {
 func (x *XFile) unAr(reader io.Reader) ([]string, error) {
 	arReader := ar.NewReader(reader)
 	files := []string{}
+	names := newNameDecoders(x, "ar")
 
 	for {
 		header, err := arReader.Next()
@@ -44,8 +45,11 @@ func (x *XFile) unAr(reader io.Reader) ([]string, error) {
 			return files, fmt.Errorf("%s: arReader.Next: %w", x.FilePath, err)
 		}
 
+		header.Name = names.decodeStream(header.Name)
+
 		file := &file{
 			Path:     x.clean(header.Name),
+			Member:   header.Name,
 			Data:     arReader,
 			FileMode: os.FileMode(header.Mode),
 			DirMode:  x.DirMode,
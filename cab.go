@@ -0,0 +1,463 @@
+package xtractr
+
+/* Microsoft Cabinet (.cab) extraction. Used directly and for cabinets embedded in MSI packages. */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	cabHeaderSize      = 36
+	cabFolderSize      = 8
+	cabFileSize        = 16
+	cabDataSize        = 8
+	cabFlagPrev        = 0x0001
+	cabFlagNext        = 0x0002
+	cabFlagReserve     = 0x0004
+	cabCompressMask    = 0x000F
+	cabCompressNone    = 0
+	cabCompressMSZIP   = 1
+	cabCompressQuantum = 2
+	cabCompressLZX     = 3
+	cabFolderContinued = 0xFFFD // iFolder values from here up span another cabinet.
+	cabAttrNameUTF     = 0x80
+	cabMaxBlock        = 32768
+	cabMaxNameLen      = 256
+)
+
+// cabinet is the parsed directory of a cabinet file.
+type cabinet struct {
+	folders []*cabFolder
+	files   []*cabFile
+	total   uint64
+	spanned bool // part of a multi-volume set
+	// Reserved bytes in each folder entry and data block header.
+	folderReserve int
+	dataReserve   int
+	// Offsets of the folder table and the file table, and the end of the file table.
+	// The MSI extractor uses these to rename files in an embedded cabinet.
+	folderTable int64
+	fileTable   int64
+	fileEnd     int64
+}
+
+type cabFolder struct {
+	offset   int64 // of the first data block
+	blocks   int
+	compress uint16
+}
+
+type cabFile struct {
+	name   string
+	size   uint32
+	offset uint32 // in the uncompressed folder data
+	folder uint16
+	mtime  time.Time
+	header []byte // the raw fixed-size part of the entry
+}
+
+// ExtractCAB extracts a Microsoft Cabinet file. Stored, MSZIP and LZX folders are
+// supported. Quantum folders, and cabinets spanning several files, are not.
+func ExtractCAB(xFile *XFile) (size uint64, filesList []string, err error) {
+	cabFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cabFile.Close()
+
+	cab, err := readCabinet(cabFile, stat.Size())
+	if err == nil {
+		err = cab.validate()
+	}
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	defer xFile.newProgress(cab.total, uint64(stat.Size()), len(cab.files)).done()
+
+	files, err := xFile.unCab(xFile.prog.readAter(cabFile), stat.Size(), cab)
+	if err != nil {
+		return xFile.prog.Wrote, files, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	return xFile.prog.Wrote, files, nil
+}
+
+// cabHeaderReader reads the variable-length cabinet header while keeping track of the offset.
+type cabHeaderReader struct {
+	*bufio.Reader
+	pos int64
+}
+
+func (r *cabHeaderReader) bytes(size int) ([]byte, error) {
+	buf := make([]byte, size)
+
+	n, err := io.ReadFull(r, buf)
+	r.pos += int64(n)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading cabinet header: %w", ErrCorruptCAB, err)
+	}
+
+	return buf, nil
+}
+
+func (r *cabHeaderReader) cString() (string, error) {
+	line, err := r.ReadBytes(0)
+	r.pos += int64(len(line))
+
+	if err != nil || len(line) > cabMaxNameLen {
+		return "", fmt.Errorf("%w: bad string in cabinet header", ErrCorruptCAB)
+	}
+
+	return string(line[:len(line)-1]), nil
+}
+
+// readCabinet parses the cabinet header, folder table and file table.
+func readCabinet(readerAt io.ReaderAt, size int64) (*cabinet, error) {
+	hdr := &cabHeaderReader{Reader: bufio.NewReader(io.NewSectionReader(readerAt, 0, size))}
+
+	header, err := hdr.bytes(cabHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], []byte("MSCF")) {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorruptCAB)
+	}
+
+	flags := binary.LittleEndian.Uint16(header[30:])
+	cab := &cabinet{
+		fileTable: int64(binary.LittleEndian.Uint32(header[16:])),
+		spanned:   flags&(cabFlagPrev|cabFlagNext) != 0,
+	}
+
+	if flags&cabFlagReserve != 0 {
+		reserve, err := hdr.bytes(4) //nolint:mnd
+		if err != nil {
+			return nil, err
+		}
+
+		cab.folderReserve = int(reserve[2])
+		cab.dataReserve = int(reserve[3])
+
+		if _, err = hdr.bytes(int(binary.LittleEndian.Uint16(reserve))); err != nil {
+			return nil, err
+		}
+	}
+
+	// Names of the previous and next cabinet, and their disks.
+	for _, flag := range []uint16{cabFlagPrev, cabFlagPrev, cabFlagNext, cabFlagNext} {
+		if flags&flag == 0 {
+			continue
+		}
+
+		if _, err = hdr.cString(); err != nil {
+			return nil, err
+		}
+	}
+
+	cab.folderTable = hdr.pos
+
+	if err = cab.readFolders(hdr, int(binary.LittleEndian.Uint16(header[26:]))); err != nil {
+		return nil, err
+	}
+
+	if cab.fileTable < hdr.pos {
+		return nil, fmt.Errorf("%w: file table overlaps folder table", ErrCorruptCAB)
+	}
+
+	if _, err = hdr.Discard(int(cab.fileTable - hdr.pos)); err != nil {
+		return nil, fmt.Errorf("%w: seeking to file table: %w", ErrCorruptCAB, err)
+	}
+
+	hdr.pos = cab.fileTable
+
+	if err = cab.readFiles(hdr, int(binary.LittleEndian.Uint16(header[28:]))); err != nil {
+		return nil, err
+	}
+
+	cab.fileEnd = hdr.pos
+
+	return cab, nil
+}
+
+func (c *cabinet) readFolders(hdr *cabHeaderReader, count int) error {
+	for range count {
+		entry, err := hdr.bytes(cabFolderSize + c.folderReserve)
+		if err != nil {
+			return err
+		}
+
+		folder := &cabFolder{
+			offset:   int64(binary.LittleEndian.Uint32(entry)),
+			blocks:   int(binary.LittleEndian.Uint16(entry[4:])),
+			compress: binary.LittleEndian.Uint16(entry[6:]),
+		}
+
+		c.folders = append(c.folders, folder)
+	}
+
+	return nil
+}
+
+func (c *cabinet) readFiles(hdr *cabHeaderReader, count int) error {
+	for range count {
+		entry, err := hdr.bytes(cabFileSize)
+		if err != nil {
+			return err
+		}
+
+		name, err := hdr.cString()
+		if err != nil {
+			return err
+		}
+
+		file := &cabFile{
+			name:   strings.ReplaceAll(name, `\`, "/"),
+			size:   binary.LittleEndian.Uint32(entry),
+			offset: binary.LittleEndian.Uint32(entry[4:]),
+			folder: binary.LittleEndian.Uint16(entry[8:]),
+			mtime:  cabDOSTime(binary.LittleEndian.Uint16(entry[10:]), binary.LittleEndian.Uint16(entry[12:])),
+			header: entry,
+		}
+
+		if file.folder < cabFolderContinued && int(file.folder) >= len(c.folders) {
+			return fmt.Errorf("%w: %s: folder %d out of range", ErrCorruptCAB, file.name, file.folder)
+		}
+
+		c.total += uint64(file.size)
+		c.files = append(c.files, file)
+	}
+
+	return nil
+}
+
+// validate returns an error for cabinets this package cannot extract.
+func (c *cabinet) validate() error {
+	if c.spanned {
+		return fmt.Errorf("%w: multi-volume cabinet", ErrUnsupportedCAB)
+	}
+
+	for idx, folder := range c.folders {
+		switch folder.compress & cabCompressMask {
+		case cabCompressNone, cabCompressMSZIP:
+		case cabCompressLZX:
+			if cabLZXWindowOrder(folder.compress) == 0 {
+				return fmt.Errorf("%w: folder %d: lzx window order %d", ErrUnsupportedCAB, idx, folder.compress>>8&0x1F)
+			}
+		case cabCompressQuantum:
+			return fmt.Errorf("%w: folder %d: Quantum compression", ErrUnsupportedCAB, idx)
+		default:
+			return fmt.Errorf("%w: folder %d: compression type %d", ErrUnsupportedCAB, idx, folder.compress&cabCompressMask)
+		}
+	}
+
+	return nil
+}
+
+// cabDOSTime converts an MS-DOS date and time to a time.Time.
+func cabDOSTime(date, clock uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0x0F), int(date&0x1F), //nolint:mnd
+		int(clock>>11), int(clock>>5&0x3F), int(clock&0x1F)*2, 0, time.Local) //nolint:mnd
+}
+
+// unCab writes the files of each folder in the order their data is stored.
+func (x *XFile) unCab(readerAt io.ReaderAt, size int64, cab *cabinet) ([]string, error) {
+	files := []string{}
+
+	for idx, folder := range cab.folders {
+		entries := []*cabFile{}
+
+		for _, file := range cab.files {
+			if int(file.folder) == idx {
+				entries = append(entries, file)
+			}
+		}
+
+		slices.SortStableFunc(entries, func(a, b *cabFile) int { return int(a.offset) - int(b.offset) })
+
+		var data *cabFolderReader
+
+		for _, entry := range entries {
+			// Files sharing data (or listed out of order) restart the folder.
+			if data == nil || int64(entry.offset) < data.pos {
+				data = newCabFolderReader(readerAt, size, cab, folder)
+			}
+
+			path, err := x.writeCabFile(data, entry)
+			if err != nil {
+				return files, err
+			}
+
+			files = append(files, path)
+		}
+	}
+
+	return x.cleanup(files)
+}
+
+func (x *XFile) writeCabFile(data *cabFolderReader, entry *cabFile) (string, error) {
+	if _, err := io.CopyN(io.Discard, data, int64(entry.offset)-data.pos); err != nil {
+		return "", fmt.Errorf("%w: seeking to %s: %w", ErrCorruptCAB, entry.name, err)
+	}
+
+	file := &file{
+		Path:    x.clean(entry.name),
+		Member:  entry.name,
+		Data:    io.LimitReader(data, int64(entry.size)),
+		DirMode: x.DirMode,
+		Mtime:   entry.mtime,
+	}
+
+	if !x.pathWithinOutput(file.Path) {
+		// The file being written is trying to write outside of our base path. Malicious archive?
+		return "", fmt.Errorf("%w: %s (from: %s)", ErrInvalidPath, file.Path, entry.name)
+	}
+
+	fSize, err := x.write(file)
+	if err != nil {
+		return file.Path, err
+	}
+
+	if fSize != uint64(entry.size) {
+		return file.Path, fmt.Errorf("%w: %s: wrote %d of %d bytes", ErrCorruptCAB, entry.name, fSize, entry.size)
+	}
+
+	x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+		file.Path, fSize, x.prog.Files, x.prog.Wrote)
+
+	return file.Path, nil
+}
+
+// cabFolderReader decompresses the data blocks of one folder in sequence.
+type cabFolderReader struct {
+	input    *bufio.Reader
+	compress uint16
+	reserve  int
+	blocks   int
+	window   []byte // MSZIP blocks use the previous 32 KiB of output as a dictionary.
+	lzx      *cabLZX
+	buf      []byte
+	pos      int64 // uncompressed bytes returned so far
+}
+
+func newCabFolderReader(readerAt io.ReaderAt, size int64, cab *cabinet, folder *cabFolder) *cabFolderReader {
+	reader := &cabFolderReader{
+		input:    bufio.NewReader(io.NewSectionReader(readerAt, folder.offset, size-folder.offset)),
+		compress: folder.compress & cabCompressMask,
+		reserve:  cab.dataReserve,
+		blocks:   folder.blocks,
+	}
+
+	if reader.compress == cabCompressLZX {
+		reader.lzx = newCabLZX(folder.compress)
+	}
+
+	return reader
+}
+
+func (r *cabFolderReader) Read(data []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.blocks == 0 {
+			return 0, io.EOF
+		}
+
+		if err := r.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(data, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+
+	return n, nil
+}
+
+func (r *cabFolderReader) nextBlock() error {
+	header := make([]byte, cabDataSize+r.reserve)
+	if _, err := io.ReadFull(r.input, header); err != nil {
+		return fmt.Errorf("%w: reading data block: %w", ErrCorruptCAB, err)
+	}
+
+	input := make([]byte, binary.LittleEndian.Uint16(header[4:]))
+	if _, err := io.ReadFull(r.input, input); err != nil {
+		return fmt.Errorf("%w: reading data block: %w", ErrCorruptCAB, err)
+	}
+
+	r.blocks--
+
+	if sum := binary.LittleEndian.Uint32(header); sum != 0 && sum != cabChecksum(header[4:8], cabChecksum(input, 0)) {
+		return fmt.Errorf("%w: data block checksum mismatch", ErrCorruptCAB)
+	}
+
+	usize := int(binary.LittleEndian.Uint16(header[6:]))
+	if usize > cabMaxBlock {
+		return fmt.Errorf("%w: data block too large", ErrCorruptCAB)
+	}
+
+	switch r.compress {
+	case cabCompressNone:
+		if usize != len(input) {
+			return fmt.Errorf("%w: stored block size mismatch", ErrCorruptCAB)
+		}
+
+		r.buf = input
+
+		return nil
+	case cabCompressLZX:
+		out, err := r.lzx.frame(input, usize)
+		r.buf = out
+
+		return err
+	}
+
+	if !bytes.HasPrefix(input, []byte("CK")) {
+		return fmt.Errorf("%w: missing mszip block signature", ErrCorruptCAB)
+	}
+
+	out := make([]byte, usize)
+	inflater := flate.NewReaderDict(bytes.NewReader(input[2:]), r.window)
+
+	if _, err := io.ReadFull(inflater, out); err != nil {
+		return fmt.Errorf("%w: mszip: %w", ErrCorruptCAB, err)
+	}
+
+	r.window = append(r.window, out...)
+	r.window = r.window[max(0, len(r.window)-cabMaxBlock):]
+	r.buf = out
+
+	return nil
+}
+
+// cabChecksum is the XOR checksum of a data block. The trailing 1-3 bytes are
+// folded in most significant byte first.
+func cabChecksum(data []byte, sum uint32) uint32 {
+	words := len(data) / 4 //nolint:mnd
+
+	for idx := range words {
+		sum ^= binary.LittleEndian.Uint32(data[idx*4:])
+	}
+
+	var tail uint32
+
+	for _, b := range data[words*4:] {
+		tail = tail<<8 | uint32(b)
+	}
+
+	return sum ^ tail
+}
@@ -0,0 +1,137 @@
+package xtractr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCabLZXWriter adds cabinet framing to testBitWriter: frames end on a word boundary.
+type testCabLZXWriter struct {
+	testBitWriter
+
+	start int
+}
+
+// realign mirrors cabLZX.realign. Reserved words nothing was written to are dropped.
+func (w *testCabLZXWriter) realign(pad bool) {
+	if pad && w.bitsleft%16 == 0 {
+		w.bits(16, 0)
+	}
+
+	w.put(w.bitsleft%16, 0)
+
+	for ; w.bitsleft > 0; w.bitsleft -= 16 {
+		w.words = w.words[:len(w.words)-1]
+		w.out = w.out[:len(w.out)-2]
+	}
+
+	w.word, w.filled = len(w.words), 0
+}
+
+// frame ends a frame and returns its data.
+func (w *testCabLZXWriter) frame() []byte {
+	w.realign(false)
+	data := w.out[w.start:]
+	w.start = len(w.out)
+
+	return data
+}
+
+func TestCabLZX(t *testing.T) {
+	t.Parallel()
+
+	const numMainSyms = lzxNumChars + 30*(lzxNumPrimaryLens+1) // 32 KiB window.
+
+	mainLens := append(testFilledLens(16, 8), testFilledLens(numMainSyms-16, 9)...)
+	lenLens := append(testFilledLens(7, 7), testFilledLens(lzxNumLenSyms-7, 8)...)
+	preLens := append(testFilledLens(12, 4), testFilledLens(lzxNumPrecodeSyms-12, 5)...)
+	writer := &testCabLZXWriter{}
+	lengths := func(lens []uint8, same bool) {
+		for _, length := range preLens {
+			writer.bits(lzxPrecodeBits, uint32(length))
+		}
+
+		for _, length := range lens { // deltas from the previous block's lengths.
+			if same {
+				length = 0
+			}
+
+			writer.sym(lzxMaxCodeLen, preLens, (17-int(length))%17)
+		}
+	}
+	verbatim := func(size int, same bool) {
+		writer.bits(3, lzxBlockVerbatim)
+		writer.bits(16, uint32(size>>8))
+		writer.bits(8, uint32(size&0xFF))
+		lengths(mainLens[:lzxNumChars], same)
+		lengths(mainLens[lzxNumChars:], same)
+		lengths(lenLens, same)
+	}
+	literals := func(data string) {
+		for _, literal := range []byte(data) {
+			writer.sym(lzxMaxCodeLen, mainLens, int(literal))
+		}
+	}
+	longMatch := func(slot int) { // length header 7 + length symbol 248 = 257.
+		writer.sym(lzxMaxCodeLen, mainLens, lzxNumChars+slot<<3+7)
+		writer.sym(lzxMaxCodeLen, lenLens, 248)
+	}
+
+	// E8 translation size 1 MiB.
+	writer.bits(1, 1)
+	writer.bits(16, 0x10)
+	writer.bits(16, 0)
+
+	// A verbatim block spanning both frames; the last match in frame 1 overruns it by 135 bytes.
+	verbatim(7+128*257+5, false)
+	literals("a\xE8\x00\x01\x00\x00b") // call to absolute 256 at position 1.
+	longMatch(3)                       // slot 3: offset 1.
+
+	for range 127 {
+		longMatch(0) // repeat offset R0.
+	}
+
+	frame1 := bytes.Clone(writer.frame())
+
+	literals("tail!")
+
+	// An odd-sized uncompressed block. Its pad byte comes before the next block header.
+	writer.bits(3, lzxBlockUncompressed)
+	writer.bits(16, 0)
+	writer.bits(8, 3)
+	writer.realign(true)
+	writer.out = binary.LittleEndian.AppendUint32(writer.out, 3)
+	writer.out = binary.LittleEndian.AppendUint32(writer.out, 1)
+	writer.out = binary.LittleEndian.AppendUint32(writer.out, 1)
+	writer.out = append(writer.out, 'o', 'd', 'd', 0)
+
+	// The next block keeps the codes, and repeats offset R0 (3) from the uncompressed block.
+	verbatim(4, true)
+	writer.sym(lzxMaxCodeLen, mainLens, lzxNumChars+2) // length header 2 = length 4.
+
+	frame2 := writer.frame()
+
+	dec := newCabLZX(cabCompressLZX | lzxMinWindowOrder<<8)
+	out, err := dec.frame(frame1, cabLZXFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a\xE8\xFF\x00\x00\x00"), out[:6], "E8 translation is undone")
+	assert.Equal(t, bytes.Repeat([]byte("b"), cabLZXFrameSize-6), out[6:])
+
+	out, err = dec.frame(frame2, 147)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("b", 135)+"tail!oddoddo", string(out))
+
+	// A match before any output refers to data that does not exist.
+	writer = &testCabLZXWriter{}
+	writer.bits(1, 0)
+	verbatim(10, false)
+	longMatch(3)
+
+	_, err = newCabLZX(cabCompressLZX|lzxMinWindowOrder<<8).frame(writer.frame(), 10)
+	require.ErrorIs(t, err, ErrCorruptCAB)
+}
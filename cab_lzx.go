@@ -0,0 +1,189 @@
+package xtractr
+
+/* LZX decompression for cabinet folders. Unlike a WIM chunk, a folder is one LZX stream:
+ * the window, codes and recent offsets carry over from data block to data block, each
+ * data block holds one frame of up to 32 KiB of output, and LZX blocks may span frames.
+ * The framing follows libmspack's lzxd, which reads the cabinets Microsoft's tools write. */
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	cabLZXFrameSize = 32768
+	cabLZXMaxMatch  = 257   // the most a match can run past the end of a frame.
+	cabLZXE8Frames  = 32768 // E8 translation stops after the first 1 GiB of output.
+)
+
+// cabLZX decodes the data blocks of one LZX folder, in order.
+type cabLZX struct {
+	lzxDecoder
+
+	window    int    // bytes of history kept before the current frame for matches.
+	pos       int    // in out of the next byte decoded; a match may leave it past frameAt.
+	frameAt   int    // in out of the next frame.
+	frames    int    // decoded so far.
+	e8Size    int32  // from the stream header; 0 turns E8 translation off.
+	header    bool   // the stream header was read.
+	blockType uint32 // of the current LZX block.
+	blockSize int
+	remaining int    // bytes left to decode in the current LZX block.
+	carry     []byte // input words read ahead at the end of the last frame.
+}
+
+// cabLZXWindowOrder returns the window order in a folder's compression type, or 0 when
+// it is out of the range LZX supports.
+func cabLZXWindowOrder(compress uint16) uint {
+	order := uint(compress>>8) & 0x1F //nolint:mnd
+	if order < lzxMinWindowOrder || order > lzxMaxWindowOrder {
+		return 0
+	}
+
+	return order
+}
+
+// newCabLZX starts decoding a folder. The window order must be valid; cabinet.validate checks it.
+func newCabLZX(compress uint16) *cabLZX {
+	order := cabLZXWindowOrder(compress)
+	window := 1 << order
+
+	return &cabLZX{
+		lzxDecoder: lzxDecoder{
+			// Twice the window, so the history is moved down once per window of output.
+			out:         make([]byte, 2*window+cabLZXFrameSize+cabLZXMaxMatch),
+			windowOrder: order,
+			numMainSyms: lzxNumChars + lzxNumOffsetSlots(order)*(lzxNumPrimaryLens+1),
+			recent:      [lzxNumRecentOffsets]uint32{1, 1, 1},
+		},
+		window: window,
+	}
+}
+
+// frame decodes the input of one data block into size bytes of output.
+func (c *cabLZX) frame(input []byte, size int) ([]byte, error) {
+	c.bits = &wimBitReader{data: append(c.carry, input...)}
+
+	if c.frameAt+size+cabLZXMaxMatch > len(c.out) {
+		shift := c.frameAt - c.window
+		copy(c.out, c.out[shift:c.pos])
+		c.frameAt -= shift
+		c.pos -= shift
+	}
+
+	if !c.header {
+		// The stream starts with the E8 translation size, when there is one.
+		if c.bits.read(1) == 1 {
+			c.e8Size = int32(c.bits.read(16)<<16 | c.bits.read(16)) //nolint:mnd,gosec
+		}
+
+		c.header = true
+	}
+
+	end := c.frameAt + size
+
+	for c.pos < end {
+		if c.remaining == 0 {
+			if err := c.readBlock(); err != nil {
+				return nil, cabLZXError(err)
+			}
+		}
+
+		if err := c.decodeRun(min(c.remaining, end-c.pos)); err != nil {
+			return nil, cabLZXError(err)
+		}
+	}
+
+	// Each frame ends on a 16-bit boundary. Words read ahead belong to the next frame.
+	c.realign(false)
+	c.carry = bytes.Clone(c.bits.data[c.bits.pos:])
+
+	out := bytes.Clone(c.out[c.frameAt:end])
+	if c.e8Size != 0 && c.frames < cabLZXE8Frames {
+		lzxUndoE8(out, int32(c.frames*cabLZXFrameSize), c.e8Size) //nolint:gosec // at most 1 GiB.
+	}
+
+	c.frames++
+	c.frameAt = end
+
+	return out, nil
+}
+
+// readBlock reads the header of the next LZX block. Cabinet blocks always store a 24-bit size.
+func (c *cabLZX) readBlock() error {
+	// Uncompressed blocks are padded to an even size. The pad may be in the next data block.
+	if c.blockType == lzxBlockUncompressed && c.blockSize&1 == 1 {
+		c.bits.pos = min(c.bits.pos+1, len(c.bits.data))
+	}
+
+	c.blockType = c.bits.read(3)                                //nolint:mnd
+	c.blockSize = int(c.bits.read(16))<<8 | int(c.bits.read(8)) //nolint:mnd
+	c.remaining = c.blockSize
+
+	if c.blockSize == 0 {
+		return fmt.Errorf("%w: lzx block size 0", ErrCorruptWIM)
+	}
+
+	switch c.blockType {
+	case lzxBlockVerbatim, lzxBlockAligned:
+		return c.readCodes(c.blockType == lzxBlockAligned)
+	case lzxBlockUncompressed:
+		// The recent offsets and raw bytes start on the next word, or the one after it.
+		c.realign(true)
+
+		for idx := range c.recent {
+			val, err := c.bits.readUint32()
+			if err != nil {
+				return err
+			}
+
+			c.recent[idx] = val
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: lzx block type %d", ErrCorruptWIM, c.blockType)
+	}
+}
+
+// decodeRun decodes up to run bytes of the current block, stopping at the end of the frame.
+func (c *cabLZX) decodeRun(run int) error {
+	if c.blockType != lzxBlockUncompressed {
+		pos, err := c.decodeBlock(c.pos, c.pos+run, c.pos+c.remaining, c.blockType == lzxBlockAligned)
+		c.remaining -= pos - c.pos
+		c.pos = pos
+
+		return err
+	}
+
+	if c.bits.pos+run > len(c.bits.data) {
+		return fmt.Errorf("%w: lzx uncompressed block truncated", ErrCorruptWIM)
+	}
+
+	c.pos += copy(c.out[c.pos:c.pos+run], c.bits.data[c.bits.pos:])
+	c.bits.pos += run
+	c.remaining -= run
+
+	return nil
+}
+
+// realign discards the rest of the 16-bit word being read, and gives whole words read
+// ahead from the data back to the byte position. With pad, an aligned stream skips a word.
+func (c *cabLZX) realign(pad bool) {
+	bits := c.bits
+
+	if pad && bits.bitsleft%16 == 0 {
+		bits.ensure(16) //nolint:mnd
+		bits.remove(16) //nolint:mnd
+	}
+
+	bits.remove(bits.bitsleft % 16)                                  //nolint:mnd
+	bits.pos -= int(bits.bitsleft-min(bits.over, bits.bitsleft)) / 8 //nolint:mnd
+	bits.bitbuf, bits.bitsleft, bits.over = 0, 0, 0
+}
+
+// cabLZXError reports an error from the LZX decoder, which WIM shares, as a corrupt cabinet.
+func cabLZXError(err error) error {
+	return fmt.Errorf("%w: %s", ErrCorruptCAB, strings.TrimPrefix(err.Error(), ErrCorruptWIM.Error()+": "))
+}
@@ -0,0 +1,267 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+const (
+	testCabStored  = 0
+	testCabMSZIP   = 1
+	testCabQuantum = 2
+	testCabLZX     = 3 | 15<<8 // 32 KiB window.
+)
+
+type testCabFile struct {
+	name string
+	data []byte
+}
+
+func TestCAB(t *testing.T) {
+	t.Parallel()
+
+	large := bytes.Repeat([]byte("cabinet data spans several blocks. "), 3000)
+	files := []testCabFile{
+		{name: `dir\large.txt`, data: large},
+		{name: "small.txt", data: []byte("small file")},
+	}
+
+	for name, compress := range map[string]uint16{"stored": testCabStored, "mszip": testCabMSZIP, "lzx": testCabLZX} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			archive := filepath.Join(tmp, "test.cab")
+			require.NoError(t, os.WriteFile(archive, buildTestCAB(t, compress, files...), 0o600))
+
+			size, written, archives, err := xtractr.ExtractFile(&xtractr.XFile{
+				FilePath:  archive,
+				OutputDir: filepath.Join(tmp, "out"),
+				FileMode:  0o600,
+				DirMode:   0o700,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, uint64(len(large)+10), size)
+			assert.Equal(t, []string{archive}, archives)
+			assert.ElementsMatch(t, []string{
+				filepath.Join(tmp, "out", "dir", "large.txt"),
+				filepath.Join(tmp, "out", "small.txt"),
+			}, written)
+
+			data, err := os.ReadFile(filepath.Join(tmp, "out", "dir", "large.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, large, data)
+		})
+	}
+}
+
+// lzx21.cab holds one LZX folder with a 2 MiB window (makecab /L LZX:21): six 32 KiB frames,
+// E8 translation, verbatim and aligned blocks that span frames, matches that run past the
+// end of a frame, and matches reaching back more than a frame. It was checked against
+// libarchive (bsdtar 3.7.7), which extracts the same bytes.
+func TestCABLZX21(t *testing.T) {
+	t.Parallel()
+
+	out := t.TempDir()
+	size, written, err := xtractr.ExtractCAB(&xtractr.XFile{
+		FilePath: filepath.Join("test_data", "lzx21.cab"), OutputDir: out, FileMode: 0o600, DirMode: 0o700,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(180054), size)
+	assert.Len(t, written, 5)
+
+	files := map[string]string{}
+
+	for name, want := range map[string]string{
+		"docs/readme.txt": "f85007339a7114b73bbe981ad662c8e0932cda89de3b16b4f4a15fccb23ee876",
+		"bin/tool.exe":    "b4229366cc3f2c4ed2f1b17953ffea52a0ad6da37a959042d1fbaaba6266f3fc",
+		"data/random.bin": "d9a34349704d993283285c93af6a975acafd8de0037e555d9d5355d7cbc373ad",
+		"data/copies.bin": "8e1ce2ef3c36a3f4eab9cb9cd8ac6b867b74ecd63607fbed382a6fc9ec3ccaed",
+		"empty.txt":       "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	} {
+		data, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		assert.Equal(t, want, sha256Hex(string(data)), name)
+
+		files[name] = string(data)
+	}
+
+	// copies.bin repeats earlier files, from up to 2 and 4 frames back.
+	copies := files["data/copies.bin"]
+	assert.True(t, strings.HasPrefix(files["docs/readme.txt"], "0000: "))
+	assert.Equal(t, files["data/random.bin"][5000:20000], copies[:15000])
+	assert.Equal(t, strings.Repeat("\x00", 3000), copies[15000:18000])
+	assert.Equal(t, files["docs/readme.txt"][1000:9000], copies[18000:])
+}
+
+func TestCABErrors(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := testCabFile{name: "file.txt", data: []byte("some data")}
+
+	corrupt := buildTestCAB(t, testCabStored, file)
+	corrupt[len(corrupt)-1] ^= 0xFF // checksum no longer matches.
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "corrupt.cab"), corrupt, 0o600))
+
+	_, _, err := xtractr.ExtractCAB(&xtractr.XFile{
+		FilePath: filepath.Join(tmp, "corrupt.cab"), OutputDir: filepath.Join(tmp, "corrupt"),
+	})
+	require.ErrorIs(t, err, xtractr.ErrCorruptCAB)
+
+	quantum := buildTestCAB(t, testCabQuantum, file)
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "quantum.cab"), quantum, 0o600))
+
+	_, _, err = xtractr.ExtractCAB(&xtractr.XFile{
+		FilePath: filepath.Join(tmp, "quantum.cab"), OutputDir: filepath.Join(tmp, "quantum"),
+	})
+	require.ErrorIs(t, err, xtractr.ErrUnsupportedCAB)
+	assert.Contains(t, err.Error(), "folder 0: Quantum compression")
+
+	evil := testCabFile{name: `..\..\evil.txt`, data: []byte("evil")}
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "evil.cab"), buildTestCAB(t, testCabStored, evil), 0o600))
+
+	_, _, err = xtractr.ExtractCAB(&xtractr.XFile{
+		FilePath: filepath.Join(tmp, "evil.cab"), OutputDir: filepath.Join(tmp, "evil"),
+	})
+	require.ErrorIs(t, err, xtractr.ErrInvalidPath)
+}
+
+// buildTestCAB writes a cabinet with one folder. Data blocks carry checksums.
+// An LZX folder holds one uncompressed LZX block; Quantum only sets the folder type.
+func buildTestCAB(t *testing.T, compress uint16, files ...testCabFile) []byte {
+	t.Helper()
+
+	var (
+		entries bytes.Buffer
+		folder  []byte
+	)
+
+	for _, file := range files {
+		entry := make([]byte, 16)
+		binary.LittleEndian.PutUint32(entry, uint32(len(file.data)))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(folder)))
+		binary.LittleEndian.PutUint16(entry[10:], 45<<9|1<<5|1) // 2025-01-01
+		binary.LittleEndian.PutUint16(entry[14:], 0x20)
+		entries.Write(entry)
+		entries.WriteString(file.name)
+		entries.WriteByte(0)
+
+		folder = append(folder, file.data...)
+	}
+
+	var (
+		blocks bytes.Buffer
+		window []byte
+		count  int
+	)
+
+	for pos := 0; pos < len(folder); pos += 32768 {
+		chunk := folder[pos:min(pos+32768, len(folder))]
+		payload := chunk
+
+		switch compress {
+		case testCabLZX:
+			payload = testCabLZXBlock(folder, pos, chunk)
+		case testCabMSZIP:
+			var buf bytes.Buffer
+
+			buf.WriteString("CK")
+			writer, err := flate.NewWriterDict(&buf, flate.BestCompression, window)
+			require.NoError(t, err)
+			_, err = writer.Write(chunk)
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			payload = buf.Bytes()
+			window = append(window, chunk...)
+			window = window[max(0, len(window)-32768):]
+		}
+
+		header := make([]byte, 8)
+		binary.LittleEndian.PutUint16(header[4:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(header[6:], uint16(len(chunk)))
+		binary.LittleEndian.PutUint32(header, testCabChecksum(header[4:], testCabChecksum(payload, 0)))
+		blocks.Write(header)
+		blocks.Write(payload)
+
+		count++
+	}
+
+	const headerSize, folderSize = 36, 8
+
+	dataStart := headerSize + folderSize + entries.Len()
+	cab := make([]byte, headerSize+folderSize)
+	copy(cab, "MSCF")
+	binary.LittleEndian.PutUint32(cab[8:], uint32(dataStart+blocks.Len()))
+	binary.LittleEndian.PutUint32(cab[16:], headerSize+folderSize)
+	cab[24], cab[25] = 3, 1
+	binary.LittleEndian.PutUint16(cab[26:], 1)
+	binary.LittleEndian.PutUint16(cab[28:], uint16(len(files)))
+	binary.LittleEndian.PutUint32(cab[headerSize:], uint32(dataStart))
+	binary.LittleEndian.PutUint16(cab[headerSize+4:], uint16(count))
+	binary.LittleEndian.PutUint16(cab[headerSize+6:], compress)
+
+	return append(append(cab, entries.Bytes()...), blocks.Bytes()...)
+}
+
+// testCabLZXBlock returns the LZX frame of chunk, at pos in a folder stored as one uncompressed block.
+func testCabLZXBlock(folder []byte, pos int, chunk []byte) []byte {
+	frame := []byte{}
+
+	if pos == 0 {
+		// No E8 translation, block type 3 and the 24-bit size, in two words; then R0-R2.
+		header := (3<<24 | uint32(len(folder))) << 4
+		frame = binary.LittleEndian.AppendUint16(frame, uint16(header>>16))
+		frame = binary.LittleEndian.AppendUint16(frame, uint16(header))
+		frame = append(frame, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0)
+	}
+
+	frame = append(frame, chunk...)
+
+	if pos+len(chunk) == len(folder) && len(folder)%2 == 1 {
+		frame = append(frame, 0)
+	}
+
+	return frame
+}
+
+func testCabChecksum(data []byte, sum uint32) uint32 {
+	for len(data) >= 4 {
+		sum ^= binary.LittleEndian.Uint32(data)
+		data = data[4:]
+	}
+
+	var tail uint32
+	for _, b := range data {
+		tail = tail<<8 | uint32(b)
+	}
+
+	return sum ^ tail
+}
+
+// testCabNames lists the file names stored in a cabinet built by buildTestCAB.
+func testCabNames(t *testing.T, cab []byte) []string {
+	t.Helper()
+
+	names := []string{}
+	pos := int(binary.LittleEndian.Uint32(cab[16:]))
+
+	for range binary.LittleEndian.Uint16(cab[28:]) {
+		end := bytes.IndexByte(cab[pos+16:], 0)
+		require.GreaterOrEqual(t, end, 0)
+		names = append(names, strings.ReplaceAll(string(cab[pos+16:pos+16+end]), `\`, "/"))
+		pos += 16 + end + 1
+	}
+
+	return names
+}
@@ -0,0 +1,253 @@
+package xtractr
+
+/* Raw CD images: the data track of a BIN/CUE, Nero (.nrg) or Alcohol 120% (.mdf) image, read as an ISO. */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cdRawSectorSize = 2352
+	nrgMaxChunks    = 64
+	nrgMaxChunkSize = 1 << 20
+)
+
+// cdSectorLayouts are the ways a data track can store its 2048 byte sectors: the size of each
+// sector in the image and where the user data starts in it. Raw sectors begin with 12 sync
+// bytes and a 4 byte header, and mode 2 (XA) sectors add an 8 byte subheader. 2448 byte sectors
+// carry 96 bytes of subchannel data, and 2336 byte sectors are mode 2 without sync and header.
+//
+//nolint:gochecknoglobals,mnd
+var cdSectorLayouts = []struct{ size, offset int64 }{
+	{isoSectorSize, 0}, {cdRawSectorSize, 16}, {cdRawSectorSize, 24}, {2448, 16}, {2448, 24}, {2336, 8},
+}
+
+// cdTrack reads the user data of a data track as cooked 2048 byte sectors.
+type cdTrack struct {
+	image      io.ReaderAt
+	start      int64 // offset of the track's first sector in the image.
+	sectorSize int64
+	dataOffset int64
+	sectors    int64
+}
+
+// ExtractCDImage extracts the file system on the data track of a CD image: a raw .bin
+// (mode 1 or mode 2, with or without subchannel data), a Nero .nrg or an Alcohol 120%
+// .mdf. Sector headers and error correction are dropped and the 2048 byte sectors left
+// are extracted like an ISO. Only the first data track is extracted.
+func ExtractCDImage(xFile *XFile) (size uint64, filesList []string, err error) {
+	imageFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer imageFile.Close()
+
+	for _, start := range append(nrgTrackStarts(imageFile, stat.Size()), 0) {
+		if track := cookCDTrack(imageFile, start, stat.Size()); track != nil {
+			xFile.Debugf("Found data track in %s at offset %d with %d byte sectors", xFile.FilePath, start, track.sectorSize)
+			return xFile.unisoImage(track, track.size())
+		}
+	}
+
+	return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, ErrNoDataTrack)
+}
+
+// extractCueImage extracts the first data track of a BIN/CUE image.
+func extractCueImage(xFile *XFile, cue *CueSheet, timestamps []cueTimestamp) (uint64, []string, []string, error) {
+	cueDir := filepath.Dir(xFile.FilePath)
+
+	for idx, track := range cue.Tracks {
+		if !strings.HasPrefix(track.Mode, "MODE") {
+			continue // audio.
+		}
+
+		binPath, err := resolveCueImagePath(cueDir, track.File, xFile.FilePath)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		image, stat, err := openStatFile(binPath)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		defer image.Close()
+
+		start := timestamps[idx].sectors() * cueSectorSize(track.Mode)
+
+		data := cookCDTrack(image, start, stat.Size())
+		if data == nil {
+			return 0, nil, nil, fmt.Errorf("%s: %w: track %d", binPath, ErrNoDataTrack, track.Number)
+		}
+
+		xFile.Debugf("Extracting CD image track %d (%s): %s", track.Number, track.Mode, binPath)
+
+		size, files, err := xFile.unisoImage(data, data.size())
+
+		return size, files, []string{xFile.FilePath, binPath}, err
+	}
+
+	return 0, nil, nil, fmt.Errorf("%s: %w", xFile.FilePath, ErrNoDataTrack)
+}
+
+// resolveCueImagePath returns the path to a BINARY file in a cue sheet. If the FILE line does not
+// match a file, it tries the image with the same base name as the cue sheet.
+func resolveCueImagePath(cueDir, cueFile, cueFilePath string) (string, error) {
+	path := filepath.Join(cueDir, cueFile)
+	if !pathWithin(cueDir, path) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPath, cueFile)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	for _, ext := range []string{".bin", ".img"} {
+		fallbackPath := filepath.Join(cueDir, cueBaseName(cueFilePath)+ext)
+		if _, err := os.Stat(fallbackPath); err == nil {
+			return fallbackPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNoDataTrack, path)
+}
+
+// cueSectorSize returns the sector size in a track mode like "MODE2/2352".
+func cueSectorSize(mode string) int64 {
+	_, size, _ := strings.Cut(mode, "/")
+	if num, err := strconv.ParseInt(size, 10, 64); err == nil && num > 0 {
+		return num
+	}
+
+	return cdRawSectorSize
+}
+
+// cookCDTrack finds the sector layout of an ISO9660 data track at start, or returns nil.
+func cookCDTrack(image io.ReaderAt, start, end int64) *cdTrack {
+	magic := make([]byte, len("CD001"))
+
+	for _, layout := range cdSectorLayouts {
+		// The primary volume descriptor's "CD001" is at byte 1 of sector 16.
+		_, err := image.ReadAt(magic, start+isoPVDSector*layout.size+layout.offset+1)
+		if err == nil && string(magic) == "CD001" {
+			return &cdTrack{
+				image:      image,
+				start:      start,
+				sectorSize: layout.size,
+				dataOffset: layout.offset,
+				sectors:    (end - start) / layout.size,
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadAt reads cooked sectors, one sector's user data at a time.
+func (t *cdTrack) ReadAt(data []byte, off int64) (int, error) {
+	var read int
+
+	for read < len(data) {
+		sector, within := (off+int64(read))/isoSectorSize, (off+int64(read))%isoSectorSize
+		if sector >= t.sectors || off < 0 {
+			return read, io.EOF
+		}
+
+		chunk := min(int64(len(data)-read), isoSectorSize-within)
+
+		count, err := t.image.ReadAt(data[read:read+int(chunk)], t.start+sector*t.sectorSize+t.dataOffset+within)
+		read += count
+
+		if err != nil && (!errors.Is(err, io.EOF) || int64(count) < chunk) {
+			return read, err //nolint:wrapcheck
+		}
+	}
+
+	return read, nil
+}
+
+func (t *cdTrack) size() int64 {
+	return t.sectors * isoSectorSize
+}
+
+// nrgTrackStarts returns the track offsets listed in a Nero image's footer chunks.
+// Version 2 images end with "NER5" and a 64 bit chunk offset, version 1 with "NERO" and 32 bits.
+func nrgTrackStarts(image io.ReaderAt, size int64) []int64 {
+	footer := make([]byte, 12) //nolint:mnd
+	if _, err := image.ReadAt(footer, size-int64(len(footer))); err != nil {
+		return nil
+	}
+
+	var offset int64
+
+	switch {
+	case string(footer[:4]) == "NER5":
+		offset = int64(binary.BigEndian.Uint64(footer[4:])) //nolint:gosec
+	case string(footer[4:8]) == "NERO":
+		offset = int64(binary.BigEndian.Uint32(footer[8:]))
+	default:
+		return nil
+	}
+
+	starts := []int64{}
+	header := make([]byte, 8) //nolint:mnd
+
+	for range nrgMaxChunks {
+		if _, err := image.ReadAt(header, offset); err != nil || string(header[:4]) == "END!" {
+			break
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[4:]))
+
+		chunk := make([]byte, min(length, nrgMaxChunkSize))
+		if _, err := image.ReadAt(chunk, offset+int64(len(header))); err != nil {
+			break
+		}
+
+		starts = append(starts, nrgChunkStarts(string(header[:4]), chunk)...)
+		offset += int64(len(header)) + length
+	}
+
+	return starts
+}
+
+// nrgChunkStarts reads the track offsets in a disc-at-once (DAOI, DAOX)
+// or track-at-once (ETNF, ETN2) chunk. DAO offsets are each track's index 1.
+func nrgChunkStarts(chunkID string, chunk []byte) []int64 {
+	const daoHeader = 22
+
+	var (
+		starts          = []int64{}
+		first, size, at int
+		wide            bool
+	)
+
+	switch chunkID {
+	case "DAOI":
+		first, size, at = daoHeader, 30, 22 //nolint:mnd
+	case "DAOX":
+		first, size, at, wide = daoHeader, 42, 26, true //nolint:mnd
+	case "ETNF":
+		size = 20
+	case "ETN2":
+		size, wide = 32, true
+	default:
+		return nil
+	}
+
+	for pos := first; pos+size <= len(chunk); pos += size {
+		if wide {
+			starts = append(starts, int64(binary.BigEndian.Uint64(chunk[pos+at:]))) //nolint:gosec
+		} else {
+			starts = append(starts, int64(binary.BigEndian.Uint32(chunk[pos+at:])))
+		}
+	}
+
+	return starts
+}
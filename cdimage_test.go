@@ -0,0 +1,137 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestExtractCUEBinary(t *testing.T) {
+	t.Parallel()
+
+	t.Run("MODE1/2352", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(tmp, "disc.bin"), testRawCD(2352, 16, 1), 0o600))
+		testExtractCUEImage(t, tmp, "disc.bin", strings.Join([]string{
+			`FILE "disc.bin" BINARY`,
+			`  TRACK 01 MODE1/2352`,
+			`    INDEX 01 00:00:00`,
+		}, "\n"))
+	})
+
+	t.Run("audio then MODE2/2352 with a pregap", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		pregap := bytes.Repeat([]byte{0xAA}, 2*2352)
+		require.NoError(t, os.WriteFile(filepath.Join(tmp, "audio.bin"), pregap, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(tmp, "data.bin"),
+			append(pregap, testRawCD(2352, 24, 2)...), 0o600))
+		testExtractCUEImage(t, tmp, "data.bin", strings.Join([]string{
+			`FILE "audio.bin" BINARY`,
+			`  TRACK 01 AUDIO`,
+			`    INDEX 01 00:00:00`,
+			`FILE "data.bin" BINARY`,
+			`  TRACK 02 MODE2/2352`,
+			`    INDEX 00 00:00:00`,
+			`    INDEX 01 00:00:02`,
+		}, "\n"))
+	})
+
+	t.Run("no data track", func(t *testing.T) {
+		t.Parallel()
+
+		tmp := t.TempDir()
+		cuePath := filepath.Join(tmp, "audio.cue")
+		require.NoError(t, os.WriteFile(filepath.Join(tmp, "audio.bin"), make([]byte, 2352), 0o600))
+		require.NoError(t, os.WriteFile(cuePath, []byte("FILE \"audio.bin\" BINARY\n TRACK 01 AUDIO\n INDEX 01 00:00:00\n"), 0o600))
+
+		_, _, _, err := xtractr.ExtractCUE(&xtractr.XFile{FilePath: cuePath, OutputDir: filepath.Join(tmp, "out")})
+		require.ErrorIs(t, err, xtractr.ErrNoDataTrack)
+	})
+}
+
+func testExtractCUEImage(t *testing.T, tmp, bin, cue string) {
+	t.Helper()
+
+	cuePath := filepath.Join(tmp, "disc.cue")
+	require.NoError(t, os.WriteFile(cuePath, []byte(cue+"\n"), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, files, archives, err := xtractr.ExtractFile(&xtractr.XFile{FilePath: cuePath, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+	require.NoError(t, err)
+	assert.Equal(t, []string{cuePath, filepath.Join(tmp, bin)}, archives)
+	testExtractedRockRidge(t, out, files)
+}
+
+func TestExtractCDImage(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	// Nero v2: the track starts after three sectors of junk; its offset is in the ETN2 chunk.
+	nrg := append(bytes.Repeat([]byte{0x55}, 3*2352), testRawCD(2352, 16, 1)...)
+	chunks := int64(len(nrg))
+	etn := make([]byte, 32)
+	binary.BigEndian.PutUint64(etn, 3*2352)
+	nrg = append(nrg, "ETN2\x00\x00\x00\x20"...)
+	nrg = append(nrg, etn...)
+	nrg = append(nrg, "END!\x00\x00\x00\x00NER5"...)
+	nrg = binary.BigEndian.AppendUint64(nrg, uint64(chunks))
+
+	for name, data := range map[string][]byte{
+		"disc.nrg": nrg,
+		"disc.mdf": testRawCD(2448, 16, 1), // with subchannel data.
+		"disc.bin": testRawCD(2352, 24, 2), // not registered; found by its sync pattern.
+	} {
+		archive := filepath.Join(tmp, name)
+		require.NoError(t, os.WriteFile(archive, data, 0o600))
+
+		out := filepath.Join(tmp, name+".out")
+		_, files, _, err := xtractr.ExtractFile(&xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+		require.NoError(t, err, name)
+		testExtractedRockRidge(t, out, files)
+	}
+
+	archive := filepath.Join(tmp, "empty.nrg")
+	require.NoError(t, os.WriteFile(archive, make([]byte, 40*2352), 0o600))
+
+	_, _, err := xtractr.ExtractCDImage(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "empty")})
+	require.ErrorIs(t, err, xtractr.ErrNoDataTrack)
+}
+
+func testExtractedRockRidge(t *testing.T, out string, files []string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(out, "a", "deep", "inner.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "inner", string(data))
+	assert.Contains(t, files, filepath.Join(out, "Hello World.txt"))
+}
+
+// testRawCD writes the Rock Ridge test image as raw sectors: sync, header with the
+// mode byte, and the user data at offset. Error correction bytes are left zero.
+func testRawCD(size, offset int, mode byte) []byte {
+	cooked := testRockRidgeISO(rrDeepDir)
+	sync := []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00}
+	raw := make([]byte, 0, len(cooked)/testSector*size)
+
+	for pos := 0; pos < len(cooked); pos += testSector {
+		sector := make([]byte, size)
+		copy(sector, sync)
+		sector[15] = mode
+		copy(sector[offset:], cooked[pos:pos+testSector])
+		raw = append(raw, sector...)
+	}
+
+	return raw
+}
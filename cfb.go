@@ -0,0 +1,581 @@
+package xtractr
+
+/* Compound File Binary (OLE) extraction: .msi installers and legacy Office documents. */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	cfbHeaderSize    = 512
+	cfbDirEntrySize  = 128
+	cfbHeaderDIFAT   = 109
+	cfbMaxRegSect    = 0xFFFFFFFA
+	cfbEndOfChain    = 0xFFFFFFFE
+	cfbFreeSect      = 0xFFFFFFFF
+	cfbNoStream      = 0xFFFFFFFF
+	cfbTypeStorage   = 1
+	cfbTypeStream    = 2
+	cfbTypeRoot      = 5
+	cfbMaxDepth      = 256
+	cfbMaxNameUnits  = 31
+	cfbFiletimeEpoch = 116444736000000000 // 1601-01-01 to 1970-01-01 in 100ns units.
+)
+
+// msiTablePrefix marks MSI database table streams. They are written with a "!" prefix.
+const msiTablePrefix = 0x4840
+
+// msiCLSID is the class id of the root storage of an MSI package: {000C1084-0000-0000-C000-000000000046}.
+const msiCLSID = "\x84\x10\x0c\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46"
+
+// cfbFile is an open compound file: its allocation tables and directory.
+type cfbFile struct {
+	readerAt    io.ReaderAt
+	size        int64
+	sectorShift uint
+	miniShift   uint
+	cutoff      uint64
+	fat         []uint32
+	miniFAT     []uint32
+	entries     []*cfbEntry
+	miniStream  *cfbStream
+	msi         bool
+}
+
+type cfbEntry struct {
+	name  []uint16
+	kind  byte
+	left  uint32
+	right uint32
+	child uint32
+	start uint32
+	size  uint64
+	mtime time.Time
+}
+
+// cfbStream reads a sector chain as one contiguous stream.
+type cfbStream struct {
+	readerAt io.ReaderAt
+	runs     []cfbRun
+	size     int64
+}
+
+// cfbRun is a run of adjacent sectors: stream offset, offset in the container, and length.
+type cfbRun struct {
+	start  int64
+	offset int64
+	length int64
+}
+
+// cfbItem is a storage or stream with its decoded path.
+type cfbItem struct {
+	path  string
+	entry *cfbEntry
+}
+
+// ExtractCFB extracts the streams of a Compound File Binary (OLE) file, such as an
+// .msi installer or a legacy .doc. Each stream is written under its decoded name,
+// and storages become folders. Cabinets embedded in an MSI have their files renamed
+// to the real names in the File table, and are written out for recursion to extract.
+func ExtractCFB(xFile *XFile) (size uint64, filesList []string, err error) {
+	cfbFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cfbFile.Close()
+
+	cfb, err := openCFB(cfbFile, stat.Size())
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	items, err := cfb.walk()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	var (
+		total uint64
+		count int
+	)
+
+	for _, item := range items {
+		if item.entry.kind == cfbTypeStream {
+			total += item.entry.size
+			count++
+		}
+	}
+
+	defer xFile.newProgress(total, uint64(stat.Size()), count).done()
+
+	cfb.readerAt = xFile.prog.readAter(cfbFile)
+	cfb.miniStream.readerAt = cfb.readerAt
+
+	files, err := xFile.unCFB(cfb, items)
+	if err != nil {
+		return xFile.prog.Wrote, files, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	return xFile.prog.Wrote, files, nil
+}
+
+// isMSI returns true if a compound file's root storage has the MSI class id. Signature
+// detection uses it because Office documents are compound files too, but not archives.
+func isMSI(readerAt io.ReaderAt) bool {
+	header := make([]byte, cfbHeaderSize)
+	if _, err := readerAt.ReadAt(header, 0); err != nil {
+		return false
+	}
+
+	cfb := &cfbFile{sectorShift: uint(binary.LittleEndian.Uint16(header[0x1E:]))}
+	if cfb.sectorShift != 9 && cfb.sectorShift != 12 {
+		return false
+	}
+
+	// The root entry is first in the directory, and its class id is at 0x50.
+	clsid := make([]byte, len(msiCLSID))
+	_, err := readerAt.ReadAt(clsid, cfb.sectorOffset(binary.LittleEndian.Uint32(header[0x30:]))+0x50)
+
+	return err == nil && string(clsid) == msiCLSID
+}
+
+// openCFB reads the header, allocation tables and directory of a compound file.
+func openCFB(readerAt io.ReaderAt, size int64) (*cfbFile, error) {
+	header := make([]byte, cfbHeaderSize)
+
+	if _, err := readerAt.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %w", ErrCorruptCFB, err)
+	}
+
+	if !bytes.Equal(header[:8], []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}) {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorruptCFB)
+	}
+
+	cfb := &cfbFile{
+		readerAt:    readerAt,
+		size:        size,
+		sectorShift: uint(binary.LittleEndian.Uint16(header[0x1E:])),
+		miniShift:   uint(binary.LittleEndian.Uint16(header[0x20:])),
+		cutoff:      uint64(binary.LittleEndian.Uint32(header[0x38:])),
+	}
+
+	if cfb.sectorShift != 9 && cfb.sectorShift != 12 || cfb.miniShift >= cfb.sectorShift {
+		return nil, fmt.Errorf("%w: sector size 2^%d", ErrCorruptCFB, cfb.sectorShift)
+	}
+
+	if err := cfb.readFAT(header); err != nil {
+		return nil, err
+	}
+
+	if err := cfb.readDirectory(binary.LittleEndian.Uint32(header[0x30:])); err != nil {
+		return nil, err
+	}
+
+	miniFAT, err := cfb.chainStream(binary.LittleEndian.Uint32(header[0x3C:]), -1)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfb.miniFAT, err = readUint32s(miniFAT); err != nil {
+		return nil, err
+	}
+
+	root := cfb.entries[0]
+	if root.kind != cfbTypeRoot {
+		return nil, fmt.Errorf("%w: missing root entry", ErrCorruptCFB)
+	}
+
+	if cfb.miniStream, err = cfb.chainStream(root.start, int64(root.size)); err != nil {
+		return nil, err
+	}
+
+	return cfb, nil
+}
+
+// readFAT collects the FAT sector numbers from the header and DIFAT chain, then reads the FAT.
+func (c *cfbFile) readFAT(header []byte) error {
+	numFAT := int(binary.LittleEndian.Uint32(header[0x2C:]))
+	perSector := 1 << (c.sectorShift - 2) //nolint:mnd
+
+	if int64(numFAT)<<c.sectorShift > c.size {
+		return fmt.Errorf("%w: fat larger than file", ErrCorruptCFB)
+	}
+
+	difat := make([]uint32, 0, numFAT)
+	for idx := range cfbHeaderDIFAT {
+		difat = append(difat, binary.LittleEndian.Uint32(header[0x4C+idx*4:]))
+	}
+
+	next := binary.LittleEndian.Uint32(header[0x44:])
+	for count := int(binary.LittleEndian.Uint32(header[0x48:])); count > 0 && next <= cfbMaxRegSect; count-- {
+		sector := make([]byte, 1<<c.sectorShift)
+		if _, err := c.readerAt.ReadAt(sector, c.sectorOffset(next)); err != nil {
+			return fmt.Errorf("%w: reading difat: %w", ErrCorruptCFB, err)
+		}
+
+		for idx := range perSector - 1 {
+			difat = append(difat, binary.LittleEndian.Uint32(sector[idx*4:]))
+		}
+
+		next = binary.LittleEndian.Uint32(sector[(perSector-1)*4:])
+	}
+
+	c.fat = make([]uint32, 0, numFAT*perSector)
+	sector := make([]byte, 1<<c.sectorShift)
+
+	for _, fatSector := range difat[:min(numFAT, len(difat))] {
+		if fatSector > cfbMaxRegSect {
+			continue
+		}
+
+		if _, err := c.readerAt.ReadAt(sector, c.sectorOffset(fatSector)); err != nil {
+			return fmt.Errorf("%w: reading fat: %w", ErrCorruptCFB, err)
+		}
+
+		for idx := range perSector {
+			c.fat = append(c.fat, binary.LittleEndian.Uint32(sector[idx*4:]))
+		}
+	}
+
+	return nil
+}
+
+func (c *cfbFile) readDirectory(start uint32) error {
+	stream, err := c.chainStream(start, -1)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(stream, 0, stream.size))
+	if err != nil {
+		return fmt.Errorf("%w: reading directory: %w", ErrCorruptCFB, err)
+	}
+
+	for pos := 0; pos+cfbDirEntrySize <= len(data); pos += cfbDirEntrySize {
+		raw := data[pos : pos+cfbDirEntrySize]
+		entry := &cfbEntry{
+			kind:  raw[0x42],
+			left:  binary.LittleEndian.Uint32(raw[0x44:]),
+			right: binary.LittleEndian.Uint32(raw[0x48:]),
+			child: binary.LittleEndian.Uint32(raw[0x4C:]),
+			start: binary.LittleEndian.Uint32(raw[0x74:]),
+			size:  binary.LittleEndian.Uint64(raw[0x78:]),
+			mtime: cfbTime(binary.LittleEndian.Uint64(raw[0x6C:])),
+		}
+
+		if c.sectorShift == 9 { //nolint:mnd // version 3 files only use the low 32 bits.
+			entry.size &= 0xFFFFFFFF
+		}
+
+		units := min(int(binary.LittleEndian.Uint16(raw[0x40:]))/2, cfbMaxNameUnits+1) //nolint:mnd
+		for idx := range max(units-1, 0) {
+			entry.name = append(entry.name, binary.LittleEndian.Uint16(raw[idx*2:]))
+		}
+
+		c.entries = append(c.entries, entry)
+	}
+
+	if len(c.entries) == 0 {
+		return fmt.Errorf("%w: empty directory", ErrCorruptCFB)
+	}
+
+	return nil
+}
+
+func (c *cfbFile) sectorOffset(sector uint32) int64 {
+	return (int64(sector) + 1) << c.sectorShift
+}
+
+// chainStream follows a FAT chain. A negative size means the whole chain.
+func (c *cfbFile) chainStream(start uint32, size int64) (*cfbStream, error) {
+	return buildChain(c.readerAt, c.fat, start, size, c.sectorShift, c.sectorOffset)
+}
+
+// miniChainStream follows a mini FAT chain through the mini stream.
+func (c *cfbFile) miniChainStream(start uint32, size int64) (*cfbStream, error) {
+	return buildChain(c.miniStream, c.miniFAT, start, size, c.miniShift, func(sector uint32) int64 {
+		return int64(sector) << c.miniShift
+	})
+}
+
+func buildChain(readerAt io.ReaderAt, fat []uint32, start uint32, size int64, shift uint,
+	offset func(uint32) int64,
+) (*cfbStream, error) {
+	stream := &cfbStream{readerAt: readerAt}
+	sectorSize := int64(1) << shift
+
+	for sector, count := start, 0; sector != cfbEndOfChain && sector != cfbFreeSect; count++ {
+		if size >= 0 && stream.size >= size {
+			break
+		}
+
+		if sector > cfbMaxRegSect || int(sector) >= len(fat) || count >= len(fat) {
+			return nil, fmt.Errorf("%w: bad sector chain", ErrCorruptCFB)
+		}
+
+		stream.add(offset(sector), sectorSize)
+		sector = fat[sector]
+	}
+
+	if size > stream.size {
+		return nil, fmt.Errorf("%w: stream shorter than its size", ErrCorruptCFB)
+	} else if size >= 0 {
+		stream.size = size
+	}
+
+	return stream, nil
+}
+
+func (s *cfbStream) add(offset, length int64) {
+	if last := len(s.runs) - 1; last >= 0 && s.runs[last].offset+s.runs[last].length == offset {
+		s.runs[last].length += length
+	} else {
+		s.runs = append(s.runs, cfbRun{start: s.size, offset: offset, length: length})
+	}
+
+	s.size += length
+}
+
+// ReadAt makes a stream usable as an io.ReaderAt.
+func (s *cfbStream) ReadAt(data []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+
+	wanted := len(data)
+	data = data[:min(int64(len(data)), s.size-off)]
+	read := 0
+
+	run := sort.Search(len(s.runs), func(i int) bool { return s.runs[i].start+s.runs[i].length > off })
+
+	for ; len(data) > 0 && run < len(s.runs); run++ {
+		within := off - s.runs[run].start
+		chunk := data[:min(int64(len(data)), s.runs[run].length-within)]
+
+		n, err := s.readerAt.ReadAt(chunk, s.runs[run].offset+within)
+		read += n
+
+		if err != nil && n < len(chunk) {
+			return read, fmt.Errorf("%w: reading stream: %w", ErrCorruptCFB, err)
+		}
+
+		data = data[n:]
+		off += int64(n)
+	}
+
+	if read < wanted {
+		return read, io.EOF
+	}
+
+	return read, nil
+}
+
+// stream returns a reader for a stream entry, from the mini stream if it is small.
+func (c *cfbFile) stream(entry *cfbEntry) (*cfbStream, error) {
+	if entry.size < c.cutoff {
+		return c.miniChainStream(entry.start, int64(entry.size))
+	}
+
+	return c.chainStream(entry.start, int64(entry.size))
+}
+
+// walk returns every storage and stream below the root, parents first.
+func (c *cfbFile) walk() ([]*cfbItem, error) {
+	root := c.entries[0]
+	seen := map[uint32]bool{0: true}
+
+	c.msi = false
+
+	for _, child := range c.siblings(root.child, map[uint32]bool{}) {
+		if name := c.entries[child].name; len(name) > 0 && name[0] == msiTablePrefix {
+			c.msi = true
+		}
+	}
+
+	return c.walkStorage(root, "", seen, 0)
+}
+
+func (c *cfbFile) walkStorage(storage *cfbEntry, prefix string, seen map[uint32]bool, depth int) ([]*cfbItem, error) {
+	if depth > cfbMaxDepth {
+		return nil, fmt.Errorf("%w: storages nested too deep", ErrCorruptCFB)
+	}
+
+	items := []*cfbItem{}
+
+	for _, idx := range c.siblings(storage.child, seen) {
+		entry := c.entries[idx]
+		item := &cfbItem{path: filepath.Join(prefix, cfbName(entry.name, c.msi)), entry: entry}
+
+		switch entry.kind {
+		case cfbTypeStream:
+			items = append(items, item)
+		case cfbTypeStorage:
+			children, err := c.walkStorage(entry, item.path, seen, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(append(items, item), children...)
+		}
+	}
+
+	return items, nil
+}
+
+// siblings returns the entries of one red-black tree in order. Entries seen before are
+// dropped, so a corrupt directory cannot cause a loop.
+func (c *cfbFile) siblings(node uint32, seen map[uint32]bool) []uint32 {
+	if node == cfbNoStream || int(node) >= len(c.entries) || seen[node] {
+		return nil
+	}
+
+	seen[node] = true
+	entry := c.entries[node]
+
+	list := c.siblings(entry.left, seen)
+	list = append(list, node)
+
+	return append(list, c.siblings(entry.right, seen)...)
+}
+
+// cfbName decodes a directory entry name. MSI packs stream names two characters
+// per code unit; control characters (as in "\x05SummaryInformation") become "[5]".
+func cfbName(units []uint16, msi bool) string {
+	var name strings.Builder
+
+	for _, char := range utf16.Decode(units) {
+		switch {
+		case msi && char == msiTablePrefix:
+			name.WriteByte('!')
+		case msi && char >= 0x3800 && char < 0x4800:
+			name.WriteByte(msiNameChar(int(char-0x3800) & 0x3F)) //nolint:mnd
+			name.WriteByte(msiNameChar(int(char-0x3800) >> 6))   //nolint:mnd
+		case msi && char >= 0x4800 && char < msiTablePrefix:
+			name.WriteByte(msiNameChar(int(char - 0x4800)))
+		case char < ' ':
+			name.WriteString("[" + strconv.Itoa(int(char)) + "]")
+		case char == '/' || char == '\\':
+			name.WriteByte('_')
+		default:
+			name.WriteRune(char)
+		}
+	}
+
+	return name.String()
+}
+
+// msiNameChar maps a 6-bit value to the character set MSI uses in stream names.
+func msiNameChar(value int) byte {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz._"
+	return chars[value]
+}
+
+func cfbTime(filetime uint64) time.Time {
+	if filetime < cfbFiletimeEpoch {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(filetime-cfbFiletimeEpoch)*100) //nolint:mnd
+}
+
+func readUint32s(stream *cfbStream) ([]uint32, error) {
+	data, err := io.ReadAll(io.NewSectionReader(stream, 0, stream.size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptCFB, err)
+	}
+
+	values := make([]uint32, len(data)/4) //nolint:mnd
+	for idx := range values {
+		values[idx] = binary.LittleEndian.Uint32(data[idx*4:])
+	}
+
+	return values, nil
+}
+
+// unCFB writes storages as folders and streams as files.
+func (x *XFile) unCFB(cfb *cfbFile, items []*cfbItem) ([]string, error) {
+	var cabinets map[string]map[string]string
+
+	if cfb.msi {
+		db, err := loadMSI(cfb, items)
+		if err != nil {
+			x.warn("reading msi tables, cabinet files keep their internal names: %v", err)
+		} else {
+			cabinets = db.cabinetNames()
+		}
+	}
+
+	files := []string{}
+
+	for _, item := range items {
+		path := x.clean(item.path)
+		if !x.pathWithinOutput(path) {
+			return files, fmt.Errorf("%w: %s (from: %s)", ErrInvalidPath, path, item.path)
+		}
+
+		if item.entry.kind == cfbTypeStorage {
+			if err := x.mkDirEntry(path, x.DirMode, item.entry.mtime); err != nil {
+				return files, fmt.Errorf("making storage folder: %w", err)
+			}
+
+			continue
+		}
+
+		path, err := x.writeCFBStream(cfb, item, path, cabinets)
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, path)
+	}
+
+	return x.cleanup(files)
+}
+
+func (x *XFile) writeCFBStream(cfb *cfbFile, item *cfbItem, path string,
+	cabinets map[string]map[string]string,
+) (string, error) {
+	stream, err := cfb.stream(item.entry)
+	if err != nil {
+		return path, fmt.Errorf("%s: %w", item.path, err)
+	}
+
+	file := &file{
+		Path:    path,
+		Member:  item.path,
+		Data:    io.NewSectionReader(stream, 0, stream.size),
+		DirMode: x.DirMode,
+		Mtime:   item.entry.mtime,
+	}
+
+	if names, ok := cabinets[item.path]; ok {
+		// Embedded cabinet: rename its files, and make sure recursion recognizes it.
+		if file.Data, err = renameCabinet(stream, names); err != nil {
+			x.warn("cabinet %s keeps its internal file names: %v", item.path, err)
+			file.Data = io.NewSectionReader(stream, 0, stream.size)
+		}
+
+		if !strings.HasSuffix(strings.ToLower(file.Path), ".cab") {
+			file.Path += ".cab"
+		}
+	}
+
+	fSize, err := x.write(file)
+	if err != nil {
+		return file.Path, err
+	}
+
+	x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+		file.Path, fSize, x.prog.Files, x.prog.Wrote)
+
+	return file.Path, nil
+}
@@ -0,0 +1,416 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// testCFBEntry is a stream, or a storage when children is not nil.
+type testCFBEntry struct {
+	name     []uint16
+	data     []byte
+	children []*testCFBEntry
+}
+
+func TestCFB(t *testing.T) {
+	t.Parallel()
+
+	document := bytes.Repeat([]byte("word document "), 500) // past the mini stream cutoff.
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "legacy.doc")
+
+	require.NoError(t, os.WriteFile(archive, buildTestCFB(t, "", []*testCFBEntry{
+		{name: testCFBName("WordDocument"), data: document},
+		{name: testCFBName("\x05SummaryInformation"), data: []byte("summary")},
+		{name: testCFBName("ObjectPool"), children: []*testCFBEntry{
+			{name: testCFBName("\x01CompObj"), data: []byte("embedded object")},
+		}},
+	}), 0o600))
+
+	// Only MSI packages are archives by content; a document is extracted when asked for.
+	out := filepath.Join(tmp, "out")
+	_, _, _, err := xtractr.ExtractFile(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+	require.ErrorIs(t, err, xtractr.ErrUnknownArchiveType)
+	assert.False(t, xtractr.IsArchiveFileByContent(archive))
+
+	size, files, err := xtractr.ExtractCFB(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(document)+7+15), size)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(out, "WordDocument"),
+		filepath.Join(out, "[5]SummaryInformation"),
+		filepath.Join(out, "ObjectPool", "[1]CompObj"),
+	}, files)
+
+	data, err := os.ReadFile(filepath.Join(out, "WordDocument"))
+	require.NoError(t, err)
+	assert.Equal(t, document, data)
+
+	data, err = os.ReadFile(filepath.Join(out, "ObjectPool", "[1]CompObj"))
+	require.NoError(t, err)
+	assert.Equal(t, "embedded object", string(data))
+}
+
+func TestMSI(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "setup.msi")
+	cab := buildTestCAB(t, testCabMSZIP,
+		testCabFile{name: "filReadme", data: []byte("read me")},
+		testCabFile{name: "filGuide", data: []byte("user guide")},
+	)
+
+	require.NoError(t, os.WriteFile(archive, buildTestCFB(t, testMSICLSID, testMSIStreams(cab)), 0o600))
+	assert.True(t, xtractr.IsArchiveFileByContent(archive))
+
+	out := filepath.Join(tmp, "out")
+	_, files, err := xtractr.ExtractCFB(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+	require.NoError(t, err)
+	assert.Contains(t, files, filepath.Join(out, "Binary.Logo"))
+	assert.Contains(t, files, filepath.Join(out, "!_StringPool"))
+	require.Contains(t, files, filepath.Join(out, "data1.cab"))
+
+	// The embedded cabinet is left for recursion, with its files renamed.
+	written, err := os.ReadFile(filepath.Join(out, "data1.cab"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PFiles/Café/readme.txt", "PFiles/Café/docs/guide.txt"}, testCabNames(t, written))
+
+	cabOut := filepath.Join(tmp, "cab")
+	_, files, _, err = xtractr.ExtractFile(&xtractr.XFile{
+		FilePath: filepath.Join(out, "data1.cab"), OutputDir: cabOut, DirMode: 0o700,
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(cabOut, "PFiles", "Café", "readme.txt"),
+		filepath.Join(cabOut, "PFiles", "Café", "docs", "guide.txt"),
+	}, files)
+
+	data, err := os.ReadFile(filepath.Join(cabOut, "PFiles", "Café", "docs", "guide.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "user guide", string(data))
+}
+
+// testMSI builds MSI table streams. Strings are interned in the string pool.
+type testMSI struct {
+	pool    []string
+	ids     map[string]uint16
+	columns [][]any // Table, Number, Name, Type
+}
+
+func (m *testMSI) id(value string) uint16 {
+	if value == "" {
+		return 0
+	}
+
+	if id, ok := m.ids[value]; ok {
+		return id
+	}
+
+	m.pool = append(m.pool, value)
+	m.ids[value] = uint16(len(m.pool))
+
+	return m.ids[value]
+}
+
+// table encodes rows column by column. Column types: "s" string, "i2" and "i4" integers.
+func (m *testMSI) table(name string, columns, types []string, rows ...[]any) *testCFBEntry {
+	var data bytes.Buffer
+
+	for col, kind := range types {
+		msiType := map[string]int{"s": 0x0D48, "i2": 0x0502, "i4": 0x0104}[kind]
+		m.columns = append(m.columns, []any{name, col + 1, columns[col], msiType})
+
+		for _, row := range rows {
+			switch kind {
+			case "s":
+				_ = binary.Write(&data, binary.LittleEndian, m.id(row[col].(string)))
+			case "i2":
+				_ = binary.Write(&data, binary.LittleEndian, uint16(row[col].(int)+0x8000))
+			case "i4":
+				_ = binary.Write(&data, binary.LittleEndian, uint32(row[col].(int))^0x80000000)
+			}
+		}
+	}
+
+	return &testCFBEntry{name: testMSIName(name, true), data: data.Bytes()}
+}
+
+// testMSIStreams returns the streams of a small MSI package with one embedded cabinet.
+func testMSIStreams(cab []byte) []*testCFBEntry {
+	msi := &testMSI{ids: map[string]uint16{}}
+	streams := []*testCFBEntry{
+		msi.table("Directory", []string{"Directory", "Directory_Parent", "DefaultDir"}, []string{"s", "s", "s"},
+			[]any{"TARGETDIR", "", "SourceDir"},
+			[]any{"ProgramFilesFolder", "TARGETDIR", ".:PFiles"},
+			[]any{"APPDIR", "ProgramFilesFolder", "CAFE~1|Café"},
+			[]any{"DOCS", "APPDIR", "docs"},
+		),
+		msi.table("Component", []string{"Component", "Directory_"}, []string{"s", "s"},
+			[]any{"Main", "APPDIR"},
+			[]any{"Docs", "DOCS"},
+		),
+		msi.table("File", []string{"File", "Component_", "FileName", "FileSize", "Sequence"},
+			[]string{"s", "s", "s", "i4", "i2"},
+			[]any{"filReadme", "Main", "README~1.TXT|readme.txt", 7, 1},
+			[]any{"filGuide", "Docs", "guide.txt", 10, 2},
+		),
+		msi.table("Media", []string{"DiskId", "LastSequence", "Cabinet"}, []string{"i2", "i2", "s"},
+			[]any{1, 2, "#data1.cab"},
+		),
+	}
+
+	var columns bytes.Buffer
+
+	for field, kind := range []string{"s", "i2", "s", "i2"} {
+		for _, row := range msi.columns {
+			if kind == "s" {
+				_ = binary.Write(&columns, binary.LittleEndian, msi.id(row[field].(string)))
+			} else {
+				_ = binary.Write(&columns, binary.LittleEndian, uint16(row[field].(int)+0x8000))
+			}
+		}
+	}
+
+	var pool, data bytes.Buffer
+
+	_ = binary.Write(&pool, binary.LittleEndian, uint32(1252))
+
+	for _, value := range msi.pool {
+		encoded := []byte(strings.ReplaceAll(value, "é", "\xe9")) // code page 1252
+		_ = binary.Write(&pool, binary.LittleEndian, []uint16{uint16(len(encoded)), 1})
+		data.Write(encoded)
+	}
+
+	return append(streams,
+		&testCFBEntry{name: testMSIName("_Columns", true), data: columns.Bytes()},
+		&testCFBEntry{name: testMSIName("_StringPool", true), data: pool.Bytes()},
+		&testCFBEntry{name: testMSIName("_StringData", true), data: data.Bytes()},
+		&testCFBEntry{name: testMSIName("data1.cab", false), data: cab},
+		&testCFBEntry{name: testMSIName("Binary.Logo", false), data: []byte("logo")},
+		&testCFBEntry{name: testCFBName("\x05SummaryInformation"), data: []byte("summary")},
+	)
+}
+
+func testCFBName(name string) []uint16 {
+	return utf16.Encode([]rune(name))
+}
+
+// testMSIName packs a stream name the way MSI does: two characters per code unit.
+func testMSIName(name string, table bool) []uint16 {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz._"
+
+	units := []uint16{}
+	if table {
+		units = append(units, 0x4840)
+	}
+
+	for idx := 0; idx < len(name); idx++ {
+		first := strings.IndexByte(chars, name[idx])
+		if idx+1 < len(name) {
+			units = append(units, uint16(0x3800+first+strings.IndexByte(chars, name[idx+1])<<6))
+			idx++
+		} else {
+			units = append(units, uint16(0x4800+first))
+		}
+	}
+
+	return units
+}
+
+// testCFB lays out a version 3 compound file: 512-byte sectors and a 64-byte mini stream.
+type testCFB struct {
+	sectors    [][]byte
+	fat        []uint32
+	miniStream []byte
+	miniFAT    []uint32
+	dir        [][]byte
+}
+
+const (
+	testCFBEndOfChain = 0xFFFFFFFE
+	testCFBNoStream   = 0xFFFFFFFF
+	// testMSICLSID is the root storage class id of MSI packages.
+	testMSICLSID = "\x84\x10\x0c\x00\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x46"
+)
+
+// buildTestCFB lays out entries under a root storage with the class id clsid, which may be empty.
+func buildTestCFB(t *testing.T, clsid string, entries []*testCFBEntry) []byte {
+	t.Helper()
+
+	cfb := &testCFB{dir: [][]byte{testDirEntry(testCFBName("Root Entry"), 5)}}
+	copy(cfb.dir[0][0x50:], clsid)
+	binary.LittleEndian.PutUint32(cfb.dir[0][0x4C:], cfb.addEntries(entries))
+
+	miniStart := cfb.alloc(cfb.miniStream, 512)
+	binary.LittleEndian.PutUint32(cfb.dir[0][0x74:], miniStart)
+	binary.LittleEndian.PutUint64(cfb.dir[0][0x78:], uint64(len(cfb.miniStream)))
+
+	miniFAT := make([]byte, len(cfb.miniFAT)*4)
+	for idx, next := range cfb.miniFAT {
+		binary.LittleEndian.PutUint32(miniFAT[idx*4:], next)
+	}
+
+	miniFATStart := cfb.alloc(miniFAT, 512)
+	dirStart := cfb.alloc(bytes.Join(cfb.dir, nil), 512)
+
+	numFAT := 1
+	for len(cfb.sectors)+numFAT > numFAT*128 {
+		numFAT++
+	}
+
+	fatStart := len(cfb.sectors)
+	for range numFAT {
+		cfb.fat = append(cfb.fat, 0xFFFFFFFD)
+	}
+
+	fat := make([]byte, numFAT*512)
+	for idx := range numFAT * 128 {
+		next := uint32(0xFFFFFFFF)
+		if idx < len(cfb.fat) {
+			next = cfb.fat[idx]
+		}
+
+		binary.LittleEndian.PutUint32(fat[idx*4:], next)
+	}
+
+	for idx := range numFAT {
+		cfb.sectors = append(cfb.sectors, fat[idx*512:(idx+1)*512])
+	}
+
+	header := make([]byte, 512)
+	copy(header, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
+	binary.LittleEndian.PutUint16(header[0x18:], 0x3E)
+	binary.LittleEndian.PutUint16(header[0x1A:], 3)
+	binary.LittleEndian.PutUint16(header[0x1C:], 0xFFFE)
+	binary.LittleEndian.PutUint16(header[0x1E:], 9)
+	binary.LittleEndian.PutUint16(header[0x20:], 6)
+	binary.LittleEndian.PutUint32(header[0x2C:], uint32(numFAT))
+	binary.LittleEndian.PutUint32(header[0x30:], dirStart)
+	binary.LittleEndian.PutUint32(header[0x38:], 4096)
+	binary.LittleEndian.PutUint32(header[0x3C:], miniFATStart)
+	binary.LittleEndian.PutUint32(header[0x40:], uint32((len(miniFAT)+511)/512))
+	binary.LittleEndian.PutUint32(header[0x44:], testCFBEndOfChain)
+
+	for idx := range 109 {
+		sector := uint32(0xFFFFFFFF)
+		if idx < numFAT {
+			sector = uint32(fatStart + idx)
+		}
+
+		binary.LittleEndian.PutUint32(header[0x4C+idx*4:], sector)
+	}
+
+	return append(header, bytes.Join(cfb.sectors, nil)...)
+}
+
+// addEntries adds directory entries for a list of siblings, linked through their
+// right pointers, and returns the index of the first.
+func (c *testCFB) addEntries(entries []*testCFBEntry) uint32 {
+	first, prev := uint32(testCFBNoStream), -1
+
+	for _, entry := range entries {
+		idx := len(c.dir)
+		kind := byte(2)
+
+		if entry.children != nil {
+			kind = 1
+		}
+
+		c.dir = append(c.dir, testDirEntry(entry.name, kind))
+
+		if entry.children != nil {
+			binary.LittleEndian.PutUint32(c.dir[idx][0x4C:], c.addEntries(entry.children))
+		} else {
+			start := c.alloc(entry.data, 512)
+			if len(entry.data) < 4096 {
+				start = c.allocMini(entry.data)
+			}
+
+			binary.LittleEndian.PutUint32(c.dir[idx][0x74:], start)
+			binary.LittleEndian.PutUint64(c.dir[idx][0x78:], uint64(len(entry.data)))
+		}
+
+		if prev < 0 {
+			first = uint32(idx)
+		} else {
+			binary.LittleEndian.PutUint32(c.dir[prev][0x48:], uint32(idx))
+		}
+
+		prev = idx
+	}
+
+	return first
+}
+
+func (c *testCFB) alloc(data []byte, size int) uint32 {
+	if len(data) == 0 {
+		return testCFBEndOfChain
+	}
+
+	start := len(c.sectors)
+
+	for pos := 0; pos < len(data); pos += size {
+		sector := make([]byte, size)
+		copy(sector, data[pos:])
+		c.sectors = append(c.sectors, sector)
+
+		next := uint32(len(c.sectors))
+		if pos+size >= len(data) {
+			next = testCFBEndOfChain
+		}
+
+		c.fat = append(c.fat, next)
+	}
+
+	return uint32(start)
+}
+
+func (c *testCFB) allocMini(data []byte) uint32 {
+	if len(data) == 0 {
+		return testCFBEndOfChain
+	}
+
+	start := len(c.miniFAT)
+
+	for pos := 0; pos < len(data); pos += 64 {
+		sector := make([]byte, 64)
+		copy(sector, data[pos:])
+		c.miniStream = append(c.miniStream, sector...)
+
+		next := uint32(len(c.miniFAT) + 1)
+		if pos+64 >= len(data) {
+			next = testCFBEndOfChain
+		}
+
+		c.miniFAT = append(c.miniFAT, next)
+	}
+
+	return uint32(start)
+}
+
+func testDirEntry(name []uint16, kind byte) []byte {
+	entry := make([]byte, 128)
+
+	for idx, unit := range name {
+		binary.LittleEndian.PutUint16(entry[idx*2:], unit)
+	}
+
+	binary.LittleEndian.PutUint16(entry[0x40:], uint16((len(name)+1)*2))
+	entry[0x42] = kind
+	entry[0x43] = 1 // black
+	binary.LittleEndian.PutUint32(entry[0x44:], testCFBNoStream)
+	binary.LittleEndian.PutUint32(entry[0x48:], testCFBNoStream)
+	binary.LittleEndian.PutUint32(entry[0x4C:], testCFBNoStream)
+
+	return entry
+}
@@ -4,23 +4,35 @@ import (
 	"archive/zip"
 	"encoding/binary"
 	"hash/crc32"
+	"slices"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/saintfish/chardet"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
 	"golang.org/x/text/encoding/japanese"
 	"golang.org/x/text/encoding/korean"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/encoding/traditionalchinese"
 )
 
-// zipNameDecoders stores per-entry filename encodings with an archive-level fallback.
-type zipNameDecoders struct {
+// nameDecoders decode archive member names that are not valid UTF-8. A name's
+// decoded path parts come first, then its own detected encoding, then an
+// archive-level fallback. Random-access formats detect every name up front with
+// detectNameEncoding. Streaming formats start with newNameDecoders and learn each
+// name as it is read; see decodeStream.
+type nameDecoders struct {
+	xFile           *XFile
+	format          string
+	forced          bool // defaultEncoding is XFile.NameEncoding: detection is skipped.
 	defaultEncoding encoding.Encoding
 	nameEncodings   map[string]encoding.Encoding
 	partNames       map[string]string
+	samples         []string // non-UTF-8 names learned by decodeStream.
+	sampleSize      int
 }
 
 // Encoding preference scores for tiebreaking. Higher = more commonly seen in non-UTF8 zips.
@@ -39,39 +51,54 @@ const (
 const (
 	scoreKanaBonus      = 200 // kana is an unambiguous marker for Japanese
 	scoreHangulBonus    = 150 // pure Hangul is a clear marker for Korean
+	scoreCyrillicBonus  = 160 // pure Cyrillic: rarely what CJK bytes decode to in a Cyrillic code page
 	scoreMixedHangulCJK = 50  // mixed Hangul + CJK is suspicious (likely wrong encoding)
 	scorePureCJK        = 100 // pure CJK Unified: consistent Chinese text
 	scorePercentDivisor = 100 // used to compute percentage-based scores
+	confidentBytes      = 32  // non-ASCII bytes chardet needs before its confidence counts in full
 	maxASCII            = 0x80
 )
 
-const zipExtraUnicodePathID = 0x7075 // Info-ZIP Unicode Path extra field.
+const (
+	zipExtraUnicodePathID = 0x7075 // Info-ZIP Unicode Path extra field.
+	// nameSampleLimit is how many bytes of non-UTF-8 names a streaming format
+	// learns from before its archive-level fallback encoding stops changing.
+	nameSampleLimit = 4096
+)
 
-// encodingCandidate holds a charset detection result with its validation score.
-type encodingCandidate struct {
-	charset    string
-	confidence int
-	enc        encoding.Encoding
-	score      int
+// EncodingCandidate is a character set that member names may be in, from DetectNameEncoding.
+type EncodingCandidate struct {
+	// Charset is the character set's name. Pass it to XFile.NameEncoding to use it.
+	Charset string
+	// Confidence is chardet's confidence in the character set, 0 to 100.
+	Confidence int
+	// Score ranks the candidates: confidence, plus how much the decoded names
+	// look like one writing system, plus a preference for common code pages.
+	Score int
+	enc   encoding.Encoding
 }
 
 // detectZipEncoding scans all zip file entries for non-UTF8 filenames and
-// attempts to detect their character encoding. It uses chardet for initial
-// candidates, then validates and scores each one. Returns nil if no non-UTF8
+// attempts to detect their character encoding. Returns nil if no non-UTF8
 // filenames are found or no suitable decoder can be determined.
-func detectZipEncoding(xFile *XFile, entries []*zip.File) *zipNameDecoders {
-	var rawNames []string
-
-	for _, f := range entries {
-		if f.NonUTF8 || !utf8.ValidString(f.Name) {
-			rawNames = append(rawNames, f.Name)
-		}
-	}
+func detectZipEncoding(xFile *XFile, entries []*zip.File) *nameDecoders {
+	return detectNameEncoding(xFile, "zip", zipRawNames(entries))
+}
 
+// detectNameEncoding attempts to detect the character encoding of an archive's
+// non-UTF8 member names. It uses chardet for initial candidates, then validates
+// and scores each one. Returns nil if there are no names or no suitable decoder
+// can be determined.
+func detectNameEncoding(xFile *XFile, format string, rawNames []string) *nameDecoders {
 	if len(rawNames) == 0 {
 		return nil
 	}
 
+	decoders := newNameDecoders(xFile, format)
+	if decoders.forced {
+		return decoders
+	}
+
 	// Concatenate all non-UTF8 names for an archive-level fallback.
 	var allBytes []byte
 	for _, name := range rawNames {
@@ -79,11 +106,15 @@ func detectZipEncoding(xFile *XFile, entries []*zip.File) *zipNameDecoders {
 	}
 
 	// Get a map of filename->encoding.
-	detector, decoders := detectEachFileEncoding(rawNames)
+	detector := chardet.NewTextDetector()
+
+	for _, name := range rawNames {
+		decoders.detectName(detector, name)
+	}
 
 	results, err := detector.DetectAll(allBytes)
 	if err != nil {
-		xFile.Debugf("Charset detection failed for zip filenames: %v", err)
+		xFile.Debugf("Charset detection failed for %s filenames: %v", format, err)
 
 		if len(decoders.nameEncodings) == 0 {
 			return nil
@@ -95,73 +126,158 @@ func detectZipEncoding(xFile *XFile, entries []*zip.File) *zipNameDecoders {
 	best := pickBestEncoding(results, rawNames)
 	if best != nil {
 		decoders.defaultEncoding = best.enc
-		xFile.Debugf("Detected zip fallback filename encoding: %s (confidence: %d, score: %d)",
-			best.charset, best.confidence, best.score)
+		xFile.Debugf("Detected %s fallback filename encoding: %s (confidence: %d, score: %d)",
+			format, best.Charset, best.Confidence, best.Score)
 	}
 
 	if len(decoders.nameEncodings) == 0 && decoders.defaultEncoding == nil {
-		xFile.Debugf("No suitable encoding found for %d non-UTF8 zip filenames", len(rawNames))
+		xFile.Debugf("No suitable encoding found for %d non-UTF8 %s filenames", len(rawNames), format)
 		return nil
 	}
 
-	xFile.Debugf("Detected zip filename encodings for %d/%d entries and %d path parts",
-		len(decoders.nameEncodings), len(rawNames), len(decoders.partNames))
+	xFile.Debugf("Detected %s filename encodings for %d/%d entries and %d path parts",
+		format, len(decoders.nameEncodings), len(rawNames), len(decoders.partNames))
 
 	return decoders
 }
 
-func detectEachFileEncoding(rawNames []string) (*chardet.Detector, *zipNameDecoders) {
-	detector := chardet.NewTextDetector()
-	decoders := &zipNameDecoders{
-		nameEncodings: make(map[string]encoding.Encoding, len(rawNames)),
+// newNameDecoders returns empty decoders for a streaming format to learn names with.
+// With XFile.NameEncoding set, they decode every name with it instead.
+func newNameDecoders(xFile *XFile, format string) *nameDecoders {
+	decoders := &nameDecoders{
+		xFile:         xFile,
+		format:        format,
+		nameEncodings: map[string]encoding.Encoding{},
 		partNames:     map[string]string{},
 	}
-	// Detect the encoding of the filenames, per filename.
-	for _, name := range rawNames {
-		results, err := detector.DetectAll([]byte(name))
-		if err != nil {
+
+	if xFile.NameEncoding == "" {
+		return decoders
+	}
+
+	if decoders.defaultEncoding = charsetToEncoding(xFile.NameEncoding); decoders.defaultEncoding == nil {
+		xFile.warn("unknown name encoding %q, detecting it instead", xFile.NameEncoding)
+	} else {
+		decoders.forced = true
+	}
+
+	return decoders
+}
+
+// detectName detects the encoding of one name, and records the decoding of each
+// of its path parts that does not have one yet.
+func (d *nameDecoders) detectName(detector *chardet.Detector, name string) {
+	results, err := detector.DetectAll([]byte(name))
+	if err != nil {
+		return
+	}
+
+	best := pickBestEncoding(results, []string{name})
+	if best == nil {
+		return
+	}
+
+	d.nameEncodings[name] = best.enc
+
+	decodedName, err := best.enc.NewDecoder().String(name)
+	if err != nil {
+		return
+	}
+
+	rawParts := strings.Split(name, "/")
+
+	decodedParts := strings.Split(decodedName, "/")
+	if len(rawParts) != len(decodedParts) {
+		return
+	}
+
+	for idx, part := range rawParts {
+		if part == "" {
 			continue
 		}
 
-		best := pickBestEncoding(results, []string{name})
-		if best == nil {
+		if _, ok := d.partNames[part]; ok {
 			continue
 		}
 
-		decoders.nameEncodings[name] = best.enc
+		d.partNames[part] = decodedParts[idx]
+	}
+}
 
-		decodedName, err := best.enc.NewDecoder().String(name)
-		if err != nil {
-			continue
-		}
+// decodeStream decodes a name read by a streaming format (tar, cpio, ar, rar, iso).
+// Valid UTF-8 is returned as is. Other names are learned first: the name's own
+// encoding is detected, and until nameSampleLimit bytes have been seen, the
+// archive-level fallback is detected again from every non-UTF8 name so far.
+// Decoded path parts never change once set, so a folder decodes the same way for
+// every member in it.
+func (d *nameDecoders) decodeStream(name string) string {
+	if d == nil || utf8.ValidString(name) {
+		return name
+	}
 
-		rawParts := strings.Split(name, "/")
+	if d.forced {
+		return d.decode(name, true)
+	}
 
-		decodedParts := strings.Split(decodedName, "/")
-		if len(rawParts) != len(decodedParts) {
-			continue
-		}
+	detector := chardet.NewTextDetector()
+	d.detectName(detector, name)
 
-		for idx, part := range rawParts {
-			if part == "" {
-				continue
-			}
+	if d.sampleSize < nameSampleLimit {
+		d.samples = append(d.samples, name)
+		d.sampleSize += len(name)
 
-			if _, ok := decoders.partNames[part]; ok {
-				continue
+		if results, err := detector.DetectAll([]byte(strings.Join(d.samples, ""))); err == nil {
+			if best := pickBestEncoding(results, d.samples); best != nil && best.enc != d.defaultEncoding {
+				d.defaultEncoding = best.enc
+				d.xFile.Debugf("Detected %s fallback filename encoding: %s (confidence: %d, score: %d)",
+					d.format, best.Charset, best.Confidence, best.Score)
 			}
-
-			decoders.partNames[part] = decodedParts[idx]
 		}
 	}
 
-	return detector, decoders
+	return d.decode(name, true)
 }
 
+// fallbackCharsets are scored with no confidence when chardet does not suggest them.
+// Short names often give chardet too little text to suggest the right code page,
+// and it never suggests IBM866, the OEM code page of RAR archives made on Russian Windows.
+//
+//nolint:gochecknoglobals
+var fallbackCharsets = []string{"windows-1251", "ibm866", "GB-18030", "Shift_JIS", "Big5", "EUC-KR", "windows-1252"}
+
 // pickBestEncoding evaluates chardet results against the raw filenames and
 // returns the candidate with the highest combined score, or nil if none are valid.
-func pickBestEncoding(results []chardet.Result, rawNames []string) *encodingCandidate {
-	var candidates []encodingCandidate
+func pickBestEncoding(results []chardet.Result, rawNames []string) *EncodingCandidate {
+	candidates := rankEncodings(results, rawNames)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return &candidates[0]
+}
+
+// rankEncodings scores chardet's results and the fallback character sets against
+// the names, and returns the ones that decode every name, best first.
+func rankEncodings(results []chardet.Result, rawNames []string) []EncodingCandidate {
+	var candidates []EncodingCandidate
+
+	for _, charset := range fallbackCharsets {
+		if !slices.ContainsFunc(results, func(result chardet.Result) bool {
+			return charsetToEncoding(result.Charset) == charsetToEncoding(charset)
+		}) {
+			results = append(results, chardet.Result{Charset: charset})
+		}
+	}
+
+	// chardet's confidence means little until it has seen a few names' worth of bytes.
+	nonASCII := 0
+	for _, name := range rawNames {
+		for idx := range len(name) {
+			if name[idx] >= maxASCII {
+				nonASCII++
+			}
+		}
+	}
 
 	for _, result := range results {
 		enc := charsetToEncoding(result.Charset)
@@ -177,46 +293,51 @@ func pickBestEncoding(results []chardet.Result, rawNames []string) *encodingCand
 		}
 
 		// Score: chardet confidence + script analysis + encoding preference.
-		score := result.Confidence
+		score := result.Confidence * min(nonASCII, confidentBytes) / confidentBytes
 		score += scriptConsistencyScore(decoded)
 		score += encodingPreference(result.Charset)
 
-		candidates = append(candidates, encodingCandidate{
-			charset:    result.Charset,
-			confidence: result.Confidence,
+		candidates = append(candidates, EncodingCandidate{
+			Charset:    result.Charset,
+			Confidence: result.Confidence,
+			Score:      score,
 			enc:        enc,
-			score:      score,
 		})
 	}
 
-	if len(candidates) == 0 {
-		return nil
-	}
+	// Highest combined score first. Ties keep chardet's order.
+	slices.SortStableFunc(candidates, func(a, b EncodingCandidate) int { return b.Score - a.Score })
 
-	// Pick the candidate with the highest combined score.
-	best := &candidates[0]
-	for idx := range candidates[1:] {
-		if candidates[idx+1].score > best.score {
-			best = &candidates[idx+1]
+	// Some character sets have more than one name; keep the best of each.
+	ranked := candidates[:0]
+	for _, candidate := range candidates {
+		if !slices.ContainsFunc(ranked, func(have EncodingCandidate) bool { return have.enc == candidate.enc }) {
+			ranked = append(ranked, candidate)
 		}
 	}
 
-	return best
+	return ranked
 }
 
 // decodeZipFilename decodes a zip entry filename if it's non-UTF8 and a decoder is available.
-func decodeZipFilename(name string, extra []byte, nonUTF8 bool, decoders *zipNameDecoders) string {
+func decodeZipFilename(name string, extra []byte, nonUTF8 bool, decoders *nameDecoders) string {
 	// Prefer ZIP's Unicode Path extra field when present. This is explicit metadata
 	// and avoids heuristic guessing for mixed-language filenames.
 	if unicodeName, ok := decodeUnicodePathExtra(name, extra); ok {
 		return unicodeName
 	}
 
-	if decoders == nil {
+	return decoders.decode(name, nonUTF8)
+}
+
+// decode decodes each path part of a name that is not valid UTF-8, or every part
+// when force is true. Parts decoded with a name or fallback encoding are recorded.
+func (d *nameDecoders) decode(name string, force bool) string {
+	if d == nil {
 		return name
 	}
 
-	if !nonUTF8 && utf8.ValidString(name) {
+	if !force && utf8.ValidString(name) {
 		return name
 	}
 
@@ -229,11 +350,11 @@ func decodeZipFilename(name string, extra []byte, nonUTF8 bool, decoders *zipNam
 			continue
 		}
 
-		enc := decoders.defaultEncoding
-		if value, ok := decoders.partNames[part]; ok {
+		enc := d.defaultEncoding
+		if value, ok := d.partNames[part]; ok {
 			decoded[idx] = value
 			continue
-		} else if specific, ok := decoders.nameEncodings[name]; ok {
+		} else if specific, ok := d.nameEncodings[name]; ok {
 			enc = specific
 		}
 
@@ -249,6 +370,7 @@ func decodeZipFilename(name string, extra []byte, nonUTF8 bool, decoders *zipNam
 		}
 
 		decoded[idx] = value
+		d.partNames[part] = value
 	}
 
 	return strings.Join(decoded, "/")
@@ -305,13 +427,13 @@ func encodingPreference(charset string) int {
 }
 
 // decodeAll attempts to decode every name using the given decoder.
-// Returns the decoded names and whether all decoded successfully into valid UTF-8.
+// Returns the decoded names and whether all decoded into valid UTF-8 without replacement characters.
 func decodeAll(decoder *encoding.Decoder, names []string) ([]string, bool) {
 	decoded := make([]string, len(names))
 
 	for idx, name := range names {
 		d, err := decoder.String(name)
-		if err != nil || !utf8.ValidString(d) {
+		if err != nil || !utf8.ValidString(d) || strings.ContainsRune(d, utf8.RuneError) {
 			return nil, false
 		}
 
@@ -328,7 +450,7 @@ func decodeAll(decoder *encoding.Decoder, names []string) ([]string, bool) {
 func scriptConsistencyScore(decoded []string) int {
 	counts := countScriptRunes(decoded)
 
-	total := counts.cjk + counts.hiragana + counts.katakana + counts.hangul + counts.latin + counts.other
+	total := counts.cjk + counts.hiragana + counts.katakana + counts.hangul + counts.latin + counts.cyrillic + counts.other
 	if total == 0 {
 		return 0
 	}
@@ -358,25 +480,35 @@ func scriptConsistencyScore(decoded []string) int {
 		return scoreMixedHangulCJK
 	}
 
+	// Pure Cyrillic is a clear marker for Russian and other Cyrillic code pages. It beats
+	// Hangul because a short Cyrillic name often decodes to a few valid Hangul syllables.
+	// CJK bytes in a Cyrillic code page also decode to letters, but with random case.
+	if counts.cyrillic > 0 && counts.caseFlips == 0 && counts.cjk+counts.hangul+counts.latin+counts.other == 0 {
+		return scoreCyrillicBonus + counts.cyrillic*scorePercentDivisor/total
+	}
+
 	// Pure CJK Unified: consistent Chinese text (GBK/Big5).
 	if counts.cjk > 0 && counts.other == 0 && counts.latin == 0 {
 		return scorePureCJK
 	}
 
 	// General consistency score.
-	dominant := max(counts.latin, max(counts.hangul, max(kana, counts.cjk)))
+	dominant := max(counts.latin, counts.cyrillic, counts.hangul, kana, counts.cjk)
 
 	return dominant * scorePercentDivisor / total
 }
 
 // scriptCounts holds per-script character counts from decoded filenames.
 type scriptCounts struct {
-	cjk      int // CJK Unified Ideographs (U+4E00-U+9FFF)
+	cjk      int // CJK Unified and Compatibility Ideographs (U+4E00-U+9FFF, U+F900-U+FAFF)
 	hiragana int // Japanese Hiragana (U+3040-U+309F)
 	katakana int // Japanese Katakana (U+30A0-U+30FF)
 	hangul   int // Korean Hangul Syllables (U+AC00-U+D7AF)
 	latin    int // Latin Extended (U+00C0-U+024F)
+	cyrillic int // Cyrillic (U+0400-U+04FF)
 	other    int // everything else non-ASCII
+	// caseFlips counts upper case Cyrillic letters that follow a lower case one.
+	caseFlips int
 }
 
 // countScriptRunes classifies non-ASCII runes in the decoded names by Unicode block.
@@ -384,20 +516,30 @@ func countScriptRunes(decoded []string) scriptCounts {
 	var counts scriptCounts
 
 	for _, name := range decoded {
+		var prev rune
+
 		for _, char := range name {
+			if unicode.Is(unicode.Cyrillic, char) && unicode.IsUpper(char) && unicode.IsLower(prev) {
+				counts.caseFlips++
+			}
+
+			prev = char
+
 			switch {
 			case char < maxASCII:
 				// ASCII - ignore for scoring
-			case char >= 0x4E00 && char <= 0x9FFF:
+			case char >= 0x4E00 && char <= 0x9FFF, char >= 0xF900 && char <= 0xFAFF:
 				counts.cjk++
 			case char >= 0x3040 && char <= 0x309F:
 				counts.hiragana++
 			case char >= 0x30A0 && char <= 0x30FF:
 				counts.katakana++
-			case char >= 0xAC00 && char <= 0xD7AF:
+			case char >= 0xAC00 && char <= 0xD7AF && commonHangul(char):
 				counts.hangul++
 			case char >= 0x00C0 && char <= 0x024F:
 				counts.latin++
+			case char >= 0x0400 && char <= 0x04FF:
+				counts.cyrillic++
 			default:
 				counts.other++
 			}
@@ -407,7 +549,16 @@ func countScriptRunes(decoded []string) scriptCounts {
 	return counts
 }
 
-// charsetToEncoding maps charset names returned by chardet to golang.org/x/text encodings.
+// commonHangul reports whether a syllable is one of the 2350 in KS X 1001. Other
+// syllables only exist in the UHC extension, and are mostly what wrong bytes decode to.
+func commonHangul(char rune) bool {
+	encoded, err := korean.EUCKR.NewEncoder().String(string(char))
+
+	return err == nil && len(encoded) == 2 && encoded[0] >= 0xB0 && encoded[1] >= 0xA1 //nolint:mnd
+}
+
+// charsetToEncoding maps charset names returned by chardet, and the IANA names
+// given to XFile.NameEncoding, to golang.org/x/text encodings.
 func charsetToEncoding(charset string) encoding.Encoding {
 	switch strings.ToLower(charset) {
 	case "gb-2312", "gb2312", "gbk", "gb18030", "gb-18030":
@@ -448,7 +599,15 @@ func charsetToEncoding(charset string) encoding.Encoding {
 		return charmap.Windows1256
 	case "koi8-r":
 		return charmap.KOI8R
-	default:
+	case "ibm866":
+		return charmap.CodePage866
+	}
+
+	// Any other IANA name or alias, like "cp866" or "windows-874".
+	enc, err := ianaindex.IANA.Encoding(charset)
+	if err != nil {
 		return nil
 	}
+
+	return enc
 }
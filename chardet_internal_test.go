@@ -6,8 +6,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
 	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
 )
 
 //nolint:gosmopolitan
@@ -34,7 +37,7 @@ func TestDecodeZipFilename_PrefersPartEncodingForSharedFolders(t *testing.T) {
 	japanesePathRaw := rootRaw + "/" + japaneseLeafRaw
 	chinesePathRaw := rootRaw + "/" + chineseLeafRaw
 
-	decoders := &zipNameDecoders{
+	decoders := &nameDecoders{
 		defaultEncoding: simplifiedchinese.GBK,
 		nameEncodings: map[string]encoding.Encoding{
 			japanesePathRaw: japanese.ShiftJIS, // would garble root without part-level override
@@ -50,3 +53,42 @@ func TestDecodeZipFilename_PrefersPartEncodingForSharedFolders(t *testing.T) {
 	assert.Equal(t, rootUTF+"/"+japaneseLeafUTF, decodeZipFilename(japanesePathRaw, nil, true, decoders))
 	assert.Equal(t, rootUTF+"/"+chineseLeafUTF, decodeZipFilename(chinesePathRaw, nil, true, decoders))
 }
+
+func TestNameDecodersStream(t *testing.T) {
+	t.Parallel()
+
+	// IBM866 is the OEM code page RAR 4 used for names on Russian Windows.
+	encoder := charmap.CodePage866.NewEncoder()
+	decoders := newNameDecoders(&XFile{}, "rar")
+
+	for _, name := range []string{"Музыка/", "Музыка/песня.mp3", "Музыка/Альбом/трек 01.mp3", "readme.txt"} {
+		raw, err := encoder.String(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, decoders.decodeStream(raw))
+	}
+
+	// A part keeps the decoding it was first given, even if the fallback changes.
+	decoders.defaultEncoding = simplifiedchinese.GBK
+	raw, err := encoder.String("Музыка/")
+	require.NoError(t, err)
+	assert.Equal(t, "Музыка/", decoders.decode(raw, true))
+
+	for encoder, names := range map[*encoding.Encoder][]string{
+		korean.EUCKR.NewEncoder():            {"음악/", "음악/노래.mp3"},
+		simplifiedchinese.GBK.NewEncoder():   {"音乐/", "音乐/歌曲.mp3"},
+		japanese.ShiftJIS.NewEncoder():       {"ミュージック/", "ミュージック/テスト.mp3"},
+		charmap.Windows1251.NewEncoder():     {"Документы/", "Документы/отчет.txt"},
+		traditionalchinese.Big5.NewEncoder(): {"音樂/", "音樂/歌曲.mp3"},
+	} {
+		decoders := newNameDecoders(&XFile{}, "tar")
+
+		for _, name := range names {
+			raw, err := encoder.String(name)
+			require.NoError(t, err)
+			assert.Equal(t, name, decoders.decodeStream(raw))
+		}
+	}
+
+	var nilDecoders *nameDecoders
+	assert.Equal(t, "\xff", nilDecoders.decodeStream("\xff"), "nil decoders leave names alone")
+}
@@ -1,10 +1,13 @@
 package xtractr
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 
 	"github.com/cavaliergopher/cpio"
@@ -27,6 +30,9 @@ func ExtractCPIOGzip(xFile *XFile) (size uint64, filesList []string, err error)
 	defer zipStream.Close()
 
 	files, err := xFile.uncpio(zipStream)
+	if err == nil {
+		files, err = xFile.cleanup(files)
+	}
 
 	return xFile.prog.Wrote, files, err
 }
@@ -42,12 +48,36 @@ func ExtractCPIO(xFile *XFile) (size uint64, filesList []string, err error) {
 	defer xFile.newProgress(uint64(stat.Size()), uint64(stat.Size()), 0).done()
 
 	files, err := xFile.uncpio(xFile.prog.reader(fileReader))
+	if err == nil {
+		files, err = xFile.cleanup(files)
+	}
 
 	return xFile.prog.Wrote, files, err
 }
 
+// uncpio extracts a cpio stream. Archives concatenated after the first trailer,
+// like the segments of an initramfs, are extracted too. Callers run cleanup once
+// the last stream is written.
 func (x *XFile) uncpio(reader io.Reader) ([]string, error) {
-	zipReader := cpio.NewReader(reader)
+	buffered := bufio.NewReader(reader)
+	files := []string{}
+	names := newNameDecoders(x, "cpio")
+
+	for {
+		written, err := x.uncpioArchive(cpio.NewReader(buffered), names)
+		files = append(files, written...)
+
+		if err != nil {
+			return files, err
+		}
+
+		if !x.nextCPIOArchive(buffered) {
+			return files, nil
+		}
+	}
+}
+
+func (x *XFile) uncpioArchive(zipReader *cpio.Reader, names *nameDecoders) ([]string, error) {
 	files := []string{}
 
 	for {
@@ -55,27 +85,54 @@ func (x *XFile) uncpio(reader io.Reader) ([]string, error) {
 		if errors.Is(err, io.EOF) {
 			return files, nil
 		} else if err != nil {
-			return nil, fmt.Errorf("cpio Next() failed: %w", err)
+			return files, fmt.Errorf("cpio Next() failed: %w", err)
 		}
 
+		zipFile.Name = names.decodeStream(zipFile.Name)
+		zipFile.Linkname = names.decodeStream(zipFile.Linkname)
+
 		fSize, err := x.uncpioFile(zipFile, zipReader)
+		if errors.Is(err, errSkipEntry) {
+			continue
+		}
+
 		if err != nil {
 			return files, fmt.Errorf("%s: %w", x.FilePath, err)
 		}
 
-		files = append(files, filepath.Join(x.OutputDir, zipFile.Name))
+		files = append(files, x.clean(zipFile.Name))
 		x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
 			zipFile.Name, fSize, x.prog.Files, x.prog.Wrote)
 	}
 }
 
+// nextCPIOArchive skips the zero padding after a cpio trailer and reports
+// whether another newc archive follows it.
+func (x *XFile) nextCPIOArchive(reader *bufio.Reader) bool {
+	if !skipZeros(reader) {
+		return false
+	}
+
+	magic, _ := reader.Peek(6) //nolint:mnd
+	if bytes.Equal(magic, []byte("070701")) || bytes.Equal(magic, []byte("070702")) {
+		x.Debugf("Found another cpio archive concatenated in: %s", x.FilePath)
+		return true
+	}
+
+	x.Debugf("Stopped at data after the end of cpio archive: %s", x.FilePath)
+
+	return false
+}
+
 func (x *XFile) uncpioFile(cpioFile *cpio.Header, cpioReader *cpio.Reader) (uint64, error) {
 	file := &file{
 		Path:     x.clean(cpioFile.Name),
+		Member:   cpioFile.Name,
 		Data:     cpioReader,
 		FileMode: cpioFile.FileInfo().Mode(),
 		DirMode:  x.DirMode,
 		Mtime:    cpioFile.ModTime,
+		Owner:    &fileOwner{uid: cpioFile.Uid, gid: cpioFile.Guid},
 	}
 
 	if !x.pathWithinOutput(file.Path) {
@@ -84,7 +141,7 @@ func (x *XFile) uncpioFile(cpioFile *cpio.Header, cpioReader *cpio.Reader) (uint
 	}
 
 	if cpioFile.Mode.IsDir() || cpioFile.FileInfo().IsDir() {
-		err := x.mkDir(file.Path, cpioFile.FileInfo().Mode(), cpioFile.ModTime)
+		err := x.mkDirFile(file)
 		if err != nil {
 			return 0, fmt.Errorf("making cpio dir: %w", err)
 		}
@@ -105,11 +162,17 @@ func (x *XFile) uncpioFile(cpioFile *cpio.Header, cpioReader *cpio.Reader) (uint
 			return 0, fmt.Errorf("%s: %w", cpioFile.FileInfo().Name(), err)
 		}
 
+		file.FileMode = os.ModeSymlink // Hard links are written as symlinks too.
+		x.restoreMetadata(file)
+
 		return 0, nil
 	}
 
-	// This should turn non-regular files into empty files.
-	// ie. sockets, block, character and fifo devices.
+	// The cpio reader does not return device numbers, so device nodes can not be created.
+	if file.FileMode&specialModes != 0 {
+		return 0, x.writeSpecial(file)
+	}
+
 	s, err := x.write(file)
 	if err != nil {
 		return s, fmt.Errorf("%s: %w: %s (from: %s)", cpioFile.FileInfo().Name(), err, file.Path, cpioFile.Name)
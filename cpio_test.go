@@ -0,0 +1,54 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestCPIOConcatenated(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "joined.cpio")
+	first := testCPIO(t, map[string]string{"early/microcode.bin": "microcode"})
+	first = append(first, make([]byte, 512-len(first)%512)...) // padded like an initramfs segment.
+	require.NoError(t, os.WriteFile(archive, append(first, testCPIO(t, map[string]string{"init": "#!/bin/sh\n"})...), 0o600))
+
+	_, files, _, err := xtractr.ExtractFile(&xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(tmp, "out", "early", "microcode.bin"),
+		filepath.Join(tmp, "out", "init"),
+	}, files)
+
+	data, err := os.ReadFile(filepath.Join(tmp, "out", "init"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\n", string(data))
+}
+
+func testCPIO(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	writer := cpio.NewWriter(&buf)
+
+	for name, content := range files {
+		require.NoError(t, writer.WriteHeader(&cpio.Header{Name: name, Mode: 0o100644, Size: int64(len(content))}))
+		_, err := writer.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
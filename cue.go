@@ -47,6 +47,10 @@ type CueTrack struct {
 	Performer string
 	// StartSample is the starting sample position for this track.
 	StartSample uint64
+	// Mode is the track's data type (e.g. "AUDIO", "MODE1/2352").
+	Mode string
+	// File is the FILE the track is in.
+	File string
 }
 
 // cueTimestamp holds the raw parsed CUE time (MM:SS:FF).
@@ -71,14 +75,26 @@ func (t cueTimestamp) toSamples(sampleRate uint32) uint64 {
 	return samples
 }
 
+// sectors converts a CUE timestamp to a count of CD sectors (frames).
+func (t cueTimestamp) sectors() int64 {
+	const secondsPerMinute = 60
+
+	return (int64(t.minutes)*secondsPerMinute+int64(t.seconds))*cdFramesPerSecond + int64(t.frames)
+}
+
 // ExtractCUE extracts individual tracks from a FLAC file referenced by a CUE sheet.
 // The xFile.FilePath should point to the .cue file (or .cue.txt).
+// Cue sheets for CD images (FILE type BINARY) extract the image's data track. See ExtractCDImage.
 func ExtractCUE(xFile *XFile) (size uint64, files, archives []string, err error) {
 	cue, timestamps, err := parseCueSheetFile(xFile.FilePath)
 	if err != nil {
 		return 0, nil, nil, fmt.Errorf("parsing cue sheet: %w", err)
 	}
 
+	if strings.EqualFold(cue.FileType, "BINARY") {
+		return extractCueImage(xFile, cue, timestamps)
+	}
+
 	// Resolve the audio file path relative to the CUE file.
 	// Some CUE sheets say FILE "album.wav" WAVE but the file on disk is album.flac; try .flac when .wav is missing.
 	// If the FILE line still does not match (e.g. O vs Ö), try the FLAC with the same base name as the CUE file.
@@ -258,7 +274,7 @@ func parseCueSheet(reader io.Reader) (*CueSheet, []cueTimestamp, error) { //noli
 			}
 
 			trackNum := parseCueTrackNum(args)
-			currentTrack = &CueTrack{Number: trackNum}
+			currentTrack = &CueTrack{Number: trackNum, Mode: parseCueTrackMode(args), File: cue.File}
 			hasTimestamp = false
 			currentTimestamp = cueTimestamp{}
 		case "INDEX":
@@ -428,6 +444,16 @@ func parseCueTrackNum(args string) int {
 	return num
 }
 
+// parseCueTrackMode parses the track data type from TRACK args like "01 MODE1/2352".
+func parseCueTrackMode(args string) string {
+	fields := strings.Fields(args)
+	if len(fields) < 2 { //nolint:mnd
+		return ""
+	}
+
+	return strings.ToUpper(fields[1])
+}
+
 // parseCueIndex parses the INDEX command args like "01 03:45:12".
 func parseCueIndex(args string) (int, cueTimestamp) {
 	parts := strings.Fields(args)
@@ -0,0 +1,273 @@
+package xtractr
+
+/* Debian package (.deb) extraction: the data tarball as a tree, the control tarball in DEBIAN/. */
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/peterebden/ar"
+	"github.com/therootcompany/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// debControlDir is the folder the control tarball is extracted into, as dpkg-deb -R does.
+const debControlDir = "DEBIAN"
+
+// debMaxControlSize caps how much of the control file is parsed.
+const debMaxControlSize = 1 << 20
+
+// DebControl holds the fields of a Debian package's control file.
+type DebControl struct {
+	Package      string
+	Version      string
+	Architecture string
+	// Depends is split on commas. Alternatives ("a | b") and versions are kept as written.
+	Depends []string
+	// Fields has every field in the control file, including those above.
+	// Multi-line values keep their line breaks, with the leading space removed.
+	Fields map[string]string
+}
+
+// ExtractDeb extracts a Debian package. The data.tar member is written as the
+// filesystem tree, and control.tar is written into a DEBIAN folder. The parsed
+// control file is stored in xFile.DebControl.
+func ExtractDeb(xFile *XFile) (size uint64, filesList []string, err error) {
+	debFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer debFile.Close()
+
+	defer xFile.newProgress(0, uint64(stat.Size()), 0).done()
+
+	files, err := xFile.unDeb(xFile.prog.reader(debFile))
+
+	return xFile.prog.Wrote, files, err
+}
+
+func (x *XFile) unDeb(reader io.Reader) ([]string, error) {
+	arReader := ar.NewReader(reader)
+	files := []string{}
+	names := newNameDecoders(x, "tar")
+
+	var foundData bool
+
+	for {
+		header, err := arReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return files, fmt.Errorf("%s: arReader.Next: %w", x.FilePath, err)
+		}
+
+		name := strings.TrimSuffix(header.Name, "/")
+
+		switch {
+		case name == "debian-binary":
+			version, _ := io.ReadAll(io.LimitReader(arReader, 16)) //nolint:mnd
+			if !bytes.HasPrefix(version, []byte("2.")) {
+				return files, fmt.Errorf("%s: %w: format version %q", x.FilePath, ErrInvalidDeb, bytes.TrimSpace(version))
+			}
+		case strings.HasPrefix(name, "control.tar"), strings.HasPrefix(name, "data.tar"):
+			foundData = foundData || strings.HasPrefix(name, "data.tar")
+
+			written, err := x.untarDebMember(name, arReader, names)
+			files = append(files, written...)
+
+			if err != nil {
+				return files, err
+			}
+		default:
+			x.Debugf("Skipping debian package member: %s", name)
+		}
+	}
+
+	if !foundData {
+		return files, fmt.Errorf("%s: %w: missing data.tar member", x.FilePath, ErrInvalidDeb)
+	}
+
+	if x.DebControl == nil {
+		return files, fmt.Errorf("%s: %w: missing control file", x.FilePath, ErrInvalidDeb)
+	}
+
+	return x.cleanup(files)
+}
+
+// untarDebMember extracts a control.tar or data.tar member using the decompressor its suffix names.
+func (x *XFile) untarDebMember(name string, reader io.Reader, names *nameDecoders) ([]string, error) {
+	tarReader, err := x.debMemberReader(name, reader)
+	if err != nil {
+		return nil, err
+	}
+	defer tarReader.Close()
+
+	if strings.HasPrefix(name, "control.tar") {
+		return x.untarDebControl(newTarStream(tarReader), names)
+	}
+
+	return x.untarArchive(newTarStream(tarReader), names)
+}
+
+// debMemberReader decompresses a control.tar or data.tar member.
+func (x *XFile) debMemberReader(name string, reader io.Reader) (io.ReadCloser, error) {
+	switch filepath.Ext(name) {
+	case ".tar":
+		return io.NopCloser(reader), nil
+	case ".gz":
+		zipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s: gzip.NewReader: %w", name, err)
+		}
+
+		return zipReader, nil
+	case ".xz":
+		zipReader, err := xz.NewReader(reader, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: xz.NewReader: %w", name, err)
+		}
+
+		return io.NopCloser(zipReader), nil
+	case ".zst":
+		zipReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s: zstd.NewReader: %w", name, err)
+		}
+
+		return zipReader.IOReadCloser(), nil
+	case ".bz2":
+		return io.NopCloser(bzip2.NewReader(reader)), nil
+	case ".lzma":
+		zipReader, err := lzma.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s: lzma.NewReader: %w", name, err)
+		}
+
+		return io.NopCloser(zipReader), nil
+	default:
+		return nil, fmt.Errorf("%s: %w: %s", x.FilePath, ErrUnsupportedDebCompression, name)
+	}
+}
+
+// untarDebControl extracts control.tar into the DEBIAN folder. The control file is
+// parsed as it is written, so nothing data.tar writes can change what is parsed.
+func (x *XFile) untarDebControl(tarReader *tarStream, names *nameDecoders) ([]string, error) {
+	files := []string{}
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		} else if err != nil {
+			return files, fmt.Errorf("%s: tarReader.Next: %w", x.FilePath, err)
+		}
+
+		member := x.normalize(names.decodeStream(header.Name))
+		if !filepath.IsLocal(member) {
+			return files, fmt.Errorf("%s: %w: %s is outside %s", x.FilePath, ErrInvalidPath, member, debControlDir)
+		}
+
+		header.Name = path.Join(debControlDir, member)
+		file := x.tarFile(header, tarReader)
+		file.Member = member
+
+		var control debControlBuffer
+		if path.Clean(member) == "control" && header.Typeflag == tar.TypeReg {
+			file.Data = io.TeeReader(tarReader, &control)
+		}
+
+		fSize, err := x.writeTarFile(header, file)
+		if errors.Is(err, errSkipEntry) {
+			continue
+		} else if err != nil {
+			return files, err
+		}
+
+		if control.Len() > 0 {
+			x.DebControl = parseDebControl(control.Bytes())
+		}
+
+		files = append(files, filepath.Join(debControlDir, member))
+		x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+			header.Name, fSize, x.prog.Files, x.prog.Wrote)
+	}
+}
+
+// debControlBuffer keeps the part of the control file that is parsed.
+type debControlBuffer struct {
+	bytes.Buffer
+}
+
+func (b *debControlBuffer) Write(data []byte) (int, error) {
+	if room := debMaxControlSize - b.Len(); room > 0 {
+		b.Buffer.Write(data[:min(room, len(data))])
+	}
+
+	return len(data), nil
+}
+
+// parseDebControl parses the first paragraph of a control file. Continuation lines
+// begin with a space or tab, and a line holding only " ." is an empty line.
+func parseDebControl(data []byte) *DebControl {
+	control := &DebControl{Fields: map[string]string{}}
+	scanner := bufio.NewScanner(io.LimitReader(bytes.NewReader(data), debMaxControlSize))
+	last := ""
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(control.Fields) > 0 {
+				return control.fill()
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			if last == "" {
+				continue
+			}
+
+			line = strings.TrimSpace(line)
+			if line == "." {
+				line = ""
+			}
+
+			control.Fields[last] += "\n" + line
+		case line[0] == '#':
+			continue
+		default:
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+
+			last = strings.TrimSpace(key)
+			control.Fields[last] = strings.TrimSpace(value)
+		}
+	}
+
+	return control.fill()
+}
+
+func (d *DebControl) fill() *DebControl {
+	d.Package = d.Fields["Package"]
+	d.Version = d.Fields["Version"]
+	d.Architecture = d.Fields["Architecture"]
+
+	for dep := range strings.SplitSeq(d.Fields["Depends"], ",") {
+		if dep = strings.Join(strings.Fields(dep), " "); dep != "" {
+			d.Depends = append(d.Depends, dep)
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,158 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/peterebden/ar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"golift.io/xtractr"
+)
+
+const testDebControl = `Package: hello
+Version: 2.10-3
+Architecture: amd64
+Maintainer: Test <test@example.com>
+Depends: libc6 (>= 2.34),  adduser | passwd
+Description: example package
+ A longer description
+ .
+ with a blank line.
+`
+
+func TestExtractDeb(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []string{"gz", "xz", "zst"} {
+		t.Run(compression, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			archive := filepath.Join(tmp, "hello_2.10-3_amd64.deb")
+			writeTestDeb(t, archive, compression)
+
+			out := filepath.Join(tmp, "out")
+			xFile := &xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700}
+			_, files, _, err := xtractr.ExtractFile(xFile)
+			require.NoError(t, err)
+			assert.Contains(t, files, filepath.Join("DEBIAN", "control"))
+			assert.Contains(t, files, "./usr/bin/hello")
+
+			data, err := os.ReadFile(filepath.Join(out, "usr", "bin", "hello"))
+			require.NoError(t, err)
+			assert.Equal(t, "#!/bin/sh\necho hello\n", string(data))
+
+			data, err = os.ReadFile(filepath.Join(out, "DEBIAN", "postinst"))
+			require.NoError(t, err)
+			assert.Equal(t, "#!/bin/sh\n", string(data))
+
+			require.NotNil(t, xFile.DebControl)
+			assert.Equal(t, "hello", xFile.DebControl.Package)
+			assert.Equal(t, "2.10-3", xFile.DebControl.Version)
+			assert.Equal(t, "amd64", xFile.DebControl.Architecture)
+			assert.Equal(t, []string{"libc6 (>= 2.34)", "adduser | passwd"}, xFile.DebControl.Depends)
+			assert.Equal(t, "example package\nA longer description\n\nwith a blank line.",
+				xFile.DebControl.Fields["Description"])
+		})
+	}
+}
+
+func TestExtractDebErrors(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "bad.deb")
+	writeTestDeb(t, archive, "lz4")
+
+	_, _, err := xtractr.ExtractDeb(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")})
+	require.ErrorIs(t, err, xtractr.ErrUnsupportedDebCompression)
+}
+
+func TestExtractDebControlFromControlTar(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hello.deb")
+	writeTestDebFiles(t, archive, "gz", map[string]string{"./DEBIAN/control": "Package: replaced\n"})
+
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700}
+	_, _, err := xtractr.ExtractDeb(xFile)
+	require.NoError(t, err)
+	require.NotNil(t, xFile.DebControl)
+	assert.Equal(t, "hello", xFile.DebControl.Package, "data.tar does not change the parsed control file")
+}
+
+// writeTestDeb writes a package with control.tar and data.tar compressed the same way.
+// Unknown compressions are written uncompressed under that suffix.
+func writeTestDeb(t *testing.T, path, compression string) {
+	t.Helper()
+	writeTestDebFiles(t, path, compression, map[string]string{"./usr/bin/hello": "#!/bin/sh\necho hello\n"})
+}
+
+// writeTestDebFiles writes a package like writeTestDeb, with these files in data.tar.
+func writeTestDebFiles(t *testing.T, path, compression string, files map[string]string) {
+	t.Helper()
+
+	control := testTar(t, testTarFiles(map[string]string{"./control": testDebControl, "./postinst": "#!/bin/sh\n"})...)
+	data := testTar(t, testTarFiles(files)...)
+
+	var buf bytes.Buffer
+
+	writer := ar.NewWriter(&buf)
+	require.NoError(t, writer.WriteGlobalHeader())
+
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar." + compression, testCompress(t, compression, control)},
+		{"data.tar." + compression, testCompress(t, compression, data)},
+	}
+
+	for _, member := range members {
+		require.NoError(t, writer.WriteHeader(&ar.Header{
+			Name: member.name, ModTime: time.Now(), Mode: 0o644, Size: int64(len(member.data)),
+		}))
+		_, err := writer.Write(member.data)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+}
+
+func testCompress(t *testing.T, compression string, data []byte) []byte {
+	t.Helper()
+
+	var (
+		buf    bytes.Buffer
+		writer io.WriteCloser
+		err    error
+	)
+
+	switch compression {
+	case "gz":
+		writer = gzip.NewWriter(&buf)
+	case "xz":
+		writer, err = xz.NewWriter(&buf)
+	case "zst":
+		writer, err = zstd.NewWriter(&buf)
+	default:
+		return data
+	}
+
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
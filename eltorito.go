@@ -0,0 +1,386 @@
+package xtractr
+
+/* El Torito boot images and the MBR or GPT partitions of hybrid ISO images. */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// isoBootDir is the folder boot images and appended partitions are written into, like 7-Zip does.
+	isoBootDir    = "[BOOT]"
+	elToritoID    = "EL TORITO SPECIFICATION"
+	mbrSectorSize = 512
+	bootEntrySize = 32
+	gptMaxEntries = 256
+)
+
+// ISOPartition is a partition in the MBR or GPT of a hybrid ISO image.
+// Hybrid images boot from USB sticks; some append partitions (often a FAT
+// EFI system partition) after the ISO9660 volume.
+type ISOPartition struct {
+	// Index is the partition number, starting at 1.
+	Index int `json:"index"`
+	// Scheme is "mbr" or "gpt".
+	Scheme string `json:"scheme"`
+	// Type is the MBR partition type in hex (e.g. "ef"), or the GPT type GUID.
+	Type string `json:"type"`
+	// Name is the GPT partition name.
+	Name string `json:"name,omitempty"`
+	// Start and Size are byte offsets in the image.
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+	// Appended is true when the partition lies past the end of the ISO9660 volume.
+	Appended bool `json:"appended"`
+	// File is where an appended partition was written with XFile.ISOBoot.
+	File string `json:"file,omitempty"`
+}
+
+// isoBootImage is one El Torito boot catalog entry.
+type isoBootImage struct {
+	platform byte
+	offset   int64
+	size     int64
+}
+
+// unisoBoot lists a hybrid image's partitions in x.ISOPartitions. With x.ISOBoot, it writes
+// the El Torito boot images as [BOOT]/n-<platform>.img and appended partitions as [BOOT]/partition-n.img.
+func (x *XFile) unisoBoot(image io.ReaderAt, imageSize int64) (uint64, []string, error) {
+	volumeEnd := isoVolumeSize(image)
+	if volumeEnd == 0 {
+		volumeEnd = imageSize
+	}
+
+	x.ISOPartitions = readISOPartitions(image, imageSize, volumeEnd)
+	if !x.ISOBoot {
+		return 0, nil, nil
+	}
+
+	boots, err := readElTorito(image, imageSize)
+	if err != nil {
+		x.warn("reading boot catalog: %v", err)
+	}
+
+	files := []string{}
+	size := uint64(0)
+
+	for idx, boot := range boots {
+		name := fmt.Sprintf("%d-%s.img", idx+1, bootPlatform(boot.platform))
+
+		wrote, err := x.writeISOSection(image, name, boot.offset, boot.size)
+		size += wrote
+
+		if err != nil {
+			return size, files, err
+		}
+
+		files = append(files, x.clean(filepath.Join(isoBootDir, name)))
+	}
+
+	for _, part := range x.ISOPartitions {
+		if !part.Appended {
+			continue
+		}
+
+		part.File = filepath.Join(isoBootDir, fmt.Sprintf("partition-%d.img", part.Index))
+
+		wrote, err := x.writeISOSection(image, filepath.Base(part.File), part.Start, part.Size)
+		size += wrote
+
+		if err != nil {
+			return size, files, err
+		}
+
+		files = append(files, x.clean(part.File))
+	}
+
+	return size, files, nil
+}
+
+func (x *XFile) writeISOSection(image io.ReaderAt, name string, offset, size int64) (uint64, error) {
+	file := &file{
+		Path:     x.clean(filepath.Join(isoBootDir, name)),
+		Member:   filepath.Join(isoBootDir, name),
+		Data:     io.NewSectionReader(image, offset, size),
+		FileMode: x.FileMode,
+		DirMode:  x.DirMode,
+	}
+
+	x.Debugf("Writing ISO boot image: %s (offset: %d, bytes: %d)", file.Path, offset, size)
+
+	return x.write(file)
+}
+
+func bootPlatform(platform byte) string {
+	switch platform {
+	case 0:
+		return "x86"
+	case 1:
+		return "ppc"
+	case 2: //nolint:mnd
+		return "mac"
+	case 0xEF: //nolint:mnd
+		return "efi"
+	default:
+		return fmt.Sprintf("platform-%02x", platform)
+	}
+}
+
+// isoVolumeSize returns the size of the ISO9660 volume from its primary volume descriptor, or 0.
+func isoVolumeSize(image io.ReaderAt) int64 {
+	sector := make([]byte, isoSectorSize)
+
+	for idx := range isoMaxVDs {
+		if _, err := image.ReadAt(sector, int64(isoPVDSector+idx)*isoSectorSize); err != nil ||
+			string(sector[1:6]) != "CD001" || sector[0] == 0xFF {
+			return 0
+		}
+
+		if sector[0] == 1 {
+			return int64(le32(sector, 80)) * isoSectorSize //nolint:mnd
+		}
+	}
+
+	return 0
+}
+
+// readElTorito returns the images in the boot catalog, if the image has one.
+func readElTorito(image io.ReaderAt, imageSize int64) ([]*isoBootImage, error) {
+	sector := make([]byte, isoSectorSize)
+	catalog := int64(0)
+
+	for idx := range isoMaxVDs {
+		if _, err := image.ReadAt(sector, int64(isoPVDSector+idx)*isoSectorSize); err != nil ||
+			string(sector[1:6]) != "CD001" || sector[0] == 0xFF {
+			break
+		}
+
+		if sector[0] == 0 && string(bytes.TrimRight(sector[7:39], "\x00")) == elToritoID {
+			catalog = int64(le32(sector, 0x47)) * isoSectorSize //nolint:mnd
+			break
+		}
+	}
+
+	if catalog == 0 {
+		return nil, nil
+	}
+
+	if _, err := image.ReadAt(sector, catalog); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptISO, err)
+	}
+
+	if !validBootCatalog(sector[:bootEntrySize]) {
+		return nil, fmt.Errorf("%w: bad boot catalog validation entry", ErrCorruptISO)
+	}
+
+	platform, boots := sector[1], []*isoBootImage{}
+
+	for pos := bootEntrySize; pos+bootEntrySize <= isoSectorSize; pos += bootEntrySize {
+		entry := sector[pos : pos+bootEntrySize]
+
+		switch entry[0] {
+		case 0x90, 0x91: // section header; 0x91 is the last one.
+			platform = entry[1]
+		case 0x88, 0x00: // bootable and not bootable entries.
+			if boot := readBootEntry(image, imageSize, platform, entry); boot != nil {
+				boots = append(boots, boot)
+			} else if entry[0] == 0 && bytes.Count(entry, []byte{0}) == bootEntrySize {
+				return boots, nil // end of the catalog.
+			}
+		}
+	}
+
+	return boots, nil
+}
+
+// validBootCatalog checks the validation entry: its 16-bit words sum to 0 and it ends with 55 AA.
+func validBootCatalog(entry []byte) bool {
+	var sum uint16
+
+	for idx := 0; idx < len(entry); idx += 2 {
+		sum += binary.LittleEndian.Uint16(entry[idx:])
+	}
+
+	return entry[0] == 1 && entry[30] == 0x55 && entry[31] == 0xAA && sum == 0
+}
+
+// readBootEntry finds the size of a boot image. Floppy emulation has fixed sizes, hard disk
+// emulation has an MBR, and no emulation images use a count of 512 byte sectors; that count
+// is often wrong for EFI images, so a FAT boot sector's size is used when there is one.
+func readBootEntry(image io.ReaderAt, imageSize int64, platform byte, entry []byte) *isoBootImage {
+	boot := &isoBootImage{platform: platform, offset: int64(le32(entry, 8)) * isoSectorSize} //nolint:mnd
+	if boot.offset == 0 || boot.offset >= imageSize {
+		return nil
+	}
+
+	switch entry[1] & 0x0F {
+	case 1:
+		boot.size = 1200 * 1024 //nolint:mnd
+	case 2: //nolint:mnd
+		boot.size = 1440 * 1024 //nolint:mnd
+	case 3: //nolint:mnd
+		boot.size = 2880 * 1024 //nolint:mnd
+	case 4: //nolint:mnd // hard disk.
+		boot.size = mbrDiskSize(image, boot.offset)
+	default:
+		boot.size = fatVolumeSize(image, boot.offset)
+	}
+
+	if boot.size == 0 {
+		boot.size = max(int64(binary.LittleEndian.Uint16(entry[6:])), 1) * mbrSectorSize
+	}
+
+	boot.size = min(boot.size, imageSize-boot.offset)
+
+	return boot
+}
+
+// fatVolumeSize returns the size recorded in a FAT boot sector at offset, or 0.
+func fatVolumeSize(image io.ReaderAt, offset int64) int64 {
+	sector := make([]byte, mbrSectorSize)
+	if _, err := image.ReadAt(sector, offset); err != nil || sector[510] != 0x55 || sector[511] != 0xAA {
+		return 0
+	}
+
+	switch perSector := binary.LittleEndian.Uint16(sector[11:]); perSector {
+	case 512, 1024, 2048, 4096: //nolint:mnd
+		total := int64(binary.LittleEndian.Uint16(sector[19:]))
+		if total == 0 {
+			total = int64(le32(sector, 32)) //nolint:mnd
+		}
+
+		return total * int64(perSector)
+	default:
+		return 0
+	}
+}
+
+// mbrDiskSize returns the end of the last partition in an MBR at offset, or 0.
+func mbrDiskSize(image io.ReaderAt, offset int64) int64 {
+	sector := make([]byte, mbrSectorSize)
+	if _, err := image.ReadAt(sector, offset); err != nil || sector[510] != 0x55 || sector[511] != 0xAA {
+		return 0
+	}
+
+	end := int64(0)
+
+	for idx := range 4 {
+		entry := sector[446+idx*16:] //nolint:mnd
+		end = max(end, (int64(le32(entry, 8))+int64(le32(entry, 12)))*mbrSectorSize)
+	}
+
+	return end
+}
+
+// readISOPartitions reads the GPT of a hybrid image, or its MBR when it has no GPT.
+func readISOPartitions(image io.ReaderAt, imageSize, volumeEnd int64) []*ISOPartition {
+	mbr := make([]byte, mbrSectorSize)
+	if _, err := image.ReadAt(mbr, 0); err != nil || mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return nil
+	}
+
+	parts := []*ISOPartition{}
+
+	for idx := range 4 {
+		entry := mbr[446+idx*16:] //nolint:mnd
+		if entry[4] == 0xEE {     // protective MBR.
+			if gpt := readGPT(image); len(gpt) > 0 {
+				parts = gpt
+				break
+			}
+		}
+
+		if entry[4] != 0 && le32(entry, 12) != 0 {
+			parts = append(parts, &ISOPartition{
+				Index:  idx + 1,
+				Scheme: "mbr",
+				Type:   fmt.Sprintf("%02x", entry[4]),
+				Start:  int64(le32(entry, 8)) * mbrSectorSize,
+				Size:   int64(le32(entry, 12)) * mbrSectorSize,
+			})
+		}
+	}
+
+	list := []*ISOPartition{}
+
+	for _, part := range parts {
+		if part.Start >= imageSize {
+			continue // points past the end of a cut image.
+		}
+
+		part.Size = min(part.Size, imageSize-part.Start)
+		part.Appended = part.Start >= volumeEnd
+		list = append(list, part)
+	}
+
+	return list
+}
+
+// readGPT reads the partition entries of a GPT with 512 byte sectors.
+func readGPT(image io.ReaderAt) []*ISOPartition {
+	header := make([]byte, mbrSectorSize)
+	if _, err := image.ReadAt(header, mbrSectorSize); err != nil || string(header[:8]) != "EFI PART" {
+		return nil
+	}
+
+	count, size := min(le32(header, 80), gptMaxEntries), int(le32(header, 84)) //nolint:mnd
+	if size < 128 || size > mbrSectorSize {
+		return nil
+	}
+
+	entries := make([]byte, int(count)*size)
+	if _, err := image.ReadAt(entries, int64(binary.LittleEndian.Uint64(header[72:]))*mbrSectorSize); err != nil {
+		return nil
+	}
+
+	parts := []*ISOPartition{}
+
+	for idx := range int(count) {
+		entry := entries[idx*size:]
+		if bytes.Count(entry[:16], []byte{0}) == 16 { //nolint:mnd // unused entry.
+			continue
+		}
+
+		first, last := binary.LittleEndian.Uint64(entry[32:]), binary.LittleEndian.Uint64(entry[40:])
+		if last < first {
+			continue
+		}
+
+		parts = append(parts, &ISOPartition{
+			Index:  idx + 1,
+			Scheme: "gpt",
+			Type:   gptGUID(entry[:16]),
+			Name:   gptName(entry[56:128]),
+			Start:  int64(first) * mbrSectorSize,        //nolint:gosec
+			Size:   int64(last-first+1) * mbrSectorSize, //nolint:gosec
+		})
+	}
+
+	return parts
+}
+
+// gptGUID formats a GUID; the first three fields are little endian.
+func gptGUID(guid []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", binary.LittleEndian.Uint32(guid),
+		binary.LittleEndian.Uint16(guid[4:]), binary.LittleEndian.Uint16(guid[6:]), guid[8:10], guid[10:16])
+}
+
+func gptName(name []byte) string {
+	chars := make([]uint16, 0, len(name)/2) //nolint:mnd
+
+	for idx := 0; idx+1 < len(name); idx += 2 {
+		if char := binary.LittleEndian.Uint16(name[idx:]); char != 0 {
+			chars = append(chars, char)
+		} else {
+			break
+		}
+	}
+
+	return strings.TrimSpace(string(utf16.Decode(chars)))
+}
@@ -0,0 +1,170 @@
+package xtractr_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/Unpackerr/iso9660"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// Sectors in the boot test image. The appended partition follows the volume.
+const (
+	btRootDir  = 19
+	btCatalog  = 20
+	btX86Image = 21
+	btEFIImage = 22
+	btReadme   = 23
+	btSectors  = 24
+	btAppended = 4096
+)
+
+func TestExtractISOBoot(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hybrid.iso")
+	require.NoError(t, os.WriteFile(archive, testBootISO(), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, ISOBoot: true}
+	_, files, err := xtractr.ExtractISO(xFile)
+	require.NoError(t, err)
+
+	x86, err := os.ReadFile(filepath.Join(out, "[BOOT]", "1-x86.img"))
+	require.NoError(t, err)
+	assert.Len(t, x86, 4*512, "the x86 image is sized by its sector count")
+	assert.Equal(t, "x86 boot", string(x86[:8]))
+
+	efi, err := os.ReadFile(filepath.Join(out, "[BOOT]", "2-efi.img"))
+	require.NoError(t, err)
+	assert.Len(t, efi, testSector, "the EFI image is sized by its FAT boot sector, not its sector count")
+
+	part, err := os.ReadFile(filepath.Join(out, "[BOOT]", "partition-1.img"))
+	require.NoError(t, err)
+	assert.Len(t, part, btAppended)
+	assert.Equal(t, "appended", string(part[:8]))
+
+	require.Len(t, xFile.ISOPartitions, 1)
+	assert.Equal(t, &xtractr.ISOPartition{
+		Index: 1, Scheme: "gpt", Type: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", Name: "EFI",
+		Start: btSectors * testSector, Size: btAppended, Appended: true,
+		File: filepath.Join("[BOOT]", "partition-1.img"),
+	}, xFile.ISOPartitions[0])
+
+	assert.Subset(t, files, []string{
+		filepath.Join(out, "[BOOT]", "1-x86.img"), filepath.Join(out, "[BOOT]", "2-efi.img"),
+		filepath.Join(out, "[BOOT]", "partition-1.img"),
+	})
+	assert.Len(t, files, 4, "the boot files and README")
+}
+
+func TestExtractISOBootDisabled(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hybrid.iso")
+	require.NoError(t, os.WriteFile(archive, testBootISO(), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700}
+	_, files, err := xtractr.ExtractISO(xFile)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.NoDirExists(t, filepath.Join(out, "[BOOT]"))
+
+	// Partitions are listed without ISOBoot.
+	require.Len(t, xFile.ISOPartitions, 1)
+	assert.True(t, xFile.ISOPartitions[0].Appended)
+	assert.Empty(t, xFile.ISOPartitions[0].File)
+}
+
+// testBootISO builds an image with a boot catalog for x86 and EFI, and a GPT
+// with one EFI system partition appended after the ISO9660 volume.
+func testBootISO() []byte {
+	image := make([]byte, btSectors*testSector+btAppended)
+
+	// Protective MBR and GPT with 512 byte sectors.
+	image[446+4] = 0xEE
+	binary.LittleEndian.PutUint32(image[446+8:], 1)
+	binary.LittleEndian.PutUint32(image[446+12:], uint32(len(image)/512-1))
+	image[510], image[511] = 0x55, 0xAA
+
+	gpt := image[512:]
+	copy(gpt, "EFI PART")
+	binary.LittleEndian.PutUint64(gpt[72:], 2) // entries at LBA 2.
+	binary.LittleEndian.PutUint32(gpt[80:], 4)
+	binary.LittleEndian.PutUint32(gpt[84:], 128)
+
+	entry := image[1024:]
+	// C12A7328-F81F-11D2-BA4B-00A0C93EC93B, EFI system partition.
+	copy(entry, []byte{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B})
+	entry[16] = 1 // unique GUID.
+	binary.LittleEndian.PutUint64(entry[32:], btSectors*testSector/512)
+	binary.LittleEndian.PutUint64(entry[40:], (btSectors*testSector+btAppended)/512-1)
+
+	for idx, char := range utf16.Encode([]rune("EFI")) {
+		binary.LittleEndian.PutUint16(entry[56+idx*2:], char)
+	}
+
+	pvd := image[16*testSector:]
+	pvd[0], pvd[6] = 1, 1
+	copy(pvd[1:], "CD001")
+	iso9660.WriteInt32LSBMSB(pvd[80:], btSectors)
+	iso9660.WriteInt16LSBMSB(pvd[120:], 1)
+	iso9660.WriteInt16LSBMSB(pvd[124:], 1)
+	iso9660.WriteInt16LSBMSB(pvd[128:], testSector)
+	copy(pvd[156:], testDirRecord("\x00", btRootDir, testSector, 0x02))
+
+	boot := image[17*testSector:]
+	boot[6] = 1
+	copy(boot[1:], "CD001")
+	copy(boot[7:], "EL TORITO SPECIFICATION")
+	binary.LittleEndian.PutUint32(boot[0x47:], btCatalog)
+
+	term := image[18*testSector:]
+	term[0], term[6] = 0xFF, 1
+	copy(term[1:], "CD001")
+
+	testDirSector(image, btRootDir,
+		testDirRecord("\x00", btRootDir, testSector, 0x02),
+		testDirRecord("\x01", btRootDir, testSector, 0x02),
+		testDirRecord("README.TXT;1", btReadme, 6, 0),
+	)
+
+	catalog := image[btCatalog*testSector:]
+	catalog[0], catalog[30], catalog[31] = 1, 0x55, 0xAA // validation entry, x86.
+
+	var sum uint16
+	for idx := 0; idx < 32; idx += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[idx:])
+	}
+
+	binary.LittleEndian.PutUint16(catalog[28:], -sum)
+	// Default entry: bootable, no emulation, 4 sectors.
+	catalog[32] = 0x88
+	binary.LittleEndian.PutUint16(catalog[32+6:], 4)
+	binary.LittleEndian.PutUint32(catalog[32+8:], btX86Image)
+	// Last section header for EFI, with one entry that claims a single sector.
+	catalog[64], catalog[65], catalog[66] = 0x91, 0xEF, 1
+	catalog[96] = 0x88
+	binary.LittleEndian.PutUint16(catalog[96+6:], 1)
+	binary.LittleEndian.PutUint32(catalog[96+8:], btEFIImage)
+
+	copy(image[btX86Image*testSector:], "x86 boot")
+
+	fat := image[btEFIImage*testSector:]
+	binary.LittleEndian.PutUint16(fat[11:], 512)
+	binary.LittleEndian.PutUint16(fat[19:], 4) // 4 sectors of 512 bytes.
+	fat[510], fat[511] = 0x55, 0xAA
+
+	copy(image[btReadme*testSector:], "readme")
+	copy(image[btSectors*testSector:], "appended")
+
+	return image
+}
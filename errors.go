@@ -29,10 +29,71 @@ var (
 	ErrAudioNotFound    = errors.New("audio file referenced by cue sheet not found")
 	ErrUnsupportedAudio = errors.New("cue sheet references unsupported audio format (only FLAC and APE are supported)")
 
+	// CD images.
+
+	ErrNoDataTrack = errors.New("no iso9660 data track in cd image")
+
+	// APK.
+
+	ErrInvalidAPK = errors.New("invalid alpine package")
+
+	// DEB.
+
+	ErrInvalidDeb                = errors.New("invalid debian package")
+	ErrUnsupportedDebCompression = errors.New("unsupported debian package member compression")
+
+	// Initramfs.
+
+	ErrInvalidInitramfs = errors.New("unrecognized initramfs segment")
+
+	// ISO.
+
+	ErrCorruptISO = errors.New("corrupt iso9660 directory")
+
+	// Metadata.
+
+	ErrInvalidACL              = errors.New("invalid access control list")
+	ErrSpecialFile             = errors.New("special file in archive")
+	ErrNoDeviceNumbers         = errors.New("archive does not record device numbers")
+	ErrSpecialFilesUnsupported = errors.New("special files are not supported on this platform")
+	ErrLink                    = errors.New("link in archive")
+	ErrLinkLoop                = errors.New("link target contains the link")
+
+	// OCI.
+
+	ErrInvalidImage = errors.New("invalid container image")
+
 	// RPM.
 
 	ErrUnsupportedRPMCompression = errors.New("unsupported rpm compression")
 	ErrUnsupportedRPMArchiveFmt  = errors.New("unsupported rpm archive format")
+	ErrUnsupportedRPMDigest      = errors.New("unsupported rpm file digest algorithm")
+	ErrInvalidRPMHeader          = errors.New("invalid rpm package header")
+
+	// UDF.
+
+	ErrCorruptUDF        = errors.New("corrupt udf file entry")
+	ErrXattrTooLarge     = errors.New("stream is too large for an extended attribute")
+	ErrXattrsUnsupported = errors.New("extended attributes are not supported on this platform")
+
+	// WIM.
+
+	ErrUnsupportedWIM  = errors.New("unsupported wim feature")
+	ErrInvalidWIMImage = errors.New("wim image index out of range")
+	ErrCorruptWIM      = errors.New("corrupt wim data")
+
+	// CFB (MSI) and CAB.
+
+	ErrCorruptCFB     = errors.New("corrupt compound file")
+	ErrCorruptCAB     = errors.New("corrupt cabinet file")
+	ErrUnsupportedCAB = errors.New("unsupported cabinet feature")
+
+	// Checksum files.
+
+	ErrChecksumMismatch = errors.New("files are missing or do not match their checksums")
+	ErrCorruptPAR2      = errors.New("corrupt par2 file")
+	ErrPAR2Unrepairable = errors.New("par2 files can not repair the damaged files")
+	ErrRARUnrepairable  = errors.New("no par2 set describes the rar archive")
 )
 
 // ExtractError is a rich error type that can carry multiple errors and warnings
@@ -100,7 +161,8 @@ func (e *ExtractError) HasWarnings() bool {
 
 // WrapExtractError ensures the error is an ExtractError with context from xFile.
 // If err is already an *ExtractError, its context fields are filled from xFile when empty.
-// If err is nil, returns nil. xFile may be nil when only path/context are available.
+// Warnings from xFile are added to it. If err is nil, returns nil.
+// xFile may be nil when only path/context are available.
 func WrapExtractError(err error, xFile *XFile, bytesWritten uint64, archiveType string) error {
 	if err == nil {
 		return nil
@@ -108,18 +170,13 @@ func WrapExtractError(err error, xFile *XFile, bytesWritten uint64, archiveType
 
 	var extErr *ExtractError
 	if !errors.As(err, &extErr) {
-		filePath := ""
-		outputDir := ""
-
-		if xFile != nil {
-			filePath = xFile.FilePath
-			outputDir = xFile.OutputDir
-		}
-
-		return NewExtractError(err, filePath, outputDir, bytesWritten, archiveType)
+		extErr = &ExtractError{Errs: []error{err}}
 	}
 
 	if xFile != nil {
+		// The same XFile's error can be wrapped more than once.
+		extErr.Warnings = append(extErr.Warnings, Difference(extErr.Warnings, xFile.Warnings)...)
+
 		if extErr.FilePath == "" {
 			extErr.FilePath = xFile.FilePath
 		}
@@ -3,8 +3,10 @@ package xtractr
 /* Code to find, write, move and delete files. */
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"maps"
 	"os"
@@ -48,13 +50,16 @@ var extension2function = []archive{
 	// The ones with double extensions that match a single (below) need to come first.
 	{Type: "7zip", Ext: ".7z", Fn: Extract7z},
 	{Type: "7zip", Ext: ".7z.001", Fn: Extract7z},
+	{Type: "apk", Ext: ".apk", Fn: ChngInt(ExtractAPK)},
 	{Type: "ar", Ext: ".ar", Fn: ChngInt(ExtractAr)},
 	{Type: "brotli", Ext: ".br", Fn: ChngInt(ExtractBrotli)},
 	{Type: "brotli", Ext: ".brotli", Fn: ChngInt(ExtractBrotli)},
 	{Type: "bz2", Ext: ".bz2", Fn: ChngInt(ExtractBzip)},
+	{Type: "cab", Ext: ".cab", Fn: ChngInt(ExtractCAB)},
 	{Type: "cpio.gzip", Ext: ".cpgz", Fn: ChngInt(ExtractCPIOGzip)},
 	{Type: "cpio", Ext: ".cpio", Fn: ChngInt(ExtractCPIO)},
-	{Type: "deb", Ext: ".deb", Fn: ChngInt(ExtractAr)},
+	{Type: "deb", Ext: ".deb", Fn: ChngInt(ExtractDeb)},
+	{Type: "wim", Ext: ".esd", Fn: ChngInt(ExtractWIM)},
 	{Type: "gzip", Ext: ".gz", Fn: ChngInt(ExtractGzip)},
 	{Type: "gzip", Ext: ".gzip", Fn: ChngInt(ExtractGzip)},
 	{Type: "iso", Ext: ".iso", Fn: ChngInt(ExtractISO)},
@@ -63,6 +68,9 @@ var extension2function = []archive{
 	{Type: "lzma", Ext: ".lzip", Fn: ChngInt(ExtractLZMA)},
 	{Type: "lzma", Ext: ".lzma", Fn: ChngInt(ExtractLZMA)},
 	{Type: "lzma2", Ext: ".lzma2", Fn: ChngInt(ExtractLZMA2)},
+	{Type: "iso", Ext: ".mdf", Fn: ChngInt(ExtractCDImage)},
+	{Type: "msi", Ext: ".msi", Fn: ChngInt(ExtractCFB)},
+	{Type: "iso", Ext: ".nrg", Fn: ChngInt(ExtractCDImage)},
 	{Type: "rar", Ext: ".r00", Fn: ExtractRAR},
 	{Type: "rar", Ext: ".rar", Fn: ExtractRAR},
 	{Type: "snappy2", Ext: ".s2", Fn: ChngInt(ExtractS2)},
@@ -76,6 +84,7 @@ var extension2function = []archive{
 	{Type: "tar.lzma", Ext: ".tlz", Fn: ChngInt(ExtractTarLzip)},
 	{Type: "tar.xz", Ext: ".txz", Fn: ChngInt(ExtractTarXZ)},
 	{Type: "tar.lzw", Ext: ".tz", Fn: ChngInt(ExtractTarZ)},
+	{Type: "wim", Ext: ".wim", Fn: ChngInt(ExtractWIM)},
 	{Type: "xz", Ext: ".xz", Fn: ChngInt(ExtractXZ)},
 	{Type: "lzw", Ext: ".z", Fn: ChngInt(ExtractLZW)}, // everything is lowercase...
 	{Type: "zip", Ext: ".zip", Fn: ChngInt(ExtractZIP)},
@@ -100,7 +109,7 @@ func ChngInt(smallFn func(*XFile) (uint64, []string, error)) Interface {
 // dispatchWorkers runs work for each entry using a bounded worker pool.
 // Dispatch stops when a worker reports an error, in-flight entries finish,
 // and the first error encountered is returned. Used by the random-access
-// extractors (ZIP, 7z) when XFile.FileWorkers > 1.
+// extractors (ZIP, 7z, ISO, UDF) when XFile.FileWorkers > 1.
 func dispatchWorkers[T any](count int, entries []T, work func(T) error) error {
 	var (
 		waitGroup sync.WaitGroup
@@ -160,7 +169,7 @@ type XFile struct {
 	// (RAR/7z) Archive passwords (to try multiple).
 	Passwords []string
 	// FileWorkers controls how many files within a single archive are extracted
-	// concurrently. Only effective for random-access formats (ZIP, 7z).
+	// concurrently. Only effective for random-access formats (ZIP, 7z, ISO, UDF).
 	// Streaming formats ignore this. 0 or 1 = sequential (current behavior).
 	// Total concurrent I/O when using the queue = Config.Parallel * FileWorkers.
 	FileWorkers int
@@ -175,6 +184,78 @@ type XFile struct {
 	// this true will cause the extracted content to be moved into the
 	// output folder, and the root folder in the archive to be removed.
 	SquashRoot bool
+	// (WIM/ESD) Image index to extract, starting at 1. 0 extracts every image;
+	// with more than one image, each is written to a numbered subfolder.
+	WIMImage int
+	// (TAR) When a tarball holds a container image (docker save or an OCI layout),
+	// extract the image's flattened root filesystem instead of its layers. See ExtractOCI.
+	FlattenImages bool
+	// (RPM) Parse the package header, check extracted files against its digests,
+	// and write it as JSON into the output folder. See RPMPackage.
+	RPMMetadata bool
+	// (ISO) Write El Torito boot images as [BOOT]/n-<platform>.img, and partitions
+	// appended to hybrid images as [BOOT]/partition-n.img.
+	ISOBoot bool
+	// (ISO/UDF) Apply the owner and group (when running as root) and the setuid, setgid
+	// and sticky bits recorded in UDF file entries, and write named streams as
+	// user.<name> extended attributes on Linux.
+	UDFAttributes bool
+	// (ZIP/RAR/TAR/CPIO/AR/ISO) Decode member names that are not UTF-8 with this
+	// character set (an IANA name like "IBM866" or "Shift_JIS") instead of detecting
+	// it. Names that are valid UTF-8 are left alone. See DetectNameEncoding.
+	NameEncoding string
+	// NameSanitizer, if set, is called with each part of every path written, and returns
+	// the name to write it as. Parts that then differ only in case get ~1, ~2, etc. Use
+	// WindowsSafeName for an OutputDir on NTFS, exFAT or an SMB share. Renames are
+	// recorded in Warnings.
+	NameSanitizer func(name string) string
+	// NameForm, if set, normalizes every path written to NFC or NFD. Archives made
+	// on macOS hold NFD names that look like, but do not match, NFC names on Linux.
+	NameForm NameForm
+	// (TAR/ZIP/CPIO/RAR) Set PreserveOwnership to restore archived owners and groups
+	// when running as root. Tar and RAR5 user and group names that exist on this
+	// system are used over the archived ids. RAR 4 archives have no owners, and
+	// RAR5 archives with encrypted headers keep theirs hidden.
+	PreserveOwnership bool
+	// (TAR) Set PreserveXattrs to restore extended attributes (SCHILY.xattr PAX
+	// records) and POSIX ACLs (SCHILY.acl) on Linux. Attributes the file system or
+	// the user may not set are skipped. Only user.* attributes and ACLs are restored
+	// by default; security.* and trusted.* also need KeepSetuid, and others are
+	// skipped with a warning.
+	PreserveXattrs bool
+	// Set SparseFiles to seek over blocks of zeros instead of writing them, so disk
+	// images and database files only take the space their data needs. The holes in
+	// tar entries with GNU sparse maps are always seeked over.
+	SparseFiles bool
+	// (TAR/CPIO) SpecialFilePolicy says what to do with device nodes, FIFOs and
+	// sockets. The default skips them; each one skipped is recorded in Warnings.
+	SpecialFilePolicy SpecialFilePolicy
+	// SetuidPolicy says what to do with setuid and setgid bits on files. The default,
+	// StripSetuid, removes them and records each file in Warnings.
+	SetuidPolicy SetuidPolicy
+	// LinkPolicy says how to write symlinks and hard links: create them (the default),
+	// copy their targets, skip them with a warning, or fail. It applies to every format.
+	LinkPolicy LinkPolicy
+	// (RAR) When extraction fails on bad or missing data, damaged and missing volumes
+	// are repaired in place with the PAR2 set next to the archive that describes them,
+	// and extraction is tried again. Set DisablePAR2Repair to leave the volumes alone.
+	DisablePAR2Repair bool
+	// Repaired is set to the volumes repaired with PAR2 files. They are in Warnings too.
+	Repaired []string
+	// Set Manifest to hash each file as it is written, and list it in ManifestEntries.
+	Manifest bool
+	// ManifestEntries is set during extraction with Manifest: one entry for each
+	// file written from an archive member, with its SHA-256.
+	ManifestEntries []ManifestEntry
+	// Set during extraction to non-fatal messages, like files renamed by NameSanitizer.
+	// They are also copied into ExtractError.Warnings when extraction fails.
+	Warnings []string
+	// (ISO) Set by ExtractISO to the MBR or GPT partitions of a hybrid image.
+	ISOPartitions []*ISOPartition
+	// (DEB) Set by ExtractDeb to the package's parsed control file.
+	DebControl *DebControl
+	// (RPM) Set by ExtractRPM to the package's header metadata when RPMMetadata is true.
+	RPMPackage *RPMPackage
 	// SkipOnRecursion, if set by an extractor, lists paths that were copied into
 	// the output (e.g. a CUE sheet) and must not be re-extracted when recursing.
 	SkipOnRecursion []string
@@ -182,6 +263,7 @@ type XFile struct {
 	log       Logger
 	moveFiles func(fromPath, toPath string, overwrite bool) ([]string, error)
 	prog      *progressTracker
+	state     *extractState
 }
 
 // Filter is the input to find compressed files.
@@ -214,6 +296,56 @@ func (x *XFile) Printf(format string, v ...any) {
 	}
 }
 
+// extractState is what one extraction's parallel workers add to. The copies of an
+// XFile that an extractor makes for part of an archive (like a package's control
+// files) share it, and its Warnings and ManifestEntries go to the XFile it started with.
+type extractState struct {
+	mu       sync.Mutex
+	xFile    *XFile
+	renames  *nameRenames
+	links    []pendingLink
+	dirTimes map[string]dirTime
+	// memberHash, if set, hashes each regular file as it is written into memberSums,
+	// by archive member name. ExtractRPM checks the sums against the package header.
+	memberHash func() hash.Hash
+	memberSums map[string]string
+}
+
+// shared returns the state of the extraction x is in, and starts one if there is none.
+// newProgress calls it before an extractor starts any workers.
+func (x *XFile) shared() *extractState {
+	if x.state == nil {
+		x.state = &extractState{xFile: x}
+	}
+
+	return x.state
+}
+
+// retry returns a copy of x to extract the archive again with another password. It starts
+// with the Warnings and ManifestEntries x has now, and a state of its own, so nothing from
+// a failed attempt is kept unless the caller copies it back.
+func (x *XFile) retry(password string) *XFile {
+	attempt := *x
+	attempt.Password = password
+	attempt.Warnings = slices.Clip(x.Warnings)
+	attempt.ManifestEntries = slices.Clip(x.ManifestEntries)
+	attempt.state = nil
+
+	return &attempt
+}
+
+// warn adds a message to Warnings, and logs it with Debugf. Parallel workers may call it.
+func (x *XFile) warn(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	state := x.shared()
+
+	state.mu.Lock()
+	state.xFile.Warnings = append(state.xFile.Warnings, msg)
+	state.mu.Unlock()
+
+	x.Debugf("Warning: %s: %s", x.FilePath, msg)
+}
+
 // GetFileList returns all the files in a path or paths.
 // This is non-recursive and only returns files _in_ the base paths provided.
 // This is a helper method and only exposed for convenience. You do not have to call this.
@@ -478,6 +610,7 @@ func ExtractFile(xFile *XFile) (size uint64, filesList, archiveList []string, er
 			FilePath:    xFile.FilePath,
 			OutputDir:   xFile.OutputDir,
 			ArchiveType: extensionType,
+			Warnings:    xFile.Warnings,
 		}
 		if err != nil {
 			extErr.Errs = append(extErr.Errs, err)
@@ -666,6 +799,18 @@ type file struct {
 	// Linkname is an explicit symlink target when the archive format stores it
 	// outside the file payload (e.g. RAR5 redirection records).
 	Linkname string
+	// Owner and Xattrs (extended attributes, including POSIX ACLs) are
+	// restored with PreserveOwnership and PreserveXattrs.
+	Owner  *fileOwner
+	Xattrs map[string][]byte
+	// Sparse writes Holes as holes. Without Holes, it writes blocks of zeros
+	// as holes, like SparseFiles does for every file.
+	Sparse bool
+	Holes  []sparseRange
+	// Device is the major and minor number of a device node, if the archive has them.
+	Device *fileDevice
+	// Member is the entry's name in the archive, for ManifestEntry.Member.
+	Member string
 }
 
 // Rename is an attempt to deal with "invalid cross link device" on weird file systems.
@@ -787,11 +932,15 @@ func (x *XFile) SetLogger(logger Logger) {
 // cleanup runs after a successful extract.
 // The intent it to move files into their final location.
 func (x *XFile) cleanup(files []string) ([]string, error) {
+	files = x.withoutLinks(files, x.resolveLinks())
+
 	files, err := x.squashRoot(files)
 	if err != nil {
 		return files, err
 	}
 
+	x.restoreDirTimes()
+
 	return files, nil
 }
 
@@ -810,6 +959,8 @@ func (x *XFile) squashRoot(files []string) ([]string, error) {
 
 	if len(roots) == 1 { // only 1 root folder...
 		for root := range roots { // ...move it's content up a level.
+			x.moveDirTimes(filepath.Join(x.OutputDir, root), x.OutputDir)
+			x.moveManifest(filepath.Join(x.OutputDir, root), x.OutputDir)
 			return x.moveFiles(filepath.Join(x.OutputDir, root), x.OutputDir, false)
 		}
 	}
@@ -832,6 +983,10 @@ func (x *XFile) safeFileMode(current os.FileMode) os.FileMode {
 		return x.FileMode
 	}
 
+	if x.SetuidPolicy == StripSetuid {
+		current &^= os.ModeSetuid | os.ModeSetgid
+	}
+
 	const minimum = 0o400 // ensure owner has read access to the file.
 
 	return current | minimum
@@ -900,11 +1055,15 @@ func (x *XFile) writeFile(file *file, parallel bool) (uint64, error) {
 		err := x.writeSymlink(file)
 		if errors.Is(err, errSkipEntry) {
 			return 0, nil
+		} else if err == nil {
+			x.restoreMetadata(file)
 		}
 
 		return 0, err
 	}
 
+	file.FileMode = x.stripSetuid(file.Path, file.FileMode)
+
 	flags, usedPath, err := openFlagsForExtract(file.Path)
 	if err != nil {
 		return 0, err
@@ -918,9 +1077,28 @@ func (x *XFile) writeFile(file *file, parallel bool) (uint64, error) {
 
 	file.Path = pathUsed
 
-	progWriter := x.prog.writer(fout)
+	var (
+		dest   io.Writer = fout
+		sparse *sparseWriter
+	)
+
+	if x.SparseFiles || file.Sparse {
+		sparse = &sparseWriter{file: fout, holes: file.Holes, scan: x.SparseFiles || file.Holes == nil}
+		dest = sparse
+	}
+
+	progWriter := x.prog.writer(dest)
 	if parallel {
-		progWriter = x.prog.parallelWriter(fout)
+		progWriter = x.prog.parallelWriter(dest)
+	}
+
+	if x.Manifest {
+		progWriter.digest = sha256.New()
+	}
+
+	memberHash := x.shared().memberHash
+	if memberHash != nil {
+		progWriter.memberDigest = memberHash()
 	}
 
 	size, err := io.Copy(progWriter, file.Data)
@@ -928,6 +1106,22 @@ func (x *XFile) writeFile(file *file, parallel bool) (uint64, error) {
 		return uint64(size), fmt.Errorf("copying archived file '%s' io: %w", file.Path, err)
 	}
 
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			return uint64(size), fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+
+	x.restoreMetadata(file)
+
+	if progWriter.digest != nil {
+		x.addManifest(file, size, progWriter.digest)
+	}
+
+	if progWriter.memberDigest != nil {
+		x.addMemberSum(file.Member, progWriter.memberDigest)
+	}
+
 	// The error is ignored because it's not critical and pops up on OSes like Windows.
 	defer os.Chtimes(file.Path, file.Atime, file.Mtime)
 
@@ -1033,7 +1227,8 @@ func (x *XFile) writeSymlink(file *file) error {
 	return x.createSymlink(file.Path, linkName)
 }
 
-// clean returns an absolute path for a file inside the OutputDir.
+// clean returns an absolute path for a file inside the OutputDir, normalized to
+// NameForm and passed through NameSanitizer, so containment checks see the path written.
 // If trim length is > 0, then the suffixes are trimmed, and filepath removed.
 func (x *XFile) clean(filePath string, trim ...string) string {
 	if len(trim) != 0 {
@@ -1043,7 +1238,7 @@ func (x *XFile) clean(filePath string, trim ...string) string {
 		}
 	}
 
-	return filepath.Clean(filepath.Join(x.OutputDir, filePath))
+	return x.sanitize(filepath.Clean(filepath.Join(x.OutputDir, x.normalize(filePath))))
 }
 
 // pathWithin reports whether target is base or a descendant of it.
@@ -1136,11 +1331,18 @@ func (x *XFile) createSymlink(path, linkName string) error {
 		return errSkipEntry
 	}
 
+	// The target must be in the same form as the names it points to, and renamed like them.
+	linkName = x.sanitizeLink(path, x.normalize(linkName))
+
 	err := x.ensureLinkWithinOutput(path, linkName)
 	if err != nil {
 		return err
 	}
 
+	if handled, err := x.applyLinkPolicy("symlink", path, resolveLinkTarget(path, linkName)); handled {
+		return err
+	}
+
 	x.Debugf("Writing archived symlink: %s -> %s", path, linkName)
 
 	err = os.Symlink(linkName, path)
@@ -1168,6 +1370,10 @@ func (x *XFile) createHardLink(path, linkName string) error {
 		return fmt.Errorf("%s: %w: %s (from: %s)", x.FilePath, ErrInvalidPath, target, linkName)
 	}
 
+	if handled, err := x.applyLinkPolicy("hard link", path, target); handled {
+		return err
+	}
+
 	x.Debugf("Writing archived hard link: %s => %s", path, target)
 
 	err := os.Link(target, path)
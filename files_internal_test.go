@@ -204,3 +204,36 @@ func TestWriteExtractFileNameTooLongDoesNotFollowTruncatedSymlink(t *testing.T)
 	require.NoError(t, err)
 	assert.Equal(t, []byte("secret"), got, "must not follow symlink at truncated path")
 }
+
+func TestRetryStartsClean(t *testing.T) {
+	t.Parallel()
+
+	xFile := &XFile{Password: "first", Warnings: []string{"before"}, Manifest: true}
+
+	failed := xFile.retry("wrong")
+	failed.warn("from the failed attempt")
+	failed.ManifestEntries = append(failed.ManifestEntries, ManifestEntry{Path: "a"})
+
+	attempt := xFile.retry("right")
+	assert.Equal(t, "right", attempt.Password)
+	assert.Equal(t, []string{"before"}, attempt.Warnings, "a failed attempt's warnings must not carry over")
+	assert.Empty(t, attempt.ManifestEntries, "a failed attempt's files must not carry over")
+	assert.Equal(t, []string{"before"}, xFile.Warnings, "attempts must not write into the caller's XFile")
+}
+
+func TestExtractStateShared(t *testing.T) {
+	t.Parallel()
+
+	xFile := &XFile{OutputDir: t.TempDir(), Manifest: true}
+	xFile.newProgress(0, 0, 0)
+
+	member := *xFile // like a package's control files: another folder, the same extraction.
+	member.OutputDir = filepath.Join(xFile.OutputDir, "control")
+
+	member.warn("from a copy")
+	member.recordDirTime(member.OutputDir, time.Time{}, time.Unix(1, 0))
+
+	assert.Equal(t, []string{"from a copy"}, xFile.Warnings, "a copy's warnings must reach the XFile it came from")
+	assert.Empty(t, member.Warnings)
+	assert.Len(t, xFile.state.dirTimes, 1)
+}
@@ -0,0 +1,157 @@
+package xtractr
+
+/* Linux initramfs (initrd) images: cpio archives back to back, each one optionally compressed. */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/therootcompany/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// initramfsMagicSize is enough bytes to match any offset 0 entry in signatureTable.
+const initramfsMagicSize = 32
+
+// ExtractInitramfs extracts a Linux initramfs or initrd image. These are cpio
+// archives back to back: usually an uncompressed early cpio with CPU microcode,
+// then the main archive compressed with gzip, xz, zstd, lz4, bzip2 or lzma.
+// Each segment's compression is found by its signature and every segment is
+// extracted into the same output folder. Only gzip segments may be followed by
+// another segment; the other decompressors can read past the end of their data.
+func ExtractInitramfs(xFile *XFile) (size uint64, filesList []string, err error) {
+	imageFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer imageFile.Close()
+
+	defer xFile.newProgress(0, uint64(stat.Size()), 0).done()
+
+	files, err := xFile.unInitramfs(bufio.NewReader(xFile.prog.reader(imageFile)))
+
+	return xFile.prog.Wrote, files, err
+}
+
+func (x *XFile) unInitramfs(reader *bufio.Reader) ([]string, error) {
+	files := []string{}
+
+	for segment := 1; skipZeros(reader); segment++ {
+		magic, _ := reader.Peek(initramfsMagicSize)
+
+		if bytes.HasPrefix(magic, []byte("0707")) {
+			// uncpio reads this bufio.Reader directly and stops in front of the next compressed segment.
+			written, err := x.uncpio(reader)
+			files = append(files, written...)
+
+			if err != nil {
+				return files, fmt.Errorf("initramfs segment %d: %w", segment, err)
+			}
+
+			continue
+		}
+
+		sig := matchSignature(magic, nil)
+		if sig == nil && len(files) == 0 {
+			return files, fmt.Errorf("%s: %w: segment %d", x.FilePath, ErrInvalidInitramfs, segment)
+		} else if sig == nil {
+			x.warn("ignoring unrecognized data after initramfs segment %d", segment-1)
+			break
+		}
+
+		x.Debugf("Extracting %s compressed initramfs segment %d: %s", sig.Type, segment, x.FilePath)
+
+		written, last, err := x.uncpioCompressed(reader, sig.Type)
+		files = append(files, written...)
+
+		if err != nil {
+			return files, fmt.Errorf("initramfs segment %d: %w", segment, err)
+		}
+
+		if last {
+			break
+		}
+	}
+
+	return x.cleanup(files)
+}
+
+// uncpioCompressed extracts one compressed initramfs segment. It reports last when
+// the decompressor may have read past the segment, so nothing after it can be found.
+func (x *XFile) uncpioCompressed(reader *bufio.Reader, compression string) ([]string, bool, error) {
+	var stream io.Reader
+
+	switch compression {
+	case "gzip":
+		zipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, true, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		defer zipReader.Close()
+
+		// Stop at the end of this member; flate reads the bufio.Reader one byte at a time.
+		zipReader.Multistream(false)
+
+		files, err := x.uncpio(zipReader)
+		if err != nil {
+			return files, true, err
+		}
+
+		_, err = io.Copy(io.Discard, zipReader) // trailer padding.
+
+		return files, false, err //nolint:wrapcheck
+	case "xz":
+		zipReader, err := xz.NewReader(reader, 0)
+		if err != nil {
+			return nil, true, fmt.Errorf("xz.NewReader: %w", err)
+		}
+
+		stream = zipReader
+	case "zstandard":
+		zipReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, true, fmt.Errorf("zstd.NewReader: %w", err)
+		}
+		defer zipReader.Close()
+
+		stream = zipReader
+	case "lz4":
+		stream = lz4.NewReader(reader)
+	case "bz2":
+		stream = bzip2.NewReader(reader)
+	case "lzma":
+		zipReader, err := lzma.NewReader(reader)
+		if err != nil {
+			return nil, true, fmt.Errorf("lzma.NewReader: %w", err)
+		}
+
+		stream = zipReader
+	default:
+		return nil, true, fmt.Errorf("%s: %w: %s compressed segment", x.FilePath, ErrInvalidInitramfs, compression)
+	}
+
+	files, err := x.uncpio(stream)
+
+	return files, true, err
+}
+
+// skipZeros discards zero padding and reports whether more data follows.
+func skipZeros(reader *bufio.Reader) bool {
+	for {
+		next, err := reader.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		if next != 0 {
+			_ = reader.UnreadByte()
+			return true
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestExtractInitramfs(t *testing.T) {
+	t.Parallel()
+
+	// Uncompressed microcode, then a gzip segment, then the main archive.
+	early := testCPIO(t, map[string]string{"kernel/x86/microcode/GenuineIntel.bin": "microcode"})
+	early = append(early, make([]byte, 512-len(early)%512)...)
+	modules := testCompress(t, "gz", testCPIO(t, map[string]string{"lib/modules/mod.ko": "module"}))
+	main := testCPIO(t, map[string]string{"init": "#!/bin/sh\n", "etc/fstab": "none"})
+
+	for _, compression := range []string{"xz", "zst", "lz4"} {
+		t.Run(compression, func(t *testing.T) {
+			t.Parallel()
+
+			image := append(append([]byte{}, early...), modules...)
+			image = append(image, make([]byte, 7)...) // padding between segments.
+
+			if compression == "lz4" {
+				image = append(image, testLZ4Legacy(t, main)...)
+			} else {
+				image = append(image, testCompress(t, compression, main)...)
+			}
+
+			tmp := t.TempDir()
+			archive := filepath.Join(tmp, "initrd.img-6.1.0")
+			require.NoError(t, os.WriteFile(archive, image, 0o600))
+
+			out := filepath.Join(tmp, "out")
+			_, files, _, err := xtractr.ExtractFile(&xtractr.XFile{
+				FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700,
+			})
+			require.NoError(t, err)
+			assert.Len(t, files, 4)
+
+			for name, want := range map[string]string{
+				"kernel/x86/microcode/GenuineIntel.bin": "microcode",
+				"lib/modules/mod.ko":                    "module",
+				"init":                                  "#!/bin/sh\n",
+				"etc/fstab":                             "none",
+			} {
+				data, err := os.ReadFile(filepath.Join(out, name))
+				require.NoError(t, err)
+				assert.Equal(t, want, string(data))
+			}
+		})
+	}
+}
+
+func TestExtractInitramfsErrors(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "initrd.img")
+	require.NoError(t, os.WriteFile(archive, bytes.Repeat([]byte("not an initramfs "), 10), 0o600))
+
+	_, _, err := xtractr.ExtractInitramfs(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")})
+	require.ErrorIs(t, err, xtractr.ErrInvalidInitramfs)
+
+	// Unknown data after a good segment is skipped.
+	image := append(testCPIO(t, map[string]string{"init": "x"}), []byte("signature block")...)
+	require.NoError(t, os.WriteFile(archive, image, 0o600))
+
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")}
+	_, files, err := xtractr.ExtractInitramfs(xFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmp, "out", "init")}, files)
+	assert.Equal(t, []string{"ignoring unrecognized data after initramfs segment 1"}, xFile.Warnings)
+}
+
+func TestExtractInitramfsSegmentsShareCleanup(t *testing.T) {
+	t.Parallel()
+
+	var early bytes.Buffer
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	writer := cpio.NewWriter(&early)
+	require.NoError(t, writer.WriteHeader(&cpio.Header{Name: "lib", Mode: cpio.TypeDir | 0o755, ModTime: mtime}))
+	// The link's target is in the next segment.
+	require.NoError(t, writer.WriteHeader(&cpio.Header{Name: "lib/link", Mode: cpio.TypeSymlink | 0o777, Size: 5}))
+	_, err := writer.Write([]byte("b.txt"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// The second segment writes into lib after the first one is done.
+	image := append(early.Bytes(), testCompress(t, "gz", testCPIO(t, map[string]string{"lib/b.txt": "bee"}))...)
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "initrd.img")
+	require.NoError(t, os.WriteFile(archive, image, 0o600))
+
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700,
+		LinkPolicy: xtractr.LinkCopy,
+	}
+
+	_, _, err = xtractr.ExtractInitramfs(xFile)
+	require.NoError(t, err)
+	assert.Empty(t, xFile.Warnings)
+
+	data, err := os.ReadFile(filepath.Join(xFile.OutputDir, "lib", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "bee", string(data), "a link must be copied once every segment is written")
+
+	stat, err := os.Stat(filepath.Join(xFile.OutputDir, "lib"))
+	require.NoError(t, err)
+	assert.True(t, mtime.Equal(stat.ModTime()), "the folder time must be set after the last segment")
+}
+
+// testLZ4Legacy compresses data the way the kernel build does for lz4 initramfs images.
+func testLZ4Legacy(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	writer := lz4.NewWriter(&buf)
+	require.NoError(t, writer.Apply(lz4.LegacyOption(true)))
+	_, err := writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
@@ -1,57 +1,124 @@
 package xtractr
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/Unpackerr/iso9660"
 )
 
 // ExtractISO writes an ISO's contents to disk.
 // It tries UDF first (which preserves full filenames), then falls back
-// to ISO9660 (with Joliet support) if UDF parsing fails.
+// to ISO9660 (with Joliet support) if UDF parsing fails. Partitions in the
+// MBR or GPT of hybrid images are listed in xFile.ISOPartitions; set
+// xFile.ISOBoot to also write boot images and appended partitions.
 func ExtractISO(xFile *XFile) (size uint64, filesList []string, err error) {
-	openISO, err := os.Open(xFile.FilePath) // os.Open on purpose.
+	openISO, stat, err := openStatFile(xFile.FilePath)
 	if err != nil {
-		return 0, nil, fmt.Errorf("os.Open: %w", err)
+		return 0, nil, err
 	}
 	defer openISO.Close()
 
+	return xFile.unisoImage(openISO, stat.Size())
+}
+
+// unisoImage extracts the file system in an ISO image, then its boot images and partitions.
+func (x *XFile) unisoImage(image io.ReaderAt, imageSize int64) (uint64, []string, error) {
+	size, files, err := x.unisoVolume(image)
+	if err != nil {
+		return size, files, err
+	}
+
+	bootSize, bootFiles, err := x.unisoBoot(image, imageSize)
+
+	return size + bootSize, append(files, bootFiles...), err
+}
+
+// unisoVolume extracts the UDF, Rock Ridge or ISO9660 file system.
+func (x *XFile) unisoVolume(openISO io.ReaderAt) (uint64, []string, error) {
 	// Try UDF first — it preserves full-length filenames.
-	size, filesList, udfErr := extractUDF(xFile, openISO)
+	size, filesList, udfErr := extractUDF(x, openISO)
 	if udfErr == nil {
-		xFile.Debugf("Extracted %s via UDF path", xFile.FilePath)
+		x.Debugf("Extracted %s via UDF path", x.FilePath)
 		return size, filesList, nil
 	}
 
-	xFile.Debugf("UDF extraction failed for %s, falling back to ISO9660: %v", xFile.FilePath, udfErr)
+	x.Debugf("UDF extraction failed for %s, falling back to ISO9660: %v", x.FilePath, udfErr)
 
 	// Fall back to ISO9660 (now with Joliet support for full filenames).
 	image, isoErr := iso9660.OpenImage(openISO)
 	if isoErr != nil {
-		return 0, nil, fmt.Errorf("failed to open iso image: %s: %w", xFile.FilePath, isoErr)
+		return 0, nil, fmt.Errorf("failed to open iso image: %s: %w", x.FilePath, isoErr)
 	}
 
-	defer xFile.newProgress(getUncompressedIsoSize(image)).done()
+	defer x.newProgress(getUncompressedIsoSize(image)).done()
 
-	iso, err := iso9660.OpenImage(xFile.prog.readAter(openISO))
+	imageReader := x.prog.readAter(openISO)
+	if x.FileWorkers > 1 {
+		imageReader = x.prog.parallelReadAter(openISO)
+	}
+
+	// Rock Ridge lives in the primary volume; the library reads the Joliet tree when there is one.
+	rr, rrRoot, err := openRockRidge(imageReader)
+	if err != nil {
+		x.Debugf("Reading Rock Ridge entries failed for %s, using ISO9660 names: %v", x.FilePath, err)
+	} else if rrRoot != nil {
+		return x.unisoRockRidge(rr, rrRoot)
+	}
+
+	iso, err := iso9660.OpenImage(imageReader)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to open iso image: %s: %w", xFile.FilePath, err)
+		return 0, nil, fmt.Errorf("failed to open iso image: %s: %w", x.FilePath, err)
 	}
 
 	root, err := iso.RootDir()
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to open iso root: %s: %w", xFile.FilePath, err)
+		return 0, nil, fmt.Errorf("failed to open iso root: %s: %w", x.FilePath, err)
 	}
 
 	// Extract directly to output directory (no ISO-name subfolder).
-	size, files, err := xFile.uniso(root, "")
+	writes := x.newISOWrites()
+
+	size, files, err := x.uniso(root, "", writes, newNameDecoders(x, "iso"))
+	if err == nil {
+		var wrote uint64
+		wrote, err = x.flushISOWrites(writes)
+		size += wrote
+	}
+
 	if err != nil {
-		return size, files, fmt.Errorf("%s: %w", xFile.FilePath, err)
+		return size, files, fmt.Errorf("%s: %w", x.FilePath, err)
 	}
 
-	return size, files, nil
+	files, err = x.cleanup(files)
+
+	return size, files, err
+}
+
+// unisoRockRidge extracts the primary volume with its Rock Ridge attributes.
+func (x *XFile) unisoRockRidge(rr *rockRidge, root *isoRecord) (uint64, []string, error) {
+	x.Debugf("Extracting %s with Rock Ridge attributes", x.FilePath)
+
+	rr.writes = x.newISOWrites()
+	rr.names = newNameDecoders(x, "iso")
+
+	size, files, err := x.unRockRidge(rr, root, "")
+	if err == nil {
+		var wrote uint64
+		wrote, err = x.flushISOWrites(rr.writes)
+		size += wrote
+	}
+
+	if err != nil {
+		return size, files, fmt.Errorf("%s: %w", x.FilePath, err)
+	}
+
+	files, err = x.cleanup(files)
+
+	return size, files, err
 }
 
 //nolint:unparam // so we can pass it in.
@@ -86,15 +153,18 @@ func getUncompressedIsoSize(image *iso9660.Image) (total, _ uint64, count int) {
 	return total, 0, count
 }
 
-func (x *XFile) uniso(isoFile *iso9660.File, parent string) (uint64, []string, error) {
-	itemName := filepath.Join(parent, isoFile.Name())
+func (x *XFile) uniso(
+	isoFile *iso9660.File, parent string, writes *isoWrites, names *nameDecoders,
+) (uint64, []string, error) {
+	// Names without Joliet are in whatever code page the image was mastered with.
+	itemName := filepath.Join(parent, names.decodeStream(isoFile.Name()))
 
 	if isoFile.Name() == string([]byte{0}) { // root directory - extract to output dir directly.
 		itemName = ""
 	}
 
 	if !isoFile.IsDir() { // it's a file
-		return x.unisofile(isoFile, itemName)
+		return x.unisofile(isoFile, itemName, writes)
 	}
 
 	if itemName != "" {
@@ -105,7 +175,7 @@ func (x *XFile) uniso(isoFile *iso9660.File, parent string) (uint64, []string, e
 				x.FilePath, ErrInvalidPath, dirPath, isoFile.Name())
 		}
 
-		err := x.mkDir(dirPath, isoFile.Mode(), isoFile.ModTime())
+		err := x.mkDirEntry(dirPath, isoFile.Mode(), isoFile.ModTime())
 		if err != nil {
 			return 0, nil, fmt.Errorf("making iso directory %s: %w", isoFile.Name(), err)
 		}
@@ -120,7 +190,7 @@ func (x *XFile) uniso(isoFile *iso9660.File, parent string) (uint64, []string, e
 	size := uint64(0)
 
 	for _, child := range children {
-		childSize, childFiles, err := x.uniso(child, itemName)
+		childSize, childFiles, err := x.uniso(child, itemName, writes, names)
 		if err != nil {
 			return size + childSize, files, err
 		}
@@ -130,14 +200,13 @@ func (x *XFile) uniso(isoFile *iso9660.File, parent string) (uint64, []string, e
 		files = append(files, childFiles...)
 	}
 
-	files, err = x.cleanup(files)
-
-	return size, files, err
+	return size, files, nil
 }
 
-func (x *XFile) unisofile(isoFile *iso9660.File, wfile string) (uint64, []string, error) {
+func (x *XFile) unisofile(isoFile *iso9660.File, wfile string, writes *isoWrites) (uint64, []string, error) {
 	file := &file{
 		Path:     x.clean(wfile),
+		Member:   wfile,
 		Data:     isoFile.Reader(),
 		FileMode: isoFile.Mode(),
 		DirMode:  x.DirMode,
@@ -150,6 +219,11 @@ func (x *XFile) unisofile(isoFile *iso9660.File, wfile string) (uint64, []string
 			x.FilePath, ErrInvalidPath, file.Path, x.OutputDir, isoFile.Name())
 	}
 
+	if writes != nil {
+		writes.add(file, nil)
+		return 0, []string{file.Path}, nil
+	}
+
 	x.Debugf("Writing archived file: %s (bytes: %d)", file.Path, isoFile.Size())
 
 	size, err := x.write(file)
@@ -158,3 +232,70 @@ func (x *XFile) unisofile(isoFile *iso9660.File, wfile string) (uint64, []string
 
 	return size, []string{file.Path}, err
 }
+
+// isoWrites holds the files found while walking an ISO or UDF image when FileWorkers > 1.
+// Pass 1 (sequential): the walk makes directories and symlinks, and queues files here.
+// Pass 2 (parallel): flushISOWrites writes the files, then makes the queued hard links.
+type isoWrites struct {
+	files []isoWrite
+	links []isoLink
+	size  atomic.Uint64
+}
+
+// isoWrite is a queued file, and a function to run after it is written (or nil).
+type isoWrite struct {
+	file  *file
+	after func()
+}
+
+// isoLink is a queued hard link to a file that is written in pass 2.
+type isoLink struct {
+	path   string
+	target string
+}
+
+// newISOWrites returns nil when files are written sequentially.
+func (x *XFile) newISOWrites() *isoWrites {
+	if x.FileWorkers > 1 {
+		return &isoWrites{}
+	}
+
+	return nil
+}
+
+func (w *isoWrites) add(file *file, after func()) {
+	w.files = append(w.files, isoWrite{file: file, after: after})
+}
+
+// flushISOWrites writes queued files with FileWorkers workers, then makes the queued hard links.
+func (x *XFile) flushISOWrites(writes *isoWrites) (uint64, error) {
+	if writes == nil {
+		return 0, nil
+	}
+
+	err := dispatchWorkers(x.FileWorkers, writes.files, func(entry isoWrite) error {
+		size, err := x.writeParallel(entry.file)
+		writes.size.Add(size)
+
+		if err != nil {
+			return fmt.Errorf("writing iso file %s: %w", entry.file.Path, err)
+		}
+
+		if entry.after != nil {
+			entry.after()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return writes.size.Load(), err
+	}
+
+	for _, link := range writes.links {
+		if err := x.createHardLink(link.path, link.target); err != nil && !errors.Is(err, errSkipEntry) {
+			return writes.size.Load(), err
+		}
+	}
+
+	return writes.size.Load(), nil
+}
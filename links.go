@@ -0,0 +1,175 @@
+package xtractr
+
+/* Code to apply LinkPolicy to the symlinks and hard links in archives. */
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// LinkPolicy says how to write the symlinks and hard links in archives.
+type LinkPolicy int
+
+// Link policies for XFile.LinkPolicy.
+const (
+	// LinkCreate creates links. Hard links that can not be made become symlinks. This is the default.
+	LinkCreate LinkPolicy = iota
+	// LinkCopy writes a copy of each link's target in its place, for file systems
+	// and clients without links. Copies are made after the rest of the archive is
+	// extracted, so a link may point at a member stored after it.
+	LinkCopy
+	// LinkSkip skips links, with a warning.
+	LinkSkip
+	// LinkFail stops the extraction with ErrLink.
+	LinkFail
+)
+
+// pendingLink is a link LinkCopy writes as a copy once extraction is done.
+type pendingLink struct {
+	kind   string // symlink or hard link.
+	path   string
+	target string // absolute path in the OutputDir.
+}
+
+// applyLinkPolicy returns true if LinkPolicy handled the link at path instead of creating it.
+// Callers have already checked the target is in the OutputDir.
+func (x *XFile) applyLinkPolicy(kind, path, target string) (bool, error) {
+	switch x.LinkPolicy {
+	case LinkCopy:
+		state := x.shared()
+
+		state.mu.Lock()
+		state.links = append(state.links, pendingLink{kind: kind, path: path, target: target})
+		state.mu.Unlock()
+
+		x.Debugf("Copying archived %s after extraction: %s => %s", kind, path, target)
+
+		return true, nil
+	case LinkSkip:
+		x.warn("skipped %s %s", kind, x.relPath(path))
+		return true, errSkipEntry
+	case LinkFail:
+		return true, fmt.Errorf("%s: %w: %s %s", x.FilePath, ErrLink, kind, x.relPath(path))
+	case LinkCreate:
+	}
+
+	return false, nil
+}
+
+// resolveLinks writes the copies LinkCopy deferred. A copy waits for links into its
+// target to be copied first; links that never resolve are skipped with a warning.
+// It returns the paths of the links that were not copied.
+func (x *XFile) resolveLinks() []string {
+	state := x.shared()
+
+	state.mu.Lock()
+	links := state.links
+	state.links = nil
+	state.mu.Unlock()
+
+	skipped := []string{}
+
+	for len(links) > 0 {
+		waiting := []pendingLink{}
+
+		for _, link := range links {
+			if slices.ContainsFunc(links, func(other pendingLink) bool {
+				return other != link && pathWithin(link.target, other.path)
+			}) {
+				waiting = append(waiting, link)
+				continue
+			}
+
+			if err := x.copyLink(link); err != nil {
+				x.warn("skipped %s %s: %v", link.kind, x.relPath(link.path), err)
+				skipped = append(skipped, link.path)
+			}
+		}
+
+		if len(waiting) == len(links) {
+			for _, link := range waiting {
+				x.warn("skipped %s %s: %v", link.kind, x.relPath(link.path), ErrLinkLoop)
+				skipped = append(skipped, link.path)
+			}
+
+			waiting = nil
+		}
+
+		links = waiting
+	}
+
+	return skipped
+}
+
+// withoutLinks removes the links resolveLinks skipped from a list of files written.
+// Extractors list files by absolute path or by their path in the OutputDir.
+func (x *XFile) withoutLinks(files, skipped []string) []string {
+	if len(skipped) == 0 {
+		return files
+	}
+
+	return slices.DeleteFunc(files, func(path string) bool {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(x.OutputDir, path)
+		}
+
+		return slices.Contains(skipped, path)
+	})
+}
+
+// copyLink writes a copy of a link's target file, or folder, at the link's path.
+func (x *XFile) copyLink(link pendingLink) error {
+	info, err := os.Stat(link.target)
+	if err != nil {
+		return fmt.Errorf("reading link target: %w", err)
+	}
+
+	x.Debugf("Copying archived %s target: %s => %s", link.kind, link.path, link.target)
+
+	if !info.IsDir() {
+		return x.copyFile(link.target, link.path, info)
+	}
+
+	if pathWithin(link.target, link.path) {
+		return ErrLinkLoop
+	}
+
+	if err = os.CopyFS(link.path, os.DirFS(link.target)); err != nil {
+		return fmt.Errorf("copying link target: %w", err)
+	}
+
+	return nil
+}
+
+// copyFile copies a file in the OutputDir to a new file, without following a symlink at the new path.
+func (x *XFile) copyFile(source, path string, info os.FileInfo) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer input.Close()
+
+	flags, usedPath, err := openFlagsForExtract(path)
+	if err != nil {
+		return err
+	}
+
+	output, path, err := openFile(usedPath, flags, x.safeFileMode(info.Mode()))
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	if _, err = io.Copy(output, input); err != nil {
+		return fmt.Errorf("copying link target: %w", err)
+	}
+
+	// The error is ignored because it's not critical, like in writeFile.
+	_ = os.Chtimes(path, time.Now(), info.ModTime())
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package xtractr_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// linksTar returns a tarball with a symlink stored before its target,
+// a hard link, a symlink to a folder and a symlink that contains itself.
+func linksTar(t *testing.T) string {
+	t.Helper()
+
+	return writeTestTar(t, "links.tar",
+		testTarEntry{name: "early", header: tar.Header{Linkname: "data/later.txt", Typeflag: tar.TypeSymlink}},
+		testTarEntry{name: "data/file.txt", data: "firs"},
+		testTarEntry{name: "data/later.txt", data: "first"},
+		testTarEntry{name: "hard", header: tar.Header{Linkname: "data/file.txt", Typeflag: tar.TypeLink}},
+		testTarEntry{name: "folder", header: tar.Header{Linkname: "data", Typeflag: tar.TypeSymlink}},
+		testTarEntry{name: "data/self", header: tar.Header{Linkname: ".", Typeflag: tar.TypeSymlink}},
+	)
+}
+
+// assertCopy checks that path is a regular file with content, not a link.
+func assertCopy(t *testing.T, path, content string) {
+	t.Helper()
+
+	info, err := os.Lstat(path)
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular(), path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data), path)
+}
+
+func TestLinkCopy(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+	xFile := &xtractr.XFile{
+		FilePath: linksTar(t), OutputDir: out, FileMode: 0o600, DirMode: 0o700, LinkPolicy: xtractr.LinkCopy,
+	}
+	_, files, err := xtractr.ExtractTar(xFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"early", "data/file.txt", "data/later.txt", "hard", "folder"}, files,
+		"the link that could not be copied must not be listed")
+
+	assertCopy(t, filepath.Join(out, "early"), "first")
+	assertCopy(t, filepath.Join(out, "hard"), "firs")
+	assertCopy(t, filepath.Join(out, "folder", "file.txt"), "firs")
+	assertCopy(t, filepath.Join(out, "folder", "later.txt"), "first")
+
+	info, err := os.Lstat(filepath.Join(out, "folder"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.NoFileExists(t, filepath.Join(out, "data", "self"))
+	assert.Equal(t, []string{"skipped symlink " + filepath.Join("data", "self") + ": link target contains the link"},
+		xFile.Warnings)
+}
+
+func TestLinkSkip(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+	xFile := &xtractr.XFile{
+		FilePath: linksTar(t), OutputDir: out, FileMode: 0o600, DirMode: 0o700, LinkPolicy: xtractr.LinkSkip,
+	}
+	_, files, err := xtractr.ExtractTar(xFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/file.txt", "data/later.txt"}, files)
+	assert.Equal(t, []string{
+		"skipped symlink early",
+		"skipped hard link hard",
+		"skipped symlink folder",
+		"skipped symlink " + filepath.Join("data", "self"),
+	}, xFile.Warnings)
+
+	for _, name := range []string{"early", "hard", "folder"} {
+		_, err := os.Lstat(filepath.Join(out, name))
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+}
+
+func TestLinkFail(t *testing.T) {
+	t.Parallel()
+
+	_, _, _, err := xtractr.ExtractFile(&xtractr.XFile{
+		FilePath: linksTar(t), OutputDir: filepath.Join(t.TempDir(), "out"), FileMode: 0o600, DirMode: 0o700,
+		LinkPolicy: xtractr.LinkFail,
+	})
+	require.ErrorIs(t, err, xtractr.ErrLink)
+}
+
+func TestLinkCopyZIP(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	writer := zip.NewWriter(&buf)
+	link := &zip.FileHeader{Name: "link.txt"}
+	link.SetMode(os.ModeSymlink | 0o777)
+	entry, err := writer.CreateHeader(link)
+	require.NoError(t, err)
+	_, err = entry.Write([]byte("target.txt"))
+	require.NoError(t, err)
+	entry, err = writer.Create("target.txt")
+	require.NoError(t, err)
+	_, err = entry.Write([]byte("target"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "links.zip")
+	require.NoError(t, os.WriteFile(archive, buf.Bytes(), 0o600))
+
+	for _, workers := range []int{0, 4} {
+		out := filepath.Join(tmp, "out", strconv.Itoa(workers))
+		_, _, err := xtractr.ExtractZIP(&xtractr.XFile{
+			FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700,
+			LinkPolicy: xtractr.LinkCopy, FileWorkers: workers,
+		})
+		require.NoError(t, err)
+		assertCopy(t, filepath.Join(out, "link.txt"), "target")
+	}
+}
@@ -20,6 +20,9 @@ type signature struct {
 	Fn Interface
 	// Type is the archive type name (e.g. "zip", "7zip", "gzip"), matching extension2function Type.
 	Type string
+	// Check, if set, must also return true for a match. It is for magic bytes that files
+	// which are not archives share, and is skipped (no match) when there is no file to read.
+	Check func(io.ReaderAt) bool
 }
 
 // maxSignatureRead is the maximum number of bytes to read for signature detection.
@@ -29,39 +32,65 @@ const maxSignatureRead = 0x9006
 // signatureTable maps file signatures (magic numbers) to their corresponding extract functions and types.
 //
 //nolint:gochecknoglobals
-var signatureTable = []signature{
-	// RAR v5 (longer match first).
-	{Offset: 0, Magic: []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07, 0x01, 0x00}, Fn: ExtractRAR, Type: "rar"},
-	// RAR v4.
-	{Offset: 0, Magic: []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07, 0x00}, Fn: ExtractRAR, Type: "rar"},
-	// 7-Zip.
-	{Offset: 0, Magic: []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}, Fn: Extract7z, Type: "7zip"},
-	// ZIP (PK\x03\x04).
-	{Offset: 0, Magic: []byte{0x50, 0x4B, 0x03, 0x04}, Fn: ChngInt(ExtractZIP), Type: "zip"},
-	// Gzip.
-	{Offset: 0, Magic: []byte{0x1F, 0x8B}, Fn: ChngInt(ExtractGzip), Type: "gzip"},
-	// Bzip2 (BZh).
-	{Offset: 0, Magic: []byte{0x42, 0x5A, 0x68}, Fn: ChngInt(ExtractBzip), Type: "bz2"},
-	// XZ.
-	{Offset: 0, Magic: []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, Fn: ChngInt(ExtractXZ), Type: "xz"},
-	// Zstandard.
-	{Offset: 0, Magic: []byte{0x28, 0xB5, 0x2F, 0xFD}, Fn: ChngInt(ExtractZstandard), Type: "zstandard"},
-	// LZ4.
-	{Offset: 0, Magic: []byte{0x04, 0x22, 0x4D, 0x18}, Fn: ChngInt(ExtractLZ4), Type: "lz4"},
-	// LZMA.
-	{Offset: 0, Magic: []byte{0x5D, 0x00, 0x00}, Fn: ChngInt(ExtractLZMA), Type: "lzma"},
-	// Brotli.
-	{Offset: 0, Magic: []byte{0xCE, 0xB2, 0xCF, 0x81}, Fn: ChngInt(ExtractBrotli), Type: "brotli"},
-	// AR / DEB ("!<arch>\n").
-	{Offset: 0, Magic: []byte{0x21, 0x3C, 0x61, 0x72, 0x63, 0x68, 0x3E, 0x0A}, Fn: ChngInt(ExtractAr), Type: "ar"},
-	// RPM.
-	{Offset: 0, Magic: []byte{0xED, 0xAB, 0xEE, 0xDB}, Fn: ChngInt(ExtractRPM), Type: "rpm"},
-	// ISO9660 at offset 0x8001.
-	{Offset: 0x8001, Magic: []byte{0x43, 0x44, 0x30, 0x30, 0x31}, Fn: ChngInt(ExtractISO), Type: "iso"}, //nolint:mnd
-	// ISO9660 at offset 0x8801.
-	{Offset: 0x8801, Magic: []byte{0x43, 0x44, 0x30, 0x30, 0x31}, Fn: ChngInt(ExtractISO), Type: "iso"}, //nolint:mnd
-	// ISO9660 at offset 0x9001.
-	{Offset: 0x9001, Magic: []byte{0x43, 0x44, 0x30, 0x30, 0x31}, Fn: ChngInt(ExtractISO), Type: "iso"}, //nolint:mnd
+var signatureTable []signature
+
+// The table is assigned in init because ExtractInitramfs matches signatures
+// too, and a package variable's initializer can not refer back to itself.
+//
+//nolint:gochecknoinits
+func init() {
+	signatureTable = []signature{
+		// RAR v5 (longer match first).
+		{Offset: 0, Magic: []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07, 0x01, 0x00}, Fn: ExtractRAR, Type: "rar"},
+		// RAR v4.
+		{Offset: 0, Magic: []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07, 0x00}, Fn: ExtractRAR, Type: "rar"},
+		// 7-Zip.
+		{Offset: 0, Magic: []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}, Fn: Extract7z, Type: "7zip"},
+		// ZIP (PK\x03\x04).
+		{Offset: 0, Magic: []byte{0x50, 0x4B, 0x03, 0x04}, Fn: ChngInt(ExtractZIP), Type: "zip"},
+		// Gzip.
+		{Offset: 0, Magic: []byte{0x1F, 0x8B}, Fn: ChngInt(ExtractGzip), Type: "gzip"},
+		// Bzip2 (BZh).
+		{Offset: 0, Magic: []byte{0x42, 0x5A, 0x68}, Fn: ChngInt(ExtractBzip), Type: "bz2"},
+		// XZ.
+		{Offset: 0, Magic: []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, Fn: ChngInt(ExtractXZ), Type: "xz"},
+		// Zstandard.
+		{Offset: 0, Magic: []byte{0x28, 0xB5, 0x2F, 0xFD}, Fn: ChngInt(ExtractZstandard), Type: "zstandard"},
+		// LZ4.
+		{Offset: 0, Magic: []byte{0x04, 0x22, 0x4D, 0x18}, Fn: ChngInt(ExtractLZ4), Type: "lz4"},
+		// LZ4 legacy frame, as written by the Linux kernel build.
+		{Offset: 0, Magic: []byte{0x02, 0x21, 0x4C, 0x18}, Fn: ChngInt(ExtractLZ4), Type: "lz4"},
+		// LZMA.
+		{Offset: 0, Magic: []byte{0x5D, 0x00, 0x00}, Fn: ChngInt(ExtractLZMA), Type: "lzma"},
+		// Brotli.
+		{Offset: 0, Magic: []byte{0xCE, 0xB2, 0xCF, 0x81}, Fn: ChngInt(ExtractBrotli), Type: "brotli"},
+		// DEB (an ar archive starting with "debian-binary").
+		{Offset: 0, Magic: []byte("!<arch>\ndebian-binary"), Fn: ChngInt(ExtractDeb), Type: "deb"},
+		// AR ("!<arch>\n").
+		{Offset: 0, Magic: []byte{0x21, 0x3C, 0x61, 0x72, 0x63, 0x68, 0x3E, 0x0A}, Fn: ChngInt(ExtractAr), Type: "ar"},
+		// RPM.
+		{Offset: 0, Magic: []byte{0xED, 0xAB, 0xEE, 0xDB}, Fn: ChngInt(ExtractRPM), Type: "rpm"},
+		// WIM / ESD ("MSWIM\0\0\0").
+		{Offset: 0, Magic: []byte{0x4D, 0x53, 0x57, 0x49, 0x4D, 0x00, 0x00, 0x00}, Fn: ChngInt(ExtractWIM), Type: "wim"},
+		// Compound File Binary, only MSI packages: legacy Office documents share the signature.
+		{
+			Offset: 0, Magic: []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1},
+			Fn: ChngInt(ExtractCFB), Type: "msi", Check: isMSI,
+		},
+		// Microsoft Cabinet ("MSCF\0\0\0\0").
+		{Offset: 0, Magic: []byte{0x4D, 0x53, 0x43, 0x46, 0x00, 0x00, 0x00, 0x00}, Fn: ChngInt(ExtractCAB), Type: "cab"},
+		// CPIO newc and newc with checksums ("070701", "070702"); initramfs images begin with one.
+		{Offset: 0, Magic: []byte("070701"), Fn: ChngInt(ExtractInitramfs), Type: "cpio"},
+		{Offset: 0, Magic: []byte("070702"), Fn: ChngInt(ExtractInitramfs), Type: "cpio"},
+		// Raw CD sector sync pattern (BIN, MDF): 00, ten FF bytes, 00.
+		{Offset: 0, Magic: []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00}, Fn: ChngInt(ExtractCDImage), Type: "iso"},
+		// ISO9660 at offset 0x8001.
+		{Offset: 0x8001, Magic: []byte{0x43, 0x44, 0x30, 0x30, 0x31}, Fn: ChngInt(ExtractISO), Type: "iso"}, //nolint:mnd
+		// ISO9660 at offset 0x8801.
+		{Offset: 0x8801, Magic: []byte{0x43, 0x44, 0x30, 0x30, 0x31}, Fn: ChngInt(ExtractISO), Type: "iso"}, //nolint:mnd
+		// ISO9660 at offset 0x9001.
+		{Offset: 0x9001, Magic: []byte{0x43, 0x44, 0x30, 0x30, 0x31}, Fn: ChngInt(ExtractISO), Type: "iso"}, //nolint:mnd
+	}
 }
 
 // detectBySignature reads the first bytes of a file and attempts to match
@@ -91,20 +120,32 @@ func detectBySignature(filePath string) (Interface, string, error) {
 		return nil, "", fmt.Errorf("reading file for signature detection: %w", err)
 	}
 
-	buf = buf[:n]
+	if sig := matchSignature(buf[:n], file); sig != nil {
+		return sig.Fn, sig.Type, nil
+	}
 
-	for _, sig := range signatureTable {
+	return nil, "", fmt.Errorf("%w: %s", ErrUnknownArchiveType, filePath)
+}
+
+// matchSignature returns the first signature found in buf, or nil.
+// file is the file buf was read from, for signature checks; it may be nil.
+func matchSignature(buf []byte, file io.ReaderAt) *signature {
+	for idx, sig := range signatureTable {
 		end := sig.Offset + len(sig.Magic)
 		if end > len(buf) {
 			continue
 		}
 
-		if bytes.Equal(buf[sig.Offset:end], sig.Magic) {
-			return sig.Fn, sig.Type, nil
+		if !bytes.Equal(buf[sig.Offset:end], sig.Magic) {
+			continue
+		}
+
+		if sig.Check == nil || (file != nil && sig.Check(file)) {
+			return &signatureTable[idx]
 		}
 	}
 
-	return nil, "", fmt.Errorf("%w: %s", ErrUnknownArchiveType, filePath)
+	return nil
 }
 
 // IsArchiveFileByContent returns true if the provided file path contains
@@ -0,0 +1,116 @@
+package xtractr
+
+/* Code to list and hash the files an extraction writes. */
+
+import (
+	"encoding/hex"
+	"hash"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ManifestEntry is a file written with XFile.Manifest (or Xtract.Manifest) set.
+type ManifestEntry struct {
+	// Path is where the file was written. It is absolute in XFile.ManifestEntries,
+	// and relative to the output folder in Response.Manifest and manifest files.
+	Path string `json:"path"`
+	// Member is the file's name in the archive, with forward slashes. It differs
+	// from Path when NameSanitizer, NameForm or path cleaning changed it.
+	Member string `json:"member"`
+	// Archive is the archive the file was extracted from.
+	Archive string `json:"archive"`
+	// Size is the number of bytes written.
+	Size int64 `json:"size"`
+	// Mode and Mtime are the file's permissions and modification time.
+	Mode  os.FileMode `json:"mode"`
+	Mtime time.Time   `json:"mtime"`
+	// SHA256 is the hex encoded SHA-256 of the file, hashed as it was written.
+	SHA256 string `json:"sha256"`
+}
+
+// addManifest records a file writeFile wrote, with the hash progressWrapper computed.
+func (x *XFile) addManifest(file *file, size int64, digest hash.Hash) {
+	entry := ManifestEntry{
+		Path:    file.Path,
+		Member:  file.Member,
+		Archive: x.FilePath,
+		Size:    size,
+		Mode:    x.safeFileMode(file.FileMode),
+		Mtime:   file.Mtime,
+		SHA256:  hex.EncodeToString(digest.Sum(nil)),
+	}
+
+	if entry.Member == "" { // single file formats, like .gz, have no member names.
+		entry.Member = x.relPath(file.Path)
+	}
+
+	entry.Member = filepath.ToSlash(entry.Member)
+	state := x.shared()
+
+	state.mu.Lock()
+	state.xFile.ManifestEntries = append(state.xFile.ManifestEntries, entry)
+	state.mu.Unlock()
+}
+
+// addMemberSum records the hash extractState.memberHash made of a file as writeFile wrote it.
+func (x *XFile) addMemberSum(member string, digest hash.Hash) {
+	state := x.shared()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.memberSums == nil {
+		state.memberSums = map[string]string{}
+	}
+
+	state.memberSums[member] = hex.EncodeToString(digest.Sum(nil))
+}
+
+// moveManifest updates the paths in ManifestEntries after squashRoot moves the contents of from into to.
+func (x *XFile) moveManifest(from, to string) {
+	state := x.shared()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for idx, entry := range state.xFile.ManifestEntries {
+		if rel, err := filepath.Rel(from, entry.Path); err == nil && filepath.IsLocal(rel) {
+			state.xFile.ManifestEntries[idx].Path = filepath.Join(to, rel)
+		}
+	}
+}
+
+// dropManifest removes the entries for path from ManifestEntries, after the file is deleted
+// or before it is written again.
+func (x *XFile) dropManifest(path string) {
+	state := x.shared()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	// A copy, because an attempt may share the array with the XFile it started from.
+	state.xFile.ManifestEntries = slices.DeleteFunc(slices.Clone(state.xFile.ManifestEntries), func(entry ManifestEntry) bool {
+		return entry.Path == path
+	})
+}
+
+// sha256Sums formats a manifest like sha256sum does, so `sha256sum -c` can check it.
+func sha256Sums(entries []ManifestEntry) []byte {
+	var sums strings.Builder
+
+	for _, entry := range entries {
+		path := entry.Path
+		if strings.ContainsAny(path, "\\\n\r") {
+			// sha256sum escapes these names, and marks the line with a backslash.
+			path = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(path)
+			sums.WriteString(`\`)
+		}
+
+		sums.WriteString(entry.SHA256 + "  " + path + "\n")
+	}
+
+	return []byte(sums.String())
+}
@@ -0,0 +1,212 @@
+package xtractr_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// manifestZip returns a zip file with the named files, each containing its own name.
+func manifestZip(t *testing.T, names ...string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	writer := zip.NewWriter(&buf)
+
+	for _, name := range names {
+		entry, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = entry.Write([]byte(name))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	archive := filepath.Join(t.TempDir(), "manifest.zip")
+	require.NoError(t, os.WriteFile(archive, buf.Bytes(), 0o600))
+
+	return archive
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifest(t *testing.T) {
+	t.Parallel()
+
+	names := []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "d.txt", "e.txt", "f.txt"}
+
+	for _, workers := range []int{1, 4} {
+		archive := manifestZip(t, names...)
+		out := filepath.Join(t.TempDir(), "out")
+		xFile := &xtractr.XFile{
+			FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, Manifest: true, FileWorkers: workers,
+		}
+
+		_, _, err := xtractr.ExtractZIP(xFile)
+		require.NoError(t, err)
+		require.Len(t, xFile.ManifestEntries, len(names), "every file written must be listed")
+
+		entries := xFile.ManifestEntries
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Member < entries[j].Member })
+		sort.Strings(names)
+
+		for idx, entry := range entries {
+			assert.Equal(t, names[idx], entry.Member)
+			assert.Equal(t, filepath.Join(out, filepath.FromSlash(names[idx])), entry.Path)
+			assert.Equal(t, archive, entry.Archive)
+			assert.Equal(t, int64(len(names[idx])), entry.Size)
+			assert.Equal(t, os.FileMode(0o666), entry.Mode, "the mode is the archived mode")
+			assert.Equal(t, sha256Hex(names[idx]), entry.SHA256, "the hash must match the file's contents")
+		}
+	}
+}
+
+func TestManifestRenamedMember(t *testing.T) {
+	t.Parallel()
+
+	for _, workers := range []int{1, 4} {
+		archive := manifestZip(t, "dir:x/a?.txt", "dir:x/b.txt")
+		xFile := &xtractr.XFile{
+			FilePath: archive, OutputDir: filepath.Join(t.TempDir(), "out"), FileMode: 0o600, DirMode: 0o700,
+			Manifest: true, NameSanitizer: xtractr.WindowsSafeName, FileWorkers: workers,
+		}
+
+		_, _, err := xtractr.ExtractZIP(xFile)
+		require.NoError(t, err)
+		require.Len(t, xFile.ManifestEntries, 2)
+
+		entries := xFile.ManifestEntries
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Member < entries[j].Member })
+		assert.Equal(t, "dir:x/a?.txt", entries[0].Member, "the member is the archived name")
+		assert.Equal(t, filepath.Join(xFile.OutputDir, "dir-x", "a.txt"), entries[0].Path)
+		assert.Equal(t, "dir:x/b.txt", entries[1].Member)
+	}
+}
+
+func TestManifestRenamed7zMember(t *testing.T) {
+	t.Parallel()
+
+	for _, workers := range []int{1, 4} {
+		xFile := &xtractr.XFile{
+			FilePath: filepath.Join("test_data", "multivol.7z.001"), OutputDir: t.TempDir(), FileMode: 0o600,
+			DirMode: 0o700, Manifest: true, NameSanitizer: strings.ToUpper, FileWorkers: workers,
+		}
+
+		_, _, _, err := xtractr.Extract7z(xFile)
+		require.NoError(t, err)
+		require.NotEmpty(t, xFile.ManifestEntries)
+
+		for _, entry := range xFile.ManifestEntries {
+			rel, err := filepath.Rel(xFile.OutputDir, entry.Path)
+			require.NoError(t, err)
+			assert.Equal(t, strings.ToUpper(entry.Member), filepath.ToSlash(rel), "the member is the archived name")
+			assert.NotEqual(t, entry.Member, filepath.ToSlash(rel))
+		}
+	}
+}
+
+func TestManifestNormalizedMember(t *testing.T) {
+	t.Parallel()
+
+	archive := manifestZip(t, "cafe\u0301/menu.txt")
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(t.TempDir(), "out"), FileMode: 0o600, DirMode: 0o700,
+		Manifest: true, NameForm: xtractr.NameFormNFC,
+	}
+
+	_, _, err := xtractr.ExtractZIP(xFile)
+	require.NoError(t, err)
+	require.Len(t, xFile.ManifestEntries, 1)
+	assert.Equal(t, "cafe\u0301/menu.txt", xFile.ManifestEntries[0].Member, "the member is the archived name")
+	assert.Equal(t, filepath.Join(xFile.OutputDir, "caf\u00e9", "menu.txt"), xFile.ManifestEntries[0].Path)
+}
+
+func TestManifestOff(t *testing.T) {
+	t.Parallel()
+
+	xFile := &xtractr.XFile{
+		FilePath: manifestZip(t, "a.txt"), OutputDir: t.TempDir(), FileMode: 0o600, DirMode: 0o700,
+	}
+
+	_, _, err := xtractr.ExtractZIP(xFile)
+	require.NoError(t, err)
+	assert.Empty(t, xFile.ManifestEntries)
+}
+
+func TestQueueManifest(t *testing.T) {
+	t.Parallel()
+
+	queue := xtractr.NewQueue(&xtractr.Config{Logger: &testLogger{t: t}})
+	defer queue.Stop()
+
+	xFile := &xtractr.Xtract{
+		Name:         "SomeItem",
+		Filter:       xtractr.Filter{Path: testSetupTestDir(t)},
+		TempFolder:   true,
+		Password:     "some_password",
+		Manifest:     true,
+		ManifestSums: true,
+		CBChannel:    make(chan *xtractr.Response),
+	}
+
+	_, err := queue.Extract(xFile)
+	require.NoError(t, err)
+
+	for resp := range xFile.CBChannel {
+		if !resp.Done {
+			continue
+		}
+
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Manifest, len(filesInTestArchive)*4, "every extracted file must be listed")
+		// Each folder with an archive in it gets a manifest and a checksum file.
+		assert.Len(t, resp.NewFiles, len(filesInTestArchive)*4+8, "the manifest files must be listed too")
+
+		for _, entry := range resp.Manifest {
+			assert.False(t, filepath.IsAbs(entry.Path), "paths are relative to the output folder")
+			assert.FileExists(t, filepath.Join(resp.Output, entry.Path))
+		}
+
+		listed := 0
+
+		for _, path := range resp.NewFiles {
+			if !strings.HasSuffix(path, ".manifest.json") {
+				continue
+			}
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			var written []xtractr.ManifestEntry
+			require.NoError(t, json.Unmarshal(data, &written))
+			require.Len(t, written, len(filesInTestArchive))
+
+			listed += len(written)
+
+			sums, err := os.ReadFile(strings.TrimSuffix(path, ".manifest.json") + ".sha256")
+			require.NoError(t, err)
+			assert.Contains(t, string(sums), written[0].SHA256+"  "+written[0].Path+"\n")
+		}
+
+		assert.Equal(t, len(resp.Manifest), listed, "the manifest files must list every extracted file")
+
+		break
+	}
+
+	_ = os.RemoveAll(xFile.Path + xtractr.DefaultSuffix)
+}
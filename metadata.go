@@ -0,0 +1,405 @@
+package xtractr
+
+/* Code to restore the owners, extended attributes and POSIX ACLs of archived files, and folder times. */
+
+import (
+	"archive/tar"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POSIX ACL tags and the version of the system.posix_acl_* extended attribute format.
+const (
+	aclVersion  = 2
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+	aclNoID     = 0xFFFFFFFF
+)
+
+// Zip extra fields with Unix owners.
+const (
+	zipExtraUnixOwner = 0x7875 // Info-ZIP new Unix: version, then sized uid and gid.
+	zipExtraOldUnix   = 0x5855 // Info-ZIP old Unix: atime, mtime, then 16-bit uid and gid.
+)
+
+// paxXattrPrefix marks PAX records that hold extended attributes (star, GNU tar and bsdtar).
+const paxXattrPrefix = "SCHILY.xattr."
+
+// ownerIDs caches the local ids of user and group names: "u:name" or "g:name" -> id.
+var ownerIDs sync.Map //nolint:gochecknoglobals
+
+// dirTime is when an archived folder was last accessed and modified. A zero time is left as is.
+type dirTime struct {
+	atime time.Time
+	mtime time.Time
+}
+
+// fileOwner is who owns an archived file. A name that exists on this
+// system is used over the archived id, like tar does when run as root.
+type fileOwner struct {
+	uid   int
+	gid   int
+	uname string
+	gname string
+}
+
+// ids returns the local uid and gid for the owner.
+func (o *fileOwner) ids() (int, int) {
+	return lookupOwnerID("u:", o.uname, o.uid), lookupOwnerID("g:", o.gname, o.gid)
+}
+
+// lookupOwnerID returns the local id of a user ("u:") or group ("g:") name, or archived
+// if there is no name or it does not exist here.
+func lookupOwnerID(kind, name string, archived int) int {
+	if name == "" {
+		return archived
+	}
+
+	cached, ok := ownerIDs.Load(kind + name)
+	if !ok {
+		cached = localOwnerID(kind, name)
+		ownerIDs.Store(kind+name, cached)
+	}
+
+	if id := cached.(int); id >= 0 { //nolint:forcetypeassert // only ints are stored.
+		return id
+	}
+
+	return archived
+}
+
+// localOwnerID returns the id of a user or group name on this system, or -1.
+func localOwnerID(kind, name string) int {
+	var (
+		local string
+		err   error
+	)
+
+	if kind == "u:" {
+		var found *user.User
+		if found, err = user.Lookup(name); err == nil {
+			local = found.Uid
+		}
+	} else {
+		var found *user.Group
+		if found, err = user.LookupGroup(name); err == nil {
+			local = found.Gid
+		}
+	}
+
+	id, convErr := strconv.Atoi(local)
+	if err != nil || convErr != nil {
+		return -1
+	}
+
+	return id
+}
+
+// restoreMetadata applies an archived file's owner (when running as root) with
+// PreserveOwnership, and its extended attributes and ACLs with PreserveXattrs.
+// Failures are logged and skipped: an unprivileged extraction keeps what it can.
+// Attributes outside the namespaces xattrAllowed permits are skipped with a warning.
+func (x *XFile) restoreMetadata(file *file) {
+	if x.PreserveOwnership && file.Owner != nil && os.Geteuid() == 0 {
+		uid, gid := file.Owner.ids()
+
+		if err := os.Lchown(file.Path, uid, gid); err != nil {
+			x.Debugf("Restoring owner %d:%d of %s: %v", uid, gid, file.Path, err)
+		} else if file.FileMode.IsRegular() && file.FileMode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			// Changing the owner clears setuid and setgid on files.
+			_ = os.Chmod(file.Path, x.safeFileMode(file.FileMode))
+		}
+	}
+
+	// Extended attributes on a symlink would be set on its target.
+	if !x.PreserveXattrs || file.FileMode&os.ModeSymlink != 0 {
+		return
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(file.Xattrs)) {
+		if !x.xattrAllowed(name) {
+			x.warn("skipped extended attribute %s of %s", name, x.relPath(file.Path))
+			continue
+		}
+
+		if err := setXattr(file.Path, name, file.Xattrs[name]); err != nil {
+			x.Debugf("Restoring extended attribute %s of %s: %v", name, file.Path, err)
+		}
+	}
+}
+
+// xattrAllowed says if an archived extended attribute may be restored. User attributes and
+// POSIX ACLs are. security.* (file capabilities, SELinux labels) and trusted.* grant
+// privileges like setuid bits do, so they need KeepSetuid. Other namespaces are never set.
+func (x *XFile) xattrAllowed(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "user."), name == "system.posix_acl_access", name == "system.posix_acl_default":
+		return true
+	case strings.HasPrefix(name, "security."), strings.HasPrefix(name, "trusted."):
+		return x.SetuidPolicy == KeepSetuid
+	default:
+		return false
+	}
+}
+
+// mkDirFile makes an archived directory with mkDirEntry, then restores its owner and extended attributes.
+func (x *XFile) mkDirFile(dir *file) error {
+	if err := x.mkDir(dir.Path, dir.FileMode, dir.Mtime); err != nil {
+		return err
+	}
+
+	x.restoreMetadata(dir)
+	x.recordDirTime(dir.Path, dir.Atime, dir.Mtime)
+
+	return nil
+}
+
+// mkDirEntry makes a folder the archive has an entry for. Writing files in it changes its
+// time again, so the archived time is recorded for restoreDirTimes to set at the end.
+func (x *XFile) mkDirEntry(path string, mode os.FileMode, mtime time.Time) error {
+	if err := x.mkDir(path, mode, mtime); err != nil {
+		return err
+	}
+
+	x.recordDirTime(path, time.Time{}, mtime)
+
+	return nil
+}
+
+// recordDirTime remembers the time of an archived folder for restoreDirTimes.
+func (x *XFile) recordDirTime(path string, atime, mtime time.Time) {
+	if mtime.IsZero() && atime.IsZero() {
+		return
+	}
+
+	state := x.shared()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.dirTimes == nil {
+		state.dirTimes = map[string]dirTime{}
+	}
+
+	state.dirTimes[path] = dirTime{atime: atime, mtime: mtime}
+}
+
+// moveDirTimes updates recorded folder times after squashRoot moves the contents of from into to.
+func (x *XFile) moveDirTimes(from, to string) {
+	state := x.shared()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	moved := make(map[string]dirTime, len(state.dirTimes))
+
+	for path, times := range state.dirTimes {
+		if rel, err := filepath.Rel(from, path); err != nil || !filepath.IsLocal(rel) {
+			moved[path] = times // not in from, or from itself, which is removed.
+		} else if rel != "." {
+			moved[filepath.Join(to, rel)] = times
+		}
+	}
+
+	state.dirTimes = moved
+}
+
+// restoreDirTimes sets the recorded times of archived folders, deepest first,
+// once every file in them is written.
+func (x *XFile) restoreDirTimes() {
+	state := x.shared()
+
+	state.mu.Lock()
+	times := state.dirTimes
+	state.dirTimes = nil
+	state.mu.Unlock()
+
+	for _, path := range slices.Backward(slices.Sorted(maps.Keys(times))) {
+		// The error is ignored because it's not critical, like in writeFile.
+		_ = os.Chtimes(path, times[path].atime, times[path].mtime)
+	}
+}
+
+// tarXattrs returns a tar entry's PAX extended attributes and ACLs.
+func (x *XFile) tarXattrs(header *tar.Header) map[string][]byte {
+	xattrs := map[string][]byte{}
+
+	for key, value := range header.PAXRecords {
+		switch {
+		case strings.HasPrefix(key, paxXattrPrefix):
+			xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = []byte(value)
+		case key == "SCHILY.acl.access", key == "SCHILY.acl.default":
+			acl, err := aclFromText(value)
+			if err != nil {
+				x.warn("skipping ACL of %s: %v", header.Name, err)
+				continue
+			}
+
+			xattrs["system.posix_acl_"+strings.TrimPrefix(key, "SCHILY.acl.")] = acl
+		}
+	}
+
+	return xattrs
+}
+
+// aclFromText converts an ACL in the text form tar stores, like
+// "user::rw-,user:alice:r--:1001,group::r--,mask::r--,other::---",
+// to the binary value of a system.posix_acl_access extended attribute.
+func aclFromText(text string) ([]byte, error) {
+	type aclEntry struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}
+
+	var entries []aclEntry
+
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) == 2 { //nolint:mnd // "other:r--" has no qualifier.
+			parts = []string{parts[0], "", parts[1]}
+		}
+
+		if len(parts) < 3 { //nolint:mnd
+			return nil, fmt.Errorf("%w: ACL entry %q", ErrInvalidACL, field)
+		}
+
+		entry := aclEntry{id: aclNoID}
+
+		for _, char := range parts[2] {
+			switch char {
+			case 'r':
+				entry.perm |= 4
+			case 'w':
+				entry.perm |= 2
+			case 'x':
+				entry.perm |= 1
+			case '-':
+			default:
+				return nil, fmt.Errorf("%w: ACL permissions %q", ErrInvalidACL, parts[2])
+			}
+		}
+
+		var err error
+
+		switch parts[0] {
+		case "user", "u":
+			entry.tag = aclUserObj
+			if parts[1] != "" {
+				entry.tag = aclUser
+				entry.id, err = aclQualifier("u:", parts)
+			}
+		case "group", "g":
+			entry.tag = aclGroupObj
+			if parts[1] != "" {
+				entry.tag = aclGroup
+				entry.id, err = aclQualifier("g:", parts)
+			}
+		case "mask", "m":
+			entry.tag = aclMask
+		case "other", "o":
+			entry.tag = aclOther
+		default:
+			err = fmt.Errorf("%w: ACL tag %q", ErrInvalidACL, parts[0])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// The kernel wants entries ordered by tag, then by id.
+	slices.SortFunc(entries, func(a, b aclEntry) int {
+		return cmp.Or(cmp.Compare(a.tag, b.tag), cmp.Compare(a.id, b.id))
+	})
+
+	data := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, entry := range entries {
+		data = binary.LittleEndian.AppendUint16(data, entry.tag)
+		data = binary.LittleEndian.AppendUint16(data, entry.perm)
+		data = binary.LittleEndian.AppendUint32(data, entry.id)
+	}
+
+	return data, nil
+}
+
+// aclQualifier returns the id of a named ACL entry: a numeric qualifier, the local id
+// of the user or group name, or the id star and bsdtar append after the permissions.
+func aclQualifier(kind string, parts []string) (uint32, error) {
+	if id, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	if id := lookupOwnerID(kind, parts[1], -1); id >= 0 {
+		return uint32(id), nil
+	}
+
+	if len(parts) > 3 { //nolint:mnd
+		if id, err := strconv.ParseUint(parts[3], 10, 32); err == nil {
+			return uint32(id), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: unknown ACL qualifier %q", ErrInvalidACL, parts[1])
+}
+
+// zipOwner returns the Unix owner in a zip entry's extra fields, or nil.
+func zipOwner(extra []byte) *fileOwner {
+	for len(extra) >= 4 { //nolint:mnd
+		fieldID, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			return nil
+		}
+
+		data := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		switch {
+		case fieldID == zipExtraUnixOwner && size >= 3 && data[0] == 1:
+			uid, rest, ok := zipOwnerID(data[1:])
+			if !ok {
+				return nil
+			}
+
+			if gid, _, ok := zipOwnerID(rest); ok {
+				return &fileOwner{uid: uid, gid: gid}
+			}
+
+			return nil
+		case fieldID == zipExtraOldUnix && size >= 12: //nolint:mnd // only local headers have the ids.
+			return &fileOwner{uid: int(binary.LittleEndian.Uint16(data[8:])), gid: int(binary.LittleEndian.Uint16(data[10:]))}
+		}
+	}
+
+	return nil
+}
+
+// zipOwnerID reads a size-prefixed little endian id from an Info-ZIP Unix extra field.
+func zipOwnerID(data []byte) (int, []byte, bool) {
+	if len(data) == 0 || int(data[0]) > len(data)-1 || data[0] > 8 { //nolint:mnd
+		return 0, nil, false
+	}
+
+	var id uint64
+	for idx := int(data[0]); idx > 0; idx-- {
+		id = id<<8 | uint64(data[idx])
+	}
+
+	return int(id), data[1+int(data[0]):], true
+}
@@ -0,0 +1,115 @@
+package xtractr
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nwaples/rardecode/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLFromText(t *testing.T) {
+	t.Parallel()
+
+	acl, err := aclFromText("user::rw-,group::r--,other::---,user:nobody-here:r-x:1001,mask::r-x,group:40:rw-")
+	require.NoError(t, err)
+
+	want := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, entry := range [][3]uint32{
+		{aclUserObj, 6, aclNoID},
+		{aclUser, 5, 1001},
+		{aclGroupObj, 4, aclNoID},
+		{aclGroup, 6, 40},
+		{aclMask, 5, aclNoID},
+		{aclOther, 0, aclNoID},
+	} {
+		want = binary.LittleEndian.AppendUint16(want, uint16(entry[0]))
+		want = binary.LittleEndian.AppendUint16(want, uint16(entry[1]))
+		want = binary.LittleEndian.AppendUint32(want, entry[2])
+	}
+
+	assert.Equal(t, want, acl, "entries are sorted by tag, then id")
+
+	for _, bad := range []string{"user::rwz", "wheel::r--", "user", "user:nobody-here:r--"} {
+		_, err := aclFromText(bad)
+		require.ErrorIs(t, err, ErrInvalidACL, bad)
+	}
+}
+
+func TestZipOwner(t *testing.T) {
+	t.Parallel()
+
+	// Info-ZIP new Unix field: version 1, a 4 byte uid of 1000 and a 2 byte gid of 100,
+	// after an unrelated extended timestamp field.
+	extra := []byte{0x55, 0x54, 5, 0, 1, 0, 0, 0, 0}
+	extra = append(extra, 0x75, 0x78, 9, 0, 1, 4, 0xe8, 0x03, 0, 0, 2, 100, 0)
+	assert.Equal(t, &fileOwner{uid: 1000, gid: 100}, zipOwner(extra))
+
+	// Info-ZIP old Unix field from a local header: atime, mtime, uid 501, gid 20.
+	old := []byte{0x55, 0x58, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xf5, 0x01, 20, 0}
+	assert.Equal(t, &fileOwner{uid: 501, gid: 20}, zipOwner(old))
+
+	assert.Nil(t, zipOwner(nil))
+	assert.Nil(t, zipOwner([]byte{0x75, 0x78, 10, 0, 1}), "truncated field")
+}
+
+// rar5Block returns a RAR5 header with its CRC32 and size: type, flags, the extra area size when
+// there is one, fields, then the extra area.
+func rar5Block(kind byte, fields, extra []byte) []byte {
+	body := []byte{kind, 0}
+	if len(extra) > 0 {
+		body[1] = rar5ExtraArea
+		body = binary.AppendUvarint(body, uint64(len(extra)))
+	}
+
+	body = append(append(body, fields...), extra...)
+	sized := append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+
+	return append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(sized)), sized...)
+}
+
+func TestReadRAR5Owners(t *testing.T) {
+	t.Parallel()
+
+	// File header fields: flags, size, attributes, compression, host OS (Unix), then the name.
+	fileFields := func(name string) []byte {
+		return append([]byte{0, 0, 0o44, 0, 1, byte(len(name))}, name...)
+	}
+	// Owner record: size, type 6, flags (user and group names, uid, gid), names and ids.
+	owner := []byte{16, rar5OwnerRecord, 0x0f, 4, 'r', 'o', 'o', 't', 5, 'w', 'h', 'e', 'e', 'l', 0, 0x80, 0x01}
+	// A group name only, after an unrelated (hash) record.
+	groupOnly := append([]byte{3, 2, 0, 0}, 7, rar5OwnerRecord, rar5OwnerGroup, 4, 'u', 's', 'e', 'r')
+
+	archive := []byte("SFX stub" + rar5Signature)
+	archive = append(archive, rar5Block(1, []byte{0}, nil)...) // main header, no flags.
+	archive = append(archive, rar5Block(rar5FileType, fileFields("dir/owned"), owner)...)
+	archive = append(archive, rar5Block(rar5FileType, fileFields("group"), groupOnly)...)
+	archive = append(archive, rar5Block(rar5FileType, fileFields("plain"), nil)...)
+	archive = append(archive, rar5Block(rar5EndType, []byte{0}, nil)...)
+	archive = append(archive, "trailing data after the end header"...)
+
+	path := filepath.Join(t.TempDir(), "owners.rar")
+	require.NoError(t, os.WriteFile(path, archive, 0o600))
+
+	owners := map[string]*fileOwner{}
+	require.NoError(t, readRAR5Owners(path, owners))
+	assert.Equal(t, map[string]*fileOwner{
+		"dir/owned": {uid: 0, gid: 128, uname: "root", gname: "wheel"},
+		"group":     {uid: -1, gid: -1, gname: "user"},
+	}, owners)
+
+	archive[len("SFX stub"+rar5Signature)+5]++ // damage the main header.
+	require.NoError(t, os.WriteFile(path, archive, 0o600))
+	require.ErrorIs(t, readRAR5Owners(path, owners), rardecode.ErrBadHeaderCRC)
+
+	// Real archives, made without owners: every header is walked to the end.
+	for _, name := range []string{"archive.rar", "symlink.rar", "multivol.part1.rar", "multivol.part4.rar"} {
+		owners = map[string]*fileOwner{}
+		require.NoError(t, readRAR5Owners(filepath.Join("test_data", name), owners), name)
+		assert.Empty(t, owners, name)
+	}
+}
@@ -0,0 +1,90 @@
+package xtractr_test
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestPreserveXattrs(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	probe := filepath.Join(tmp, "probe")
+	require.NoError(t, os.WriteFile(probe, nil, 0o600))
+
+	if err := syscall.Setxattr(probe, "user.probe", []byte("1"), 0); err != nil {
+		t.Skipf("user extended attributes are not supported in %s: %v", tmp, err)
+	}
+
+	archive := writeTestTar(t, "xattrs.tar", testTarEntry{name: "tagged.txt", data: "hi", header: tar.Header{
+		Uid: 12345, Gid: 12345, Uname: "no-such-user-here", Format: tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.user.comment": "kept"},
+	}})
+
+	for preserve, want := range map[bool]string{true: "kept", false: ""} {
+		out := filepath.Join(tmp, "out", map[bool]string{true: "on", false: "off"}[preserve])
+		_, _, err := xtractr.ExtractTar(&xtractr.XFile{
+			FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700,
+			PreserveXattrs: preserve, PreserveOwnership: true,
+		})
+		require.NoError(t, err, "an unprivileged extraction skips what it can not restore")
+
+		value := make([]byte, 64)
+
+		size, err := syscall.Getxattr(filepath.Join(out, "tagged.txt"), "user.comment", value)
+		if want == "" {
+			require.True(t, errors.Is(err, syscall.ENODATA), err)
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, want, string(value[:size]))
+	}
+}
+
+func TestRockRidgeOwnersAndDevices(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() != 0 {
+		t.Skip("owners and device nodes are only restored by root")
+	}
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "rockridge.iso")
+	require.NoError(t, os.WriteFile(archive, testRockRidgeISO(rrDeepDir), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, _, err := xtractr.ExtractISO(&xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o644, DirMode: 0o755,
+		PreserveOwnership: true, SpecialFilePolicy: xtractr.SpecialFilesCreate,
+	})
+	require.NoError(t, err)
+
+	// testPX gives every record uid and gid 1000.
+	for _, name := range []string{"Hello World.txt", "link", "a", filepath.Join("a", "deep", "inner.txt")} {
+		info, err := os.Lstat(filepath.Join(out, name))
+		require.NoError(t, err)
+
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		require.NotNil(t, stat)
+		assert.Equal(t, [2]uint32{1000, 1000}, [2]uint32{stat.Uid, stat.Gid}, name)
+	}
+
+	info, err := os.Lstat(filepath.Join(out, "null"))
+	if err != nil {
+		t.Skipf("device nodes can not be created here: %v", err)
+	}
+
+	stat, _ := info.Sys().(*syscall.Stat_t)
+	require.NotNil(t, stat)
+	assert.Equal(t, uint64(0x0103), stat.Rdev, "PN device 1:3")
+}
@@ -0,0 +1,155 @@
+package xtractr_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestTarMetadataOnlyWhenPreserved(t *testing.T) {
+	t.Parallel()
+
+	archive := writeTestTar(t, "acl.tar", testTarEntry{name: "acl.txt", data: "x", header: tar.Header{
+		Format: tar.FormatPAX, PAXRecords: map[string]string{"SCHILY.acl.access": "user::rwz"},
+	}})
+
+	for preserve, want := range map[bool]int{false: 0, true: 1} {
+		xFile := &xtractr.XFile{
+			FilePath: archive, OutputDir: filepath.Join(t.TempDir(), "out"), FileMode: 0o600, DirMode: 0o700,
+			PreserveXattrs: preserve,
+		}
+		_, _, err := xtractr.ExtractTar(xFile)
+		require.NoError(t, err)
+		assert.Len(t, xFile.Warnings, want, "ACLs are only read with PreserveXattrs")
+	}
+}
+
+func TestPrivilegedXattrsNeedKeepSetuid(t *testing.T) {
+	t.Parallel()
+
+	archive := writeTestTar(t, "caps.tar", testTarEntry{name: "ping", data: "x", header: tar.Header{
+		Format: tar.FormatPAX, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00",
+			"SCHILY.xattr.trusted.overlay":     "y",
+		},
+	}})
+
+	for policy, want := range map[xtractr.SetuidPolicy]int{xtractr.StripSetuid: 2, xtractr.KeepSetuid: 0} {
+		xFile := &xtractr.XFile{
+			FilePath: archive, OutputDir: filepath.Join(t.TempDir(), "out"), FileMode: 0o600, DirMode: 0o700,
+			PreserveXattrs: true, SetuidPolicy: policy,
+		}
+		_, _, err := xtractr.ExtractTar(xFile)
+		require.NoError(t, err)
+		require.Len(t, xFile.Warnings, want, "security and trusted attributes need KeepSetuid")
+
+		if want > 0 {
+			assert.Contains(t, xFile.Warnings[0], "security.capability")
+			assert.Contains(t, xFile.Warnings[1], "trusted.overlay")
+		}
+	}
+}
+
+// dirTimes returns the times of the folders in dirTimesTar and dirTimesZip.
+func dirTimes() map[string]time.Time {
+	return map[string]time.Time{
+		"root/":           time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"root/inner/":     time.Date(2002, 2, 2, 0, 0, 0, 0, time.UTC),
+		"root/inner/sub/": time.Date(2003, 3, 3, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// dirTimesTar returns a tarball with its folders before the files written in them.
+func dirTimesTar(t *testing.T) string {
+	t.Helper()
+
+	entries := []testTarEntry{}
+	for _, name := range []string{"root/", "root/inner/", "root/inner/sub/"} {
+		entries = append(entries, testTarEntry{name: name, header: tar.Header{ModTime: dirTimes()[name]}})
+	}
+
+	for _, name := range []string{"root/a.txt", "root/inner/b.txt", "root/inner/sub/c.txt"} {
+		entries = append(entries, testTarEntry{name: name, data: "x"})
+	}
+
+	return writeTestTar(t, "dirs.tar", entries...)
+}
+
+func assertDirTimes(t *testing.T, out, trim string) {
+	t.Helper()
+
+	for name, want := range dirTimes() {
+		rel, _ := filepath.Rel(trim, filepath.FromSlash(name))
+		if rel == "." {
+			continue // the squashed root is gone.
+		}
+
+		info, err := os.Stat(filepath.Join(out, rel))
+		require.NoError(t, err)
+		assert.Equal(t, want, info.ModTime().UTC(), name)
+	}
+}
+
+func TestDirTimes(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+	_, _, err := xtractr.ExtractTar(&xtractr.XFile{
+		FilePath: dirTimesTar(t), OutputDir: out, FileMode: 0o600, DirMode: 0o700,
+	})
+	require.NoError(t, err)
+	assertDirTimes(t, out, "")
+}
+
+func TestDirTimesSquashRoot(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+	_, _, _, err := xtractr.ExtractFile(&xtractr.XFile{
+		FilePath: dirTimesTar(t), OutputDir: out, FileMode: 0o600, DirMode: 0o700, SquashRoot: true,
+	})
+	require.NoError(t, err)
+	assertDirTimes(t, out, "root")
+}
+
+func TestDirTimesZIPParallel(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	writer := zip.NewWriter(&buf)
+
+	for _, name := range []string{"root/", "root/inner/", "root/inner/sub/"} {
+		_, err := writer.CreateHeader(&zip.FileHeader{Name: name, Modified: dirTimes()[name]})
+		require.NoError(t, err)
+	}
+
+	for idx := range 20 {
+		entry, err := writer.Create("root/inner/sub/" + strconv.Itoa(idx) + ".txt")
+		require.NoError(t, err)
+		_, err = entry.Write([]byte("x"))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "dirs.zip")
+	require.NoError(t, os.WriteFile(archive, buf.Bytes(), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, _, err := xtractr.ExtractZIP(&xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, FileWorkers: 4,
+	})
+	require.NoError(t, err)
+	assertDirTimes(t, out, "")
+}
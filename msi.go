@@ -0,0 +1,448 @@
+package xtractr
+
+/* MSI database tables, read to give the files in embedded cabinets their real names. */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+)
+
+const (
+	msiTypeString    = 0x0800
+	msiTypeValid     = 0x0100
+	msiTypeNullable  = 0x1000
+	msiTypeTemporary = 0x4000
+	msiTypeSizeMask  = 0x00FF
+	msiLongRefs      = 0x8000
+	msiIntBias       = 0x8000
+	msiMaxTableSize  = 64 << 20
+	msiMaxDirDepth   = 256
+	msiCodepageUTF8  = 65001
+)
+
+// msiDatabase holds the string pool and column definitions of an MSI database.
+type msiDatabase struct {
+	cfb     *cfbFile
+	streams map[string]*cfbEntry
+	strings []string
+	refSize int
+	columns map[string][]msiColumn
+}
+
+type msiColumn struct {
+	name   string
+	kind   uint16
+	number int
+}
+
+// msiRow maps column names to values. Integers are formatted in base 10, and nulls are empty.
+type msiRow map[string]string
+
+// msiColumnsSchema is the fixed layout of the _Columns table, which describes every other table.
+//
+//nolint:gochecknoglobals
+var msiColumnsSchema = []msiColumn{
+	{name: "Table", kind: msiTypeValid | msiTypeString | 64}, //nolint:mnd
+	{name: "Number", kind: msiTypeValid | 2},                 //nolint:mnd
+	{name: "Name", kind: msiTypeValid | msiTypeString | 64},  //nolint:mnd
+	{name: "Type", kind: msiTypeValid | 2},                   //nolint:mnd
+}
+
+// loadMSI reads the string pool and column definitions from the root streams.
+func loadMSI(cfb *cfbFile, items []*cfbItem) (*msiDatabase, error) {
+	db := &msiDatabase{cfb: cfb, streams: map[string]*cfbEntry{}, columns: map[string][]msiColumn{}}
+
+	for _, item := range items {
+		if item.entry.kind == cfbTypeStream && !strings.ContainsRune(item.path, filepath.Separator) {
+			db.streams[item.path] = item.entry
+		}
+	}
+
+	if err := db.loadStrings(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.rows("_Columns", msiColumnsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		kind, _ := strconv.Atoi(row["Type"])
+		number, _ := strconv.Atoi(row["Number"])
+		table := row["Table"]
+		db.columns[table] = append(db.columns[table], msiColumn{name: row["Name"], kind: uint16(kind), number: number})
+	}
+
+	// Columns are listed by table then number, but sort them anyway.
+	for _, columns := range db.columns {
+		slices.SortStableFunc(columns, func(a, b msiColumn) int { return a.number - b.number })
+	}
+
+	return db, nil
+}
+
+func (db *msiDatabase) read(name string) ([]byte, error) {
+	entry, ok := db.streams[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing msi stream %s", ErrCorruptCFB, name)
+	} else if entry.size > msiMaxTableSize {
+		return nil, fmt.Errorf("%w: msi stream %s too large", ErrCorruptCFB, name)
+	}
+
+	stream, err := db.cfb.stream(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(stream, 0, stream.size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading msi stream %s: %w", ErrCorruptCFB, name, err)
+	}
+
+	return data, nil
+}
+
+// loadStrings reads the string pool. Each pool entry holds a length and a reference
+// count; a zero length with a non-zero count means the next entry holds a long length.
+func (db *msiDatabase) loadStrings() error {
+	pool, err := db.read("!_StringPool")
+	if err != nil {
+		return err
+	}
+
+	data, err := db.read("!_StringData")
+	if err != nil {
+		return err
+	}
+
+	if len(pool) < 4 { //nolint:mnd
+		return fmt.Errorf("%w: short msi string pool", ErrCorruptCFB)
+	}
+
+	db.refSize = 2
+	if binary.LittleEndian.Uint16(pool[2:])&msiLongRefs != 0 {
+		db.refSize = 3
+	}
+
+	decoder := msiCodepage(binary.LittleEndian.Uint32(pool) &^ (msiLongRefs << 16)) //nolint:mnd
+	db.strings = []string{""}                                                       // id 0 is null.
+
+	for pos, offset := 4, 0; pos+4 <= len(pool); pos += 4 {
+		length := int(binary.LittleEndian.Uint16(pool[pos:]))
+		refs := binary.LittleEndian.Uint16(pool[pos+2:])
+
+		if length == 0 && refs != 0 && pos+8 <= len(pool) {
+			length = int(binary.LittleEndian.Uint16(pool[pos+6:]))<<16 | int(binary.LittleEndian.Uint16(pool[pos+4:]))
+			pos += 4
+		}
+
+		if offset+length > len(data) {
+			return fmt.Errorf("%w: msi string data truncated", ErrCorruptCFB)
+		}
+
+		value := data[offset : offset+length]
+		offset += length
+
+		if decoder != nil && !isASCII(value) {
+			if decoded, err := decoder.NewDecoder().Bytes(value); err == nil {
+				value = decoded
+			}
+		}
+
+		db.strings = append(db.strings, string(value))
+	}
+
+	return nil
+}
+
+// msiCodepage returns a decoder for the string pool codepage, or nil for UTF-8 and ASCII.
+func msiCodepage(codepage uint32) encoding.Encoding {
+	switch codepage {
+	case msiCodepageUTF8:
+		return nil
+	case 0: // neutral
+		return charsetToEncoding("windows-1252")
+	case 932: //nolint:mnd
+		return charsetToEncoding("shift_jis")
+	case 936: //nolint:mnd
+		return charsetToEncoding("gbk")
+	case 949: //nolint:mnd
+		return charsetToEncoding("euc-kr")
+	case 950: //nolint:mnd
+		return charsetToEncoding("big5")
+	default:
+		return charsetToEncoding("windows-" + strconv.FormatUint(uint64(codepage), 10))
+	}
+}
+
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 { //nolint:mnd
+			return false
+		}
+	}
+
+	return true
+}
+
+// width returns the number of bytes a column takes in each row.
+func (c msiColumn) width(refSize int) int {
+	switch {
+	case c.kind&^msiTypeNullable == msiTypeString|msiTypeValid: // binary stream name
+		return 2 //nolint:mnd
+	case c.kind&msiTypeString != 0:
+		return refSize
+	case c.kind&msiTypeSizeMask <= 2: //nolint:mnd
+		return 2 //nolint:mnd
+	default:
+		return 4 //nolint:mnd
+	}
+}
+
+// table reads every row of a table. Missing tables have no rows.
+func (db *msiDatabase) table(name string) ([]msiRow, error) {
+	columns, ok := db.columns[name]
+	if !ok {
+		return nil, nil
+	}
+
+	return db.rows(name, columns)
+}
+
+// rows decodes a table stream. Tables are stored column by column.
+func (db *msiDatabase) rows(name string, columns []msiColumn) ([]msiRow, error) {
+	stored := []msiColumn{}
+	rowSize := 0
+
+	for _, column := range columns {
+		if column.kind&msiTypeTemporary == 0 {
+			stored = append(stored, column)
+			rowSize += column.width(db.refSize)
+		}
+	}
+
+	if _, ok := db.streams["!"+name]; !ok || rowSize == 0 {
+		return nil, nil // empty tables have no stream.
+	}
+
+	data, err := db.read("!" + name)
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(data) / rowSize
+	rows := make([]msiRow, count)
+
+	for idx := range rows {
+		rows[idx] = msiRow{}
+	}
+
+	offset := 0
+
+	for _, column := range stored {
+		width := column.width(db.refSize)
+
+		for idx, row := range rows {
+			row[column.name] = db.cell(column, data[offset+idx*width:offset+(idx+1)*width])
+		}
+
+		offset += count * width
+	}
+
+	return rows, nil
+}
+
+func (db *msiDatabase) cell(column msiColumn, raw []byte) string {
+	var value uint32
+
+	switch len(raw) {
+	case 2: //nolint:mnd
+		value = uint32(binary.LittleEndian.Uint16(raw))
+	case 3: //nolint:mnd // long string references
+		value = uint32(binary.LittleEndian.Uint16(raw)) | uint32(raw[2])<<16 //nolint:mnd
+	default:
+		value = binary.LittleEndian.Uint32(raw)
+	}
+
+	switch {
+	case column.kind&^msiTypeNullable == msiTypeString|msiTypeValid: // binary stream name
+		return ""
+	case column.kind&msiTypeString != 0:
+		if int(value) < len(db.strings) {
+			return db.strings[value]
+		}
+
+		return ""
+	case value == 0:
+		return "" // null
+	case len(raw) == 2: //nolint:mnd
+		return strconv.Itoa(int(value) - msiIntBias)
+	default:
+		return strconv.Itoa(int(int32(value ^ 0x80000000))) //nolint:mnd
+	}
+}
+
+// cabinetNames maps each embedded cabinet stream (listed in the Media table
+// with a leading #) to the real names of the files it holds.
+func (db *msiDatabase) cabinetNames() map[string]map[string]string {
+	media, err := db.table("Media")
+	if err != nil {
+		return nil
+	}
+
+	names := db.fileNames()
+	cabinets := map[string]map[string]string{}
+
+	for _, row := range media {
+		if cabinet, ok := strings.CutPrefix(row["Cabinet"], "#"); ok && cabinet != "" {
+			cabinets[cabinet] = names
+		}
+	}
+
+	return cabinets
+}
+
+// fileNames maps File table keys (the names used inside the cabinets) to paths
+// built from the File, Component and Directory tables.
+func (db *msiDatabase) fileNames() map[string]string {
+	files, err := db.table("File")
+	if err != nil {
+		return nil
+	}
+
+	components, _ := db.table("Component")
+	directories, _ := db.table("Directory")
+
+	componentDir := map[string]string{}
+	for _, row := range components {
+		componentDir[row["Component"]] = row["Directory_"]
+	}
+
+	dirs := map[string]msiRow{}
+	for _, row := range directories {
+		dirs[row["Directory"]] = row
+	}
+
+	paths := map[string]string{}
+	names := map[string]string{}
+	used := map[string]bool{}
+
+	for _, row := range files {
+		name := msiLongName(row["FileName"])
+		if name == "" || name == "." {
+			continue
+		}
+
+		full := path.Join(msiDirPath(componentDir[row["Component_"]], dirs, paths, 0), name)
+		if used[strings.ToLower(full)] {
+			continue // keep the key name rather than overwrite another file.
+		}
+
+		used[strings.ToLower(full)] = true
+		names[row["File"]] = full
+	}
+
+	return names
+}
+
+// msiDirPath resolves a Directory key to a path. Root directories (TARGETDIR) are
+// the output folder, and "." entries add no folder. The source name is used when
+// present, as in an administrative install.
+func msiDirPath(key string, dirs map[string]msiRow, paths map[string]string, depth int) string {
+	if found, ok := paths[key]; ok {
+		return found
+	}
+
+	row, ok := dirs[key]
+	if !ok || depth > msiMaxDirDepth {
+		return ""
+	}
+
+	parent := row["Directory_Parent"]
+	if parent == "" || parent == key {
+		paths[key] = ""
+		return ""
+	}
+
+	names := strings.Split(row["DefaultDir"], ":")
+	name := msiLongName(names[len(names)-1])
+
+	found := msiDirPath(parent, dirs, paths, depth+1)
+	if name != "." {
+		found = path.Join(found, name)
+	}
+
+	paths[key] = found
+
+	return found
+}
+
+// msiLongName returns the long name of a "short|long" pair. Names that are
+// not a single path element are returned empty.
+func msiLongName(name string) string {
+	if _, long, ok := strings.Cut(name, "|"); ok {
+		name = long
+	}
+
+	if name == ".." || strings.ContainsAny(name, `/\`) {
+		return ""
+	}
+
+	return name
+}
+
+// renameCabinet returns a copy of a cabinet with its files renamed. Only the file
+// table changes; folder offsets and the cabinet size are adjusted for its new length.
+func renameCabinet(stream *cfbStream, names map[string]string) (io.Reader, error) {
+	cab, err := readCabinet(stream, stream.size)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, cab.fileTable)
+	if _, err = stream.ReadAt(head, 0); err != nil {
+		return nil, fmt.Errorf("%w: reading cabinet header: %w", ErrCorruptCAB, err)
+	}
+
+	var table bytes.Buffer
+
+	for _, file := range cab.files {
+		header := slices.Clone(file.header)
+		name := strings.ReplaceAll(file.name, "/", `\`)
+
+		if renamed, ok := names[file.name]; ok && len(renamed) < cabMaxNameLen {
+			name = strings.ReplaceAll(renamed, "/", `\`)
+
+			if !isASCII([]byte(name)) {
+				binary.LittleEndian.PutUint16(header[14:], binary.LittleEndian.Uint16(header[14:])|cabAttrNameUTF)
+			}
+		}
+
+		table.Write(header)
+		table.WriteString(name)
+		table.WriteByte(0)
+	}
+
+	delta := uint32(int64(table.Len()) - (cab.fileEnd - cab.fileTable))
+	binary.LittleEndian.PutUint32(head[8:], binary.LittleEndian.Uint32(head[8:])+delta)
+
+	for idx := range cab.folders {
+		entry := head[cab.folderTable+int64(idx*(cabFolderSize+cab.folderReserve)):]
+		if offset := binary.LittleEndian.Uint32(entry); int64(offset) >= cab.fileEnd {
+			binary.LittleEndian.PutUint32(entry, offset+delta)
+		}
+	}
+
+	return io.MultiReader(bytes.NewReader(head), &table,
+		io.NewSectionReader(stream, cab.fileEnd, stream.size-cab.fileEnd)), nil
+}
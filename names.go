@@ -0,0 +1,218 @@
+package xtractr
+
+/* Code to list the member names of an archive that are not UTF-8, so a caller can pick their encoding. */
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nwaples/rardecode/v2"
+	"github.com/peterebden/ar"
+	"github.com/saintfish/chardet"
+	"github.com/therootcompany/xz"
+)
+
+// DetectNameEncoding returns the character sets the member names of an archive
+// may be in, best first. Only names that are not valid UTF-8 are considered;
+// the list is empty when there are none. Pass a candidate's Charset to
+// XFile.NameEncoding to extract with it. ZIP, RAR, cpio, ar and tar archives
+// (plain, or compressed with gzip, bzip2, xz or zstd) are supported. Streaming
+// formats are read to the end, so this can take as long as extracting them.
+func DetectNameEncoding(path string) ([]EncodingCandidate, error) {
+	rawNames, err := rawArchiveNames(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rawNames) == 0 {
+		return []EncodingCandidate{}, nil
+	}
+
+	results, err := chardet.NewTextDetector().DetectAll([]byte(strings.Join(rawNames, "")))
+	if err != nil {
+		return nil, fmt.Errorf("detecting name encoding: %w", err)
+	}
+
+	return rankEncodings(results, rawNames), nil
+}
+
+// rawArchiveNames returns an archive's member names and link targets that are not valid UTF-8.
+func rawArchiveNames(path string) ([]string, error) {
+	_, kind, err := detectBySignature(path)
+	if err != nil && !errors.Is(err, ErrUnknownArchiveType) {
+		return nil, err
+	}
+
+	if kind == "zip" {
+		zipReader, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("zip.OpenReader: %w", err)
+		}
+		defer zipReader.Close()
+
+		return zipRawNames(zipReader.File), nil
+	}
+
+	if kind == "rar" {
+		return rarRawNames(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close()
+
+	switch kind {
+	case "ar":
+		return arRawNames(file)
+	case "cpio":
+		return cpioRawNames(file)
+	case "gzip":
+		stream, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		defer stream.Close()
+
+		return tarRawNames(stream)
+	case "bz2":
+		return tarRawNames(bzip2.NewReader(file))
+	case "xz":
+		stream, err := xz.NewReader(file, 0)
+		if err != nil {
+			return nil, fmt.Errorf("xz.NewReader: %w", err)
+		}
+
+		return tarRawNames(stream)
+	case "zstandard":
+		stream, err := zstd.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewReader: %w", err)
+		}
+		defer stream.Close()
+
+		return tarRawNames(stream)
+	case "":
+		// Plain tar has no signature at the start of the file.
+		return tarRawNames(file)
+	default:
+		return nil, fmt.Errorf("%w: listing %s names: %s", ErrUnknownArchiveType, kind, path)
+	}
+}
+
+// zipRawNames returns the names of entries that are flagged, or look, non-UTF-8.
+func zipRawNames(entries []*zip.File) []string {
+	var rawNames []string
+
+	for _, f := range entries {
+		if f.NonUTF8 || !utf8.ValidString(f.Name) {
+			rawNames = append(rawNames, f.Name)
+		}
+	}
+
+	return rawNames
+}
+
+func rarRawNames(path string) ([]string, error) {
+	rarReader, err := rardecode.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("rardecode.OpenReader: %w", err)
+	}
+	defer rarReader.Close()
+
+	var rawNames []string
+
+	for {
+		header, err := rarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return rawNames, nil
+		} else if err != nil {
+			return rawNames, fmt.Errorf("rarReader.Next: %w", err)
+		}
+
+		rawNames = appendNonUTF8(rawNames, header.Name, header.Linkname)
+	}
+}
+
+func arRawNames(reader io.Reader) ([]string, error) {
+	arReader := ar.NewReader(reader)
+
+	var rawNames []string
+
+	for {
+		header, err := arReader.Next()
+		if errors.Is(err, io.EOF) {
+			return rawNames, nil
+		} else if err != nil {
+			return rawNames, fmt.Errorf("arReader.Next: %w", err)
+		}
+
+		rawNames = appendNonUTF8(rawNames, header.Name)
+	}
+}
+
+// cpioRawNames reads every cpio archive in the stream, like uncpio does.
+func cpioRawNames(reader io.Reader) ([]string, error) {
+	buffered := bufio.NewReader(reader)
+
+	var rawNames []string
+
+	for {
+		cpioReader := cpio.NewReader(buffered)
+
+		for {
+			header, err := cpioReader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return rawNames, fmt.Errorf("cpio Next() failed: %w", err)
+			}
+
+			rawNames = appendNonUTF8(rawNames, header.Name, header.Linkname)
+		}
+
+		if !(&XFile{}).nextCPIOArchive(buffered) {
+			return rawNames, nil
+		}
+	}
+}
+
+func tarRawNames(reader io.Reader) ([]string, error) {
+	tarReader := tar.NewReader(reader)
+
+	var rawNames []string
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return rawNames, nil
+		} else if err != nil {
+			return rawNames, fmt.Errorf("tarReader.Next: %w", err)
+		}
+
+		rawNames = appendNonUTF8(rawNames, header.Name, header.Linkname)
+	}
+}
+
+// appendNonUTF8 appends the names that are not valid UTF-8.
+func appendNonUTF8(rawNames []string, names ...string) []string {
+	for _, name := range names {
+		if !utf8.ValidString(name) {
+			rawNames = append(rawNames, name)
+		}
+	}
+
+	return rawNames
+}
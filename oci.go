@@ -0,0 +1,464 @@
+package xtractr
+
+/* Container image tarballs (docker save and OCI image layouts), flattened into one root filesystem. */
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+	// ociMaxManifestSize caps how much of a manifest or index is read.
+	ociMaxManifestSize = 16 << 20
+	// ociMaxIndexDepth limits how many nested image indexes are followed.
+	ociMaxIndexDepth = 4
+)
+
+// ociImage is an image tarball with the position of every regular file in it,
+// so layers can be read in manifest order instead of archive order.
+type ociImage struct {
+	file    io.ReaderAt
+	members map[string]ociMember
+}
+
+type ociMember struct {
+	offset int64
+	size   int64
+}
+
+// ociDescriptor is the part of an OCI content descriptor, manifest or index that we use.
+type ociDescriptor struct {
+	Digest    string          `json:"digest"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociTree tracks which paths make up the root filesystem as layers are applied.
+type ociTree struct {
+	names   []string
+	present map[string]bool
+}
+
+// ExtractOCI extracts a container image saved as a tarball, either by `docker save`
+// (manifest.json) or as an OCI image layout (index.json). The layers of the first
+// image are applied in order, with whiteout files removing what lower layers wrote,
+// so OutputDir holds the image's final root filesystem. Whiteouts never remove files
+// that were in OutputDir before, and ManifestEntries lists only the files left. The
+// tarball must not be compressed; layers may be plain, gzip or zstd tarballs.
+func ExtractOCI(xFile *XFile) (size uint64, filesList []string, err error) {
+	imageFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer imageFile.Close()
+
+	defer xFile.newProgress(0, uint64(stat.Size()), 0).done()
+
+	image, err := readOCIImage(imageFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	layers, err := image.layers()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	files, err := xFile.unOCI(image, layers)
+
+	return xFile.prog.Wrote, files, err
+}
+
+// isOCITarball reports whether a tar file has a docker save manifest or an OCI layout in its root.
+func isOCITarball(filePath string) bool {
+	imageFile, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer imageFile.Close()
+
+	image, err := readOCIImage(imageFile)
+	if err != nil {
+		return false
+	}
+
+	_, manifest := image.members["manifest.json"]
+	_, layout := image.members["oci-layout"]
+
+	return manifest || layout
+}
+
+// readOCIImage indexes the regular files in a tarball. The tar reader does not
+// read ahead, so the file offset after each header is where that file's data begins.
+func readOCIImage(imageFile *os.File) (*ociImage, error) {
+	image := &ociImage{file: imageFile, members: map[string]ociMember{}}
+	tarReader := tar.NewReader(imageFile)
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return image, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("tarReader.Next: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		offset, err := imageFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("finding tar member offset: %w", err)
+		}
+
+		image.members[ociKey(header.Name)] = ociMember{offset: offset, size: header.Size}
+	}
+}
+
+// read returns a small member of the tarball, such as a manifest.
+func (o *ociImage) read(name string) ([]byte, error) {
+	member, ok := o.members[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidImage, name)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(io.NewSectionReader(o.file, member.offset, member.size), ociMaxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	return data, nil
+}
+
+// layers returns the tarball member names of the first image's layers, lowest first.
+func (o *ociImage) layers() ([]string, error) {
+	if _, ok := o.members["manifest.json"]; ok {
+		return o.dockerLayers()
+	}
+
+	data, err := o.read("index.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var index ociDescriptor
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("%w: index.json: %w", ErrInvalidImage, err)
+	}
+
+	// An index lists manifests, and each may be another index (e.g. one per platform).
+	for range ociMaxIndexDepth {
+		if len(index.Manifests) == 0 {
+			return nil, fmt.Errorf("%w: index lists no manifests", ErrInvalidImage)
+		}
+
+		blob, err := ociBlobPath(index.Manifests[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		if data, err = o.read(blob); err != nil {
+			return nil, err
+		}
+
+		index = ociDescriptor{}
+		if err = json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidImage, blob, err)
+		}
+
+		if len(index.Manifests) == 0 {
+			return ociLayerPaths(index.Layers)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: image indexes nested more than %d deep", ErrInvalidImage, ociMaxIndexDepth)
+}
+
+func (o *ociImage) dockerLayers() ([]string, error) {
+	data, err := o.read("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest []struct {
+		Layers []string `json:"Layers"`
+	}
+
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: manifest.json: %w", ErrInvalidImage, err)
+	}
+
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("%w: manifest.json lists no images", ErrInvalidImage)
+	}
+
+	layers := make([]string, len(manifest[0].Layers))
+	for idx, layer := range manifest[0].Layers {
+		layers[idx] = ociKey(layer)
+	}
+
+	return layers, nil
+}
+
+func ociLayerPaths(descriptors []ociDescriptor) ([]string, error) {
+	layers := make([]string, len(descriptors))
+
+	for idx, layer := range descriptors {
+		blob, err := ociBlobPath(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		layers[idx] = blob
+	}
+
+	return layers, nil
+}
+
+// ociBlobPath turns a digest like sha256:abc into blobs/sha256/abc.
+func ociBlobPath(digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || encoded == "" || strings.ContainsAny(digest, `/\`) || strings.Contains(digest, "..") {
+		return "", fmt.Errorf("%w: bad digest %q", ErrInvalidImage, digest)
+	}
+
+	return path.Join("blobs", algorithm, encoded), nil
+}
+
+// ociKey normalizes a tar member name to a clean relative path, e.g. ./usr/bin/ -> usr/bin.
+func ociKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func (x *XFile) unOCI(image *ociImage, layers []string) ([]string, error) {
+	tree := &ociTree{present: map[string]bool{}}
+
+	for idx, name := range layers {
+		member, ok := image.members[name]
+		if !ok {
+			return tree.list(), fmt.Errorf("%s: %w: missing layer %s", x.FilePath, ErrInvalidImage, name)
+		}
+
+		layer, err := ociDecompress(x.prog.reader(io.NewSectionReader(image.file, member.offset, member.size)))
+		if err != nil {
+			return tree.list(), fmt.Errorf("%s: layer %s: %w", x.FilePath, name, err)
+		}
+
+		err = x.applyOCILayer(layer, tree)
+		layer.Close()
+
+		if err != nil {
+			return tree.list(), fmt.Errorf("%s: layer %s: %w", x.FilePath, name, err)
+		}
+
+		x.Debugf("Applied image layer %d of %d: %s, total: %d files and %d bytes",
+			idx+1, len(layers), name, x.prog.Files, x.prog.Wrote)
+	}
+
+	return x.cleanup(tree.list())
+}
+
+// ociDecompress opens a layer, which may be a gzip, zstd or uncompressed tarball.
+func ociDecompress(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	magic, _ := buffered.Peek(4) //nolint:mnd
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+
+		return zipReader, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zipReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewReader: %w", err)
+		}
+
+		return zipReader.IOReadCloser(), nil
+	default:
+		return io.NopCloser(buffered), nil
+	}
+}
+
+// applyOCILayer writes one layer over the ones before it. A ".wh.name" file deletes
+// name from lower layers, and ".wh..wh..opq" empties its folder of lower-layer content.
+func (x *XFile) applyOCILayer(reader io.Reader, tree *ociTree) error {
+	tarReader := newTarStream(reader)
+	written := map[string]bool{} // paths from this layer, which an opaque whiteout keeps.
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("tarReader.Next: %w", err)
+		}
+
+		key := ociKey(header.Name)
+		dir, base := path.Split(key)
+
+		switch {
+		case key == "":
+			continue
+		case base == ociOpaqueWhiteout:
+			err = x.ociOpaque(strings.TrimSuffix(dir, "/"), written, tree)
+		case strings.HasPrefix(base, ociWhiteoutPrefix):
+			err = x.ociRemove(path.Join(dir, strings.TrimPrefix(base, ociWhiteoutPrefix)), tree)
+		default:
+			err = x.ociWrite(key, header, tarReader, tree)
+
+			for name := key; name != "."; name = path.Dir(name) {
+				written[name] = true
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ociWrite writes a layer entry, first removing a lower-layer entry of a different kind at its path.
+func (x *XFile) ociWrite(key string, header *tar.Header, tarReader *tarStream, tree *ociTree) error {
+	if info, err := os.Lstat(x.clean(key)); err == nil && info.IsDir() != (header.Typeflag == tar.TypeDir) {
+		if err := x.ociRemove(key, tree); err != nil {
+			return err
+		}
+	}
+
+	if tree.present[key] {
+		x.dropManifest(x.clean(key)) // the lower layer's file is replaced.
+	}
+
+	fSize, err := x.untarFile(header, tarReader)
+	if errors.Is(err, errSkipEntry) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tree.add(key)
+	x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+		key, fSize, x.prog.Files, x.prog.Wrote)
+
+	return nil
+}
+
+// ociRemove deletes a path written by a lower layer, and everything the layers wrote in it.
+// Files in the output folder that no layer wrote are kept, with the folders that hold them.
+func (x *XFile) ociRemove(key string, tree *ociTree) error {
+	target := x.clean(key)
+	if key == "" || key == "." || !x.pathWithinOutput(target) || !x.resolvedWithinOutput(filepath.Dir(target)) {
+		return fmt.Errorf("%w: %s (from whiteout: %s)", ErrInvalidPath, target, key)
+	}
+
+	removed := tree.remove(key)
+	if len(removed) > 0 && !slices.Contains(removed, key) {
+		removed = append(removed, key) // a folder made for the files in it, with no entry of its own.
+	}
+
+	// In reverse order, so the files in a folder go before it.
+	slices.Sort(removed)
+	slices.Reverse(removed)
+
+	for _, name := range removed {
+		path := x.clean(name)
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			if info, statErr := os.Lstat(path); statErr == nil && info.IsDir() {
+				x.Debugf("Kept image folder with files no layer wrote: %s", name)
+				continue
+			}
+
+			return fmt.Errorf("removing whiteout path: %w", err)
+		}
+
+		x.dropManifest(path)
+	}
+
+	x.Debugf("Removed image path: %s", key)
+
+	return nil
+}
+
+// ociOpaque removes everything in dir that lower layers wrote and the current layer did not.
+func (x *XFile) ociOpaque(dir string, written map[string]bool, tree *ociTree) error {
+	target := x.clean(dir)
+	if !x.pathWithinOutput(target) || !x.resolvedWithinOutput(target) {
+		return fmt.Errorf("%w: %s (from opaque whiteout: %s)", ErrInvalidPath, target, dir)
+	}
+
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
+	for _, name := range tree.list() {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok || !tree.present[name] { // removed with a folder before it.
+			continue
+		}
+
+		// The entry in dir this name is, or is in.
+		if child := prefix + strings.SplitN(rest, "/", 2)[0]; !written[child] { //nolint:mnd
+			if err := x.ociRemove(child, tree); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *ociTree) add(name string) {
+	if _, ok := t.present[name]; !ok {
+		t.names = append(t.names, name)
+	}
+
+	t.present[name] = true
+}
+
+// remove marks name and the paths in it deleted, and returns those that were present.
+func (t *ociTree) remove(name string) []string {
+	removed := []string{}
+
+	for _, existing := range t.names {
+		if t.present[existing] && (existing == name || strings.HasPrefix(existing, name+"/")) {
+			t.present[existing] = false
+			removed = append(removed, existing)
+		}
+	}
+
+	return removed
+}
+
+// list returns the paths still in the filesystem, in the order they were first written.
+func (t *ociTree) list() []string {
+	files := []string{}
+
+	for _, name := range t.names {
+		if t.present[name] {
+			files = append(files, name)
+		}
+	}
+
+	return files
+}
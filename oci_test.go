@@ -0,0 +1,199 @@
+package xtractr_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// Each layer changes the one below it. The top layer deletes old.txt and
+// replaces everything in opt/dir, so only y is left there.
+var testImageLayers = [][]testTarEntry{ //nolint:gochecknoglobals
+	{
+		{name: "etc/"}, {name: "etc/a.txt", data: "first"}, {name: "etc/old.txt", data: "old"},
+		{name: "opt/"}, {name: "opt/dir/"}, {name: "opt/dir/x", data: "x"}, {name: "opt/dir/sub/"},
+		{name: "opt/dir/sub/z", data: "z"}, {name: "bin", data: "file, later a folder"},
+	},
+	{
+		{name: "etc/a.txt", data: "second"}, {name: "etc/.wh.old.txt"},
+		{name: "opt/dir/"}, {name: "opt/dir/.wh..wh..opq"}, {name: "opt/dir/y", data: "y"},
+		{name: "bin/"}, {name: "bin/sh", data: "shell"},
+	},
+}
+
+func TestExtractOCIDocker(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "image.tar")
+	require.NoError(t, os.WriteFile(archive, testDockerImage(t, testImageLayers), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, FlattenImages: true}
+	_, files, _, err := xtractr.ExtractFile(xFile)
+	require.NoError(t, err)
+	testFlattenedImage(t, out, files)
+}
+
+// Whiteouts only remove what the layers wrote, and the manifest lists only the files left.
+func TestExtractOCIOutputFiles(t *testing.T) {
+	t.Parallel()
+
+	layers := append(slices.Clone(testImageLayers), []testTarEntry{{name: "etc/.wh.mine.txt"}, {name: "home/.wh.me"}})
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "image.tar")
+	require.NoError(t, os.WriteFile(archive, testDockerImage(t, layers), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	mine := []string{"etc/mine.txt", "opt/dir/mine.txt", "opt/dir/sub/mine.txt", "home/me/mine.txt"}
+
+	for _, name := range mine {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(out, name)), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(out, name), []byte("mine"), 0o600))
+	}
+
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, FlattenImages: true, Manifest: true,
+	}
+	_, _, _, err := xtractr.ExtractFile(xFile)
+	require.NoError(t, err)
+
+	for _, name := range mine {
+		assert.FileExists(t, filepath.Join(out, name))
+	}
+
+	assert.NoFileExists(t, filepath.Join(out, "opt/dir/x"))
+	assert.NoFileExists(t, filepath.Join(out, "opt/dir/sub/z"))
+
+	sums := map[string]string{}
+	for _, entry := range xFile.ManifestEntries {
+		rel, err := filepath.Rel(out, entry.Path)
+		require.NoError(t, err)
+
+		sums[filepath.ToSlash(rel)] = entry.SHA256
+	}
+
+	assert.Len(t, xFile.ManifestEntries, 3, "deleted and replaced files are not listed")
+	assert.Equal(t, map[string]string{
+		"etc/a.txt": sha256Hex("second"), "opt/dir/y": sha256Hex("y"), "bin/sh": sha256Hex("shell"),
+	}, sums)
+}
+
+func TestExtractOCILayout(t *testing.T) {
+	t.Parallel()
+
+	blobs := map[string]string{}
+	descriptors := []map[string]any{}
+
+	addBlob := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		blobs["blobs/sha256/"+hex.EncodeToString(sum[:])] = string(data)
+
+		return digest
+	}
+
+	for _, layer := range testImageLayers {
+		digest := addBlob(testCompress(t, "gz", testTar(t, layer...)))
+		descriptors = append(descriptors, map[string]any{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": digest,
+		})
+	}
+
+	manifest, err := json.Marshal(map[string]any{"schemaVersion": 2, "layers": descriptors})
+	require.NoError(t, err)
+
+	// index.json -> platform index -> manifest.
+	platforms, err := json.Marshal(map[string]any{"manifests": []map[string]any{{"digest": addBlob(manifest)}}})
+	require.NoError(t, err)
+
+	index, err := json.Marshal(map[string]any{"manifests": []map[string]any{{"digest": addBlob(platforms)}}})
+	require.NoError(t, err)
+
+	blobs["index.json"] = string(index)
+	blobs["oci-layout"] = `{"imageLayoutVersion":"1.0.0"}`
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "image.oci")
+	require.NoError(t, os.WriteFile(archive, testTar(t, testTarFiles(blobs)...), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, files, err := xtractr.ExtractOCI(&xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+	require.NoError(t, err)
+	testFlattenedImage(t, out, files)
+}
+
+func TestExtractOCIErrors(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "plain.tar")
+	require.NoError(t, os.WriteFile(archive, testTar(t, testTarFiles(map[string]string{"file.txt": "data"})...), 0o600))
+
+	_, _, err := xtractr.ExtractOCI(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")})
+	require.ErrorIs(t, err, xtractr.ErrInvalidImage)
+
+	// Without an image manifest, FlattenImages leaves tar extraction alone.
+	_, files, err := xtractr.ExtractTar(&xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(tmp, "tar"), FlattenImages: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file.txt"}, files)
+
+	evil := testTar(t, testTarEntry{name: "../evil.txt", data: "evil"})
+	manifest := `[{"Layers":["evil/layer.tar"]}]`
+	archive = filepath.Join(tmp, "evil.tar")
+	require.NoError(t, os.WriteFile(archive, testTar(t, testTarFiles(map[string]string{
+		"manifest.json": manifest, "evil/layer.tar": string(evil),
+	})...), 0o600))
+
+	_, _, err = xtractr.ExtractOCI(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "evil")})
+	require.ErrorIs(t, err, xtractr.ErrInvalidPath)
+}
+
+// testDockerImage writes layers into a tarball like `docker save` makes.
+func testDockerImage(t *testing.T, layers [][]testTarEntry) []byte {
+	t.Helper()
+
+	files := map[string]string{"config.json": "{}"}
+	names := []string{}
+
+	for idx, layer := range layers {
+		name := strings.Repeat(string(rune('a'+idx)), 8) + "/layer.tar"
+		files[name] = string(testTar(t, layer...))
+		names = append(names, name)
+	}
+
+	data, err := json.Marshal([]map[string]any{{"Config": "config.json", "RepoTags": []string{"test:latest"}, "Layers": names}})
+	require.NoError(t, err)
+
+	files["manifest.json"] = string(data)
+
+	return testTar(t, testTarFiles(files)...)
+}
+
+func testFlattenedImage(t *testing.T, out string, files []string) {
+	t.Helper()
+
+	for name, want := range map[string]string{"etc/a.txt": "second", "opt/dir/y": "y", "bin/sh": "shell"} {
+		data, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+
+	for _, name := range []string{"etc/old.txt", "etc/.wh.old.txt", "opt/dir/x", "opt/dir/sub", "opt/dir/.wh..wh..opq"} {
+		assert.NoFileExists(t, filepath.Join(out, name))
+		assert.NotContains(t, files, name)
+	}
+
+	assert.ElementsMatch(t, []string{"etc", "etc/a.txt", "opt", "opt/dir", "opt/dir/y", "bin", "bin/sh"}, files)
+}
@@ -0,0 +1,311 @@
+package xtractr
+
+/* Code to read the packets in PAR2 recovery files. */
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec // PAR2 is built on MD5.
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	par2Magic      = "PAR2\x00PKT"
+	par2HeaderSize = 64
+	// par2MaxPacket limits the packets read into memory. Recovery slices are read when they are used.
+	par2MaxPacket = 1 << 20
+	// par2FileDescSize is the size of a file description packet body without the file name.
+	par2FileDescSize = 56
+	// par2MainSize is the size of a main packet body without the file IDs.
+	par2MainSize = 12
+	// par2SliceSumSize is the size of each slice's MD5 and CRC32 in an IFSC packet.
+	par2SliceSumSize = 20
+	// par2ExponentSize is the size of the exponent that starts a recovery slice packet body.
+	par2ExponentSize = 4
+	// par2ScanSize is how much is read at a time while looking for the next packet after damage.
+	par2ScanSize = 64 * 1024
+)
+
+// PAR2 packet types.
+const (
+	par2MainType     = "PAR 2.0\x00Main\x00\x00\x00\x00"
+	par2FileDescType = "PAR 2.0\x00FileDesc"
+	par2IFSCType     = "PAR 2.0\x00IFSC\x00\x00\x00\x00"
+	par2RecvSlicType = "PAR 2.0\x00RecvSlic"
+)
+
+// par2Packet is a PAR2 packet with a valid MD5. Recovery slice packets are
+// not checked or read into body until they are used: see recovery().
+type par2Packet struct {
+	setID [16]byte
+	kind  string
+	body  []byte
+	// exponent is a recovery slice packet's exponent.
+	exponent uint32
+	// path, offset, size and sum locate and check a recovery slice packet.
+	path   string
+	offset int64
+	size   int64
+	sum    [16]byte
+}
+
+// par2File is a file described in a PAR2 file description packet.
+type par2File struct {
+	id   [16]byte
+	md5  [16]byte
+	size int64
+	name string
+	// slices has the MD5 of each slice of the file, from its IFSC packet.
+	slices [][16]byte
+}
+
+// par2Set is the packets of one PAR2 recovery set.
+type par2Set struct {
+	sliceSize int64
+	// fileIDs are the files the recovery slices were made from, in input slice order.
+	fileIDs  [][16]byte
+	files    map[[16]byte]*par2File
+	recovery map[uint32]*par2Packet
+}
+
+// readPar2Packets returns the packets of the wanted types in a PAR2 file. Other
+// packets, and packets that fail their MD5 check, are skipped. Damaged data
+// between packets is skipped too, like par2cmdline does.
+func readPar2Packets(path string, wanted ...string) ([]*par2Packet, error) {
+	par2, stat, err := openStatFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer par2.Close()
+
+	packets := []*par2Packet{}
+	header := make([]byte, par2HeaderSize)
+
+	for offset, end := int64(0), stat.Size(); offset+par2HeaderSize <= end; {
+		if _, err = par2.ReadAt(header, offset); err != nil {
+			return packets, fmt.Errorf("reading %s: %w", path, err)
+		}
+
+		size := binary.LittleEndian.Uint64(header[8:16])
+		if string(header[:8]) != par2Magic || size < par2HeaderSize || size%4 != 0 || size > uint64(end-offset) {
+			offset = findPar2Magic(par2, offset+1, end)
+			continue
+		}
+
+		packet := &par2Packet{kind: string(header[48:64]), path: path, offset: offset, size: int64(size)}
+		copy(packet.setID[:], header[32:48])
+		copy(packet.sum[:], header[16:32])
+
+		if offset += int64(size); !slices.Contains(wanted, packet.kind) {
+			continue
+		}
+
+		if err = packet.read(par2); err == nil {
+			packets = append(packets, packet)
+		}
+	}
+
+	return packets, nil
+}
+
+// read reads a packet's body, or a recovery slice packet's exponent.
+func (p *par2Packet) read(par2 io.ReaderAt) error {
+	if p.kind == par2RecvSlicType {
+		if p.size < par2HeaderSize+par2ExponentSize {
+			return ErrCorruptPAR2
+		}
+
+		exponent := make([]byte, par2ExponentSize)
+		if _, err := par2.ReadAt(exponent, p.offset+par2HeaderSize); err != nil {
+			return fmt.Errorf("reading par2 exponent: %w", err)
+		}
+
+		p.exponent = binary.LittleEndian.Uint32(exponent)
+
+		return nil
+	}
+
+	if p.size > par2MaxPacket {
+		return fmt.Errorf("%w: %d byte %s packet", ErrCorruptPAR2, p.size, strings.TrimRight(p.kind[8:], "\x00"))
+	}
+
+	body := make([]byte, p.size-par2HeaderSize)
+	if _, err := par2.ReadAt(body, p.offset+par2HeaderSize); err != nil {
+		return fmt.Errorf("reading par2 packet: %w", err)
+	}
+
+	if !p.valid(body) {
+		return ErrCorruptPAR2 // damaged packet; another volume probably has a copy.
+	}
+
+	p.body = body
+
+	return nil
+}
+
+// valid checks a packet's MD5.
+func (p *par2Packet) valid(body []byte) bool {
+	hash := md5.New() //nolint:gosec
+	hash.Write(p.setID[:])
+	hash.Write([]byte(p.kind))
+	hash.Write(body)
+
+	return bytes.Equal(hash.Sum(nil), p.sum[:])
+}
+
+// recovery reads and checks a recovery slice packet, and returns its recovery data.
+func (p *par2Packet) recovery() ([]byte, error) {
+	par2, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer par2.Close()
+
+	body := make([]byte, p.size-par2HeaderSize)
+	if _, err = par2.ReadAt(body, p.offset+par2HeaderSize); err != nil {
+		return nil, fmt.Errorf("reading par2 recovery slice: %w", err)
+	}
+
+	if !p.valid(body) {
+		return nil, fmt.Errorf("%w: recovery slice %d in %s", ErrCorruptPAR2, p.exponent, filepath.Base(p.path))
+	}
+
+	return body[par2ExponentSize:], nil
+}
+
+// findPar2Magic returns the offset of the next packet header at or after from, or end.
+func findPar2Magic(par2 io.ReaderAt, from, end int64) int64 {
+	chunk := make([]byte, par2ScanSize)
+
+	for ; from < end; from += par2ScanSize - int64(len(par2Magic)) + 1 {
+		size, _ := par2.ReadAt(chunk, from)
+		if idx := bytes.Index(chunk[:size], []byte(par2Magic)); idx >= 0 {
+			return from + int64(idx)
+		}
+
+		if size < len(chunk) {
+			break
+		}
+	}
+
+	return end
+}
+
+// parsePar2File parses a file description packet body.
+func parsePar2File(body []byte) *par2File {
+	if len(body) < par2FileDescSize {
+		return nil
+	}
+
+	file := &par2File{
+		size: int64(binary.LittleEndian.Uint64(body[48:56])), //nolint:gosec
+		name: string(bytes.TrimRight(body[par2FileDescSize:], "\x00")),
+	}
+	copy(file.id[:], body[:16])
+	copy(file.md5[:], body[16:32])
+
+	return file
+}
+
+// readPar2Files returns the files described in a PAR2 file.
+func readPar2Files(path string) ([]*par2File, error) {
+	packets, err := readPar2Packets(path, par2FileDescType)
+	files := make([]*par2File, 0, len(packets))
+
+	for _, packet := range packets {
+		if file := parsePar2File(packet.body); file != nil {
+			files = append(files, file)
+		}
+	}
+
+	return files, err
+}
+
+// readPar2Sets returns the recovery sets in the PAR2 files in a folder. A set's
+// packets are usually repeated in each of its files; the first valid copy is kept.
+func readPar2Sets(dir string) (map[[16]byte]*par2Set, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading par2 folder: %w", err)
+	}
+
+	sets := map[[16]byte]*par2Set{}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".par2") {
+			continue
+		}
+
+		packets, err := readPar2Packets(filepath.Join(dir, entry.Name()),
+			par2MainType, par2FileDescType, par2IFSCType, par2RecvSlicType)
+		if err != nil {
+			return sets, err
+		}
+
+		for _, packet := range packets {
+			if sets[packet.setID] == nil {
+				sets[packet.setID] = &par2Set{files: map[[16]byte]*par2File{}, recovery: map[uint32]*par2Packet{}}
+			}
+
+			sets[packet.setID].add(packet)
+		}
+	}
+
+	return sets, nil
+}
+
+// add adds a packet to a recovery set.
+func (s *par2Set) add(packet *par2Packet) {
+	switch packet.kind {
+	case par2MainType:
+		if len(packet.body) < par2MainSize || s.sliceSize != 0 {
+			return
+		}
+
+		count := int(binary.LittleEndian.Uint32(packet.body[8:12]))
+		if len(packet.body) < par2MainSize+count*16 { //nolint:mnd
+			return
+		}
+
+		s.sliceSize = int64(binary.LittleEndian.Uint64(packet.body[:8])) //nolint:gosec
+		for idx := range count {
+			s.fileIDs = append(s.fileIDs, [16]byte(packet.body[par2MainSize+idx*16:]))
+		}
+	case par2FileDescType:
+		if file := parsePar2File(packet.body); file != nil && s.file(file.id).name == "" {
+			file.slices = s.files[file.id].slices
+			s.files[file.id] = file
+		}
+	case par2IFSCType:
+		if len(packet.body) < 16 { //nolint:mnd
+			return
+		}
+
+		file := s.file([16]byte(packet.body))
+		if file.slices != nil {
+			return
+		}
+
+		for sums := packet.body[16:]; len(sums) >= par2SliceSumSize; sums = sums[par2SliceSumSize:] {
+			file.slices = append(file.slices, [16]byte(sums))
+		}
+	case par2RecvSlicType:
+		if s.recovery[packet.exponent] == nil {
+			s.recovery[packet.exponent] = packet
+		}
+	}
+}
+
+// file returns a file in the set, adding it if it is not there.
+func (s *par2Set) file(id [16]byte) *par2File {
+	if s.files[id] == nil {
+		s.files[id] = &par2File{id: id}
+	}
+
+	return s.files[id]
+}
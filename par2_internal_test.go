@@ -0,0 +1,357 @@
+package xtractr
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGF16(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, uint16(0x100B), gf().exp[16], "2^16 must wrap around the generator")
+	assert.Equal(t, []uint32{1, 2, 4, 7, 8, 11, 13, 14, 16, 19}, par2Bases(10))
+
+	for _, pair := range [][2]uint16{{1, 1}, {2, 3}, {0x8000, 0x100B}, {0xFFFF, 0x1234}, {777, 65000}} {
+		assert.Equal(t, pair[0], gfMul(gfDiv(pair[0], pair[1]), pair[1]), pair)
+	}
+
+	matrix := [][]uint16{{par2Factor(1, 0), par2Factor(2, 0)}, {par2Factor(1, 1), par2Factor(2, 1)}}
+	inverse, ok := gfInvert([][]uint16{slices.Clone(matrix[0]), slices.Clone(matrix[1])})
+	require.True(t, ok)
+
+	for row := range matrix {
+		for col := range matrix {
+			var sum uint16
+			for idx := range matrix {
+				sum ^= gfMul(matrix[row][idx], inverse[idx][col])
+			}
+
+			want := uint16(0)
+			if row == col {
+				want = 1
+			}
+
+			assert.Equal(t, want, sum, "the product must be the identity matrix")
+		}
+	}
+}
+
+// testPar2Packet returns a PAR2 packet.
+func testPar2Packet(setID [16]byte, kind string, body []byte) []byte {
+	hashed := append(append(append([]byte{}, setID[:]...), kind...), body...)
+	sum := md5.Sum(hashed) //nolint:gosec
+
+	packet := []byte(par2Magic)
+	packet = binary.LittleEndian.AppendUint64(packet, uint64(par2HeaderSize+len(body)))
+	packet = append(packet, sum[:]...)
+
+	return append(packet, hashed...)
+}
+
+// writeTestPar2 writes name.par2 with the descriptions of files in dir, and
+// name.vol.par2 with a recovery slice for each exponent, like par2create.
+func writeTestPar2(t *testing.T, dir, name string, sliceSize int, files []string, exponents []uint32) {
+	t.Helper()
+
+	ids := map[[16]byte]string{}
+	sorted := [][16]byte{}
+
+	for _, file := range files {
+		id := md5.Sum([]byte(file)) //nolint:gosec
+		ids[id] = file
+		sorted = append(sorted, id)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+
+	main := binary.LittleEndian.AppendUint64(nil, uint64(sliceSize))
+	main = binary.LittleEndian.AppendUint32(main, uint32(len(sorted)))
+
+	for _, id := range sorted {
+		main = append(main, id[:]...)
+	}
+
+	setID := md5.Sum(main) //nolint:gosec
+	index := testPar2Packet(setID, par2MainType, main)
+	recovery := make([][]byte, len(exponents))
+
+	for row := range recovery {
+		recovery[row] = make([]byte, sliceSize)
+	}
+
+	number := 0
+	bases := par2Bases(100)
+
+	for _, id := range sorted {
+		data, err := os.ReadFile(filepath.Join(dir, ids[id]))
+		require.NoError(t, err)
+
+		sum := md5.Sum(data) //nolint:gosec
+		desc := append(append(append([]byte{}, id[:]...), sum[:]...), make([]byte, 16)...)
+		desc = binary.LittleEndian.AppendUint64(desc, uint64(len(data)))
+		desc = append(desc, ids[id]...)
+		desc = append(desc, make([]byte, (4-len(ids[id])%4)%4)...)
+		ifsc := append([]byte{}, id[:]...)
+
+		for offset := 0; offset < len(data); offset += sliceSize {
+			slice := make([]byte, sliceSize)
+			copy(slice, data[offset:])
+
+			// The CRC32 after each slice's MD5 is not used.
+			sum := md5.Sum(slice) //nolint:gosec
+			ifsc = append(append(ifsc, sum[:]...), 0, 0, 0, 0)
+
+			for row, exponent := range exponents {
+				gfMulAdd(recovery[row], slice, par2Factor(bases[number], exponent))
+			}
+
+			number++
+		}
+
+		index = append(index, testPar2Packet(setID, par2FileDescType, desc)...)
+		index = append(index, testPar2Packet(setID, par2IFSCType, ifsc)...)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".par2"), index, 0o600))
+
+	volume := []byte("some damage to skip first")
+
+	for row, exponent := range exponents {
+		body := binary.LittleEndian.AppendUint32(nil, exponent)
+		volume = append(volume, testPar2Packet(setID, par2RecvSlicType, append(body, recovery[row]...))...)
+	}
+
+	volume = append(volume, index...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%s.vol00+%02d.par2", name, len(exponents))),
+		volume, 0o600))
+}
+
+func TestRepairPAR2(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	contents := map[string][]byte{
+		"a.bin":       bytes.Repeat([]byte("abcdefgh"), 60), // 480 bytes: 3.75 slices.
+		"b.bin":       []byte("one short slice"),
+		"sub/c.bin":   bytes.Repeat([]byte{0xfe, 0x01, 0x7f}, 100),
+		"empty.bin":   {},
+		"exact.bin":   bytes.Repeat([]byte{9}, 256),
+		"another.bin": []byte("yet another file"),
+	}
+	names := []string{}
+
+	for name, data := range contents {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+		names = append(names, name)
+	}
+
+	writeTestPar2(t, dir, "set", 128, names, []uint32{0, 1, 2, 3, 5})
+
+	repaired, err := RepairPAR2(dir, nil)
+	require.NoError(t, err)
+	assert.Empty(t, repaired, "nothing is damaged")
+
+	// Damage 4 slices: one in a.bin, all of b.bin, two of sub/c.bin (by truncating it), and
+	// lengthen exact.bin, which needs no slices. Remove empty.bin, which has none.
+	damaged := bytes.Clone(contents["a.bin"])
+	damaged[200] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.bin"), damaged, 0o600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "b.bin")))
+	require.NoError(t, os.Truncate(filepath.Join(dir, "sub", "c.bin"), 150))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "exact.bin"), append(contents["exact.bin"], 1), 0o600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "empty.bin")))
+
+	var last Progress
+
+	repaired, err = RepairPAR2(dir, func(p Progress) {
+		last = p
+		assert.Equal(t, dir, p.XFile.FilePath, "callbacks may read the XFile")
+	})
+	require.NoError(t, err)
+	assert.Len(t, repaired, 5)
+	assert.True(t, last.Done)
+	assert.Positive(t, last.Wrote)
+
+	for name, data := range contents {
+		written, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, data, written, name)
+	}
+
+	// 7 damaged slices are too many for 5 recovery slices.
+	require.NoError(t, os.Remove(filepath.Join(dir, "a.bin")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "sub", "c.bin")))
+
+	_, err = RepairPAR2(dir, nil)
+	require.ErrorIs(t, err, ErrPAR2Unrepairable)
+}
+
+// par2TestVolumes copies the multi-volume test archive into a folder with a PAR2 set for
+// it, and damages the second volume and removes the third. It returns the folder and
+// the number of volumes. other.bin is damaged too, and has a PAR2 set of its own.
+func par2TestVolumes(t *testing.T) (string, int) {
+	t.Helper()
+
+	dir := t.TempDir()
+	parts, err := filepath.Glob(filepath.Join("test_data", "multivol.part*.rar"))
+	require.NoError(t, err)
+
+	names := []string{}
+
+	for _, part := range parts {
+		data, err := os.ReadFile(part)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.Base(part)), data, 0o600))
+		names = append(names, filepath.Base(part))
+	}
+
+	writeTestPar2(t, dir, "multivol", 1024, names, []uint32{0, 1, 2, 3, 4, 5, 6})
+
+	second := filepath.Join(dir, "multivol.part2.rar")
+	data, err := os.ReadFile(second)
+	require.NoError(t, err)
+
+	for idx := 2048; idx < 2100; idx++ {
+		data[idx] ^= 0x55
+	}
+
+	require.NoError(t, os.WriteFile(second, data, 0o600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "multivol.part3.rar")))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.bin"), []byte("other file"), 0o600))
+	writeTestPar2(t, dir, "other", 64, []string{"other.bin"}, []uint32{0})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.bin"), []byte("damaged!!!"), 0o600))
+
+	return dir, len(parts)
+}
+
+func TestExtractRARRepairPAR2(t *testing.T) {
+	t.Parallel()
+
+	dir, volumes := par2TestVolumes(t)
+
+	_, _, _, err := ExtractRAR(&XFile{
+		FilePath: filepath.Join(dir, "multivol.part1.rar"), OutputDir: filepath.Join(dir, "fail"),
+		FileMode: 0o600, DirMode: 0o700, DisablePAR2Repair: true,
+	})
+	require.Error(t, err, "the damaged archive must not extract without repair")
+	require.True(t, rarDamaged(err), "the error must be recognized as damage: %v", err)
+
+	var updates []Progress
+
+	xFile := &XFile{
+		FilePath: filepath.Join(dir, "multivol.part1.rar"), OutputDir: filepath.Join(dir, "out"),
+		FileMode: 0o600, DirMode: 0o700, Progress: func(p Progress) { updates = append(updates, p) },
+	}
+
+	_, files, archives, err := ExtractRAR(xFile)
+	require.NoError(t, err)
+	assert.NotEmpty(t, files)
+	assert.Len(t, archives, volumes)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "multivol.part2.rar"), filepath.Join(dir, "multivol.part3.rar"),
+	}, xFile.Repaired)
+	assert.Len(t, xFile.Warnings, 2)
+
+	for _, update := range updates {
+		assert.Same(t, xFile, update.XFile)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "other.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "damaged!!!", string(data), "only the set for the archive is repaired")
+}
+
+type par2TestLogger struct{}
+
+func (par2TestLogger) Printf(string, ...any) {}
+func (par2TestLogger) Debugf(string, ...any) {}
+
+// The verify gate repairs what it can before it fails.
+func TestQueueVerifyRepairPAR2(t *testing.T) {
+	t.Parallel()
+
+	queue := NewQueue(&Config{Logger: par2TestLogger{}})
+	defer queue.Stop()
+
+	for _, disable := range []bool{true, false} {
+		dir, _ := par2TestVolumes(t)
+		xtract := &Xtract{
+			Filter:            Filter{Path: dir},
+			TempFolder:        true,
+			Verify:            VerifyFail,
+			DisablePAR2Repair: disable,
+			CBChannel:         make(chan *Response),
+		}
+
+		_, err := queue.Extract(xtract)
+		require.NoError(t, err)
+
+		for resp := range xtract.CBChannel {
+			if !resp.Done {
+				continue
+			}
+
+			if disable {
+				var sumErr *ChecksumError
+				require.ErrorAs(t, resp.Error, &sumErr)
+				assert.Empty(t, resp.Repaired)
+				assert.Empty(t, resp.NewFiles)
+
+				break
+			}
+
+			require.NoError(t, resp.Error)
+			assert.NotEmpty(t, resp.NewFiles)
+			assert.ElementsMatch(t, []string{
+				filepath.Join(dir, "multivol.part2.rar"), filepath.Join(dir, "multivol.part3.rar"), filepath.Join(dir, "other.bin"),
+			}, resp.Repaired, "every file that failed is repaired")
+
+			break
+		}
+	}
+}
+
+func TestRepairRAR(t *testing.T) {
+	t.Parallel()
+
+	dir, volumes := par2TestVolumes(t)
+	first := filepath.Join(dir, "multivol.part1.rar")
+
+	var updates []Progress
+
+	repaired, err := RepairRAR(first, func(p Progress) { updates = append(updates, p) })
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "multivol.part2.rar"), filepath.Join(dir, "multivol.part3.rar"),
+	}, repaired)
+	require.NotEmpty(t, updates)
+	assert.Equal(t, first, updates[0].XFile.FilePath)
+
+	data, err := os.ReadFile(filepath.Join(dir, "other.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "damaged!!!", string(data), "only the set for the archive is repaired")
+
+	xFile := &XFile{
+		FilePath: first, OutputDir: filepath.Join(dir, "out"), FileMode: 0o600, DirMode: 0o700, DisablePAR2Repair: true,
+	}
+
+	_, _, archives, err := ExtractRAR(xFile)
+	require.NoError(t, err)
+	assert.Len(t, archives, volumes)
+
+	repaired, err = RepairRAR(first, nil)
+	require.NoError(t, err)
+	assert.Empty(t, repaired, "nothing is left to repair")
+}
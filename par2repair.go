@@ -0,0 +1,523 @@
+package xtractr
+
+/* Code to repair files with PAR2 recovery slices: Reed-Solomon over GF(2^16). */
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec // PAR2 is built on MD5.
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	// gfLimit is the number of non-zero values in GF(2^16), and the period of its logs.
+	gfLimit = 65535
+	// gfGenerator is the field's generator polynomial: x^16 + x^12 + x^3 + x + 1.
+	gfGenerator = 0x1100B
+	// par2FileMode is the mode of files PAR2 repair has to create.
+	par2FileMode = 0o644
+)
+
+// gfTables has the log and anti-log tables for GF(2^16).
+type gfTables struct {
+	log [gfLimit + 1]uint32
+	exp [gfLimit + 1]uint16
+}
+
+// gf returns the GF(2^16) tables, made the first time they are needed.
+var gf = sync.OnceValue(func() *gfTables { //nolint:gochecknoglobals
+	tables, value := &gfTables{}, uint32(1)
+
+	for log := range uint32(gfLimit) {
+		tables.exp[log] = uint16(value)
+		tables.log[value] = log
+
+		if value <<= 1; value&(gfLimit+1) != 0 {
+			value ^= gfGenerator
+		}
+	}
+
+	return tables
+})
+
+func gfMul(a, b uint16) uint16 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	tables := gf()
+
+	return tables.exp[(tables.log[a]+tables.log[b])%gfLimit]
+}
+
+func gfDiv(a, b uint16) uint16 {
+	if a == 0 {
+		return 0
+	}
+
+	tables := gf()
+
+	return tables.exp[(tables.log[a]+gfLimit-tables.log[b])%gfLimit]
+}
+
+// gfMulAdd adds src multiplied by factor to dst, as little-endian 16-bit words.
+// Multiplication distributes over addition (xor), so each word is the sum of its
+// bytes' products, looked up in two 256 entry tables made for this factor.
+func gfMulAdd(dst, src []byte, factor uint16) {
+	if factor == 0 {
+		return
+	}
+
+	var low, high [256]uint16
+
+	for b := range uint16(256) { //nolint:mnd
+		low[b], high[b] = gfMul(factor, b), gfMul(factor, b<<8) //nolint:mnd
+	}
+
+	for idx := 0; idx+1 < len(src); idx += 2 {
+		product := low[src[idx]] ^ high[src[idx+1]]
+		dst[idx] ^= byte(product)
+		dst[idx+1] ^= byte(product >> 8) //nolint:mnd
+	}
+}
+
+// par2Bases returns the logs of the constants PAR2 gives its first count input
+// slices: the powers of 2 whose exponents are relatively prime to 65535.
+func par2Bases(count int) []uint32 {
+	bases := make([]uint32, 0, count)
+
+	for log := uint32(1); len(bases) < count; log++ {
+		if log%3 != 0 && log%5 != 0 && log%17 != 0 && log%257 != 0 {
+			bases = append(bases, log)
+		}
+	}
+
+	return bases
+}
+
+// par2Factor returns the factor input slice base is multiplied by in recovery slice exponent.
+func par2Factor(base, exponent uint32) uint16 {
+	return gf().exp[uint64(base)*uint64(exponent)%gfLimit]
+}
+
+// gfInvert inverts a square matrix with Gauss-Jordan elimination.
+func gfInvert(matrix [][]uint16) ([][]uint16, bool) {
+	size := len(matrix)
+	inverse := make([][]uint16, size)
+
+	for row := range inverse {
+		inverse[row] = make([]uint16, size)
+		inverse[row][row] = 1
+	}
+
+	for col := range size {
+		pivot := col
+		for pivot < size && matrix[pivot][col] == 0 {
+			pivot++
+		}
+
+		if pivot == size {
+			return nil, false
+		}
+
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfDiv(1, matrix[col][col])
+		for idx := range size {
+			matrix[col][idx] = gfMul(matrix[col][idx], scale)
+			inverse[col][idx] = gfMul(inverse[col][idx], scale)
+		}
+
+		for row := range size {
+			if factor := matrix[row][col]; row != col && factor != 0 {
+				for idx := range size {
+					matrix[row][idx] ^= gfMul(factor, matrix[col][idx])
+					inverse[row][idx] ^= gfMul(factor, inverse[col][idx])
+				}
+			}
+		}
+	}
+
+	return inverse, true
+}
+
+// RepairPAR2 checks the files described by the PAR2 files in a folder, and rebuilds
+// damaged and missing ones in place with their recovery slices. It returns the paths
+// of the files it repaired, and none when every file is intact. The error wraps
+// ErrPAR2Unrepairable when there are not enough recovery slices. A nil progress is
+// not called. Progress counts the bytes read in Read and written in Wrote, and its
+// XFile has dir in FilePath.
+func RepairPAR2(dir string, progress func(Progress)) ([]string, error) {
+	tracker := newTracker(&XFile{FilePath: dir}, progress)
+	defer tracker.done()
+
+	return repairPAR2Sets(dir, nil, tracker)
+}
+
+// repairPAR2 repairs the files in paths, in the folder of the archive, with the PAR2
+// sets that describe them. Progress is sent for x.
+func (x *XFile) repairPAR2(paths []string) ([]string, error) {
+	tracker := newTracker(x, progressFunc(x.Progress, x.Updates))
+	defer tracker.done()
+
+	return repairPAR2Sets(filepath.Dir(x.FilePath), paths, tracker)
+}
+
+// repairPAR2Sets repairs the recovery sets in dir that describe any of paths, or every
+// set when paths is empty. Sets for other files in the folder are not read past their
+// packets: their files are not checked or changed.
+func repairPAR2Sets(dir string, paths []string, tracker *progressTracker) ([]string, error) {
+	sets, err := readPar2Sets(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return repairDescribed(dir, sets, paths, tracker)
+}
+
+// repairDescribed repairs the sets that describe any of paths, or every set when paths is empty.
+func repairDescribed(
+	dir string, sets map[[16]byte]*par2Set, paths []string, tracker *progressTracker,
+) ([]string, error) {
+	repaired := []string{}
+	errs := []error{}
+
+	for _, id := range slices.SortedFunc(maps.Keys(sets), func(a, b [16]byte) int { return bytes.Compare(a[:], b[:]) }) {
+		if len(paths) > 0 && !sets[id].describes(dir, paths) {
+			continue
+		}
+
+		files, err := sets[id].repair(dir, tracker)
+		repaired = append(repaired, files...)
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return repaired, errors.Join(errs...)
+}
+
+// describes reports whether a recovery set has a file description for any of paths.
+func (s *par2Set) describes(dir string, paths []string) bool {
+	for _, file := range s.files {
+		if file.name == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(file.name))
+		if slices.ContainsFunc(paths, func(want string) bool { return filepath.Clean(want) == path }) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// par2Input is a file in a recovery set, and where its input slices are.
+type par2Input struct {
+	*par2File
+
+	path  string
+	first int // the file's first input slice number.
+	// bad are the file's damaged and missing slices. The file is damaged if it has bad
+	// slices or the wrong size.
+	bad     []int
+	damaged bool
+}
+
+// repair checks a recovery set's files, and rebuilds the damaged ones.
+func (s *par2Set) repair(dir string, tracker *progressTracker) ([]string, error) {
+	inputs, err := s.inputs(dir)
+	if err != nil || len(inputs) == 0 {
+		return nil, err
+	}
+
+	for _, input := range inputs {
+		tracker.mu.Lock()
+		tracker.Compressed += uint64(input.size) //nolint:gosec
+		tracker.mu.Unlock()
+	}
+
+	missing, damaged := []int{}, []*par2Input{}
+
+	for _, input := range inputs {
+		if input.check(s.sliceSize, tracker); input.damaged {
+			missing = append(missing, input.bad...)
+			damaged = append(damaged, input)
+		}
+	}
+
+	if len(damaged) == 0 {
+		return nil, nil
+	}
+
+	if len(missing) > 0 {
+		if err = s.rebuild(inputs, missing, tracker); err != nil {
+			return nil, err
+		}
+	}
+
+	repaired := make([]string, 0, len(damaged))
+
+	for _, input := range damaged {
+		if err = input.finish(); err != nil {
+			return repaired, err
+		}
+
+		repaired = append(repaired, input.path)
+	}
+
+	return repaired, nil
+}
+
+// inputs returns the files the set's recovery slices were made from, in input slice order.
+func (s *par2Set) inputs(dir string) ([]*par2Input, error) {
+	if s.sliceSize == 0 {
+		if len(s.files) == 0 {
+			return nil, nil // only recovery slices; their set is described in another folder.
+		}
+
+		return nil, fmt.Errorf("%w: main packet is missing", ErrCorruptPAR2)
+	}
+
+	if s.sliceSize%4 != 0 || s.sliceSize > par2MaxPacket*64 { //nolint:mnd
+		return nil, fmt.Errorf("%w: %d byte slices", ErrCorruptPAR2, s.sliceSize)
+	}
+
+	inputs, first := make([]*par2Input, 0, len(s.fileIDs)), 0
+
+	for _, id := range s.fileIDs {
+		file := s.files[id]
+		if file == nil || file.name == "" || int64(len(file.slices)) != (file.size+s.sliceSize-1)/s.sliceSize {
+			return nil, fmt.Errorf("%w: description of file %x is missing", ErrCorruptPAR2, id)
+		}
+
+		name := filepath.FromSlash(file.name)
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("%w: %s: %s", ErrCorruptPAR2, ErrInvalidPath, file.name)
+		}
+
+		inputs = append(inputs, &par2Input{par2File: file, path: filepath.Join(dir, name), first: first})
+		first += len(file.slices)
+	}
+
+	return inputs, nil
+}
+
+// check finds a file's damaged and missing slices.
+func (p *par2Input) check(sliceSize int64, tracker *progressTracker) {
+	file, stat, err := openStatFile(p.path)
+	if err != nil {
+		p.damaged = true
+		for idx := range p.slices {
+			p.bad = append(p.bad, p.first+idx)
+		}
+
+		return
+	}
+	defer file.Close()
+
+	p.damaged = stat.Size() != p.size
+	reader := tracker.readAter(file)
+	slice := make([]byte, sliceSize)
+
+	for idx, want := range p.slices {
+		if readSlice(reader, slice, int64(idx)*sliceSize, p.size) != nil || md5.Sum(slice) != want { //nolint:gosec
+			p.damaged = true
+			p.bad = append(p.bad, p.first+idx)
+		}
+	}
+}
+
+// readSlice reads the slice at offset of a file of size bytes, padded with zeros.
+func readSlice(reader io.ReaderAt, slice []byte, offset, size int64) error {
+	length := min(int64(len(slice)), size-offset)
+	clear(slice[length:])
+
+	_, err := reader.ReadAt(slice[:length], offset)
+	if err != nil {
+		return fmt.Errorf("reading slice: %w", err)
+	}
+
+	return nil
+}
+
+// rebuild solves for the missing input slices with as many recovery slices, and writes them.
+func (s *par2Set) rebuild(inputs []*par2Input, missing []int, tracker *progressTracker) error {
+	exponents, recovery := s.loadRecovery(len(missing), tracker)
+	if len(recovery) < len(missing) {
+		return fmt.Errorf("%w: %d slices are damaged or missing, and %d recovery slices are intact",
+			ErrPAR2Unrepairable, len(missing), len(recovery))
+	}
+
+	bases := par2Bases(inputs[len(inputs)-1].first + len(inputs[len(inputs)-1].slices))
+
+	// Take every intact input slice's part out of each recovery slice. What is left
+	// is the sum of the missing slices' parts: one equation for each recovery slice.
+	if err := s.subtractIntact(inputs, missing, bases, exponents, recovery, tracker); err != nil {
+		return err
+	}
+
+	matrix := make([][]uint16, len(missing))
+	for row, exponent := range exponents {
+		matrix[row] = make([]uint16, len(missing))
+		for col, slice := range missing {
+			matrix[row][col] = par2Factor(bases[slice], exponent)
+		}
+	}
+
+	inverse, ok := gfInvert(matrix)
+	if !ok {
+		return fmt.Errorf("%w: the recovery slices can not solve for the missing slices", ErrPAR2Unrepairable)
+	}
+
+	slice := make([]byte, s.sliceSize)
+
+	for row, number := range missing {
+		clear(slice)
+
+		for col := range recovery {
+			gfMulAdd(slice, recovery[col], inverse[row][col])
+		}
+
+		if err := writeSlice(inputs, number, slice, tracker); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadRecovery returns up to count intact recovery slices, and their exponents.
+func (s *par2Set) loadRecovery(count int, tracker *progressTracker) ([]uint32, [][]byte) {
+	exponents, recovery := []uint32{}, [][]byte{}
+
+	for _, exponent := range slices.Sorted(maps.Keys(s.recovery)) {
+		if len(recovery) == count {
+			break
+		}
+
+		data, err := s.recovery[exponent].recovery()
+		if err != nil || int64(len(data)) != s.sliceSize {
+			continue
+		}
+
+		tracker.mu.Lock()
+		tracker.Read += uint64(len(data))
+		tracker.mu.Unlock()
+
+		exponents = append(exponents, exponent)
+		recovery = append(recovery, data)
+	}
+
+	return exponents, recovery
+}
+
+// subtractIntact takes the intact input slices' parts out of the recovery slices.
+func (s *par2Set) subtractIntact(
+	inputs []*par2Input, missing []int, bases, exponents []uint32, recovery [][]byte, tracker *progressTracker,
+) error {
+	slice := make([]byte, s.sliceSize)
+
+	for _, input := range inputs {
+		if len(input.bad) == len(input.slices) {
+			continue
+		}
+
+		file, err := os.Open(input.path)
+		if err != nil {
+			return fmt.Errorf("os.Open: %w", err)
+		}
+
+		reader := tracker.readAter(file)
+
+		for idx := range input.slices {
+			number := input.first + idx
+			if slices.Contains(missing, number) {
+				continue
+			}
+
+			if err = readSlice(reader, slice, int64(idx)*s.sliceSize, input.size); err != nil {
+				file.Close()
+				return err
+			}
+
+			for row, exponent := range exponents {
+				gfMulAdd(recovery[row], slice, par2Factor(bases[number], exponent))
+			}
+		}
+
+		file.Close()
+	}
+
+	return nil
+}
+
+// writeSlice writes a rebuilt input slice into its file.
+func writeSlice(inputs []*par2Input, number int, slice []byte, tracker *progressTracker) error {
+	idx, _ := slices.BinarySearchFunc(inputs, number, func(input *par2Input, number int) int {
+		return input.first + len(input.slices) - 1 - number
+	})
+	input := inputs[idx]
+	offset := int64(number-input.first) * int64(len(slice))
+
+	err := os.MkdirAll(filepath.Dir(input.path), DefaultDirMode)
+	if err != nil {
+		return fmt.Errorf("making par2 file folder: %w", err)
+	}
+
+	file, err := os.OpenFile(input.path, os.O_WRONLY|os.O_CREATE, par2FileMode)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	defer file.Close()
+
+	size, err := file.WriteAt(slice[:min(int64(len(slice)), input.size-offset)], offset)
+
+	tracker.mu.Lock()
+	tracker.Wrote += uint64(size) //nolint:gosec
+	tracker.mu.Unlock()
+	tracker.send()
+
+	if err != nil {
+		return fmt.Errorf("writing repaired slice: %w", err)
+	}
+
+	return nil
+}
+
+// finish truncates a repaired file to its size, and checks it. Missing empty files are created.
+func (p *par2Input) finish() error {
+	if err := os.MkdirAll(filepath.Dir(p.path), DefaultDirMode); err != nil {
+		return fmt.Errorf("making par2 file folder: %w", err)
+	}
+
+	file, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, par2FileMode)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %w", err)
+	}
+	defer file.Close()
+
+	if err = file.Truncate(p.size); err != nil {
+		return fmt.Errorf("truncating repaired file: %w", err)
+	}
+
+	hash := md5.New() //nolint:gosec
+	if _, err = io.Copy(hash, file); err != nil {
+		return fmt.Errorf("reading repaired file: %w", err)
+	}
+
+	if !bytes.Equal(hash.Sum(nil), p.md5[:]) {
+		return fmt.Errorf("%w: %s does not match its checksum after repair", ErrPAR2Unrepairable, p.name)
+	}
+
+	return nil
+}
@@ -2,12 +2,14 @@ package xtractr_test
 
 import (
 	"archive/zip"
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync/atomic"
 	"testing"
 
+	"github.com/Unpackerr/iso9660"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golift.io/xtractr"
@@ -307,3 +309,40 @@ func TestProgressUpdatesChannel(t *testing.T) {
 
 	assert.True(t, gotDone, "should have received a Done progress update")
 }
+
+func TestParallelISOExtraction(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	writer, err := iso9660.NewWriter()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, writer.Cleanup()) }()
+
+	for fileIdx := range parallelFileCount {
+		content := generateTestContent(fileIdx, testContentSize)
+		require.NoError(t, writer.AddFile(bytes.NewReader(content), fmt.Sprintf("testdir/file_%03d.txt", fileIdx)))
+	}
+
+	isoPath := filepath.Join(tmpDir, "parallel_test.iso")
+	isoFile, err := os.Create(isoPath)
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteTo(isoFile, "parallel"))
+	require.NoError(t, isoFile.Close())
+
+	for _, workers := range []int{0, parallelWorkerCount} {
+		outDir := filepath.Join(tmpDir, fmt.Sprintf("out_%d", workers))
+
+		size, files, err := xtractr.ExtractISO(&xtractr.XFile{
+			FilePath:    isoPath,
+			OutputDir:   outDir,
+			FileMode:    0o600,
+			DirMode:     0o700,
+			FileWorkers: workers,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(parallelFileCount*testContentSize), size, "FileWorkers=%d", workers)
+		assert.Len(t, files, parallelFileCount, "FileWorkers=%d", workers)
+		verifyExtractedFiles(t, outDir)
+	}
+}
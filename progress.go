@@ -2,6 +2,7 @@ package xtractr
 
 import (
 	"fmt"
+	"hash"
 	"io"
 	"sync"
 )
@@ -27,7 +28,8 @@ type Progress struct {
 	Count int
 	// Done is set to true in the final progress update.
 	Done bool
-	// This is the input file. Do not modify the data.
+	// This is the input file. Do not modify the data. When checking or repairing
+	// downloads with VerifyChecksums or RepairPAR2, FilePath is the folder checked.
 	XFile *XFile
 	send  func()
 }
@@ -110,6 +112,7 @@ func (x *XFile) newProgress(total, compressed uint64, count int) *progressTracke
 	tracker.XFile = x
 	tracker.send = func() {}
 	x.prog = tracker
+	x.shared()
 
 	if x.Progress != nil {
 		tracker.send = func() {
@@ -126,6 +129,29 @@ func (x *XFile) newProgress(total, compressed uint64, count int) *progressTracke
 	return tracker
 }
 
+// newTracker returns a progress tracker for work that is not an extraction, like
+// checking and repairing downloads. The Progress it sends has xFile, which is never nil.
+func newTracker(xFile *XFile, progress func(Progress)) *progressTracker {
+	tracker := &progressTracker{}
+	tracker.XFile = xFile
+	tracker.send = func() {}
+
+	if progress != nil {
+		tracker.send = func() { progress(tracker.snapshot()) }
+	}
+
+	return tracker
+}
+
+// progressFunc returns a function that sends progress to updates or, without one, to progress.
+func progressFunc(progress func(Progress), updates chan Progress) func(Progress) {
+	if updates != nil {
+		return func(prog Progress) { updates <- prog }
+	}
+
+	return progress
+}
+
 // snapshot returns a copy of the Progress data, safe to send to callbacks/channels.
 func (p *progressTracker) snapshot() Progress {
 	p.mu.Lock()
@@ -152,10 +178,21 @@ type progressWrapper struct {
 	*progressTracker
 
 	parallel bool
+	// digest, if set, hashes everything written, for ManifestEntry.SHA256.
+	digest hash.Hash
+	// memberDigest, if set, hashes everything written with extractState.memberHash.
+	memberDigest hash.Hash
 }
 
 func (p *progressWrapper) Write(data []byte) (n int, err error) {
 	size, err := p.Writer.Write(data)
+	if p.digest != nil {
+		p.digest.Write(data[:size])
+	}
+
+	if p.memberDigest != nil {
+		p.memberDigest.Write(data[:size])
+	}
 
 	p.mu.Lock()
 	p.Wrote += uint64(size)
@@ -202,7 +239,7 @@ func (p *progressWrapper) ReadAt(data []byte, off int64) (n int, err error) {
 	return size, err //nolint:wrapcheck
 }
 
-func (p *progressTracker) writer(writer io.Writer) io.Writer {
+func (p *progressTracker) writer(writer io.Writer) *progressWrapper {
 	p.mu.Lock()
 	p.Files++
 	p.mu.Unlock()
@@ -210,7 +247,7 @@ func (p *progressTracker) writer(writer io.Writer) io.Writer {
 	return &progressWrapper{Writer: writer, progressTracker: p}
 }
 
-func (p *progressTracker) parallelWriter(writer io.Writer) io.Writer {
+func (p *progressTracker) parallelWriter(writer io.Writer) *progressWrapper {
 	p.mu.Lock()
 	p.Files++
 	p.mu.Unlock()
@@ -226,6 +263,10 @@ func (p *progressTracker) readAter(reader io.ReaderAt) io.ReaderAt {
 	return &progressWrapper{ReaderAt: reader, progressTracker: p}
 }
 
+func (p *progressTracker) parallelReadAter(reader io.ReaderAt) io.ReaderAt {
+	return &progressWrapper{ReaderAt: reader, progressTracker: p, parallel: true}
+}
+
 func (p *progressTracker) done() {
 	p.Done = true
 	p.send()
@@ -3,9 +3,12 @@ package xtractr
 /* This file contains methods that support the extract queuing system. */
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -30,6 +33,51 @@ type Xtract struct {
 	// Set RecurseISO to true if you want to recursively extract archives in ISO files.
 	// If ISOs and other archives are found, none will not extract recursively if this is false.
 	RecurseISO bool
+	// Set WIMImage to the image index to extract from WIM and ESD files, starting at 1.
+	// 0 extracts every image, each into a numbered subfolder when there is more than one.
+	WIMImage int
+	// Set FlattenImages to true to extract container image tarballs (docker save or
+	// OCI layout) as one root filesystem instead of a folder of layer tarballs.
+	FlattenImages bool
+	// Set RPMMetadata to true to write each RPM package's header as JSON into the output,
+	// verify extracted files against it, and return it in Response.RPMPackages.
+	RPMMetadata bool
+	// Set ISOBoot to true to write ISO boot images and partitions appended to hybrid
+	// ISOs into a [BOOT] folder. Partitions are listed in Response.ISOPartitions either way.
+	ISOBoot bool
+	// Set UDFAttributes to true to restore owners, setuid, setgid and sticky bits, and
+	// named streams (as extended attributes on Linux) from UDF images.
+	UDFAttributes bool
+	// Set NameEncoding to the character set of member names that are not UTF-8, like
+	// "IBM866", when detection guesses wrong. Use DetectNameEncoding to list candidates.
+	NameEncoding string
+	// Set NameSanitizer to rename files the output folder's file system would reject,
+	// like WindowsSafeName for NTFS or SMB. Renames are listed in Response.Warnings.
+	NameSanitizer func(name string) string
+	// Set NameForm to NameFormNFC to write the decomposed names in archives made on
+	// macOS the way Linux software writes them (or to NameFormNFD for the reverse).
+	NameForm NameForm
+	// Set PreserveOwnership to restore archived owners when running as root, and
+	// PreserveXattrs to restore extended attributes and POSIX ACLs from tarballs.
+	PreserveOwnership bool
+	PreserveXattrs    bool
+	// Set SparseFiles to write runs of zeros as holes in sparse files.
+	SparseFiles bool
+	// SpecialFilePolicy is for device nodes, FIFOs and sockets; they are skipped by default.
+	SpecialFilePolicy SpecialFilePolicy
+	// SetuidPolicy is for setuid and setgid bits; they are removed by default.
+	SetuidPolicy SetuidPolicy
+	// LinkPolicy says how to write symlinks and hard links; they are created by default.
+	LinkPolicy LinkPolicy
+	// Verify checks the files listed in .sfv, .md5, .sha1, .sha256, .sha and .par2 files
+	// next to the archives before extracting any, and warns or fails if some do not match
+	// and can not be repaired.
+	// Progress updates for the files read have the folder checked in XFile.FilePath.
+	Verify VerifyPolicy
+	// Damaged and missing RAR volumes, and files that fail Verify, are repaired in place
+	// with the PAR2 sets that describe them. See Response.Repaired. Set DisablePAR2Repair
+	// to leave them alone.
+	DisablePAR2Repair bool
 	// Folder to extract data. Default is same level as SearchPath with a suffix.
 	ExtractTo string
 	// Leave files in temporary folder? false=move files back to Filter.Path
@@ -39,6 +87,11 @@ type Xtract struct {
 	DeleteOrig bool
 	// Create a log (.txt) file of the extraction information.
 	LogFile bool
+	// Manifest hashes each file as it is written, lists them in Response.Manifest, and
+	// writes the list to a .manifest.json file in the output folder, like the LogFile.
+	Manifest bool
+	// ManifestSums also writes the hashes to a .sha256 file that `sha256sum -c` can check.
+	ManifestSums bool
 	// Callback Function, runs twice per queued item.
 	CBFunction func(*Response)
 	// Callback Channel, msg sent twice per queued item.
@@ -80,6 +133,18 @@ type Response struct {
 	// SkipOnRecursion lists paths that extractors copied into output (e.g. CUE sheet)
 	// and must not be re-extracted when recursing. Other files (e.g. CUE from a RAR) are still extracted.
 	SkipOnRecursion []string
+	// DebPackages has the parsed control file of each Debian package extracted.
+	DebPackages []*DebControl
+	// RPMPackages has the header metadata of each RPM package extracted with XFile.RPMMetadata.
+	RPMPackages []*RPMPackage
+	// ISOPartitions has the MBR or GPT partitions of each hybrid ISO extracted.
+	ISOPartitions []*ISOPartition
+	// Warnings has non-fatal messages from extraction, like files renamed by NameSanitizer.
+	Warnings []string
+	// Repaired lists the files repaired with PAR2 files. See Xtract.DisablePAR2Repair.
+	Repaired []string
+	// Manifest lists the files written with Xtract.Manifest, with paths relative to Output.
+	Manifest []ManifestEntry
 	// Error encountered, only when done=true.
 	Error error
 	// Copied from input data.
@@ -164,6 +229,10 @@ func (x *Xtractr) extract(ext *Xtract) {
 func (x *Xtractr) decompressFolders(resp *Response) error {
 	allArchives := make(ArchiveList)
 
+	if err := x.verifyChecksums(resp); err != nil {
+		return err
+	}
+
 	for subDir := range resp.Archives {
 		output := resp.Output
 		if resp.X.TempFolder {
@@ -177,17 +246,34 @@ func (x *Xtractr) decompressFolders(resp *Response) error {
 					Path:          subDir,
 					ExcludeSuffix: resp.X.ExcludeSuffix,
 				},
-				Name:             resp.X.Name,
-				Password:         resp.X.Password,
-				Passwords:        resp.X.Passwords,
-				DisableRecursion: resp.X.DisableRecursion,
-				RecurseISO:       resp.X.RecurseISO,
-				ExtractTo:        resp.X.ExtractTo,
-				DeleteOrig:       resp.X.DeleteOrig,
-				TempFolder:       resp.X.TempFolder,
-				LogFile:          resp.X.LogFile,
-				Updates:          resp.X.Updates,
-				Progress:         resp.X.Progress,
+				Name:              resp.X.Name,
+				Password:          resp.X.Password,
+				Passwords:         resp.X.Passwords,
+				DisableRecursion:  resp.X.DisableRecursion,
+				RecurseISO:        resp.X.RecurseISO,
+				WIMImage:          resp.X.WIMImage,
+				FlattenImages:     resp.X.FlattenImages,
+				RPMMetadata:       resp.X.RPMMetadata,
+				ISOBoot:           resp.X.ISOBoot,
+				UDFAttributes:     resp.X.UDFAttributes,
+				NameEncoding:      resp.X.NameEncoding,
+				NameSanitizer:     resp.X.NameSanitizer,
+				NameForm:          resp.X.NameForm,
+				PreserveOwnership: resp.X.PreserveOwnership,
+				PreserveXattrs:    resp.X.PreserveXattrs,
+				SparseFiles:       resp.X.SparseFiles,
+				SpecialFilePolicy: resp.X.SpecialFilePolicy,
+				SetuidPolicy:      resp.X.SetuidPolicy,
+				LinkPolicy:        resp.X.LinkPolicy,
+				DisablePAR2Repair: resp.X.DisablePAR2Repair,
+				ExtractTo:         resp.X.ExtractTo,
+				DeleteOrig:        resp.X.DeleteOrig,
+				TempFolder:        resp.X.TempFolder,
+				LogFile:           resp.X.LogFile,
+				Manifest:          resp.X.Manifest,
+				ManifestSums:      resp.X.ManifestSums,
+				Updates:           resp.X.Updates,
+				Progress:          resp.X.Progress,
 			},
 			Started:  resp.Started,
 			Output:   output,
@@ -196,6 +282,12 @@ func (x *Xtractr) decompressFolders(resp *Response) error {
 
 		err := x.decompressFiles(subResp)
 		resp.NewFiles = append(resp.NewFiles, subResp.NewFiles...)
+		resp.DebPackages = append(resp.DebPackages, subResp.DebPackages...)
+		resp.RPMPackages = append(resp.RPMPackages, subResp.RPMPackages...)
+		resp.ISOPartitions = append(resp.ISOPartitions, subResp.ISOPartitions...)
+		resp.Warnings = append(resp.Warnings, subResp.Warnings...)
+		resp.Repaired = append(resp.Repaired, subResp.Repaired...)
+		resp.Manifest = append(resp.Manifest, manifestIn(resp.Output, subResp.Output, subResp.Manifest)...)
 		resp.Size += subResp.Size
 
 		if err != nil {
@@ -216,6 +308,87 @@ func (x *Xtractr) decompressFolders(resp *Response) error {
 	return nil
 }
 
+// verifyChecksums applies Xtract.Verify to the folders with archives in them, before any are extracted.
+func (x *Xtractr) verifyChecksums(resp *Response) error {
+	if resp.X.Verify == VerifyOff {
+		return nil
+	}
+
+	dirs := []string{}
+
+	for _, archives := range resp.Archives {
+		for _, archive := range archives {
+			if dir := filepath.Dir(archive); !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	slices.Sort(dirs)
+
+	failed := &ChecksumError{}
+
+	for _, dir := range dirs {
+		sums, err := VerifyChecksums(dir, progressFunc(resp.X.Progress, resp.X.Updates))
+		x.config.Debugf("Verified %d checksums in %s: %v", len(sums), dir, err)
+
+		var sumErr *ChecksumError
+
+		if errors.As(err, &sumErr) && !resp.X.DisablePAR2Repair && x.repairChecksums(resp, dir, sumErr.Failed) {
+			sums, err = VerifyChecksums(dir, progressFunc(resp.X.Progress, resp.X.Updates))
+			x.config.Debugf("Verified %d checksums in %s after repair: %v", len(sums), dir, err)
+		}
+
+		switch {
+		case errors.As(err, &sumErr):
+			failed.Failed = append(failed.Failed, sumErr.Failed...)
+		case err != nil && resp.X.Verify == VerifyFail:
+			return fmt.Errorf("verifying checksums: %w", err)
+		case err != nil:
+			resp.Warnings = append(resp.Warnings, fmt.Sprintf("verifying checksums: %v", err))
+		}
+	}
+
+	if len(failed.Failed) == 0 {
+		return nil
+	}
+
+	if resp.X.Verify == VerifyFail {
+		return failed
+	}
+
+	for _, sum := range failed.Failed {
+		resp.Warnings = append(resp.Warnings, "checksum failed: "+sum.String())
+	}
+
+	return nil
+}
+
+// repairChecksums repairs the files that failed their checksums with the PAR2 sets
+// that describe them, and reports whether any were repaired.
+func (x *Xtractr) repairChecksums(resp *Response, dir string, failed []*Checksum) bool {
+	paths := make([]string, len(failed))
+	for idx, sum := range failed {
+		paths[idx] = sum.Path
+	}
+
+	tracker := newTracker(&XFile{FilePath: dir}, progressFunc(resp.X.Progress, resp.X.Updates))
+	repaired, err := repairPAR2Sets(dir, paths, tracker)
+	tracker.done()
+
+	if err != nil {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("repairing with par2: %v", err))
+	}
+
+	for _, path := range repaired {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("repaired %s with par2", filepath.Base(path)))
+	}
+
+	resp.Repaired = append(resp.Repaired, repaired...)
+
+	return len(repaired) > 0
+}
+
 func (x *Xtractr) finishExtract(resp *Response, err error) {
 	if resp.X.TempFolder {
 		x.cleanTempFolder(resp)
@@ -317,10 +490,26 @@ func (x *Xtractr) decompressFiles(resp *Response) error {
 	resp.Extras = excludePathsFromArchiveList(resp.Extras, resp.SkipOnRecursion)
 	nre := &Response{
 		X: &Xtract{
-			Password:  resp.X.Password,
-			Passwords: resp.X.Passwords,
-			Progress:  resp.X.Progress,
-			Updates:   resp.X.Updates,
+			Password:          resp.X.Password,
+			Passwords:         resp.X.Passwords,
+			WIMImage:          resp.X.WIMImage,
+			FlattenImages:     resp.X.FlattenImages,
+			RPMMetadata:       resp.X.RPMMetadata,
+			ISOBoot:           resp.X.ISOBoot,
+			UDFAttributes:     resp.X.UDFAttributes,
+			NameEncoding:      resp.X.NameEncoding,
+			NameSanitizer:     resp.X.NameSanitizer,
+			NameForm:          resp.X.NameForm,
+			PreserveOwnership: resp.X.PreserveOwnership,
+			PreserveXattrs:    resp.X.PreserveXattrs,
+			SparseFiles:       resp.X.SparseFiles,
+			SpecialFilePolicy: resp.X.SpecialFilePolicy,
+			SetuidPolicy:      resp.X.SetuidPolicy,
+			LinkPolicy:        resp.X.LinkPolicy,
+			DisablePAR2Repair: resp.X.DisablePAR2Repair,
+			Manifest:          resp.X.Manifest,
+			Progress:          resp.X.Progress,
+			Updates:           resp.X.Updates,
 		},
 		Started:  resp.Started,
 		Output:   resp.Output,
@@ -330,6 +519,12 @@ func (x *Xtractr) decompressFiles(resp *Response) error {
 	// Combine the new Response with the existing response.
 	resp.Extras = nre.Archives
 	resp.Size += nre.Size
+	resp.DebPackages = append(resp.DebPackages, nre.DebPackages...)
+	resp.RPMPackages = append(resp.RPMPackages, nre.RPMPackages...)
+	resp.ISOPartitions = append(resp.ISOPartitions, nre.ISOPartitions...)
+	resp.Warnings = append(resp.Warnings, nre.Warnings...)
+	resp.Repaired = append(resp.Repaired, nre.Repaired...)
+	resp.Manifest = append(resp.Manifest, nre.Manifest...)
 
 	if nre.NewFiles != nil {
 		resp.NewFiles = append(resp.NewFiles, nre.NewFiles...)
@@ -382,16 +577,32 @@ func (x *Xtractr) processArchive(filename string, resp *Response) (uint64, []str
 	x.config.Debugf("Extracting File: %v to %v", filename, resp.Output)
 
 	xFile := &XFile{
-		FilePath:    filename,
-		OutputDir:   resp.Output,
-		FileMode:    x.config.FileMode,
-		DirMode:     x.config.DirMode,
-		Passwords:   resp.X.Passwords,
-		Password:    resp.X.Password,
-		FileWorkers: x.config.FileWorkers,
-		log:         x.config.Logger,
-		Updates:     resp.X.Updates,
-		Progress:    resp.X.Progress,
+		FilePath:          filename,
+		OutputDir:         resp.Output,
+		FileMode:          x.config.FileMode,
+		DirMode:           x.config.DirMode,
+		Passwords:         resp.X.Passwords,
+		Password:          resp.X.Password,
+		FileWorkers:       x.config.FileWorkers,
+		RPMMetadata:       resp.X.RPMMetadata,
+		WIMImage:          resp.X.WIMImage,
+		FlattenImages:     resp.X.FlattenImages,
+		ISOBoot:           resp.X.ISOBoot,
+		UDFAttributes:     resp.X.UDFAttributes,
+		NameEncoding:      resp.X.NameEncoding,
+		NameSanitizer:     resp.X.NameSanitizer,
+		NameForm:          resp.X.NameForm,
+		PreserveOwnership: resp.X.PreserveOwnership,
+		PreserveXattrs:    resp.X.PreserveXattrs,
+		SparseFiles:       resp.X.SparseFiles,
+		SpecialFilePolicy: resp.X.SpecialFilePolicy,
+		SetuidPolicy:      resp.X.SetuidPolicy,
+		LinkPolicy:        resp.X.LinkPolicy,
+		DisablePAR2Repair: resp.X.DisablePAR2Repair,
+		Manifest:          resp.X.Manifest,
+		log:               x.config.Logger,
+		Updates:           resp.X.Updates,
+		Progress:          resp.X.Progress,
 	}
 
 	bytes, files, archives, err := ExtractFile(xFile)
@@ -404,6 +615,19 @@ func (x *Xtractr) processArchive(filename string, resp *Response) (uint64, []str
 		resp.SkipOnRecursion = append(resp.SkipOnRecursion, xFile.SkipOnRecursion...)
 	}
 
+	if xFile.DebControl != nil {
+		resp.DebPackages = append(resp.DebPackages, xFile.DebControl)
+	}
+
+	if xFile.RPMPackage != nil {
+		resp.RPMPackages = append(resp.RPMPackages, xFile.RPMPackage)
+	}
+
+	resp.ISOPartitions = append(resp.ISOPartitions, xFile.ISOPartitions...)
+	resp.Warnings = append(resp.Warnings, xFile.Warnings...)
+	resp.Repaired = append(resp.Repaired, xFile.Repaired...)
+	resp.Manifest = append(resp.Manifest, manifestIn(resp.Output, "", xFile.ManifestEntries)...)
+
 	return bytes, files, archives, nil
 }
 
@@ -412,6 +636,10 @@ func (x *Xtractr) cleanupProcessedArchives(resp *Response) error {
 		x.createLogFile(resp)
 	}
 
+	if resp.X.Manifest {
+		x.createManifest(resp)
+	}
+
 	if resp.X.DeleteOrig {
 		// as requested
 		x.deleteOriginals(resp)
@@ -457,6 +685,55 @@ func (x *Xtractr) createLogFile(resp *Response) {
 	}
 }
 
+// createManifest writes Response.Manifest to a JSON file, and with ManifestSums, a sha256sum file.
+func (x *Xtractr) createManifest(resp *Response) {
+	name := filepath.Join(resp.Output, x.config.Suffix+"."+filepath.Base(resp.X.Path))
+
+	data, err := json.MarshalIndent(resp.Manifest, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("encoding manifest: %w", err)
+	} else {
+		err = writeExtractFile(name+".manifest.json", append(data, '\n'), x.config.FileMode)
+	}
+
+	if err != nil {
+		x.config.Printf("Error: Creating Manifest File: %v", err)
+	} else {
+		resp.NewFiles = append(resp.NewFiles, name+".manifest.json")
+	}
+
+	if !resp.X.ManifestSums {
+		return
+	}
+
+	if err = writeExtractFile(name+".sha256", sha256Sums(resp.Manifest), x.config.FileMode); err != nil {
+		x.config.Printf("Error: Creating Manifest Checksum File: %v", err)
+	} else {
+		resp.NewFiles = append(resp.NewFiles, name+".sha256")
+	}
+}
+
+// manifestIn returns entries with their paths made relative to base, after
+// joining them to prefix when they are relative to a folder below base.
+func manifestIn(base, prefix string, entries []ManifestEntry) []ManifestEntry {
+	moved := make([]ManifestEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		path := entry.Path
+		if prefix != "" {
+			path = filepath.Join(prefix, path)
+		}
+
+		if rel, err := filepath.Rel(base, path); err == nil {
+			entry.Path = rel
+		}
+
+		moved = append(moved, entry)
+	}
+
+	return moved
+}
+
 func (x *Xtractr) deleteOriginals(resp *Response) {
 	for _, archives := range resp.Archives {
 		x.DeleteFiles(archives...)
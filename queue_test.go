@@ -220,3 +220,33 @@ done:
 		assert.NoFileExists(t, part, "volume %s should have been deleted", filepath.Base(part))
 	}
 }
+
+func TestQueuePackageMetadata(t *testing.T) {
+	t.Parallel()
+
+	queue := xtractr.NewQueue(&xtractr.Config{Logger: &testLogger{t: t}})
+	defer queue.Stop()
+
+	dir := t.TempDir()
+	writeTestDeb(t, filepath.Join(dir, "hello.deb"), "gz")
+
+	xFile := &xtractr.Xtract{
+		Filter:    xtractr.Filter{Path: dir},
+		CBChannel: make(chan *xtractr.Response),
+	}
+
+	_, err := queue.Extract(xFile)
+	require.NoError(t, err)
+
+	for resp := range xFile.CBChannel {
+		if !resp.Done {
+			continue
+		}
+
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.DebPackages, 1, "package metadata must reach the queue response")
+		assert.Equal(t, "hello", resp.DebPackages[0].Package)
+
+		break
+	}
+}
@@ -6,14 +6,80 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/nwaples/rardecode/v2"
 )
 
-// ExtractRAR attempts to extract a file as a rar file.
+// ExtractRAR attempts to extract a file as a rar file. When extraction fails on damaged
+// or missing data, the volumes are repaired with the PAR2 set next to the archive that
+// describes them, and the extraction is tried again, unless DisablePAR2Repair is set.
+// If it still fails, volumes with a recovery record are listed in Warnings: see RepairRAR.
 func ExtractRAR(xFile *XFile) (size uint64, filesList, archiveList []string, err error) {
+	size, filesList, archiveList, err = extractRARRepair(xFile)
+	if err != nil && rarDamaged(err) {
+		xFile.warnRecoveryRecord(archiveList)
+	}
+
+	return size, filesList, archiveList, err
+}
+
+// extractRARRepair extracts a rar file, and extracts it again after repairing it with PAR2 files.
+func extractRARRepair(xFile *XFile) (size uint64, filesList, archiveList []string, err error) {
+	manifest := xFile.ManifestEntries
+
+	size, filesList, archiveList, err = extractRARPasswords(xFile)
+	if err == nil || xFile.DisablePAR2Repair || !rarDamaged(err) {
+		return size, filesList, archiveList, err
+	}
+
+	xFile.Debugf("Repairing %s with PAR2 files after: %v", xFile.FilePath, err)
+
+	// The volumes opened before the error, and the first one, which a missing volume stops at.
+	repaired, repairErr := xFile.repairPAR2(append(slices.Clone(archiveList), xFile.FilePath))
+	if repairErr != nil {
+		return size, filesList, archiveList, fmt.Errorf("%w; repairing with par2: %w", err, repairErr)
+	}
+
+	if len(repaired) == 0 {
+		return size, filesList, archiveList, err // the par2 files say nothing is damaged.
+	}
+
+	for _, path := range repaired {
+		xFile.warn("repaired %s with par2", filepath.Base(path))
+	}
+
+	// Start over; the files written by the failed attempt are overwritten.
+	xFile.Repaired = append(xFile.Repaired, repaired...)
+	xFile.ManifestEntries = manifest
+	xFile.state = nil
+
+	return extractRARPasswords(xFile)
+}
+
+// rarDamaged reports whether a rar extraction error is from damaged or missing data.
+func rarDamaged(err error) bool {
+	for _, damaged := range []error{
+		rardecode.ErrBadFileChecksum, rardecode.ErrBadHeaderCRC, rardecode.ErrCorruptBlockHeader,
+		rardecode.ErrCorruptFileHeader, rardecode.ErrCorruptDecodeHeader, rardecode.ErrDecoderOutOfData,
+		rardecode.ErrShortFile, rardecode.ErrUnexpectedArcEnd, rardecode.ErrInvalidFileBlock,
+		rardecode.ErrBadVolumeNumber, rardecode.ErrNoSig, rardecode.ErrHuffDecodeFailed,
+		rardecode.ErrInvalidLengthTable, rardecode.ErrCorruptPPM, io.ErrUnexpectedEOF, fs.ErrNotExist,
+	} {
+		if errors.Is(err, damaged) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractRARPasswords extracts a rar file, trying each password.
+func extractRARPasswords(xFile *XFile) (uint64, []string, []string, error) {
 	if len(xFile.Passwords) == 0 && xFile.Password == "" {
 		return extractRAR(xFile)
 	}
@@ -28,11 +94,11 @@ func ExtractRAR(xFile *XFile) (size uint64, filesList, archiveList []string, err
 	for idx, password := range passwords {
 		// Copy the input so the retry keeps the logger, progress callbacks,
 		// SquashRoot and the rest of the caller-provided configuration.
-		attempt := *xFile
-		attempt.Password = password
+		attempt := xFile.retry(password)
 
-		size, files, archives, err := extractRAR(&attempt)
+		size, files, archives, err := extractRAR(attempt)
 		if err == nil {
+			xFile.Warnings, xFile.ManifestEntries = attempt.Warnings, attempt.ManifestEntries
 			return size, files, archives, nil
 		}
 
@@ -41,14 +107,18 @@ func ExtractRAR(xFile *XFile) (size uint64, filesList, archiveList []string, err
 			continue
 		}
 
+		xFile.Warnings, xFile.ManifestEntries = attempt.Warnings, attempt.ManifestEntries
+
 		return size, files, archives, fmt.Errorf("used password %d of %d: %w", idx+1, len(passwords), err)
 	}
 
 	// No password worked, try without a password.
-	attempt := *xFile
-	attempt.Password = ""
+	attempt := xFile.retry("")
+
+	size, files, archives, err := extractRAR(attempt)
+	xFile.Warnings, xFile.ManifestEntries = attempt.Warnings, attempt.ManifestEntries
 
-	return extractRAR(&attempt)
+	return size, files, archives, err
 }
 
 // extractRAR extracts a rar file. to a destination. This wraps github.com/nwaples/rardecode.
@@ -98,6 +168,8 @@ func getUncompressedRarSize(rarReader *rardecode.ReadCloser) (total, compressed
 
 func (x *XFile) unrar(rarReader *rardecode.ReadCloser) ([]string, error) {
 	files := []string{}
+	names := newNameDecoders(x, "rar")
+	owners := newRAROwners()
 
 	for {
 		header, err := rarReader.Next()
@@ -109,14 +181,25 @@ func (x *XFile) unrar(rarReader *rardecode.ReadCloser) ([]string, error) {
 			return files, fmt.Errorf("rarReader.Next: %w", err)
 		}
 
+		var owner *fileOwner
+		if x.PreserveOwnership {
+			owner = x.rarOwner(owners, normalizeVolumes(rarReader.Volumes(), x.FilePath), header.Name)
+		}
+
+		// RAR 2.x-4.x archives made without Unicode names store them in the creator's code page.
+		header.Name = names.decodeStream(header.Name)
+		header.Linkname = names.decodeStream(header.Linkname)
+
 		file := &file{
 			Path:     x.clean(header.Name),
+			Member:   header.Name,
 			Data:     rarReader,
 			FileMode: header.Mode(),
 			DirMode:  x.DirMode,
 			Mtime:    header.ModificationTime,
 			Atime:    header.AccessTime,
 			Linkname: header.Linkname,
+			Owner:    owner,
 		}
 
 		// RAR5 stores symlink targets in a redirection record (not file payload).
@@ -135,8 +218,8 @@ func (x *XFile) unrar(rarReader *rardecode.ReadCloser) ([]string, error) {
 		if header.IsDir {
 			x.Debugf("Writing archived directory: %s", file.Path)
 
-			err = x.mkDir(file.Path, header.Mode(), header.ModificationTime)
-			if err != nil {
+			file.FileMode = header.Mode()
+			if err = x.mkDirFile(file); err != nil {
 				return files, fmt.Errorf("making rar file dir: %w", err)
 			}
 
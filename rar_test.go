@@ -40,6 +40,7 @@ func TestExtractRARPasswordRetryKeepsConfig(t *testing.T) {
 		FilePath:  "./test_data/archive.rar",
 		OutputDir: t.TempDir(),
 		Passwords: []string{"wrong-password", "some_password"}, // correct password is second.
+		Manifest:  true,
 	}
 	xFile.SetLogger(logger)
 
@@ -51,6 +52,7 @@ func TestExtractRARPasswordRetryKeepsConfig(t *testing.T) {
 	assert.Len(t, files, len(filesInTestArchive))
 	assert.Positive(t, logger.debugCount.Load(),
 		"the winning password retry must keep the caller's logger")
+	assert.Len(t, xFile.ManifestEntries, len(filesInTestArchive), "only the winning attempt's files are listed")
 }
 
 // countingLogger counts log lines so tests can verify a logger is wired up.
@@ -0,0 +1,248 @@
+package xtractr
+
+/* Code to read the owner records rardecode skips in RAR5 file headers. */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+// RAR5 header types, flags and extra records, from the RAR 5.0 archive format technote.
+const (
+	rar5FileType    = 2
+	rar5EncryptType = 4
+	rar5EndType     = 5
+	rar5ExtraArea   = 0x0001
+	rar5DataArea    = 0x0002
+	rar5FileMtime   = 0x0002
+	rar5FileCRC     = 0x0004
+	rar5OwnerRecord = 6
+	rar5OwnerUser   = 0x0001
+	rar5OwnerGroup  = 0x0002
+	rar5OwnerUID    = 0x0004
+	rar5OwnerGID    = 0x0008
+	// rar5MaxHeader is the largest header RAR5 allows.
+	rar5MaxHeader = 2 << 20
+	// rar5MaxData keeps a damaged data size from overflowing the next header's offset.
+	rar5MaxData = 1 << 62
+	// rarSignatureSearch is how far into a volume to look for a signature; self-extracting archives start with a program.
+	rarSignatureSearch = 1 << 20
+)
+
+// RAR signatures: "Rar!" 1A 07, then 01 00 for RAR5. RAR 1.5-4.x archives have no owner records.
+const (
+	rarSignature  = "Rar!\x1a\x07"
+	rar5Signature = rarSignature + "\x01\x00"
+)
+
+// rarOwners has the owners of the files in the RAR5 volumes read so far, by archived name.
+type rarOwners struct {
+	read   map[string]bool
+	owners map[string]*fileOwner
+}
+
+// rar5Header is a RAR5 header: its type, then the fields after the sizes, and its extra area.
+type rar5Header struct {
+	kind   uint64
+	fields rar5Fields
+	extra  rar5Fields
+}
+
+// rar5Fields reads the fields of a RAR5 header. A field that runs past the end empties it.
+type rar5Fields []byte
+
+func newRAROwners() *rarOwners {
+	return &rarOwners{read: map[string]bool{}, owners: map[string]*fileOwner{}}
+}
+
+// rarOwner returns the owner of a file in a RAR5 archive, or nil. rardecode does not
+// return owner records, so each volume is read for them once rardecode opens it.
+func (x *XFile) rarOwner(owners *rarOwners, volumes []string, name string) *fileOwner {
+	for _, volume := range volumes {
+		if owners.read[volume] {
+			continue
+		}
+
+		owners.read[volume] = true
+
+		if err := readRAR5Owners(volume, owners.owners); err != nil {
+			x.warn("reading owners in %s: %v", filepath.Base(volume), err)
+		}
+	}
+
+	return owners.owners[name]
+}
+
+// readRAR5Owners adds the owner records in a RAR5 volume's file headers to owners.
+// It stops at encrypted headers, which can not be read without the password.
+func readRAR5Owners(path string, owners map[string]*fileOwner) error {
+	volume, stat, err := openStatFile(path)
+	if err != nil {
+		return err
+	}
+	defer volume.Close()
+
+	head := make([]byte, min(stat.Size(), rarSignatureSearch))
+	if _, err = volume.ReadAt(head, 0); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	idx := bytes.Index(head, []byte(rarSignature))
+	if idx < 0 || !bytes.HasPrefix(head[idx:], []byte(rar5Signature)) {
+		return nil
+	}
+
+	for offset := int64(idx + len(rar5Signature)); offset < stat.Size(); {
+		header, next, err := readRAR5Header(volume, offset)
+		if err != nil {
+			return err
+		}
+
+		switch header.kind {
+		case rar5EncryptType, rar5EndType:
+			return nil
+		case rar5FileType:
+			if name, owner := header.owner(); owner != nil {
+				owners[name] = owner
+			}
+		}
+
+		offset = next
+	}
+
+	return nil
+}
+
+// readRAR5Header reads the header at offset, and returns the offset of the next one:
+// CRC32, the header size, then the type, flags, extra area and data area sizes.
+func readRAR5Header(volume io.ReaderAt, offset int64) (*rar5Header, int64, error) {
+	const sizeStart = 4 // the CRC32 is before the size.
+
+	start := make([]byte, sizeStart+binary.MaxVarintLen32)
+	if read, err := volume.ReadAt(start, offset); read < len(start)-2 { //nolint:mnd // smallest header.
+		return nil, 0, fmt.Errorf("reading rar header: %w", err)
+	}
+
+	size, length := binary.Uvarint(start[sizeStart:])
+	if length <= 0 || size == 0 || size > rar5MaxHeader {
+		return nil, 0, rardecode.ErrCorruptBlockHeader
+	}
+
+	data := make([]byte, length+int(size))
+	if _, err := volume.ReadAt(data, offset+sizeStart); err != nil {
+		return nil, 0, fmt.Errorf("reading rar header: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(start) {
+		return nil, 0, rardecode.ErrBadHeaderCRC
+	}
+
+	fields := rar5Fields(data[length:])
+	header := &rar5Header{kind: fields.vint()}
+	flags := fields.vint()
+
+	var extraSize, dataSize uint64
+
+	if flags&rar5ExtraArea != 0 {
+		extraSize = fields.vint()
+	}
+
+	if flags&rar5DataArea != 0 {
+		dataSize = fields.vint()
+	}
+
+	if extraSize > uint64(len(fields)) || dataSize > rar5MaxData {
+		return nil, 0, rardecode.ErrCorruptBlockHeader
+	}
+
+	header.fields = fields[:uint64(len(fields))-extraSize]
+	header.extra = fields[uint64(len(fields))-extraSize:]
+
+	return header, offset + sizeStart + int64(len(data)) + int64(dataSize), nil //nolint:gosec // checked above.
+}
+
+// owner returns a file header's name, and the owner in its extra area, or nil.
+func (h *rar5Header) owner() (string, *fileOwner) {
+	fields := h.fields
+	flags := fields.vint()
+	fields.vint() // unpacked size
+	fields.vint() // attributes
+
+	if flags&rar5FileMtime != 0 {
+		fields.bytes(4) //nolint:mnd
+	}
+
+	if flags&rar5FileCRC != 0 {
+		fields.bytes(4) //nolint:mnd
+	}
+
+	fields.vint() // compression
+	fields.vint() // host OS
+	name := string(fields.bytes(fields.vint()))
+
+	for extra := h.extra; len(extra) > 0; {
+		record := rar5Fields(extra.bytes(extra.vint()))
+		if record.vint() == rar5OwnerRecord {
+			return name, record.owner()
+		}
+	}
+
+	return name, nil
+}
+
+// owner reads an owner record: flags, then the user and group names and ids that are present.
+// Ids that are not present are -1, which leaves them as they are.
+func (f *rar5Fields) owner() *fileOwner {
+	flags := f.vint()
+	owner := &fileOwner{uid: -1, gid: -1}
+
+	if flags&rar5OwnerUser != 0 {
+		owner.uname = string(f.bytes(f.vint()))
+	}
+
+	if flags&rar5OwnerGroup != 0 {
+		owner.gname = string(f.bytes(f.vint()))
+	}
+
+	if flags&rar5OwnerUID != 0 {
+		owner.uid = int(f.vint()) //nolint:gosec
+	}
+
+	if flags&rar5OwnerGID != 0 {
+		owner.gid = int(f.vint()) //nolint:gosec
+	}
+
+	return owner
+}
+
+// vint reads a variable length integer.
+func (f *rar5Fields) vint() uint64 {
+	value, length := binary.Uvarint(*f)
+	if length <= 0 {
+		*f = nil
+		return 0
+	}
+
+	*f = (*f)[length:]
+
+	return value
+}
+
+// bytes reads size bytes.
+func (f *rar5Fields) bytes(size uint64) []byte {
+	if size > uint64(len(*f)) {
+		*f = nil
+		return nil
+	}
+
+	read := (*f)[:size]
+	*f = (*f)[size:]
+
+	return read
+}
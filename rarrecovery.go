@@ -0,0 +1,114 @@
+package xtractr
+
+/* Code to repair RAR archives, and to find their recovery records. */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+
+	"github.com/nwaples/rardecode/v2"
+)
+
+// Main header types and flags for a recovery record, in RAR 1.5-4.x and in RAR5.
+const (
+	rar4MainType     = 0x73
+	rar4MainProtect  = 0x0040
+	rar5MainType     = 1
+	rar5MainRecovery = 0x0008
+	// rar4Signature is "Rar!" 1A 07 00: RAR 1.5-4.x.
+	rar4Signature = rarSignature + "\x00"
+)
+
+// RepairRAR repairs a RAR archive's damaged and missing volumes in place with the PAR2
+// set next to it that describes them, and returns the paths it repaired: none when the
+// set finds no damage. path is the archive's first volume. RAR recovery records are not
+// applied: rardecode does not read them, and their layout is not published. Without a
+// PAR2 set the error wraps ErrRARUnrepairable, and says so when the archive has a
+// recovery record, which WinRAR and `rar r` can repair with. A nil progress is not
+// called; its XFile has path in FilePath.
+func RepairRAR(path string, progress func(Progress)) ([]string, error) {
+	dir := filepath.Dir(path)
+
+	sets, err := readPar2Sets(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.ContainsFunc(slices.Collect(maps.Values(sets)), func(set *par2Set) bool {
+		return set.describes(dir, []string{path})
+	}) {
+		if recovery, _ := RARRecoveryRecord(path); recovery {
+			return nil, fmt.Errorf("%s: %w; it has a recovery record, which WinRAR or `rar r` can use",
+				path, ErrRARUnrepairable)
+		}
+
+		return nil, fmt.Errorf("%s: %w", path, ErrRARUnrepairable)
+	}
+
+	tracker := newTracker(&XFile{FilePath: path}, progress)
+	defer tracker.done()
+
+	return repairDescribed(dir, sets, []string{path}, tracker)
+}
+
+// RARRecoveryRecord reports whether a RAR archive or volume has a recovery record, from
+// the flag in its main header. Archives with encrypted headers report false. This library
+// can not repair with recovery records; see RepairRAR. ExtractRAR adds a warning about
+// recovery records when extraction fails on damaged data.
+func RARRecoveryRecord(path string) (bool, error) {
+	file, stat, err := openStatFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, min(stat.Size(), rarSignatureSearch))
+	if _, err = file.ReadAt(head, 0); err != nil {
+		return false, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	idx := bytes.Index(head, []byte(rarSignature))
+
+	switch {
+	case idx < 0:
+		return false, fmt.Errorf("%s: %w", path, rardecode.ErrNoSig)
+	case bytes.HasPrefix(head[idx:], []byte(rar5Signature)):
+		header, _, err := readRAR5Header(file, int64(idx+len(rar5Signature)))
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+
+		// Archives with encrypted headers start with an encryption header instead.
+		return header.kind == rar5MainType && header.fields.vint()&rar5MainRecovery != 0, nil
+	case bytes.HasPrefix(head[idx:], []byte(rar4Signature)):
+		return rar4Recovery(head[idx+len(rar4Signature):]), nil
+	default:
+		return false, fmt.Errorf("%s: %w", path, rardecode.ErrUnknownVersion)
+	}
+}
+
+// rar4Recovery reads the main header after a RAR 1.5-4.x signature: CRC16, type, flags.
+func rar4Recovery(header []byte) bool {
+	const flagsEnd = 5
+
+	return len(header) >= flagsEnd && header[2] == rar4MainType &&
+		binary.LittleEndian.Uint16(header[3:flagsEnd])&rar4MainProtect != 0
+}
+
+// warnRecoveryRecord adds a warning for each volume with a recovery record, after
+// extraction failed on damaged data.
+func (x *XFile) warnRecoveryRecord(volumes []string) {
+	if len(volumes) == 0 {
+		volumes = []string{x.FilePath}
+	}
+
+	for _, volume := range volumes {
+		if ok, _ := RARRecoveryRecord(volume); ok {
+			x.warn("%s has a recovery record; WinRAR or `rar r` may repair it", filepath.Base(volume))
+		}
+	}
+}
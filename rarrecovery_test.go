@@ -0,0 +1,143 @@
+package xtractr_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nwaples/rardecode/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestRARRecoveryRecord(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	headers := map[string]struct {
+		data     string
+		recovery bool
+	}{
+		// CRC16, type 0x73, flags, size.
+		"rar4.rar":    {"Rar!\x1a\x07\x00" + "\x00\x00\x73\x40\x00\x0d\x00", true},
+		"rar4no.rar":  {"Rar!\x1a\x07\x00" + "\x00\x00\x73\x01\x00\x0d\x00", false},
+		"rar4sfx.exe": {"MZ self-extractor" + "Rar!\x1a\x07\x00" + "\x00\x00\x73\x41\x00\x0d\x00", true},
+		// Type 1, header flags, then archive flags.
+		"rar5.rar":   {testRAR5Main("\x01\x00\x08"), true},
+		"rar5no.rar": {testRAR5Main("\x01\x00\x00"), false},
+		// An extra area (flag 1, 2 bytes) after the archive flags.
+		"rar5extra.rar": {testRAR5Main("\x01\x01\x02\x08\x01\x00"), true},
+		// Archive flags are a variable length integer: 0x88 0x01 is 0x88.
+		"rar5long.rar": {testRAR5Main("\x01\x00\x88\x01"), true},
+		"rar5sfx.exe":  {"MZ self-extractor" + testRAR5Main("\x01\x00\x08"), true},
+	}
+
+	for name, header := range headers {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(header.data), 0o600))
+
+		recovery, err := xtractr.RARRecoveryRecord(path)
+		require.NoError(t, err, name)
+		assert.Equal(t, header.recovery, recovery, name)
+	}
+
+	recovery, err := xtractr.RARRecoveryRecord(filepath.Join("test_data", "multivol.part1.rar"))
+	require.NoError(t, err)
+	assert.False(t, recovery)
+
+	recovery, err = xtractr.RARRecoveryRecord(testFile)
+	require.NoError(t, err)
+	assert.False(t, recovery, "encrypted headers must not be read as a main header")
+
+	damaged := []byte(testRAR5Main("\x01\x00\x08"))
+	damaged[8] ^= 0xFF // the header CRC32.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "damaged.rar"), damaged, 0o600))
+
+	_, err = xtractr.RARRecoveryRecord(filepath.Join(dir, "damaged.rar"))
+	require.ErrorIs(t, err, rardecode.ErrBadHeaderCRC)
+
+	notRAR := filepath.Join(dir, "not.rar")
+	require.NoError(t, os.WriteFile(notRAR, []byte("not a rar archive"), 0o600))
+
+	_, err = xtractr.RARRecoveryRecord(notRAR)
+	require.ErrorIs(t, err, rardecode.ErrNoSig)
+
+	_, err = xtractr.RARRecoveryRecord(filepath.Join(dir, "missing.rar"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// testRAR5Main returns a RAR5 signature and main header: CRC32, size, then body.
+func testRAR5Main(body string) string {
+	header := append([]byte{byte(len(body))}, body...)
+	crc := binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(header))
+
+	return "Rar!\x1a\x07\x01\x00" + string(crc) + string(header)
+}
+
+// testRecoveryVolumes copies the multivol volumes to a folder, without the last one,
+// and with the recovery record flag set in the first one if recovery is true.
+func testRecoveryVolumes(t *testing.T, recovery bool) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	parts, err := filepath.Glob(filepath.Join("test_data", "multivol.part*.rar"))
+	require.NoError(t, err)
+
+	for _, part := range parts[:len(parts)-1] {
+		data, err := os.ReadFile(part)
+		require.NoError(t, err)
+
+		if recovery && filepath.Base(part) == "multivol.part1.rar" {
+			// The main header's archive flags, then its CRC32, of the size and the 11 bytes after it.
+			data[16] |= 0x08
+			binary.LittleEndian.PutUint32(data[8:], crc32.ChecksumIEEE(data[12:24]))
+		}
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.Base(part)), data, 0o600))
+	}
+
+	return dir
+}
+
+func TestExtractRARRecoveryRecordWarning(t *testing.T) {
+	t.Parallel()
+
+	dir := testRecoveryVolumes(t, true)
+	first := filepath.Join(dir, "multivol.part1.rar")
+
+	recovery, err := xtractr.RARRecoveryRecord(first)
+	require.NoError(t, err)
+	require.True(t, recovery)
+
+	xFile := &xtractr.XFile{FilePath: first, OutputDir: filepath.Join(dir, "out"), FileMode: 0o600, DirMode: 0o700}
+
+	_, _, _, err = xtractr.ExtractRAR(xFile)
+	require.Error(t, err)
+
+	warned := 0
+
+	for _, warning := range xFile.Warnings {
+		if strings.Contains(warning, "multivol.part1.rar has a recovery record") {
+			warned++
+		}
+	}
+
+	assert.Equal(t, 1, warned, xFile.Warnings)
+}
+
+func TestRepairRARWithoutPAR2(t *testing.T) {
+	t.Parallel()
+
+	for _, recovery := range []bool{true, false} {
+		dir := testRecoveryVolumes(t, recovery)
+
+		repaired, err := xtractr.RepairRAR(filepath.Join(dir, "multivol.part1.rar"), nil)
+		require.ErrorIs(t, err, xtractr.ErrRARUnrepairable)
+		assert.Empty(t, repaired)
+		assert.Equal(t, recovery, strings.Contains(err.Error(), "has a recovery record"), err)
+	}
+}
@@ -0,0 +1,686 @@
+package xtractr
+
+/* Rock Ridge (RRIP) extensions for ISO9660: POSIX modes, symlinks, hard links, timestamps and deep directories. */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	isoSectorSize   = 2048
+	isoPVDSector    = 16 // the volume descriptor set starts here.
+	isoRootRecord   = 156
+	isoMaxVDs       = 64 // volume descriptors to look at before giving up.
+	isoMaxCE        = 32 // continuation areas followed per directory record.
+	isoDirFlag      = 0x02
+	isoMultiExtent  = 0x80
+	isoMinRecordLen = 34
+	posixTypeMask   = 0o170000
+)
+
+// rrIdentifiers are the extension identifiers an ER entry uses for Rock Ridge.
+//
+//nolint:gochecknoglobals
+var rrIdentifiers = []string{"RRIP_1991A", "IEEE_P1282", "IEEE_1282"}
+
+// isoExtent is one contiguous piece of a file or directory.
+type isoExtent struct {
+	offset int64
+	size   int64
+}
+
+// isoRecord is an ISO9660 directory record with its Rock Ridge entries decoded.
+type isoRecord struct {
+	name      string
+	rrName    string
+	hasName   bool
+	extents   []isoExtent
+	flags     byte
+	mtime     time.Time
+	atime     time.Time
+	mode      uint32 // POSIX st_mode, from PX.
+	hasMode   bool
+	nlink     uint32
+	uid       uint32
+	gid       uint32
+	rdev      uint64 // from PN.
+	hasDev    bool
+	linkParts []string
+	linkRoot  bool
+	linkOpen  bool // the last SL component continues in the next SL entry.
+	isLink    bool
+	child     uint32 // CL: location of a relocated directory.
+	hasChild  bool
+	relocated bool // RE: reached through a CL entry instead.
+	hasRR     bool
+}
+
+// rockRidge reads the primary volume directory tree with its Rock Ridge entries.
+type rockRidge struct {
+	image io.ReaderAt
+	skip  int                // SUSP bytes to skip in each system use area, from SP.
+	seen  map[int64]struct{} // directories extracted, to stop loops.
+	links map[int64]string   // first extracted path of each hard linked extent.
+	// writes queues files for parallel extraction when FileWorkers > 1.
+	writes *isoWrites
+	// names decodes NM names and symlink targets that are not UTF-8.
+	names *nameDecoders
+}
+
+// openRockRidge returns the root directory of an image's primary volume when that volume
+// uses Rock Ridge, or a nil record when it does not. Joliet trees never carry Rock Ridge.
+func openRockRidge(image io.ReaderAt) (*rockRidge, *isoRecord, error) {
+	sector := make([]byte, isoSectorSize)
+
+	for idx := range isoMaxVDs {
+		_, err := image.ReadAt(sector, int64(isoPVDSector+idx)*isoSectorSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading volume descriptor: %w", err)
+		}
+
+		if string(sector[1:6]) != "CD001" || sector[0] == 0xFF { //nolint:mnd
+			break
+		}
+
+		if sector[0] != 1 { // primary volume descriptor.
+			continue
+		}
+
+		rr := &rockRidge{image: image, seen: map[int64]struct{}{}, links: map[int64]string{}}
+
+		root, err := rr.parseRecord(sector[isoRootRecord : isoRootRecord+isoMinRecordLen])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if ok, err := rr.detect(root); err != nil || !ok {
+			return nil, nil, err
+		}
+
+		return rr, root, nil
+	}
+
+	return nil, nil, nil
+}
+
+// detect looks for the SP entry in the root "." record and a Rock Ridge ER or PX entry after it.
+func (rr *rockRidge) detect(root *isoRecord) (bool, error) {
+	if len(root.extents) == 0 {
+		return false, nil
+	}
+
+	sector := make([]byte, isoSectorSize)
+	if _, err := rr.image.ReadAt(sector, root.extents[0].offset); err != nil {
+		return false, fmt.Errorf("reading iso root directory: %w", err)
+	}
+
+	size := int(sector[0])
+	if size < isoMinRecordLen || int(sector[32]) != 1 { // "." has a one byte name.
+		return false, nil
+	}
+
+	use := sector[isoMinRecordLen:size]
+	if len(use) < 7 || string(use[:2]) != "SP" || use[4] != 0xBE || use[5] != 0xEF { //nolint:mnd
+		return false, nil
+	}
+
+	rr.skip = int(use[6])
+
+	dot := &isoRecord{}
+	rr.parseSUSP(dot, use, 0)
+
+	return dot.hasRR, nil
+}
+
+// parseRecord decodes a directory record and its system use entries.
+func (rr *rockRidge) parseRecord(buf []byte) (*isoRecord, error) {
+	if len(buf) < isoMinRecordLen || int(buf[0]) > len(buf) || int(buf[32])+33 > int(buf[0]) {
+		return nil, fmt.Errorf("%w: short directory record", ErrCorruptISO)
+	}
+
+	buf = buf[:buf[0]]
+	nameLen := int(buf[32])
+	rec := &isoRecord{
+		name:  isoName(buf[33:33+nameLen], buf[25]&isoDirFlag != 0),
+		flags: buf[25],
+		mtime: isoTime7(buf[18:25]),
+	}
+
+	if size := int64(binary.LittleEndian.Uint32(buf[10:])); size > 0 || rec.flags&isoDirFlag != 0 {
+		rec.extents = []isoExtent{{offset: int64(binary.LittleEndian.Uint32(buf[2:])) * isoSectorSize, size: size}}
+	}
+
+	use := 33 + nameLen + (1 - nameLen%2) //nolint:mnd // a pad byte follows even length names.
+	if use+rr.skip < len(buf) {
+		rr.parseSUSP(rec, buf[use+rr.skip:], 0)
+	}
+
+	return rec, nil
+}
+
+// isoName trims the version (";1") and the empty extension dot from a plain ISO9660 name.
+func isoName(name []byte, dir bool) string {
+	switch {
+	case len(name) == 1 && name[0] == 0:
+		return "."
+	case len(name) == 1 && name[0] == 1:
+		return ".."
+	case dir:
+		return string(name)
+	}
+
+	str, _, _ := strings.Cut(string(name), ";")
+
+	return strings.TrimSuffix(str, ".")
+}
+
+// parseSUSP decodes the Rock Ridge entries in a system use area, following CE continuations.
+func (rr *rockRidge) parseSUSP(rec *isoRecord, use []byte, depth int) {
+	var (
+		ceBlock, ceOffset, ceLen uint32
+		hasCE                    bool
+	)
+
+	for len(use) >= 4 {
+		size := int(use[2])
+		if size < 4 || size > len(use) {
+			break
+		}
+
+		data := use[4:size]
+		sig := string(use[:2])
+		use = use[size:]
+
+		switch sig {
+		case "ST":
+			use = nil
+		case "CE":
+			if len(data) >= 24 { //nolint:mnd
+				ceBlock, ceOffset, ceLen = le32(data, 0), le32(data, 8), le32(data, 16) //nolint:mnd
+				hasCE = true
+			}
+		case "ER":
+			if len(data) >= 4 && int(data[0])+4 <= len(data) {
+				for _, id := range rrIdentifiers {
+					rec.hasRR = rec.hasRR || string(data[4:4+data[0]]) == id
+				}
+			}
+		case "RR":
+			rec.hasRR = true
+		default:
+			rr.parseRRIP(rec, sig, data)
+		}
+	}
+
+	if !hasCE || depth >= isoMaxCE || ceOffset >= isoSectorSize {
+		return
+	}
+
+	area := make([]byte, min(int(ceLen), isoSectorSize-int(ceOffset)))
+	if _, err := rr.image.ReadAt(area, int64(ceBlock)*isoSectorSize+int64(ceOffset)); err == nil {
+		rr.parseSUSP(rec, area, depth+1)
+	}
+}
+
+// parseRRIP decodes one Rock Ridge entry into rec.
+func (rr *rockRidge) parseRRIP(rec *isoRecord, sig string, data []byte) {
+	switch sig {
+	case "PX":
+		if len(data) >= 32 { //nolint:mnd
+			rec.mode, rec.nlink, rec.uid, rec.gid = le32(data, 0), le32(data, 8), le32(data, 16), le32(data, 24) //nolint:mnd
+			rec.hasMode, rec.hasRR = true, true
+		}
+	case "PN":
+		if len(data) >= 16 { //nolint:mnd
+			rec.rdev = uint64(le32(data, 0))<<32 | uint64(le32(data, 8)) //nolint:mnd
+			rec.hasDev = true
+		}
+	case "NM":
+		if len(data) >= 1 && data[0]&0x06 == 0 { // 0x02 and 0x04 mean "." and "..".
+			rec.rrName += string(data[1:])
+			rec.hasName, rec.hasRR = true, true
+		}
+	case "SL":
+		if len(data) >= 1 {
+			rec.isLink, rec.hasRR = true, true
+			rec.parseSL(data[1:])
+		}
+	case "CL":
+		if len(data) >= 8 { //nolint:mnd
+			rec.child, rec.hasChild = le32(data, 0), true
+		}
+	case "RE":
+		rec.relocated = true
+	case "TF":
+		rec.parseTF(data)
+	}
+}
+
+// parseSL appends symlink target components. A component with flag 0x01 continues in the next one.
+func (rec *isoRecord) parseSL(data []byte) {
+	for len(data) >= 2 && int(data[1])+2 <= len(data) {
+		flags, part := data[0], string(data[2:2+data[1]])
+		data = data[2+data[1]:]
+
+		switch {
+		case flags&0x02 != 0:
+			part = "."
+		case flags&0x04 != 0:
+			part = ".."
+		case flags&0x08 != 0:
+			rec.linkRoot = true
+			continue
+		case flags&0x30 != 0: // volume root and host name: nothing to point at.
+			continue
+		}
+
+		if rec.linkOpen && len(rec.linkParts) > 0 {
+			rec.linkParts[len(rec.linkParts)-1] += part
+		} else {
+			rec.linkParts = append(rec.linkParts, part)
+		}
+
+		rec.linkOpen = flags&0x01 != 0
+	}
+}
+
+// parseTF reads the modify and access times. Bit 7 selects 17 byte timestamps over 7 byte ones.
+func (rec *isoRecord) parseTF(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+
+	flags, data, size := data[0], data[1:], 7 //nolint:mnd
+	if flags&0x80 != 0 {
+		size = 17
+	}
+
+	for bit := range 7 { // creation, modify, access, attributes, backup, expiration, effective.
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+
+		if len(data) < size {
+			return
+		}
+
+		stamp := isoTime7(data[:size])
+		if size != 7 { //nolint:mnd
+			stamp = isoTime17(data[:size])
+		}
+
+		switch bit {
+		case 1:
+			rec.mtime = stamp
+		case 2: //nolint:mnd
+			rec.atime = stamp
+		}
+
+		data = data[size:]
+	}
+}
+
+func (rec *isoRecord) linkname() string {
+	link := strings.Join(rec.linkParts, "/")
+	if rec.linkRoot {
+		return "/" + link
+	}
+
+	return link
+}
+
+// fileMode converts the PX mode, or a default for records without one.
+func (rec *isoRecord) fileMode(fallback os.FileMode) os.FileMode {
+	if !rec.hasMode {
+		return fallback
+	}
+
+	mode := os.FileMode(rec.mode & 0o777) //nolint:mnd
+
+	for bit, flag := range map[uint32]os.FileMode{0o4000: os.ModeSetuid, 0o2000: os.ModeSetgid, 0o1000: os.ModeSticky} {
+		if rec.mode&bit != 0 {
+			mode |= flag
+		}
+	}
+
+	switch rec.mode & posixTypeMask {
+	case 0o040000:
+		mode |= os.ModeDir
+	case 0o120000:
+		mode |= os.ModeSymlink
+	case 0o020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0o060000:
+		mode |= os.ModeDevice
+	case 0o010000:
+		mode |= os.ModeNamedPipe
+	case 0o140000:
+		mode |= os.ModeSocket
+	}
+
+	return mode
+}
+
+// owner returns the PX owner, or nil for records without one.
+func (rec *isoRecord) owner() *fileOwner {
+	if !rec.hasMode {
+		return nil
+	}
+
+	return &fileOwner{uid: int(rec.uid), gid: int(rec.gid)}
+}
+
+// device returns the PN device number, or nil for records without one. Like Linux, a
+// high word of 0 with more than 8 bits in the low word is read as major<<8 | minor.
+func (rec *isoRecord) device() *fileDevice {
+	if !rec.hasDev {
+		return nil
+	}
+
+	high, low := uint32(rec.rdev>>32), uint32(rec.rdev) //nolint:mnd,gosec
+
+	if high == 0 && low&^0xFF != 0 {
+		return &fileDevice{major: low >> 8, minor: low & 0xFF} //nolint:mnd
+	}
+
+	return &fileDevice{major: high, minor: low}
+}
+
+func (rec *isoRecord) size() (size int64) {
+	for _, extent := range rec.extents {
+		size += extent.size
+	}
+
+	return size
+}
+
+// reader returns the file data, joining the extents of multi-extent files.
+func (rec *isoRecord) reader(image io.ReaderAt) io.Reader {
+	readers := make([]io.Reader, len(rec.extents))
+	for idx, extent := range rec.extents {
+		readers[idx] = io.NewSectionReader(image, extent.offset, extent.size)
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// isoTime7 decodes the 7 byte directory record date; the last byte is the UTC offset in 15 minute steps.
+func isoTime7(b []byte) time.Time {
+	if len(b) < 7 || b[1] == 0 { //nolint:mnd
+		return time.Time{}
+	}
+
+	zone := time.FixedZone("", int(int8(b[6]))*15*60) //nolint:gosec,mnd
+
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// isoTime17 decodes the 17 byte "YYYYMMDDHHMMSSCC" date with a UTC offset byte.
+func isoTime17(b []byte) time.Time {
+	if len(b) < 17 { //nolint:mnd
+		return time.Time{}
+	}
+
+	nums := make([]int, 0, 7) //nolint:mnd
+
+	for _, field := range [][2]int{{0, 4}, {4, 6}, {6, 8}, {8, 10}, {10, 12}, {12, 14}, {14, 16}} {
+		num, err := strconv.Atoi(string(b[field[0]:field[1]]))
+		if err != nil {
+			return time.Time{}
+		}
+
+		nums = append(nums, num)
+	}
+
+	if nums[0] == 0 {
+		return time.Time{}
+	}
+
+	zone := time.FixedZone("", int(int8(b[16]))*15*60) //nolint:gosec,mnd
+
+	return time.Date(nums[0], time.Month(nums[1]), nums[2], nums[3], nums[4], nums[5], nums[6]*10_000_000, zone) //nolint:mnd
+}
+
+func le32(data []byte, offset int) uint32 {
+	return binary.LittleEndian.Uint32(data[offset:])
+}
+
+// readDir returns the records in a directory, without "." and "..".
+func (rr *rockRidge) readDir(dir *isoRecord) ([]*isoRecord, error) {
+	var (
+		records []*isoRecord
+		pending *isoRecord // a multi-extent file waiting for its last extent.
+		sector  = make([]byte, isoSectorSize)
+	)
+
+	for _, extent := range dir.extents {
+		for pos := int64(0); pos < extent.size; pos += isoSectorSize {
+			if _, err := rr.image.ReadAt(sector, extent.offset+pos); err != nil {
+				return nil, fmt.Errorf("reading iso directory %s: %w", dir.name, err)
+			}
+
+			for idx := 0; idx < isoSectorSize && sector[idx] != 0; idx += int(sector[idx]) {
+				rec, err := rr.parseRecord(sector[idx:])
+				if err != nil {
+					return nil, fmt.Errorf("%w in %s", err, dir.name)
+				}
+
+				switch {
+				case rec.name == "." || rec.name == "..":
+					continue
+				case pending != nil:
+					pending.extents = append(pending.extents, rec.extents...)
+				default:
+					pending = rec
+				}
+
+				if rec.flags&isoMultiExtent == 0 {
+					records = append(records, pending)
+					pending = nil
+				}
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// relocated returns the directory a CL entry points to, named like the CL entry.
+// Its "." record carries the extent and the directory's own Rock Ridge entries.
+func (rr *rockRidge) relocated(link *isoRecord) (*isoRecord, error) {
+	sector := make([]byte, isoSectorSize)
+	if _, err := rr.image.ReadAt(sector, int64(link.child)*isoSectorSize); err != nil {
+		return nil, fmt.Errorf("reading relocated directory %s: %w", link.name, err)
+	}
+
+	dir, err := rr.parseRecord(sector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: relocated directory %s", err, link.name)
+	}
+
+	if dir.name != "." || dir.flags&isoDirFlag == 0 {
+		return nil, fmt.Errorf("%w: relocated directory %s not found", ErrCorruptISO, link.name)
+	}
+
+	dir.name, dir.rrName, dir.hasName = link.name, link.rrName, link.hasName
+
+	return dir, nil
+}
+
+// unRockRidge extracts a directory tree read by openRockRidge.
+func (x *XFile) unRockRidge(rr *rockRidge, dir *isoRecord, parent string) (uint64, []string, error) {
+	if _, ok := rr.seen[dir.extents[0].offset]; ok {
+		return 0, nil, fmt.Errorf("%w: directory loop at %s", ErrCorruptISO, parent)
+	}
+
+	rr.seen[dir.extents[0].offset] = struct{}{}
+
+	children, err := rr.readDir(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	files := []string{}
+	size := uint64(0)
+
+	for _, child := range children {
+		if child.relocated {
+			continue // written where its CL entry is.
+		}
+
+		if child.hasChild {
+			if child, err = rr.relocated(child); err != nil {
+				return size, files, err
+			}
+		}
+
+		childSize, childFiles, err := x.unRockRidgeEntry(rr, child, parent)
+		size += childSize
+		files = append(files, childFiles...)
+
+		if err != nil {
+			return size, files, err
+		}
+	}
+
+	return size, files, nil
+}
+
+func (x *XFile) unRockRidgeEntry(rr *rockRidge, rec *isoRecord, parent string) (uint64, []string, error) {
+	name := rec.name
+	if rec.hasName {
+		name = rr.names.decodeStream(rec.rrName)
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return 0, nil, fmt.Errorf("%s: %w: %q in %s", x.FilePath, ErrInvalidPath, name, parent)
+	}
+
+	itemName := filepath.Join(parent, name)
+	path := x.clean(itemName)
+
+	if !x.pathWithinOutput(path) {
+		// The file being written is trying to write outside of our base path. Malicious ISO?
+		return 0, nil, fmt.Errorf("%s: %w: %s (from: %s)", x.FilePath, ErrInvalidPath, path, itemName)
+	}
+
+	mode := rec.fileMode(0)
+
+	switch {
+	case rec.flags&isoDirFlag != 0:
+		if parent == "" && rr.onlyRelocated(rec) {
+			x.Debugf("Skipping Rock Ridge relocation directory: %s", itemName)
+			return 0, nil, nil
+		}
+
+		dir := &file{Path: path, FileMode: rec.fileMode(x.DirMode), Mtime: rec.mtime, Atime: rec.atime, Owner: rec.owner()}
+		if err := x.mkDirFile(dir); err != nil {
+			return 0, nil, fmt.Errorf("making iso directory %s: %w", itemName, err)
+		}
+
+		return x.unRockRidge(rr, rec, itemName)
+	case rec.isLink || mode&os.ModeSymlink != 0:
+		if err := x.mkDir(filepath.Dir(path), x.DirMode, time.Time{}); err != nil {
+			return 0, nil, fmt.Errorf("making iso symlink %s parent folder: %w", itemName, err)
+		}
+
+		err := x.createSymlink(path, rr.names.decodeStream(rec.linkname()))
+		if errors.Is(err, errSkipEntry) {
+			return 0, nil, nil
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		x.restoreMetadata(&file{Path: path, FileMode: os.ModeSymlink, Owner: rec.owner()})
+
+		return 0, []string{path}, nil
+	case mode&specialModes != 0:
+		err := x.writeSpecial(&file{
+			Path:     path,
+			FileMode: mode,
+			DirMode:  x.DirMode,
+			Mtime:    rec.mtime,
+			Atime:    rec.atime,
+			Owner:    rec.owner(),
+			Device:   rec.device(),
+		})
+		if errors.Is(err, errSkipEntry) {
+			return 0, nil, nil
+		} else if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", x.FilePath, err)
+		}
+
+		return 0, []string{path}, nil
+	}
+
+	if rec.nlink > 1 && len(rec.extents) > 0 && rec.size() > 0 {
+		if target, ok := rr.links[rec.extents[0].offset]; ok {
+			if rr.writes != nil { // the target is written in parallel; link it after.
+				rr.writes.links = append(rr.writes.links, isoLink{path: path, target: target})
+				return 0, []string{path}, nil
+			}
+
+			err := x.createHardLink(path, target)
+			if errors.Is(err, errSkipEntry) {
+				return 0, nil, nil
+			}
+
+			return 0, []string{path}, err
+		}
+
+		rr.links[rec.extents[0].offset] = itemName
+	}
+
+	file := &file{
+		Path:     path,
+		Member:   itemName,
+		Data:     rec.reader(rr.image),
+		FileMode: rec.fileMode(x.FileMode),
+		DirMode:  x.DirMode,
+		Mtime:    rec.mtime,
+		Atime:    rec.atime,
+		Owner:    rec.owner(),
+	}
+
+	if file.Atime.IsZero() {
+		file.Atime = time.Now()
+	}
+
+	if rr.writes != nil {
+		rr.writes.add(file, nil)
+		return 0, []string{file.Path}, nil
+	}
+
+	x.Debugf("Writing archived file: %s (bytes: %d)", file.Path, rec.size())
+
+	size, err := x.write(file)
+	x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+		file.Path, size, x.prog.Files, int64(x.prog.Wrote))
+
+	return size, []string{file.Path}, err
+}
+
+// onlyRelocated reports whether a folder holds nothing but relocated directories,
+// like the rr_moved folder mkisofs writes deep directories into.
+func (rr *rockRidge) onlyRelocated(dir *isoRecord) bool {
+	children, err := rr.readDir(dir)
+	if err != nil || len(children) == 0 {
+		return false
+	}
+
+	for _, child := range children {
+		if !child.relocated {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,251 @@
+package xtractr_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Unpackerr/iso9660"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+const testSector = 2048
+
+// Sectors in the test image.
+const (
+	rrRootDir  = 18
+	rrDirA     = 19
+	rrMovedDir = 20
+	rrDeepDir  = 21
+	rrHello    = 22
+	rrInner    = 23
+	rrSectors  = 24
+)
+
+func TestExtractISORockRidge(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "rockridge.iso")
+	require.NoError(t, os.WriteFile(archive, testRockRidgeISO(rrDeepDir), 0o600))
+
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprintf("FileWorkers=%d", workers), func(t *testing.T) {
+			t.Parallel()
+
+			out := filepath.Join(tmp, fmt.Sprintf("out%d", workers))
+			_, files, _, err := xtractr.ExtractFile(&xtractr.XFile{
+				FilePath: archive, OutputDir: out, FileMode: 0o644, DirMode: 0o755, FileWorkers: workers,
+			})
+			require.NoError(t, err)
+			testExtractedRockRidgeAttrs(t, out, files)
+		})
+	}
+}
+
+func testExtractedRockRidgeAttrs(t *testing.T, out string, files []string) {
+	t.Helper()
+
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	data, err := os.ReadFile(filepath.Join(out, "Hello World.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	stat, err := os.Stat(filepath.Join(out, "Hello World.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), stat.Mode().Perm())
+	assert.True(t, mtime.Equal(stat.ModTime()), "TF modify time is used: %v", stat.ModTime())
+
+	hard, err := os.Stat(filepath.Join(out, "hard.txt"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(stat, hard), "hard link shares the first file")
+
+	link, err := os.Readlink(filepath.Join(out, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "./Hello World.txt", link)
+
+	// The relocated directory is back under a/, and rr_moved is gone.
+	data, err = os.ReadFile(filepath.Join(out, "a", "deep", "inner.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "inner", string(data))
+	assert.NoDirExists(t, filepath.Join(out, "rr_moved"))
+	assert.NoFileExists(t, filepath.Join(out, "fifo"))
+	assert.NoFileExists(t, filepath.Join(out, "null"))
+
+	assert.ElementsMatch(t, []string{
+		filepath.Join(out, "Hello World.txt"), filepath.Join(out, "hard.txt"),
+		filepath.Join(out, "link"), filepath.Join(out, "a", "deep", "inner.txt"),
+	}, files)
+}
+
+func TestExtractISORockRidgeLoop(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "loop.iso")
+	// The CL entry in a/ points back at a/.
+	require.NoError(t, os.WriteFile(archive, testRockRidgeISO(rrDirA), 0o600))
+
+	_, _, err := xtractr.ExtractISO(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")})
+	require.ErrorIs(t, err, xtractr.ErrCorruptISO)
+}
+
+func TestExtractISORockRidgeSpecialFiles(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "special.iso")
+	require.NoError(t, os.WriteFile(archive, testRockRidgeISO(rrDeepDir), 0o600))
+
+	_, _, err := xtractr.ExtractISO(&xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(tmp, "fail"), SpecialFilePolicy: xtractr.SpecialFilesFail,
+	})
+	require.ErrorIs(t, err, xtractr.ErrSpecialFile)
+
+	if runtime.GOOS != "linux" {
+		t.Skip("special files are only created on Linux")
+	}
+
+	out := filepath.Join(tmp, "create")
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o644, DirMode: 0o755,
+		SpecialFilePolicy: xtractr.SpecialFilesCreate,
+	}
+	_, files, err := xtractr.ExtractISO(xFile)
+	require.NoError(t, err)
+	assert.Contains(t, files, filepath.Join(out, "fifo"))
+
+	info, err := os.Lstat(filepath.Join(out, "fifo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe, info.Mode().Type())
+
+	// Device nodes need root, and may be refused in containers even then.
+	if info, err = os.Lstat(filepath.Join(out, "null")); err == nil {
+		assert.Equal(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type())
+	} else {
+		assert.Len(t, xFile.Warnings, 1)
+	}
+}
+
+// testRockRidgeISO builds an image with a Rock Ridge file, hard link, symlink, fifo and
+// character device 1:3 in the root, and a directory a/deep relocated into rr_moved. childLink is the CL target.
+func testRockRidgeISO(childLink uint32) []byte {
+	image := make([]byte, rrSectors*testSector)
+	stamp := []byte{121, 6, 7, 8, 9, 10, 0} // 2021-06-07 08:09:10 UTC.
+	tf := testSUSP("TF", append([]byte{0x02}, stamp...)...)
+
+	pvd := image[16*testSector:]
+	pvd[0], pvd[6] = 1, 1
+	copy(pvd[1:], "CD001")
+	iso9660.WriteInt32LSBMSB(pvd[80:], rrSectors)
+	iso9660.WriteInt16LSBMSB(pvd[120:], 1)
+	iso9660.WriteInt16LSBMSB(pvd[124:], 1)
+	iso9660.WriteInt16LSBMSB(pvd[128:], testSector)
+	copy(pvd[156:], testDirRecord("\x00", rrRootDir, testSector, 0x02, nil))
+
+	term := image[17*testSector:]
+	term[0], term[6] = 0xFF, 1
+	copy(term[1:], "CD001")
+
+	er := append([]byte{10, 0, 0, 1}, "RRIP_1991A"...)
+	testDirSector(image, rrRootDir,
+		testDirRecord("\x00", rrRootDir, testSector, 0x02,
+			testSUSP("SP", 0xBE, 0xEF, 0), testSUSP("ER", er...), testPX(0o040755, 4)),
+		testDirRecord("\x01", rrRootDir, testSector, 0x02, nil),
+		testDirRecord("HELLO_WO.TXT;1", rrHello, 5, 0,
+			testPX(0o100640, 2), testNM("Hello World.txt"), tf),
+		testDirRecord("HARD.TXT;1", rrHello, 5, 0, testPX(0o100640, 2), testNM("hard.txt")),
+		testDirRecord("LINK;1", 0, 0, 0, testPX(0o120777, 1), testNM("link"),
+			testSUSP("SL", append([]byte{0, 0x02, 0, 0, 15}, "Hello World.txt"...)...)),
+		testDirRecord("FIFO;1", 0, 0, 0, testPX(0o010644, 1), testNM("fifo")),
+		testDirRecord("NULL;1", 0, 0, 0, testPX(0o020666, 1), testNM("null"),
+			testSUSP("PN", append(testBoth32(0), testBoth32(0x0103)...)...)),
+		testDirRecord("A", rrDirA, testSector, 0x02, testPX(0o040755, 2), testNM("a")),
+		testDirRecord("RR_MOVED", rrMovedDir, testSector, 0x02, testPX(0o040755, 2), testNM("rr_moved")),
+	)
+	testDirSector(image, rrDirA,
+		testDirRecord("\x00", rrDirA, testSector, 0x02, testPX(0o040755, 2)),
+		testDirRecord("\x01", rrRootDir, testSector, 0x02, nil),
+		testDirRecord("DEEP;1", 0, 0, 0, testPX(0o100644, 1), testNM("deep"), testSUSP("CL", testBoth32(childLink)...)),
+	)
+	testDirSector(image, rrMovedDir,
+		testDirRecord("\x00", rrMovedDir, testSector, 0x02, testPX(0o040755, 2)),
+		testDirRecord("\x01", rrRootDir, testSector, 0x02, nil),
+		testDirRecord("DEEP", rrDeepDir, testSector, 0x02, testPX(0o040750, 2), testNM("deep"), testSUSP("RE")),
+	)
+	testDirSector(image, rrDeepDir,
+		testDirRecord("\x00", rrDeepDir, testSector, 0x02, testPX(0o040750, 2), tf),
+		testDirRecord("\x01", rrMovedDir, testSector, 0x02, testSUSP("PL", testBoth32(rrDirA)...)),
+		testDirRecord("INNER.TXT;1", rrInner, 5, 0, testPX(0o100644, 1), testNM("inner.txt")),
+	)
+
+	copy(image[rrHello*testSector:], "hello")
+	copy(image[rrInner*testSector:], "inner")
+
+	return image
+}
+
+func testDirSector(image []byte, sector int, records ...[]byte) {
+	pos := sector * testSector
+	for _, record := range records {
+		pos += copy(image[pos:], record)
+	}
+}
+
+// testDirRecord returns an ISO9660 directory record with system use entries.
+func testDirRecord(name string, extent, size uint32, flags byte, susp ...[]byte) []byte {
+	record := make([]byte, 33, 255)
+	copy(record[2:], testBoth32(extent))
+	copy(record[10:], testBoth32(size))
+	copy(record[18:], []byte{120, 1, 1, 0, 0, 0, 0})
+	record[25] = flags
+	iso9660.WriteInt16LSBMSB(record[28:], 1)
+	record[32] = byte(len(name))
+	record = append(record, name...)
+
+	if len(name)%2 == 0 {
+		record = append(record, 0)
+	}
+
+	for _, entry := range susp {
+		record = append(record, entry...)
+	}
+
+	if len(record)%2 == 1 {
+		record = append(record, 0)
+	}
+
+	record[0] = byte(len(record))
+
+	return record
+}
+
+func testSUSP(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+func testPX(mode, nlink uint32) []byte {
+	data := append(testBoth32(mode), testBoth32(nlink)...)
+	data = append(data, testBoth32(1000)...)
+
+	return testSUSP("PX", append(data, testBoth32(1000)...)...)
+}
+
+func testNM(name string) []byte {
+	return testSUSP("NM", append([]byte{0}, name...)...)
+}
+
+func testBoth32(num uint32) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data, num)
+	binary.BigEndian.PutUint32(data[4:], num)
+
+	return data
+}
@@ -3,8 +3,19 @@ package xtractr
 import (
 	"compress/bzip2"
 	"compress/gzip"
+	"crypto/md5"  //nolint:gosec
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/cavaliergopher/rpm"
 	"github.com/klauspost/compress/zstd"
@@ -12,7 +23,75 @@ import (
 	"github.com/ulikunitz/xz/lzma"
 )
 
+// RPMPackage holds the header metadata of an RPM package.
+// ExtractRPM fills it in when XFile.RPMMetadata is set.
+type RPMPackage struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version"`
+	Release   string   `json:"release"`
+	Epoch     int      `json:"epoch,omitempty"`
+	Arch      string   `json:"arch"`
+	Requires  []string `json:"requires,omitempty"`
+	Provides  []string `json:"provides,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+	Obsoletes []string `json:"obsoletes,omitempty"`
+	// Scriptlets run by rpm around install and removal. Empty when the package has none.
+	PreInstall    string `json:"preInstall,omitempty"`
+	PostInstall   string `json:"postInstall,omitempty"`
+	PreUninstall  string `json:"preUninstall,omitempty"`
+	PostUninstall string `json:"postUninstall,omitempty"`
+	// DigestAlgorithm names the hash used in Files (md5, sha1, sha224, sha256, sha384 or sha512).
+	DigestAlgorithm string    `json:"digestAlgorithm"`
+	Files           []RPMFile `json:"files"`
+	// DigestMismatches lists files (as named in Files) whose extracted content does not
+	// match the header digest, or that were not in the payload.
+	DigestMismatches []string `json:"digestMismatches,omitempty"`
+}
+
+// RPMFile is one file listed in an RPM package header.
+type RPMFile struct {
+	// Name is the installed path, e.g. /usr/bin/hello.
+	Name     string      `json:"name"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	Owner    string      `json:"owner"`
+	Group    string      `json:"group"`
+	Digest   string      `json:"digest,omitempty"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+// Header tags not exposed by the rpm library.
+const (
+	rpmTagFileDigestAlgo = 5011
+	rpmTagFileNames      = 1117
+	rpmTagFileDevices    = 1095
+	rpmTagFileInodes     = 1096
+)
+
+// rpmFileTags are the header tags rpm.Package.Files() indexes for every file name.
+// A header missing any of them would make it panic.
+var rpmFileTags = []int{1116, 1030, 1028, 1034, 1037, 1039, 1040, 1035, 1036} //nolint:gochecknoglobals,mnd
+
+// rpmDigests maps the header's file digest algorithm (a PGP hash id) to a hash.
+//
+//nolint:gochecknoglobals,mnd
+var rpmDigests = map[int64]struct {
+	name string
+	hash func() hash.Hash
+}{
+	0:  {"md5", md5.New}, // old packages do not set the tag.
+	1:  {"md5", md5.New},
+	2:  {"sha1", sha1.New},
+	8:  {"sha256", sha256.New},
+	9:  {"sha384", sha512.New384},
+	10: {"sha512", sha512.New},
+	11: {"sha224", sha256.New224},
+}
+
 // ExtractRPM extract a file as a RedHat Package Manager file.
+// With xFile.RPMMetadata set, the package header is stored in xFile.RPMPackage
+// and written into the output folder as <package file name>.json, and every
+// extracted file is checked against the header's file digests as it is written.
 func ExtractRPM(xFile *XFile) (size uint64, filesList []string, err error) {
 	rpmFile, stat, err := openStatFile(xFile.FilePath)
 	if err != nil {
@@ -27,13 +106,41 @@ func ExtractRPM(xFile *XFile) (size uint64, filesList []string, err error) {
 	return xFile.prog.Wrote, files, err
 }
 
-func (x *XFile) extractRPM(rpmFile io.Reader) (filesList []string, err error) { //nolint:cyclop
+func (x *XFile) extractRPM(rpmFile io.Reader) ([]string, error) {
 	// Read the package headers
 	pkg, err := rpm.Read(rpmFile)
 	if err != nil {
 		return nil, fmt.Errorf("rpm.Read: %w", err)
 	}
 
+	if !x.RPMMetadata {
+		return x.rpmPayload(pkg, rpmFile)
+	}
+
+	meta, err := newRPMPackage(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", x.FilePath, err)
+	}
+
+	x.shared().memberHash = rpmDigests[pkg.Header.GetTag(rpmTagFileDigestAlgo).Int64()].hash
+
+	files, err := x.rpmPayload(pkg, rpmFile)
+	if err != nil {
+		return files, err
+	}
+
+	x.verifyRPMDigests(pkg, meta)
+	x.RPMPackage = meta
+
+	sidecar, err := x.writeRPMSidecar(meta)
+	if err != nil {
+		return files, err
+	}
+
+	return append(files, sidecar), nil
+}
+
+func (x *XFile) rpmPayload(pkg *rpm.Package, rpmFile io.Reader) ([]string, error) { //nolint:cyclop
 	// Check the RPM compression algorithm.
 	switch compression := pkg.PayloadCompression(); compression {
 	case "xz":
@@ -84,7 +191,16 @@ func (x *XFile) unrpm(reader io.Reader, format string) (filesList []string, err
 	// Check the archive format of the payload
 	switch format {
 	case "cpio":
-		return x.uncpio(reader)
+		files, err := x.uncpio(reader)
+		if err != nil {
+			return files, err
+		}
+
+		// Unlike the other payloads, the cpio root is kept as is: there is no squashRoot.
+		files = x.withoutLinks(files, x.resolveLinks())
+		x.restoreDirTimes()
+
+		return files, nil
 	case "tar":
 		return x.untar(reader)
 	case "ar":
@@ -93,3 +209,159 @@ func (x *XFile) unrpm(reader io.Reader, format string) (filesList []string, err
 		return nil, fmt.Errorf("%w: %s", ErrUnsupportedRPMArchiveFmt, format)
 	}
 }
+
+// newRPMPackage copies the interesting parts of a package header.
+func newRPMPackage(pkg *rpm.Package) (*RPMPackage, error) {
+	digest, ok := rpmDigests[pkg.Header.GetTag(rpmTagFileDigestAlgo).Int64()]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedRPMDigest, pkg.Header.GetTag(rpmTagFileDigestAlgo).Int64())
+	}
+
+	count := len(pkg.Header.GetTag(rpmTagFileNames).StringSlice())
+	for _, tag := range rpmFileTags {
+		if count > 0 && len(pkg.Header.GetTag(tag).Int64Slice())+len(pkg.Header.GetTag(tag).StringSlice()) < count {
+			return nil, fmt.Errorf("%w: file tag %d has fewer than %d entries", ErrInvalidRPMHeader, tag, count)
+		}
+	}
+
+	meta := &RPMPackage{
+		Name:            pkg.Name(),
+		Version:         pkg.Version(),
+		Release:         pkg.Release(),
+		Epoch:           pkg.Epoch(),
+		Arch:            pkg.Architecture(),
+		Requires:        rpmDependencies(pkg.Requires()),
+		Provides:        rpmDependencies(pkg.Provides()),
+		Conflicts:       rpmDependencies(pkg.Conflicts()),
+		Obsoletes:       rpmDependencies(pkg.Obsoletes()),
+		PreInstall:      pkg.PreInstallScript(),
+		PostInstall:     pkg.PostInstallScript(),
+		PreUninstall:    pkg.PreUninstallScript(),
+		PostUninstall:   pkg.PostUninstallScript(),
+		DigestAlgorithm: digest.name,
+		Files:           []RPMFile{},
+	}
+
+	dirs := pkg.Header.GetTag(1118).StringSlice() //nolint:mnd // dirnames, indexed by tag 1116.
+	for _, idx := range pkg.Header.GetTag(1116).Int64Slice() {
+		if idx < 0 || idx >= int64(len(dirs)) {
+			return nil, fmt.Errorf("%w: directory index %d out of range", ErrInvalidRPMHeader, idx)
+		}
+	}
+
+	for _, info := range pkg.Files() {
+		meta.Files = append(meta.Files, RPMFile{
+			Name:     info.Name(),
+			Size:     info.Size(),
+			Mode:     info.Mode(),
+			Owner:    info.Owner(),
+			Group:    info.Group(),
+			Digest:   info.Digest(),
+			Linkname: info.Linkname(),
+		})
+	}
+
+	return meta, nil
+}
+
+func rpmDependencies(deps []rpm.Dependency) []string {
+	var list []string
+
+	for _, dep := range deps {
+		list = append(list, fmt.Sprint(dep))
+	}
+
+	return list
+}
+
+// verifyRPMDigests checks the hashes writeFile made of every extracted regular file that
+// has a header digest. Mismatches are not fatal; they are recorded in meta and in Warnings.
+// The payload carries the data of hard linked files once, and the other links are empty,
+// so a group of hard links is checked against the one link that matches.
+func (x *XFile) verifyRPMDigests(pkg *rpm.Package, meta *RPMPackage) {
+	state := x.shared()
+
+	state.mu.Lock()
+	sums := make(map[string]string, len(state.memberSums))
+	for member, sum := range state.memberSums {
+		// Payload names are relative ("./usr/bin/hello"); header names are absolute.
+		sums[path.Join("/", member)] = sum
+	}
+	state.mu.Unlock()
+
+	files := pkg.Files()
+	groups := rpmHardLinks(pkg, len(files))
+
+	for idx, info := range files {
+		if info.Digest() == "" || !info.Mode().IsRegular() || info.Flags()&rpm.FileFlagGhost != 0 {
+			continue // directories, links and %ghost files have no payload to check.
+		}
+
+		sum, ok := sums[path.Join("/", info.Name())]
+		if ok && sum == info.Digest() || slices.ContainsFunc(groups[idx], func(link int) bool {
+			return sums[path.Join("/", files[link].Name())] == info.Digest()
+		}) {
+			continue
+		}
+
+		if !ok {
+			x.warn("digest mismatch: %s (expected %s %s, not in the payload)", info.Name(), meta.DigestAlgorithm, info.Digest())
+		} else {
+			x.warn("digest mismatch: %s (expected %s %s, got %s)", info.Name(), meta.DigestAlgorithm, info.Digest(), sum)
+		}
+
+		meta.DigestMismatches = append(meta.DigestMismatches, meta.Files[idx].Name)
+	}
+}
+
+// rpmHardLinks returns the indexes of the files that share each file's device and inode.
+// Files that are not hard linked have no entry. Old headers without the tags have none.
+func rpmHardLinks(pkg *rpm.Package, count int) map[int][]int {
+	devices := pkg.Header.GetTag(rpmTagFileDevices).Int64Slice()
+	inodes := pkg.Header.GetTag(rpmTagFileInodes).Int64Slice()
+
+	if len(devices) < count || len(inodes) < count {
+		return nil
+	}
+
+	byInode := map[[2]int64][]int{}
+	for idx := range count {
+		key := [2]int64{devices[idx], inodes[idx]}
+		byInode[key] = append(byInode[key], idx)
+	}
+
+	groups := map[int][]int{}
+
+	for _, links := range byInode {
+		if len(links) < 2 { //nolint:mnd
+			continue
+		}
+
+		for _, idx := range links {
+			groups[idx] = links
+		}
+	}
+
+	return groups
+}
+
+// writeRPMSidecar writes the package metadata as JSON into the output folder,
+// named after the package file, and returns its path.
+func (x *XFile) writeRPMSidecar(meta *RPMPackage) (string, error) {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding rpm metadata: %w", err)
+	}
+
+	// A package with no files (like a meta package) has not made the output folder.
+	if err = x.mkDir(x.OutputDir, x.DirMode, time.Time{}); err != nil {
+		return "", fmt.Errorf("making rpm metadata folder: %w", err)
+	}
+
+	sidecar := filepath.Join(x.OutputDir, filepath.Base(x.FilePath)+".json")
+	if err = writeExtractFile(sidecar, append(data, '\n'), x.safeFileMode(0)); err != nil {
+		return "", fmt.Errorf("writing rpm metadata: %w", err)
+	}
+
+	return sidecar, nil
+}
@@ -0,0 +1,275 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// RPM header tag types.
+const (
+	testRPMInt32       = 4
+	testRPMString      = 6
+	testRPMStringArray = 8
+)
+
+type testRPMTag struct {
+	id    uint32
+	kind  uint32
+	value any // []int32 or []string.
+}
+
+func TestExtractRPMMetadata(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{"./usr/bin/hello": "#!/bin/sh\necho hello\n", "./etc/hello.conf": "greeting=hi\n"}
+	digests := map[string]string{"./usr/bin/hello": files["./usr/bin/hello"], "./etc/hello.conf": "tampered\n"}
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hello-1.0-2.x86_64.rpm")
+	require.NoError(t, os.WriteFile(archive, buildTestRPM(t, files, digests), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, RPMMetadata: true}
+	_, written, _, err := xtractr.ExtractFile(xFile)
+	require.NoError(t, err)
+
+	sidecar := filepath.Join(out, "hello-1.0-2.x86_64.rpm.json")
+	assert.Contains(t, written, sidecar)
+	assert.NoFileExists(t, archive+".json")
+	assert.Contains(t, written, filepath.Join(out, "usr", "bin", "hello"))
+
+	meta := xFile.RPMPackage
+	require.NotNil(t, meta)
+	assert.Equal(t, "hello", meta.Name)
+	assert.Equal(t, "1.0", meta.Version)
+	assert.Equal(t, "2", meta.Release)
+	assert.Equal(t, "x86_64", meta.Arch)
+	assert.Equal(t, []string{"bash", "glibc >= 2.34"}, meta.Requires)
+	assert.Equal(t, "echo installing", meta.PreInstall)
+	assert.Equal(t, "echo installed", meta.PostInstall)
+	assert.Equal(t, "sha256", meta.DigestAlgorithm)
+	require.Len(t, meta.Files, 2)
+	assert.Equal(t, []string{"/etc/hello.conf"}, meta.DigestMismatches)
+	require.Len(t, xFile.Warnings, 1)
+	assert.Contains(t, xFile.Warnings[0], "digest mismatch: /etc/hello.conf")
+
+	data, err := os.ReadFile(sidecar)
+	require.NoError(t, err)
+
+	decoded := &xtractr.RPMPackage{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, meta, decoded)
+}
+
+func TestExtractRPMNoMetadata(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{"./usr/bin/hello": "#!/bin/sh\n"}
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hello.rpm")
+	require.NoError(t, os.WriteFile(archive, buildTestRPM(t, files, files), 0o600))
+
+	xFile := &xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700}
+	_, written, err := xtractr.ExtractRPM(xFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmp, "out", "usr", "bin", "hello")}, written)
+	assert.Nil(t, xFile.RPMPackage)
+	assert.NoFileExists(t, archive+".json")
+}
+
+func TestExtractRPMDigestsOfWrittenFiles(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{"./usr/bin/hello": "#!/bin/sh\n"}
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "hello.rpm")
+	require.NoError(t, os.WriteFile(archive, buildTestRPM(t, files, files), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, RPMMetadata: true,
+		SquashRoot: true, NameSanitizer: strings.ToUpper,
+	}
+	_, written, err := xtractr.ExtractRPM(xFile)
+	require.NoError(t, err)
+
+	// The renamed file is checked as written, and the payload root is not squashed.
+	assert.Equal(t, []string{filepath.Join(out, "USR", "BIN", "HELLO"), filepath.Join(out, "hello.rpm.json")}, written)
+	require.NotNil(t, xFile.RPMPackage)
+	assert.Empty(t, xFile.RPMPackage.DigestMismatches)
+}
+
+func TestExtractRPMHardLinkDigests(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{"./usr/bin/hello": "#!/bin/sh\n", testRPMHardLink: ""}
+
+	for name, digests := range map[string]map[string]string{
+		"match":    files,
+		"mismatch": {"./usr/bin/hello": "tampered\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			archive := filepath.Join(tmp, "hello.rpm")
+			require.NoError(t, os.WriteFile(archive, buildTestRPM(t, files, digests), 0o600))
+
+			xFile := &xtractr.XFile{
+				FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700, RPMMetadata: true,
+			}
+			_, _, err := xtractr.ExtractRPM(xFile)
+			require.NoError(t, err)
+			require.NotNil(t, xFile.RPMPackage)
+
+			// The empty link is checked against the link that carried the data.
+			if name == "match" {
+				assert.Empty(t, xFile.RPMPackage.DigestMismatches)
+				assert.Empty(t, xFile.Warnings)
+			} else {
+				assert.Equal(t, []string{"/usr/bin/hi", "/usr/bin/hello"}, xFile.RPMPackage.DigestMismatches)
+			}
+		})
+	}
+}
+
+// testRPMHardLink is written as a hard link to ./usr/bin/hello when it is in files.
+// Like rpmbuild, the payload carries the data on the last link only.
+const testRPMHardLink = "./usr/bin/hi"
+
+// buildTestRPM writes a package with a gzip cpio payload of files. The header
+// lists the sha256 of each path's content in digests.
+func buildTestRPM(t *testing.T, files, digests map[string]string) []byte {
+	t.Helper()
+
+	var (
+		payload    bytes.Buffer
+		names      []string
+		dirIndexes []int32
+		modes      []int32
+		sizes      []int32
+		zeros      []int32
+		users      []string
+		sums       []string
+		links      []string
+		inodes     []int32
+	)
+
+	zipWriter := gzip.NewWriter(&payload)
+	cpioWriter := cpio.NewWriter(zipWriter)
+
+	_, hardLink := files[testRPMHardLink]
+
+	for inode, name := range []string{"./etc/hello.conf", testRPMHardLink, "./usr/bin/hello"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		header := &cpio.Header{Name: name, Mode: 0o100644, Size: int64(len(content)), Inode: int64(inode + 1), Links: 1}
+		if hardLink && name != "./etc/hello.conf" {
+			header.Inode, header.Links = 2, 2
+		}
+
+		if name == testRPMHardLink {
+			content, header.Size = files["./usr/bin/hello"], 0
+		}
+
+		require.NoError(t, cpioWriter.WriteHeader(header))
+		_, err := cpioWriter.Write([]byte(content[:header.Size]))
+		require.NoError(t, err)
+
+		sum := sha256.Sum256([]byte(digests[strings.Replace(name, testRPMHardLink, "./usr/bin/hello", 1)]))
+		names = append(names, filepath.Base(name))
+		dirIndexes = append(dirIndexes, map[bool]int32{true: 0, false: 1}[strings.HasPrefix(name, "./etc/")])
+		modes = append(modes, 0o100644)
+		sizes = append(sizes, int32(len(content)))
+		zeros = append(zeros, 0)
+		users = append(users, "root")
+		sums = append(sums, hex.EncodeToString(sum[:]))
+		links = append(links, "")
+		inodes = append(inodes, int32(header.Inode))
+	}
+
+	require.NoError(t, cpioWriter.Close())
+	require.NoError(t, zipWriter.Close())
+
+	header := testRPMHeader([]testRPMTag{
+		{1000, testRPMString, []string{"hello"}},
+		{1001, testRPMString, []string{"1.0"}},
+		{1002, testRPMString, []string{"2"}},
+		{1022, testRPMString, []string{"x86_64"}},
+		{1023, testRPMString, []string{"echo installing"}},
+		{1024, testRPMString, []string{"echo installed"}},
+		{1028, testRPMInt32, sizes},
+		{1030, testRPMInt32, modes}, // int16 in real packages.
+		{1034, testRPMInt32, zeros},
+		{1035, testRPMStringArray, sums},
+		{1036, testRPMStringArray, links},
+		{1037, testRPMInt32, zeros},
+		{1039, testRPMStringArray, users},
+		{1040, testRPMStringArray, users},
+		{1048, testRPMInt32, []int32{0, 0x08 | 0x04}},
+		{1095, testRPMInt32, zeros},
+		{1096, testRPMInt32, inodes},
+		{1049, testRPMStringArray, []string{"bash", "glibc"}},
+		{1050, testRPMStringArray, []string{"", "2.34"}},
+		{1116, testRPMInt32, dirIndexes},
+		{1117, testRPMStringArray, names},
+		{1118, testRPMStringArray, []string{"/etc/", "/usr/bin/"}},
+		{1124, testRPMString, []string{"cpio"}},
+		{1125, testRPMString, []string{"gzip"}},
+		{5011, testRPMInt32, []int32{8}},
+	})
+
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xED, 0xAB, 0xEE, 0xDB, 3, 0})
+	binary.BigEndian.PutUint16(lead[78:], 5) // signature type.
+
+	rpm := append(lead, testRPMHeader(nil)...) // empty signature, already 8-byte aligned.
+	rpm = append(rpm, header...)
+
+	return append(rpm, payload.Bytes()...)
+}
+
+func testRPMHeader(tags []testRPMTag) []byte {
+	var index, store bytes.Buffer
+
+	for _, tag := range tags {
+		switch value := tag.value.(type) {
+		case []int32:
+			for store.Len()%4 != 0 {
+				store.WriteByte(0)
+			}
+
+			_ = binary.Write(&index, binary.BigEndian, []uint32{tag.id, tag.kind, uint32(store.Len()), uint32(len(value))})
+			_ = binary.Write(&store, binary.BigEndian, value)
+		case []string:
+			_ = binary.Write(&index, binary.BigEndian, []uint32{tag.id, tag.kind, uint32(store.Len()), uint32(len(value))})
+
+			for _, str := range value {
+				store.WriteString(str)
+				store.WriteByte(0)
+			}
+		}
+	}
+
+	header := []byte{0x8E, 0xAD, 0xE8, 0x01, 0, 0, 0, 0}
+	header = binary.BigEndian.AppendUint32(header, uint32(len(tags)))
+	header = binary.BigEndian.AppendUint32(header, uint32(store.Len()))
+
+	return append(append(header, index.Bytes()...), store.Bytes()...)
+}
@@ -0,0 +1,186 @@
+package xtractr
+
+/* Code to rename archive members for file systems that reject their names or ignore case. */
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameForm is a Unicode normalization form to write archive member names in.
+type NameForm int
+
+// Unicode normalization forms for XFile.NameForm.
+const (
+	// NameFormNone writes names as they are stored in the archive.
+	NameFormNone NameForm = iota
+	// NameFormNFC composes names: what Linux and Windows software usually writes.
+	NameFormNFC
+	// NameFormNFD decomposes names, like the macOS Finder does.
+	NameFormNFD
+)
+
+// nameRenames remembers how sanitized paths were written, so every entry under a
+// renamed folder lands in the same place, and names that fold together get a suffix.
+type nameRenames struct {
+	written map[string]string // original path, relative to OutputDir -> written path.
+	taken   map[string]string // lower case written path -> the original path written there.
+}
+
+// windowsReserved are device names Windows will not create a file with, with or without an extension.
+//
+//nolint:gochecknoglobals
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true,
+	"COM9": true, "COM¹": true, "COM²": true, "COM³": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true, "LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// WindowsSafeName is a NameSanitizer for output folders on NTFS, exFAT and SMB shares.
+// Characters Windows rejects are replaced or removed like sanitizeFilename does for
+// CUE track titles, trailing dots and spaces are trimmed, and reserved device names
+// like CON or LPT1.txt get an underscore: CON_ and LPT1_.txt.
+func WindowsSafeName(name string) string {
+	name = strings.TrimRight(sanitizeFilename(name), ". ")
+	if name == "" {
+		return "_"
+	}
+
+	// Windows checks the name up to the first dot: CON.tar.gz is reserved too.
+	stem, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		return stem + "_" + name[len(stem):]
+	}
+
+	return name
+}
+
+// normalize returns a name in x.NameForm.
+func (x *XFile) normalize(name string) string {
+	switch x.NameForm {
+	case NameFormNFC:
+		return norm.NFC.String(name)
+	case NameFormNFD:
+		return norm.NFD.String(name)
+	case NameFormNone:
+	}
+
+	return name
+}
+
+// sanitize passes each part of a path in the OutputDir through NameSanitizer. Parts
+// that then match an earlier one without regard to case get ~1, ~2, etc. before the
+// extension. Each rename is recorded in Warnings. Paths outside the OutputDir are
+// returned as is, for pathWithinOutput to reject.
+func (x *XFile) sanitize(path string) string {
+	if x.NameSanitizer == nil {
+		return path
+	}
+
+	rel, err := filepath.Rel(x.OutputDir, path)
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return path
+	}
+
+	state := x.shared()
+	renamed := [][2]string{}
+
+	state.mu.Lock()
+
+	if state.renames == nil {
+		state.renames = &nameRenames{written: map[string]string{}, taken: map[string]string{}}
+	}
+
+	var original, written string
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		original = filepath.Join(original, part)
+
+		if known, ok := state.renames.written[original]; ok {
+			written = known
+			continue
+		}
+
+		written = state.renames.add(original, written, x.safeName(part))
+		if filepath.Base(written) != part {
+			renamed = append(renamed, [2]string{original, written})
+		}
+	}
+
+	state.mu.Unlock()
+
+	for _, names := range renamed {
+		x.warn("renamed %s to %s", names[0], names[1])
+	}
+
+	return filepath.Join(x.OutputDir, written)
+}
+
+// sanitizeLink returns a relative symlink target that points where NameSanitizer wrote
+// the member it names. path is the link as written; its folder is looked up in the
+// renames to find where the target is in the archive. Absolute targets and targets
+// outside the OutputDir are returned as is, for ensureLinkWithinOutput to check.
+func (x *XFile) sanitizeLink(path, linkName string) string {
+	if x.NameSanitizer == nil || filepath.IsAbs(linkName) {
+		return linkName
+	}
+
+	dir, err := filepath.Rel(x.OutputDir, filepath.Dir(path))
+	if err != nil || !filepath.IsLocal(dir) {
+		return linkName
+	}
+
+	state := x.shared()
+
+	state.mu.Lock()
+	if state.renames != nil && state.renames.taken[strings.ToLower(dir)] != "" {
+		dir = state.renames.taken[strings.ToLower(dir)]
+	}
+	state.mu.Unlock()
+
+	target := filepath.Join(dir, linkName)
+	if !filepath.IsLocal(target) {
+		return linkName
+	}
+
+	written, err := filepath.Rel(filepath.Dir(path), x.sanitize(filepath.Join(x.OutputDir, target)))
+	if err != nil {
+		return linkName
+	}
+
+	return written
+}
+
+// safeName returns NameSanitizer's name for a path part, or _ if that is not a single name.
+func (x *XFile) safeName(part string) string {
+	name := x.NameSanitizer(part)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "_"
+	}
+
+	return name
+}
+
+// add records where original is written: name in the parent folder, suffixed if that is taken.
+func (r *nameRenames) add(original, parent, name string) string {
+	ext := filepath.Ext(name)
+	written := filepath.Join(parent, name)
+
+	for attempt := 1; ; attempt++ {
+		owner, taken := r.taken[strings.ToLower(written)]
+		if !taken || owner == original {
+			break
+		}
+
+		written = filepath.Join(parent, strings.TrimSuffix(name, ext)+"~"+strconv.Itoa(attempt)+ext)
+	}
+
+	r.taken[strings.ToLower(written)] = original
+	r.written[original] = written
+
+	return written
+}
@@ -0,0 +1,170 @@
+package xtractr_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/unicode/norm"
+	"golift.io/xtractr"
+)
+
+func TestWindowsSafeName(t *testing.T) {
+	t.Parallel()
+
+	for name, want := range map[string]string{
+		"a:b?.txt":     "a-b.txt",
+		"trailing. . ": "trailing",
+		"CON.txt":      "CON_.txt",
+		"con":          "con_",
+		"LPT1.tar.gz":  "LPT1_.tar.gz",
+		"CONSOLE.txt":  "CONSOLE.txt",
+		"<>|":          "_",
+		"normal.txt":   "normal.txt",
+	} {
+		assert.Equal(t, want, xtractr.WindowsSafeName(name), name)
+	}
+}
+
+func TestNameSanitizer(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	writer := zip.NewWriter(&buf)
+
+	for _, name := range []string{"dir:x/a?.txt", "dir:x/b.txt", "Readme.txt", "README.txt", "CON.txt"} {
+		entry, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = entry.Write([]byte(name))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "linux.zip")
+	require.NoError(t, os.WriteFile(archive, buf.Bytes(), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, NameSanitizer: xtractr.WindowsSafeName,
+	}
+	_, files, err := xtractr.ExtractZIP(xFile)
+	require.NoError(t, err)
+
+	written := map[string]string{
+		"dir-x/a.txt":  "dir:x/a?.txt",
+		"dir-x/b.txt":  "dir:x/b.txt",
+		"Readme.txt":   "Readme.txt",
+		"README~1.txt": "README.txt",
+		"CON_.txt":     "CON.txt",
+	}
+
+	for path, name := range written {
+		assert.Contains(t, files, filepath.Join(out, path))
+
+		data, err := os.ReadFile(filepath.Join(out, path))
+		require.NoError(t, err)
+		assert.Equal(t, name, string(data))
+	}
+
+	assert.ElementsMatch(t, []string{
+		"renamed dir:x to dir-x",
+		"renamed dir:x/a?.txt to dir-x/a.txt",
+		"renamed README.txt to README~1.txt",
+		"renamed CON.txt to CON_.txt",
+	}, xFile.Warnings, "a folder's rename is recorded once, not for each file in it")
+}
+
+func TestNameSanitizerWarningsOnError(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := writeTestTar(t, "bad.tar", testTarEntry{name: "a|b.txt", data: "x"}, testTarEntry{name: "../escape.txt", data: "x"})
+
+	_, _, _, err := xtractr.ExtractFile(&xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700,
+		NameSanitizer: xtractr.WindowsSafeName,
+	})
+	require.ErrorIs(t, err, xtractr.ErrInvalidPath)
+
+	var extErr *xtractr.ExtractError
+	require.True(t, errors.As(err, &extErr))
+	assert.Equal(t, []string{"renamed a|b.txt to ab.txt"}, extErr.Warnings)
+}
+
+func TestNameSanitizerSymlinks(t *testing.T) {
+	t.Parallel()
+
+	symlink := func(name, target string) testTarEntry {
+		return testTarEntry{name: name, header: tar.Header{Linkname: target, Typeflag: tar.TypeSymlink}}
+	}
+
+	tmp := t.TempDir()
+	archive := writeTestTar(t, "links.tar",
+		symlink("early", "late?.txt"), // before the file it points to.
+		testTarEntry{name: "dir:x/a?.txt", data: "hi"},
+		symlink("dir:x/link", "a?.txt"),
+		symlink("top", "dir:x/a?.txt"),
+		symlink("dir:x/sub:y/up", "../a?.txt"),
+		testTarEntry{name: "late?.txt", data: "late"},
+	)
+
+	out := filepath.Join(tmp, "out")
+	_, _, err := xtractr.ExtractTar(&xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, NameSanitizer: xtractr.WindowsSafeName,
+	})
+	require.NoError(t, err)
+
+	for link, want := range map[string]string{
+		"early":          "late.txt",
+		"dir-x/link":     "a.txt",
+		"top":            filepath.Join("dir-x", "a.txt"),
+		"dir-x/sub-y/up": filepath.Join("..", "a.txt"),
+	} {
+		target, err := os.Readlink(filepath.Join(out, link))
+		require.NoError(t, err)
+		assert.Equal(t, want, target, "the target is renamed like the file it points to")
+		assert.FileExists(t, filepath.Join(out, link))
+	}
+}
+
+func TestNameForm(t *testing.T) {
+	t.Parallel()
+
+	// Café/Résumé.txt as macOS stores it: each accent is a combining character.
+	nfd := norm.NFD.String("Café/Résumé.txt")
+	nfc := norm.NFC.String(nfd)
+	require.NotEqual(t, nfc, nfd)
+
+	tmp := t.TempDir()
+	archive := writeTestTar(t, "mac.tar",
+		testTarEntry{name: nfd, data: "hi"},
+		testTarEntry{name: "link", header: tar.Header{Linkname: nfd, Typeflag: tar.TypeSymlink}},
+	)
+
+	for form, want := range map[xtractr.NameForm]string{xtractr.NameFormNFC: nfc, xtractr.NameFormNone: nfd} {
+		out := filepath.Join(tmp, fmt.Sprint(form))
+		_, files, err := xtractr.ExtractTar(&xtractr.XFile{
+			FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, NameForm: form,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{want, "link"}, files)
+
+		data, err := os.ReadFile(filepath.Join(out, want))
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(data))
+
+		target, err := os.Readlink(filepath.Join(out, "link"))
+		require.NoError(t, err)
+		assert.Equal(t, want, target, "the symlink still points at the file")
+	}
+}
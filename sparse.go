@@ -0,0 +1,420 @@
+package xtractr
+
+/* Code to write files with holes, so runs of zeros in disk images take no space. */
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sparseBlock is the size of the zero runs sparseWriter skips. File systems allocate
+// space in blocks this size or smaller, so a smaller run would not leave a hole.
+const sparseBlock = 4096
+
+// tarMaxSparseHeaders caps how much of an entry's headers are kept to read a sparse map from.
+// archive/tar allows 1 MiB for each PAX header, long name and sparse map.
+const tarMaxSparseHeaders = 4 << 20
+
+// Where the old GNU sparse map is in a header block, and in the extension blocks after it.
+const (
+	gnuSparseStart      = 386
+	gnuSparseEntries    = 4
+	gnuSparseExtended   = 482
+	gnuSparseExtEntries = 21
+	gnuSparseExtFlag    = 504
+	gnuSparseEntrySize  = 24 // a 12 byte offset, then a 12 byte length.
+)
+
+// sparseRange is a part of a sparse file: data the archive stores, or a hole it does not.
+type sparseRange struct {
+	offset int64
+	length int64
+}
+
+// sparseWriter writes a file, seeking over holes instead of writing them. Holes are
+// the ranges a sparse map leaves out, or, with scan, aligned blocks of zeros.
+// Skipped bytes read back as zeros; the file system stores nothing for them.
+// Windows allocates the skipped blocks unless the file is marked sparse, so there
+// the output is only correct, not smaller.
+type sparseWriter struct {
+	file  *os.File
+	holes []sparseRange // from a sparse map, in order.
+	scan  bool          // look for blocks of zeros outside the holes.
+	size  int64         // bytes written, skipped and in block.
+	hole  int64         // zeros skipped since the last write.
+	block []byte        // the start of a block being scanned, until the block is whole.
+}
+
+// Write writes the parts of data that are not in a hole.
+func (s *sparseWriter) Write(data []byte) (int, error) {
+	for done := 0; done < len(data); {
+		inHole, next := s.next()
+		chunk := data[done:]
+
+		if next >= 0 && next < int64(len(chunk)) {
+			chunk = chunk[:next]
+		}
+
+		var err error
+
+		switch {
+		case inHole:
+			err = s.skip(int64(len(chunk)))
+		case s.scan:
+			err = s.scanZeros(chunk)
+		default:
+			err = s.write(chunk)
+		}
+
+		if err != nil {
+			return done, err
+		}
+
+		done += len(chunk)
+	}
+
+	return len(data), nil
+}
+
+// next returns true if the file's end is in a hole of the sparse map, and how many bytes
+// are left until that changes. That is -1 when there are no more holes.
+func (s *sparseWriter) next() (bool, int64) {
+	for len(s.holes) > 0 && s.holes[0].offset+s.holes[0].length <= s.size {
+		s.holes = s.holes[1:]
+	}
+
+	switch {
+	case len(s.holes) == 0:
+		return false, -1
+	case s.holes[0].offset <= s.size:
+		return true, s.holes[0].offset + s.holes[0].length - s.size
+	default:
+		return false, s.holes[0].offset - s.size
+	}
+}
+
+// scanZeros adds data to the block being scanned. Blocks start at multiples of
+// sparseBlock in the file, so a block of zeros is one the file system can leave out.
+func (s *sparseWriter) scanZeros(data []byte) error {
+	for len(data) > 0 {
+		room := sparseBlock - int(s.size%sparseBlock)
+		part := data[:min(room, len(data))]
+		s.block = append(s.block, part...)
+		s.size += int64(len(part))
+		data = data[len(part):]
+
+		if s.size%sparseBlock == 0 {
+			if err := s.flushBlock(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// flushBlock skips the block being scanned if it is all zeros, or writes it.
+func (s *sparseWriter) flushBlock() error {
+	if len(s.block) == 0 {
+		return nil
+	}
+
+	block := s.block
+	s.block = s.block[:0]
+
+	if len(bytes.TrimLeft(block, "\x00")) == 0 {
+		s.hole += int64(len(block))
+		return nil
+	}
+
+	return s.writeAt(block)
+}
+
+// skip moves past a hole.
+func (s *sparseWriter) skip(size int64) error {
+	if err := s.flushBlock(); err != nil {
+		return err
+	}
+
+	s.hole += size
+	s.size += size
+
+	return nil
+}
+
+// write writes data that is not scanned for zeros.
+func (s *sparseWriter) write(data []byte) error {
+	if err := s.flushBlock(); err != nil {
+		return err
+	}
+
+	s.size += int64(len(data))
+
+	return s.writeAt(data)
+}
+
+// writeAt writes data after the zeros skipped since the last write.
+func (s *sparseWriter) writeAt(data []byte) error {
+	if s.hole != 0 {
+		if _, err := s.file.Seek(s.hole, io.SeekCurrent); err != nil {
+			return fmt.Errorf("seeking sparse file hole: %w", err)
+		}
+
+		s.hole = 0
+	}
+
+	if _, err := s.file.Write(data); err != nil {
+		return fmt.Errorf("writing sparse file: %w", err)
+	}
+
+	return nil
+}
+
+// finish writes or skips the last partial block, and sets the file size,
+// so a file that ends in zeros ends in a hole of the right length.
+func (s *sparseWriter) finish() error {
+	if err := s.flushBlock(); err != nil {
+		return err
+	}
+
+	if s.hole == 0 {
+		return nil
+	}
+
+	if err := s.file.Truncate(s.size); err != nil {
+		return fmt.Errorf("sizing sparse file: %w", err)
+	}
+
+	return nil
+}
+
+// tarStream reads a tar archive, and the sparse maps tar.Reader reads and keeps to itself.
+// The reader returns the holes in a map as zeros; holes says where they are.
+type tarStream struct {
+	*tar.Reader
+	tap *tarTap
+	// sparse is true if the entry has a sparse map, and holes has its holes when the map
+	// could be read. Without one, sparseWriter looks for blocks of zeros instead.
+	sparse bool
+	holes  []sparseRange
+}
+
+// tarTap keeps what tar.Reader reads while it reads the headers for an entry.
+type tarTap struct {
+	reader io.Reader
+	read   int64 // bytes read from the start of the archive.
+	start  int64 // where headers starts in the archive.
+	record bool
+	// full is true if headers got too long to keep, and is not all tar.Reader read.
+	full bool
+	// headers is what tar.Reader read for the last entry: padding, then its header blocks.
+	headers []byte
+}
+
+func newTarStream(reader io.Reader) *tarStream {
+	tap := &tarTap{reader: reader}
+	return &tarStream{Reader: tar.NewReader(tap), tap: tap}
+}
+
+func (t *tarTap) Read(data []byte) (int, error) {
+	size, err := t.reader.Read(data)
+	t.read += int64(size)
+
+	if t.record && len(t.headers)+size > tarMaxSparseHeaders {
+		t.record, t.full = false, true
+	} else if t.record {
+		t.headers = append(t.headers, data[:size]...)
+	}
+
+	return size, err //nolint:wrapcheck // tar.Reader wraps it.
+}
+
+// Next reads the rest of the current entry, so the headers of the next one are all tar.Reader
+// reads while it finds it. Then it returns the next header, and reads its sparse map.
+func (t *tarStream) Next() (*tar.Header, error) {
+	if _, err := io.Copy(io.Discard, t.Reader); err != nil {
+		return nil, fmt.Errorf("reading tar entry: %w", err)
+	}
+
+	t.tap.headers, t.tap.start, t.tap.record, t.tap.full = t.tap.headers[:0], t.tap.read, true, false
+	header, err := t.Reader.Next()
+	t.tap.record = false
+
+	if err != nil {
+		return header, err //nolint:wrapcheck // callers wrap it.
+	}
+
+	t.sparse, t.holes = false, nil
+
+	switch major := header.PAXRecords["GNU.sparse.major"]; {
+	case header.Typeflag == tar.TypeGNUSparse, major == "1":
+		t.sparse = true
+		t.holes = sparseHoles(t.tap.sparseMap(), header.Size)
+	case header.PAXRecords["GNU.sparse.map"] != "":
+		// archive/tar turns 0.0 GNU.sparse.offset and numbytes records into a 0.1 map.
+		t.sparse = true
+		t.holes = sparseHoles(paxSparseMap(header.PAXRecords["GNU.sparse.map"]), header.Size)
+	}
+
+	return header, nil
+}
+
+// sparseMap reads the map of an old GNU sparse header, and its extension blocks,
+// or the GNU 1.0 map at the start of the entry's data. PAX and long name headers
+// before the entry's header are skipped. It returns nil if there is no map to read.
+func (t *tarTap) sparseMap() []sparseRange {
+	if t.full {
+		return nil
+	}
+
+	// Headers start at a block boundary, after the padding of the last entry.
+	headers := t.headers[min(int64(len(t.headers)), (tarBlockSize-t.start%tarBlockSize)%tarBlockSize):]
+
+	for len(headers) >= tarBlockSize && isTarHeader(headers[:tarBlockSize]) {
+		const sizeStart, sizeEnd, typeflag = 124, 136, 156
+
+		switch headers[typeflag] {
+		case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, ok := tarNumber(headers[sizeStart:sizeEnd])
+			if skip := tarBlockSize + (size+tarBlockSize-1)/tarBlockSize*tarBlockSize; ok && skip <= int64(len(headers)) {
+				headers = headers[skip:]
+				continue
+			}
+
+			return nil
+		case tar.TypeGNUSparse:
+			return oldGNUSparseMap(headers)
+		default:
+			return gnuSparseMap1(headers[tarBlockSize:])
+		}
+	}
+
+	return nil
+}
+
+// oldGNUSparseMap reads the map in an old GNU sparse header, and the extension blocks after it.
+func oldGNUSparseMap(blocks []byte) []sparseRange {
+	entries, start, count, extended := []sparseRange{}, gnuSparseStart, gnuSparseEntries, gnuSparseExtended
+
+	for {
+		for idx := range count {
+			entry := blocks[start+idx*gnuSparseEntrySize:]
+			if entry[0] == 0 {
+				break
+			}
+
+			offset, ok1 := tarNumber(entry[:gnuSparseEntrySize/2])
+			length, ok2 := tarNumber(entry[gnuSparseEntrySize/2 : gnuSparseEntrySize])
+
+			if !ok1 || !ok2 {
+				return nil
+			}
+
+			entries = append(entries, sparseRange{offset: offset, length: length})
+		}
+
+		if blocks[extended] == 0 {
+			return entries
+		}
+
+		if blocks = blocks[tarBlockSize:]; len(blocks) < tarBlockSize {
+			return nil
+		}
+
+		start, count, extended = 0, gnuSparseExtEntries, gnuSparseExtFlag
+	}
+}
+
+// gnuSparseMap1 reads a GNU 1.0 map: newline terminated decimal numbers, the
+// count of entries, then the offset and length of each.
+func gnuSparseMap1(data []byte) []sparseRange {
+	fields := strings.Split(string(data), "\n")
+
+	count, err := strconv.Atoi(fields[0])
+	if err != nil || count < 0 || count > (len(fields)-1)/2 {
+		return nil
+	}
+
+	return paxSparseMap(strings.Join(fields[1:1+count*2], ","))
+}
+
+// paxSparseMap reads a GNU.sparse.map record: comma separated offsets and lengths.
+func paxSparseMap(record string) []sparseRange {
+	fields := strings.Split(record, ",")
+	if len(fields)%2 != 0 {
+		return nil
+	}
+
+	entries := []sparseRange{}
+
+	for idx := 0; idx < len(fields); idx += 2 {
+		offset, err1 := strconv.ParseInt(fields[idx], 10, 64)
+		length, err2 := strconv.ParseInt(fields[idx+1], 10, 64)
+
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+
+		entries = append(entries, sparseRange{offset: offset, length: length})
+	}
+
+	return entries
+}
+
+// sparseHoles returns the ranges of a file of size that a sparse map's data entries
+// leave out. It returns nil if there is no map, or its entries are out of order.
+func sparseHoles(entries []sparseRange, size int64) []sparseRange {
+	if entries == nil {
+		return nil
+	}
+
+	holes, end := []sparseRange{}, int64(0)
+
+	for _, entry := range entries {
+		if entry.offset < end || entry.length < 0 || entry.offset+entry.length > size {
+			return nil
+		}
+
+		if entry.offset > end {
+			holes = append(holes, sparseRange{offset: end, length: entry.offset - end})
+		}
+
+		end = entry.offset + entry.length
+	}
+
+	if end < size {
+		holes = append(holes, sparseRange{offset: end, length: size - end})
+	}
+
+	return holes
+}
+
+// tarNumber reads a numeric header field: octal, or base-256 with the high bit set.
+func tarNumber(field []byte) (int64, bool) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		var value int64
+
+		for idx, b := range field {
+			if idx == 0 {
+				b &= 0x7f
+			}
+
+			if value > (1<<63-1)>>8 { //nolint:mnd // it would overflow.
+				return 0, false
+			}
+
+			value = value<<8 | int64(b)
+		}
+
+		return value, true
+	}
+
+	value, err := strconv.ParseInt(strings.Trim(string(field), " \x00"), 8, 64)
+
+	return value, err == nil && value >= 0
+}
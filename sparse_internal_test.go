@@ -0,0 +1,62 @@
+//go:build unix
+
+package xtractr
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparseWriterAlignsBlocks(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "aligned")
+	fout, err := os.Create(path)
+	require.NoError(t, err)
+
+	defer fout.Close()
+
+	// A write that starts inside a block: its first 4 KiB reach into the second
+	// block, which is all zeros and must be left out even so.
+	data := make([]byte, 8192)
+	data[0] = 1
+	writer := &sparseWriter{file: fout, scan: true}
+
+	for _, write := range [][]byte{make([]byte, 3000), data, make([]byte, 100)} {
+		wrote, err := writer.Write(write)
+		require.NoError(t, err)
+		assert.Len(t, write, wrote)
+	}
+
+	require.NoError(t, writer.finish())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, content, 3000+8192+100)
+	assert.Equal(t, byte(1), content[3000])
+
+	info, err := fout.Stat()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Sys().(*syscall.Stat_t).Blocks*512, int64(sparseBlock), //nolint:forcetypeassert
+		"only the first block is written")
+}
+
+func TestSparseHoles(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []sparseRange{{offset: 10, length: 10}, {offset: 30, length: 70}},
+		sparseHoles(paxSparseMap("0,10,20,10,100,0"), 100))
+	assert.Equal(t, []sparseRange{}, sparseHoles(gnuSparseMap1([]byte("1\n0\n100\n")), 100), "no holes")
+	assert.Nil(t, sparseHoles(paxSparseMap("20,10,0,10"), 100), "out of order")
+	assert.Nil(t, sparseHoles(gnuSparseMap1([]byte("2\n0\n10\n")), 100), "short map")
+	assert.Nil(t, sparseHoles(paxSparseMap("0,200"), 100), "past the end")
+
+	size, ok := tarNumber([]byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0})
+	assert.True(t, ok)
+	assert.Equal(t, int64(256), size, "base-256")
+}
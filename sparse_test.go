@@ -0,0 +1,187 @@
+//go:build unix
+
+package xtractr_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+const sparseSize = 1 << 20
+
+// allocated returns the bytes of disk a file uses, or skips the test if
+// the file system under the temp folder does not support holes.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	return info.Sys().(*syscall.Stat_t).Blocks * 512 //nolint:forcetypeassert
+}
+
+// paxRecord formats a PAX extended header record: its length, a space, key=value and a newline.
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record) + len(strconv.Itoa(len(record)))
+
+	if len(strconv.Itoa(size)) > len(strconv.Itoa(len(record))) {
+		size++
+	}
+
+	return strconv.Itoa(size) + record
+}
+
+// tarHeaderBlock returns a ustar header block. archive/tar can not write
+// the GNU sparse records, so the sparse tarballs are put together by hand.
+func tarHeaderBlock(name string, typeflag byte, size int) []byte {
+	block := make([]byte, 512)
+	copy(block, name)
+	copy(block[100:], "0000644\x00")
+	copy(block[108:], "0000000\x00")
+	copy(block[116:], "0000000\x00")
+	copy(block[124:], fmt.Sprintf("%011o\x00", size))
+	copy(block[136:], "00000000000\x00")
+	block[156] = typeflag
+	copy(block[257:], "ustar\x0000")
+
+	return tarChecksum(block)
+}
+
+// tarChecksum sets a header block's checksum: the byte sum of the block with its own field as spaces.
+func tarChecksum(block []byte) []byte {
+	copy(block[148:], "        ")
+
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+
+	copy(block[148:], fmt.Sprintf("%06o\x00 ", sum))
+
+	return block
+}
+
+// padBlock pads data to a whole number of tar blocks.
+func padBlock(data string) string {
+	return data + strings.Repeat("\x00", (512-len(data)%512)%512)
+}
+
+// sparseData is what the sparse tarballs store of a 1 MiB file: 4 KiB of x and a 4 KiB block
+// of zeros at its start, and 4 KiB of y at its end. The rest is a hole.
+var sparseData = strings.Repeat("x", 4096) + strings.Repeat("\x00", 4096) + strings.Repeat("y", 4096)
+
+// sparseTar returns a tarball holding disk.img, with its sparse map in a GNU sparse
+// format: "old" (the S type flag), "0.1" or "1.0" (PAX records).
+func sparseTar(format string) []byte {
+	var (
+		buf     bytes.Buffer
+		records string
+		header  []byte
+		data    = sparseData
+	)
+
+	switch format {
+	case "old":
+		header = tarHeaderBlock("disk.img", tar.TypeGNUSparse, len(data))
+		copy(header[257:], "ustar  \x00")
+		copy(header[386:], fmt.Sprintf("%011o\x00%011o\x00", 0, 8192))
+		copy(header[410:], fmt.Sprintf("%011o\x00%011o\x00", sparseSize-4096, 4096))
+		copy(header[483:], fmt.Sprintf("%011o\x00", sparseSize))
+		header = tarChecksum(header)
+	case "0.1":
+		records = paxRecord("GNU.sparse.major", "0") + paxRecord("GNU.sparse.minor", "1") +
+			paxRecord("GNU.sparse.name", "disk.img") + paxRecord("GNU.sparse.size", strconv.Itoa(sparseSize)) +
+			paxRecord("GNU.sparse.numblocks", "2") +
+			paxRecord("GNU.sparse.map", "0,8192,"+strconv.Itoa(sparseSize-4096)+",4096")
+		header = tarHeaderBlock("./GNUSparseFile.0/disk.img", tar.TypeReg, len(data))
+	case "1.0":
+		records = paxRecord("GNU.sparse.major", "1") + paxRecord("GNU.sparse.minor", "0") +
+			paxRecord("GNU.sparse.name", "disk.img") + paxRecord("GNU.sparse.realsize", strconv.Itoa(sparseSize))
+		data = padBlock("2\n0\n8192\n"+strconv.Itoa(sparseSize-4096)+"\n4096\n") + data
+		header = tarHeaderBlock("./GNUSparseFile.0/disk.img", tar.TypeReg, len(data))
+	}
+
+	if records != "" {
+		buf.Write(tarHeaderBlock("./PaxHeaders/disk.img", tar.TypeXHeader, len(records)))
+		buf.WriteString(padBlock(records))
+	}
+
+	buf.Write(header)
+	buf.WriteString(padBlock(data))
+	buf.Write(make([]byte, 1024))
+
+	return buf.Bytes()
+}
+
+func TestSparseTar(t *testing.T) {
+	t.Parallel()
+
+	for _, format := range []string{"old", "0.1", "1.0"} {
+		t.Run(format, func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			archive := filepath.Join(tmp, "sparse.tar")
+			require.NoError(t, os.WriteFile(archive, sparseTar(format), 0o600))
+
+			out := filepath.Join(tmp, "out")
+			_, files, err := xtractr.ExtractTar(&xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"disk.img"}, files)
+
+			path := filepath.Join(out, "disk.img")
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.Len(t, data, sparseSize)
+			assert.Equal(t, sparseData[:8192], string(data[:8192]))
+			assert.Equal(t, make([]byte, sparseSize-8192-4096), data[8192:sparseSize-4096])
+			assert.Equal(t, sparseData[8192:], string(data[sparseSize-4096:]))
+
+			// The map says where the holes are: the block of zeros it stores is written.
+			assert.Less(t, allocated(t, path), int64(sparseSize/2), "the hole is not written")
+			assert.GreaterOrEqual(t, allocated(t, path), int64(len(sparseData)), "stored zeros are written")
+		})
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	t.Parallel()
+
+	// Data, a hole, data, then a hole at the end that only sets the size.
+	content := append([]byte("head"), make([]byte, sparseSize)...)
+	content = append(content, []byte("middle")...)
+	content = append(content, make([]byte, sparseSize)...)
+
+	tmp := t.TempDir()
+	archive := writeTestTar(t, "zeros.tar", testTarEntry{name: "db.bin", data: string(content)})
+
+	for sparse, check := range map[bool]func(assert.TestingT, any, any, ...any) bool{
+		true:  assert.Less,
+		false: assert.GreaterOrEqual,
+	} {
+		out := filepath.Join(tmp, map[bool]string{true: "sparse", false: "dense"}[sparse])
+		size, _, err := xtractr.ExtractTar(&xtractr.XFile{
+			FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, SparseFiles: sparse,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(content)), size, "progress counts the holes")
+
+		path := filepath.Join(out, "db.bin")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, data)
+		check(t, allocated(t, path), int64(sparseSize))
+	}
+}
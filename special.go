@@ -0,0 +1,132 @@
+package xtractr
+
+/* Code to handle device nodes, FIFOs and sockets in archives, and setuid and setgid bits. */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SpecialFilePolicy says what to do with the device nodes, FIFOs and sockets in tar and cpio archives.
+type SpecialFilePolicy int
+
+// Special file policies for XFile.SpecialFilePolicy.
+const (
+	// SpecialFilesSkip skips special files, with a warning. This is the default.
+	SpecialFilesSkip SpecialFilePolicy = iota
+	// SpecialFilesCreate creates special files with mknod (Linux only). Device nodes
+	// need root; entries that can not be created are skipped with a warning.
+	SpecialFilesCreate
+	// SpecialFilesFail stops the extraction with ErrSpecialFile.
+	SpecialFilesFail
+)
+
+// SetuidPolicy says what to do with setuid and setgid bits on extracted files.
+type SetuidPolicy int
+
+// Setuid policies for XFile.SetuidPolicy.
+const (
+	// StripSetuid removes setuid and setgid bits from files, with a warning. This is
+	// the default, so an archive can not plant a program that runs as its owner.
+	StripSetuid SetuidPolicy = iota
+	// KeepSetuid writes files with their setuid and setgid bits. With PreserveXattrs,
+	// it also restores security.* (like file capabilities) and trusted.* attributes.
+	KeepSetuid
+)
+
+// specialModes are the file types SpecialFilePolicy applies to.
+const specialModes = os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket
+
+// fileDevice is the major and minor number of an archived device node.
+type fileDevice struct {
+	major uint32
+	minor uint32
+}
+
+// writeSpecial applies SpecialFilePolicy to a device node, FIFO or socket. It
+// returns errSkipEntry for entries that are not created.
+func (x *XFile) writeSpecial(file *file) error {
+	kind, name := specialKind(file.FileMode), x.relPath(file.Path)
+
+	switch x.SpecialFilePolicy {
+	case SpecialFilesFail:
+		return fmt.Errorf("%w: %s %s", ErrSpecialFile, kind, name)
+	case SpecialFilesCreate:
+		err := x.makeSpecial(file)
+		if err == nil {
+			x.Debugf("Created archived %s: %s", kind, file.Path)
+			return nil
+		}
+
+		x.warn("skipped %s %s: %v", kind, name, err)
+	case SpecialFilesSkip:
+		x.warn("skipped %s %s", kind, name)
+	}
+
+	return errSkipEntry
+}
+
+// makeSpecial creates a special file in place of anything at its path, like untarLink does for links.
+func (x *XFile) makeSpecial(file *file) error {
+	err := x.mkDir(filepath.Dir(file.Path), file.DirMode, file.Mtime)
+	if err != nil {
+		return fmt.Errorf("making parent dir: %w", err)
+	}
+
+	if err = os.Remove(file.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing existing path: %w", err)
+	}
+
+	if file.FileMode&os.ModeDevice != 0 && file.Device == nil {
+		return ErrNoDeviceNumbers
+	}
+
+	if err = mknod(file.Path, file.FileMode, file.Device); err != nil {
+		return err
+	}
+
+	x.restoreMetadata(file)
+
+	// The error is ignored because it's not critical, like in writeFile.
+	_ = os.Chtimes(file.Path, file.Atime, file.Mtime)
+
+	return nil
+}
+
+// specialKind names the type of a special file for warnings and errors.
+func specialKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	case mode&os.ModeNamedPipe != 0:
+		return "FIFO"
+	default:
+		return "socket"
+	}
+}
+
+// stripSetuid removes setuid and setgid bits from a file's mode with StripSetuid, and records a warning.
+func (x *XFile) stripSetuid(path string, mode os.FileMode) os.FileMode {
+	const setuid = os.ModeSetuid | os.ModeSetgid
+
+	if x.SetuidPolicy != StripSetuid || mode&setuid == 0 || mode.IsDir() {
+		return mode
+	}
+
+	x.warn("removed setuid and setgid bits from %s", x.relPath(path))
+
+	return mode &^ setuid
+}
+
+// relPath returns a path relative to the OutputDir for warnings, or the path if it is not in it.
+func (x *XFile) relPath(path string) string {
+	if rel, err := filepath.Rel(x.OutputDir, path); err == nil && filepath.IsLocal(rel) {
+		return rel
+	}
+
+	return path
+}
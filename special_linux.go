@@ -0,0 +1,32 @@
+package xtractr
+
+import (
+	"os"
+	"syscall"
+)
+
+// mknod creates a device node, FIFO or socket file with mknod.
+func mknod(path string, mode os.FileMode, device *fileDevice) error {
+	var kind uint32
+
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		kind = syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		kind = syscall.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		kind = syscall.S_IFIFO
+	default:
+		kind = syscall.S_IFSOCK
+	}
+
+	var dev uint64
+
+	if device != nil {
+		// The glibc makedev() layout: 12 bits of major and 20 of minor, split around each other.
+		major, minor := uint64(device.major), uint64(device.minor)
+		dev = minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32 //nolint:mnd
+	}
+
+	return syscall.Mknod(path, kind|uint32(mode.Perm()), int(dev)) //nolint:wrapcheck
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package xtractr
+
+import "os"
+
+// mknod creates a device node, FIFO or socket file. Only Linux is supported.
+func mknod(_ string, _ os.FileMode, _ *fileDevice) error {
+	return ErrSpecialFilesUnsupported
+}
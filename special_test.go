@@ -0,0 +1,116 @@
+package xtractr_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// specialTar returns a tarball with a FIFO, a character device and a setuid program.
+func specialTar(t *testing.T) string {
+	t.Helper()
+
+	return writeTestTar(t, "special.tar",
+		testTarEntry{name: "dev/fifo", header: tar.Header{Typeflag: tar.TypeFifo}},
+		testTarEntry{name: "dev/null", header: tar.Header{Mode: 0o666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+		testTarEntry{name: "bin/su", data: "su", header: tar.Header{Mode: 0o6755}},
+	)
+}
+
+func TestSpecialFilesSkip(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+	xFile := &xtractr.XFile{FilePath: specialTar(t), OutputDir: out, FileMode: 0o600, DirMode: 0o700}
+	_, files, err := xtractr.ExtractTar(xFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bin/su"}, files, "skipped entries are not listed")
+	assert.NoFileExists(t, filepath.Join(out, "dev", "fifo"))
+	assert.NoFileExists(t, filepath.Join(out, "dev", "null"))
+
+	info, err := os.Stat(filepath.Join(out, "bin", "su"))
+	require.NoError(t, err)
+	assert.Zero(t, info.Mode()&(os.ModeSetuid|os.ModeSetgid), "setuid is stripped by default")
+
+	assert.Equal(t, []string{
+		filepath.Join("skipped FIFO dev", "fifo"),
+		filepath.Join("skipped character device dev", "null"),
+		filepath.Join("removed setuid and setgid bits from bin", "su"),
+	}, xFile.Warnings)
+}
+
+func TestSpecialFilesFail(t *testing.T) {
+	t.Parallel()
+
+	_, _, _, err := xtractr.ExtractFile(&xtractr.XFile{
+		FilePath: specialTar(t), OutputDir: filepath.Join(t.TempDir(), "out"), FileMode: 0o600, DirMode: 0o700,
+		SpecialFilePolicy: xtractr.SpecialFilesFail,
+	})
+	require.ErrorIs(t, err, xtractr.ErrSpecialFile)
+}
+
+func TestSpecialFilesCreate(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("special files are only created on Linux")
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	xFile := &xtractr.XFile{
+		FilePath: specialTar(t), OutputDir: out, FileMode: 0o600, DirMode: 0o700,
+		SpecialFilePolicy: xtractr.SpecialFilesCreate, SetuidPolicy: xtractr.KeepSetuid,
+	}
+	_, files, err := xtractr.ExtractTar(xFile)
+	require.NoError(t, err)
+	assert.Contains(t, files, "dev/fifo")
+
+	info, err := os.Lstat(filepath.Join(out, "dev", "fifo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe, info.Mode().Type())
+
+	// Device nodes need root, and may be refused in containers even then.
+	if info, err = os.Lstat(filepath.Join(out, "dev", "null")); err == nil {
+		assert.Equal(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type())
+	} else {
+		assert.Len(t, xFile.Warnings, 1)
+	}
+
+	info, err = os.Stat(filepath.Join(out, "bin", "su"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSetuid|os.ModeSetgid, info.Mode()&(os.ModeSetuid|os.ModeSetgid))
+}
+
+func TestSpecialFilesCPIO(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	writer := cpio.NewWriter(&buf)
+	require.NoError(t, writer.WriteHeader(&cpio.Header{Name: "dev/console", Mode: cpio.TypeChar | 0o600}))
+	require.NoError(t, writer.WriteHeader(&cpio.Header{Name: "init", Mode: 0o100755, Size: 1}))
+	_, err := writer.Write([]byte("#"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "initrd.cpio")
+	require.NoError(t, os.WriteFile(archive, buf.Bytes(), 0o600))
+
+	xFile := &xtractr.XFile{
+		FilePath: archive, OutputDir: filepath.Join(tmp, "out"), FileMode: 0o600, DirMode: 0o700,
+		SpecialFilePolicy: xtractr.SpecialFilesCreate,
+	}
+	_, files, err := xtractr.ExtractCPIO(xFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmp, "out", "init")}, files)
+	assert.Len(t, xFile.Warnings, 1, "cpio device numbers are not read, so the node is skipped")
+}
@@ -2,6 +2,7 @@ package xtractr
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"errors"
@@ -9,6 +10,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	lzw "github.com/sshaman1101/dcompress"
@@ -17,7 +20,12 @@ import (
 )
 
 // ExtractTar extracts a raw (non-compressed) tar archive.
+// With xFile.FlattenImages set, container image tarballs are passed to ExtractOCI.
 func ExtractTar(xFile *XFile) (size uint64, filesList []string, err error) {
+	if xFile.FlattenImages && isOCITarball(xFile.FilePath) {
+		return ExtractOCI(xFile)
+	}
+
 	tarFile, stat, err := openStatFile(xFile.FilePath)
 	if err != nil {
 		return 0, nil, err
@@ -130,20 +138,47 @@ func ExtractTarLzip(xFile *XFile) (size uint64, filesList []string, err error) {
 // errSkipEntry is returned for non-fatal archive members that should be ignored.
 var errSkipEntry = errors.New("skip archive entry")
 
+// tarBlockSize is the size of a tar header and of the zero blocks that end an archive.
+const tarBlockSize = 512
+
+// untar extracts a tar stream. Archives concatenated onto the first one, like
+// the members of a multi-member gzip file, are extracted too.
 func (x *XFile) untar(reader io.Reader) ([]string, error) {
-	tarReader := tar.NewReader(reader)
+	files := []string{}
+	names := newNameDecoders(x, "tar")
+
+	for reader != nil {
+		written, err := x.untarArchive(newTarStream(reader), names)
+		files = append(files, written...)
+
+		if err != nil {
+			return files, err
+		}
+
+		reader = x.nextTarArchive(reader)
+	}
+
+	files, err := x.cleanup(files)
+
+	return files, err
+}
+
+func (x *XFile) untarArchive(tarReader *tarStream, names *nameDecoders) ([]string, error) {
 	files := []string{}
 
 	for {
 		header, err := tarReader.Next()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				break
+				return files, nil
 			}
 
 			return files, fmt.Errorf("%s: tarReader.Next: %w", x.FilePath, err)
 		}
 
+		header.Name = x.normalize(names.decodeStream(header.Name))
+		header.Linkname = names.decodeStream(header.Linkname)
+
 		fSize, err := x.untarFile(header, tarReader)
 		if errors.Is(err, errSkipEntry) {
 			continue
@@ -157,20 +192,82 @@ func (x *XFile) untar(reader io.Reader) ([]string, error) {
 		x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
 			header.Name, fSize, x.prog.Files, x.prog.Wrote)
 	}
+}
 
-	files, err := x.cleanup(files)
+// nextTarArchive skips the zero blocks that pad the end of a tar archive. If another
+// archive follows, it returns a reader starting at that archive's first header.
+// The tar reader stops right after the two zero blocks that end an archive, so
+// reader is still block aligned.
+func (x *XFile) nextTarArchive(reader io.Reader) io.Reader {
+	var block, zero [tarBlockSize]byte
 
-	return files, err
+	for {
+		if _, err := io.ReadFull(reader, block[:]); err != nil {
+			return nil // end of input, or trailing data that is not a whole block.
+		}
+
+		if block == zero {
+			continue
+		}
+
+		if !isTarHeader(block[:]) {
+			x.Debugf("Ignoring data after the end of tar archive: %s", x.FilePath)
+			return nil
+		}
+
+		x.Debugf("Found another tar archive concatenated in: %s", x.FilePath)
+
+		return io.MultiReader(bytes.NewReader(block[:]), reader)
+	}
+}
+
+// isTarHeader reports whether a block has a valid tar header checksum.
+// The checksum is the byte sum of the header with its own field read as spaces.
+func isTarHeader(block []byte) bool {
+	const chksumStart, chksumEnd = 148, 156
+
+	want, err := strconv.ParseInt(strings.Trim(string(block[chksumStart:chksumEnd]), " \x00"), 8, 64) //nolint:mnd
+	if err != nil {
+		return false
+	}
+
+	var sum int64
+
+	for idx, b := range block {
+		if idx >= chksumStart && idx < chksumEnd {
+			b = ' '
+		}
+
+		sum += int64(b)
+	}
+
+	return sum == want
 }
 
-func (x *XFile) untarFile(header *tar.Header, tarReader *tar.Reader) (uint64, error) {
+func (x *XFile) untarFile(header *tar.Header, tarReader *tarStream) (uint64, error) {
+	return x.writeTarFile(header, x.tarFile(header, tarReader))
+}
+
+// tarFile returns the file to write for a tar entry, reading its data from tarReader.
+func (x *XFile) tarFile(header *tar.Header, tarReader *tarStream) *file {
 	file := &file{
 		Path:     x.clean(header.Name),
+		Member:   header.Name,
 		Data:     tarReader,
 		FileMode: header.FileInfo().Mode(),
 		DirMode:  x.DirMode,
 		Mtime:    header.ChangeTime,
 		Atime:    header.AccessTime,
+		Sparse:   tarReader.sparse,
+		Holes:    tarReader.holes,
+	}
+
+	if x.PreserveOwnership {
+		file.Owner = &fileOwner{uid: header.Uid, gid: header.Gid, uname: header.Uname, gname: header.Gname}
+	}
+
+	if x.PreserveXattrs {
+		file.Xattrs = x.tarXattrs(header)
 	}
 
 	if header.Format != tar.FormatGNU && header.Format != tar.FormatPAX {
@@ -178,6 +275,11 @@ func (x *XFile) untarFile(header *tar.Header, tarReader *tar.Reader) (uint64, er
 		file.Atime = time.Now()
 	}
 
+	return file
+}
+
+// writeTarFile writes a tar entry: a folder, device, link or file.
+func (x *XFile) writeTarFile(header *tar.Header, file *file) (uint64, error) {
 	if !x.pathWithinOutput(file.Path) {
 		// The file being written is trying to write outside of our base path. Malicious archive?
 		return 0, fmt.Errorf("%s: %w: %s (from: %s)", x.FilePath, ErrInvalidPath, file.Path, header.Name)
@@ -187,16 +289,21 @@ func (x *XFile) untarFile(header *tar.Header, tarReader *tar.Reader) (uint64, er
 	case tar.TypeDir:
 		x.Debugf("Writing archived directory: %s", file.Path)
 
-		err := x.mkDir(file.Path, header.FileInfo().Mode(), header.ModTime)
+		file.Mtime = header.ModTime
+
+		err := x.mkDirFile(file)
 		if err != nil {
 			return 0, fmt.Errorf("making tar file dir: %w", err)
 		}
 
 		return 0, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		file.Device = &fileDevice{major: uint32(header.Devmajor), minor: uint32(header.Devminor)}
+		return 0, x.writeSpecial(file)
 	case tar.TypeSymlink, tar.TypeLink:
 		// Symlinks (and hard links) have no file payload; writing them as regular
 		// files produces empty stubs — see https://github.com/golift/xtractr/issues/153
-		return x.untarLink(header, file.Path)
+		return x.untarLink(header, file)
 	}
 
 	x.Debugf("Writing archived file: %s (bytes: %d)", file.Path, header.FileInfo().Size())
@@ -205,7 +312,9 @@ func (x *XFile) untarFile(header *tar.Header, tarReader *tar.Reader) (uint64, er
 }
 
 // untarLink creates a symlink or hard link from a tar header.
-func (x *XFile) untarLink(header *tar.Header, path string) (uint64, error) {
+func (x *XFile) untarLink(header *tar.Header, link *file) (uint64, error) {
+	path := link.Path
+
 	err := x.mkDir(filepath.Dir(path), x.DirMode, header.ModTime)
 	if err != nil {
 		return 0, fmt.Errorf("making tar link parent dir: %w", err)
@@ -218,7 +327,12 @@ func (x *XFile) untarLink(header *tar.Header, path string) (uint64, error) {
 
 	switch header.Typeflag {
 	case tar.TypeSymlink:
-		return 0, x.createSymlink(path, header.Linkname)
+		err = x.createSymlink(path, header.Linkname)
+		if err == nil {
+			x.restoreMetadata(link)
+		}
+
+		return 0, err
 	case tar.TypeLink:
 		return 0, x.createHardLink(path, header.Linkname)
 	}
@@ -2,12 +2,14 @@ package xtractr_test
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
@@ -15,6 +17,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/ulikunitz/xz"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
 	"golift.io/xtractr"
 )
 
@@ -522,3 +527,102 @@ func (c *tarGzipCompressor) Compress(t *testing.T, sourceDir, destBase string) e
 
 	return nil
 }
+
+func TestTarConcatenated(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	first := testCompress(t, "gz", testTar(t, testTarFiles(map[string]string{"one.txt": "first archive"})...))
+	second := testCompress(t, "gz", testTar(t, testTarFiles(map[string]string{"two.txt": "second archive"})...))
+	archive := filepath.Join(tmp, "joined.tar.gz")
+	require.NoError(t, os.WriteFile(archive, append(first, second...), 0o600))
+
+	_, files, _, err := xtractr.ExtractFile(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "out")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one.txt", "two.txt"}, files)
+
+	data, err := os.ReadFile(filepath.Join(tmp, "out", "two.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "second archive", string(data))
+
+	// Data after the last archive that is not another tar header is ignored.
+	archive = filepath.Join(tmp, "trailing.tar")
+	trailing := append(testTar(t, testTarFiles(map[string]string{"one.txt": "x"})...), make([]byte, 1024)...)
+	require.NoError(t, os.WriteFile(archive, append(trailing, bytes.Repeat([]byte("junk"), 128)...), 0o600))
+
+	_, files, err = xtractr.ExtractTar(&xtractr.XFile{FilePath: archive, OutputDir: filepath.Join(tmp, "trailing")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one.txt"}, files)
+}
+
+func TestTarNonUTF8Names(t *testing.T) {
+	t.Parallel()
+
+	// Russian names in CP1251, like a tarball made on a Windows box with a legacy locale.
+	names := []string{"Документы/", "Документы/отчет.txt", "Документы/привет мир.txt"}
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "cp1251.tar")
+	require.NoError(t, os.WriteFile(archive, encodedTar(t, charmap.Windows1251.NewEncoder(), names), 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, files, err := xtractr.ExtractTar(&xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+	require.NoError(t, err)
+	assert.Equal(t, names, files)
+
+	for _, name := range names[1:] {
+		data, err := os.ReadFile(filepath.Join(out, name))
+		require.NoError(t, err, "decoded file should exist on disk: %s", name)
+		assert.Equal(t, "hello", string(data))
+	}
+}
+
+func TestTarNameEncoding(t *testing.T) {
+	t.Parallel()
+
+	// Two kanji and no kana read just as well as GBK, so only the user knows.
+	names := []string{"音楽/", "音楽/曲.txt"}
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "sjis.tar")
+	require.NoError(t, os.WriteFile(archive, encodedTar(t, japanese.ShiftJIS.NewEncoder(), names), 0o600))
+
+	candidates, err := xtractr.DetectNameEncoding(archive)
+	require.NoError(t, err)
+	require.NotEmpty(t, candidates)
+	assert.True(t, slices.ContainsFunc(candidates, func(candidate xtractr.EncodingCandidate) bool {
+		return candidate.Charset == "Shift_JIS"
+	}), "Shift_JIS is offered")
+	assert.True(t, slices.IsSortedFunc(candidates, func(a, b xtractr.EncodingCandidate) int { return b.Score - a.Score }))
+
+	// MS_Kanji is an IANA alias for Shift_JIS.
+	out := filepath.Join(tmp, "out")
+	_, files, err := xtractr.ExtractTar(&xtractr.XFile{
+		FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, NameEncoding: "MS_Kanji",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, names, files)
+
+	_, err = os.Stat(filepath.Join(out, "音楽", "曲.txt"))
+	require.NoError(t, err)
+
+	_, err = xtractr.DetectNameEncoding(filepath.Join(out, "音楽", "曲.txt"))
+	require.Error(t, err, "a file that is not an archive is not a tar either")
+}
+
+// encodedTar returns a GNU tarball of directories (names ending in /) and files holding "hello".
+func encodedTar(t *testing.T, encoder *encoding.Encoder, names []string) []byte {
+	t.Helper()
+
+	entries := []testTarEntry{}
+
+	for _, name := range names {
+		raw, err := encoder.String(name)
+		require.NoError(t, err)
+
+		entries = append(entries, testTarEntry{name: raw, data: "hello", header: tar.Header{Format: tar.FormatGNU}})
+		if name[len(name)-1] == '/' {
+			entries[len(entries)-1].data = ""
+		}
+	}
+
+	return testTar(t, entries...)
+}
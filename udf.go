@@ -1,9 +1,12 @@
 package xtractr
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"time"
 
 	"golift.io/udf"
 )
@@ -17,12 +20,22 @@ func extractUDF(xFile *XFile, ra io.ReaderAt) (uint64, []string, error) {
 
 	defer xFile.newProgress(getUncompressedUDFSize(udfImage)).done()
 
-	size, files, err := xFile.unUDF(udfImage, nil, "")
+	writes := xFile.newISOWrites()
+
+	size, files, err := xFile.unUDF(udfImage, nil, "", writes)
+	if err == nil {
+		var wrote uint64
+		wrote, err = xFile.flushISOWrites(writes)
+		size += wrote
+	}
+
 	if err != nil {
 		return size, files, fmt.Errorf("%s: %w", xFile.FilePath, err)
 	}
 
-	return size, files, nil
+	files, err = xFile.cleanup(files)
+
+	return size, files, err
 }
 
 // getUncompressedUDFSize calculates the total size of all files in a UDF volume.
@@ -38,15 +51,15 @@ func getUncompressedUDFSize(udfImage *udf.Udf) (total, _ uint64, count int) {
 		for idx := range files {
 			count++
 
-			if files[idx].IsDir() {
-				fe, err := files[idx].FileEntry()
-				if err != nil {
-					continue
-				}
+			node, err := readUDFNode(udfImage, uint32(files[idx].Fid.ICB.Location))
+			if err != nil {
+				continue
+			}
 
-				walk(fe)
+			if node.fileType == udfTypeDirectory {
+				walk(node.dirEntry())
 			} else {
-				total += uint64(files[idx].Size())
+				total += node.size
 			}
 		}
 	}
@@ -56,7 +69,9 @@ func getUncompressedUDFSize(udfImage *udf.Udf) (total, _ uint64, count int) {
 	return total, 0, count
 }
 
-func (x *XFile) unUDF(udfImage *udf.Udf, fe *udf.FileEntry, parent string) (uint64, []string, error) {
+func (x *XFile) unUDF(
+	udfImage *udf.Udf, fe *udf.FileEntry, parent string, writes *isoWrites,
+) (uint64, []string, error) {
 	entries, err := udfImage.ReadDir(fe)
 	if err != nil {
 		return 0, nil, fmt.Errorf("reading UDF directory: %w", err)
@@ -68,7 +83,7 @@ func (x *XFile) unUDF(udfImage *udf.Udf, fe *udf.FileEntry, parent string) (uint
 	)
 
 	for i := range entries {
-		size, entryFiles, err := x.unUDFEntry(udfImage, &entries[i], parent)
+		size, entryFiles, err := x.unUDFEntry(udfImage, &entries[i], parent, writes)
 		totalSize += size
 
 		files = append(files, entryFiles...)
@@ -81,15 +96,31 @@ func (x *XFile) unUDF(udfImage *udf.Udf, fe *udf.FileEntry, parent string) (uint
 	return totalSize, files, nil
 }
 
-func (x *XFile) unUDFEntry(udfImage *udf.Udf, entry *udf.File, parent string) (uint64, []string, error) {
-	if entry.IsDir() {
-		return x.unUDFDir(udfImage, entry, parent)
+func (x *XFile) unUDFEntry(
+	udfImage *udf.Udf, entry *udf.File, parent string, writes *isoWrites,
+) (uint64, []string, error) {
+	if entry.Fid.FileCharacteristics&udfDeletedFile != 0 {
+		return 0, nil, nil
 	}
 
-	return x.unUDFFile(entry, parent)
+	node, err := readUDFNode(udfImage, uint32(entry.Fid.ICB.Location))
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading UDF file entry for %s: %w", entry.Name(), err)
+	}
+
+	switch node.fileType {
+	case udfTypeDirectory:
+		return x.unUDFDir(udfImage, entry, node, parent, writes)
+	case udfTypeSymlink:
+		return x.unUDFSymlink(udfImage, entry, node, parent)
+	default:
+		return x.unUDFFile(udfImage, entry, node, parent, writes)
+	}
 }
 
-func (x *XFile) unUDFDir(udfImage *udf.Udf, entry *udf.File, parent string) (uint64, []string, error) {
+func (x *XFile) unUDFDir(
+	udfImage *udf.Udf, entry *udf.File, node *udfNode, parent string, writes *isoWrites,
+) (uint64, []string, error) {
 	dirPath := filepath.Join(parent, entry.Name())
 	cleanPath := x.clean(dirPath)
 
@@ -99,33 +130,80 @@ func (x *XFile) unUDFDir(udfImage *udf.Udf, entry *udf.File, parent string) (uin
 			x.FilePath, ErrInvalidPath, cleanPath, entry.Name())
 	}
 
-	err := x.mkDir(cleanPath, entry.Mode(), entry.ModTime())
+	err := x.mkDirEntry(cleanPath, node.mode(false), node.mtime)
 	if err != nil {
 		return 0, nil, fmt.Errorf("making UDF directory %s: %w", entry.Name(), err)
 	}
 
-	entryFE, err := entry.FileEntry()
+	size, files, err := x.unUDF(udfImage, node.dirEntry(), dirPath, writes)
+	if err == nil {
+		x.applyUDFAttributes(udfImage, node, cleanPath)
+	}
+
+	return size, files, err
+}
+
+func (x *XFile) unUDFSymlink(
+	udfImage *udf.Udf, entry *udf.File, node *udfNode, parent string,
+) (uint64, []string, error) {
+	linkPath := x.clean(filepath.Join(parent, entry.Name()))
+	if !x.pathWithinOutput(linkPath) {
+		return 0, nil, fmt.Errorf("%s: %w: %s (from: %s)", x.FilePath, ErrInvalidPath, linkPath, entry.Name())
+	}
+
+	if node.size > maxSymlinkTarget {
+		return 0, nil, fmt.Errorf("%s: %w: %s", x.FilePath, ErrSymlinkTooLong, linkPath)
+	}
+
+	reader, err := node.reader(udfImage)
 	if err != nil {
-		return 0, nil, fmt.Errorf("reading UDF file entry for %s: %w", entry.Name(), err)
+		return 0, nil, fmt.Errorf("creating reader for UDF symlink %s: %w", entry.Name(), err)
 	}
 
-	return x.unUDF(udfImage, entryFE, dirPath)
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading UDF symlink %s: %w", entry.Name(), err)
+	}
+
+	target, err := udfSymlinkTarget(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %s: %w", x.FilePath, entry.Name(), err)
+	}
+
+	if err = x.mkDir(filepath.Dir(linkPath), x.DirMode, time.Time{}); err != nil {
+		return 0, nil, fmt.Errorf("making UDF symlink %s parent folder: %w", entry.Name(), err)
+	}
+
+	err = x.createSymlink(linkPath, target)
+	if errors.Is(err, errSkipEntry) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	x.applyUDFAttributes(udfImage, node, linkPath)
+
+	return 0, []string{linkPath}, nil
 }
 
-func (x *XFile) unUDFFile(entry *udf.File, parent string) (uint64, []string, error) {
+func (x *XFile) unUDFFile(
+	udfImage *udf.Udf, entry *udf.File, node *udfNode, parent string, writes *isoWrites,
+) (uint64, []string, error) {
 	filePath := filepath.Join(parent, entry.Name())
 
-	reader, err := entry.NewReader()
+	reader, err := node.reader(udfImage)
 	if err != nil {
 		return 0, nil, fmt.Errorf("creating reader for UDF file %s: %w", entry.Name(), err)
 	}
 
 	output := &file{
 		Path:     x.clean(filePath),
+		Member:   filePath,
 		Data:     reader,
-		FileMode: entry.Mode(),
+		FileMode: node.mode(false),
 		DirMode:  x.DirMode,
-		Mtime:    entry.ModTime(),
+		Mtime:    node.mtime,
+		Atime:    node.atime,
 	}
 
 	if !x.pathWithinOutput(output.Path) {
@@ -133,12 +211,111 @@ func (x *XFile) unUDFFile(entry *udf.File, parent string) (uint64, []string, err
 			x.FilePath, ErrInvalidPath, output.Path, x.OutputDir, entry.Name())
 	}
 
-	x.Debugf("Writing UDF file: %s (bytes: %d)", output.Path, entry.Size())
+	if writes != nil {
+		writes.add(output, func() { x.applyUDFAttributes(udfImage, node, output.Path) })
+		return 0, []string{output.Path}, nil
+	}
+
+	x.Debugf("Writing UDF file: %s (bytes: %d)", output.Path, node.size)
 
 	size, err := x.write(output)
 	if err != nil {
 		return 0, nil, fmt.Errorf("writing UDF file %s: %w", entry.Name(), err)
 	}
 
+	x.applyUDFAttributes(udfImage, node, output.Path)
+
 	return size, []string{output.Path}, nil
 }
+
+// applyUDFAttributes sets the owner, group and setuid, setgid and sticky bits
+// of an extracted entry, and writes its named streams as extended attributes.
+// It does nothing unless UDFAttributes is set. Ownership is only set when
+// running as root. Failures are logged; they do not fail the extraction.
+func (x *XFile) applyUDFAttributes(udfImage *udf.Udf, node *udfNode, path string) {
+	if !x.UDFAttributes {
+		return
+	}
+
+	if os.Geteuid() == 0 && (node.uid != udfUnsetID || node.gid != udfUnsetID) {
+		uid, gid := -1, -1
+		if node.uid != udfUnsetID {
+			uid = int(node.uid)
+		}
+
+		if node.gid != udfUnsetID {
+			gid = int(node.gid)
+		}
+
+		if err := os.Lchown(path, uid, gid); err != nil {
+			x.warn("setting UDF owner of %s: %v", path, err)
+		}
+	}
+
+	if node.fileType == udfTypeSymlink {
+		return
+	}
+
+	// chown clears setuid and setgid, so the mode is set after it.
+	mode := x.safeDirMode(node.mode(true))
+	if node.fileType != udfTypeDirectory {
+		mode = x.safeFileMode(x.stripSetuid(path, node.mode(true)))
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		x.warn("setting UDF mode of %s: %v", path, err)
+	}
+
+	if node.streams != 0 {
+		x.unUDFStreams(udfImage, node.streams, path)
+	}
+}
+
+// unUDFStreams writes a file's named streams as user extended attributes on Linux.
+func (x *XFile) unUDFStreams(udfImage *udf.Udf, icb uint32, path string) {
+	dir, err := readUDFNode(udfImage, icb)
+	if err == nil && dir.fileType != udfTypeStreamDir {
+		err = fmt.Errorf("%w: file type %d is not a stream directory", ErrCorruptUDF, dir.fileType)
+	}
+
+	var streams []udf.File
+	if err == nil {
+		streams, err = udfImage.ReadDir(dir.dirEntry())
+	}
+
+	if err != nil {
+		x.warn("reading UDF streams of %s: %v", path, err)
+		return
+	}
+
+	for idx := range streams {
+		if err := x.unUDFStream(udfImage, &streams[idx], path); err != nil {
+			x.warn("writing UDF stream %s of %s: %v", streams[idx].Name(), path, err)
+		}
+	}
+}
+
+func (x *XFile) unUDFStream(udfImage *udf.Udf, stream *udf.File, path string) error {
+	node, err := readUDFNode(udfImage, uint32(stream.Fid.ICB.Location))
+	if err != nil {
+		return err
+	}
+
+	if node.size > maxXattrSize {
+		return fmt.Errorf("%w: %d bytes", ErrXattrTooLarge, node.size)
+	}
+
+	reader, err := node.reader(udfImage)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("reading stream: %w", err)
+	}
+
+	x.Debugf("Writing UDF stream as extended attribute: %s (%s, bytes: %d)", path, stream.Name(), len(data))
+
+	return setXattr(path, "user."+stream.Name(), data)
+}
@@ -0,0 +1,238 @@
+package xtractr_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// Blocks in the UDF test image's partition, which starts at sector udfPartition.
+const (
+	udfPartition = 260
+	udfRootICB   = 1
+	udfRootDir   = 2
+	udfSubICB    = 3
+	udfSubDir    = 4
+	udfLinkICB   = 5
+	udfSparseICB = 6
+	udfInnerICB  = 7
+	udfStreamICB = 8
+	udfStreamDir = 9
+	udfDataA     = 10
+	udfDataB     = 11
+	udfNoteICB   = 12
+	udfBlocks    = 13
+)
+
+func TestExtractUDF(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "udf.iso")
+	require.NoError(t, os.WriteFile(archive, testUDFImage(), 0o600))
+
+	for _, workers := range []int{0, 4} {
+		t.Run(fmt.Sprintf("FileWorkers=%d", workers), func(t *testing.T) {
+			t.Parallel()
+
+			out := filepath.Join(tmp, fmt.Sprintf("out%d", workers))
+			_, files, err := xtractr.ExtractISO(&xtractr.XFile{
+				FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700, UDFAttributes: true, FileWorkers: workers,
+			})
+			require.NoError(t, err)
+			testExtractedUDF(t, out, files)
+		})
+	}
+}
+
+func testExtractedUDF(t *testing.T, out string, files []string) {
+	t.Helper()
+
+	assert.ElementsMatch(t, []string{
+		filepath.Join(out, "sub", "inner.txt"), filepath.Join(out, "link"), filepath.Join(out, "sparse.bin"),
+	}, files, "the deleted file is not extracted")
+
+	// Extended file entry with embedded data.
+	inner := filepath.Join(out, "sub", "inner.txt")
+	data, err := os.ReadFile(inner)
+	require.NoError(t, err)
+	assert.Equal(t, "inner", string(data))
+
+	stat, err := os.Stat(inner)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), stat.Mode(), "setgid is stripped by default")
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), stat.ModTime().UTC())
+
+	target, err := os.Readlink(filepath.Join(out, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("sub", "inner.txt"), target)
+
+	// Long allocation descriptors: a recorded extent, an unrecorded one, and a short recorded one.
+	data, err = os.ReadFile(filepath.Join(out, "sparse.bin"))
+	require.NoError(t, err)
+	require.Len(t, data, 2*testSector+5)
+	assert.Equal(t, "first", string(data[:5]))
+	assert.Equal(t, make([]byte, testSector), data[testSector:2*testSector])
+	assert.Equal(t, "third", string(data[2*testSector:]))
+}
+
+func TestExtractUDFSymlinkEscape(t *testing.T) {
+	t.Parallel()
+
+	image := testUDFImage()
+	// Point the symlink at /etc/passwd: a root component, then two names.
+	testUDFEntry(image, udfLinkICB, 261, 12, 3, 0o7777, 0, nil,
+		append([]byte{2, 0, 0, 0, 5, 4, 0, 0, 8, 'e', 't', 'c', 5, 7, 0, 0, 8}, "passwd"...))
+
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "udf.iso")
+	require.NoError(t, os.WriteFile(archive, image, 0o600))
+
+	out := filepath.Join(tmp, "out")
+	_, _, err := xtractr.ExtractISO(&xtractr.XFile{FilePath: archive, OutputDir: out, FileMode: 0o600, DirMode: 0o700})
+	require.Error(t, err)
+
+	_, err = os.Lstat(filepath.Join(out, "link"))
+	assert.True(t, os.IsNotExist(err), "the escaping symlink is not created")
+}
+
+// testUDFImage builds a UDF volume with a file entry root, an extended file entry
+// subdirectory holding a setgid file with embedded data and a named stream, a symlink,
+// a file with long allocation descriptors and a sparse extent, and a deleted file.
+func testUDFImage() []byte {
+	image := make([]byte, (udfPartition+udfBlocks)*testSector)
+
+	anchor := image[256*testSector:]
+	binary.LittleEndian.PutUint16(anchor, 2)
+	binary.LittleEndian.PutUint32(anchor[16:], 3*testSector)
+	binary.LittleEndian.PutUint32(anchor[20:], 257)
+
+	binary.LittleEndian.PutUint16(image[257*testSector:], 5) // partition.
+	binary.LittleEndian.PutUint32(image[257*testSector+188:], udfPartition)
+	binary.LittleEndian.PutUint16(image[258*testSector:], 6) // logical volume, file set at block 0.
+	binary.LittleEndian.PutUint32(image[258*testSector+248:], testSector)
+	binary.LittleEndian.PutUint16(image[259*testSector:], 8) // terminator.
+
+	fileSet := image[udfPartition*testSector:]
+	binary.LittleEndian.PutUint16(fileSet, 256)
+	binary.LittleEndian.PutUint32(fileSet[400:], testSector)
+	binary.LittleEndian.PutUint32(fileSet[404:], udfRootICB)
+
+	root := testUDFDir(image, udfRootDir,
+		testUDFID("", udfRootICB, 0x0A),
+		testUDFID("sub", udfSubICB, 0x02),
+		testUDFID("link", udfLinkICB, 0),
+		testUDFID("sparse.bin", udfSparseICB, 0),
+		testUDFID("deleted.txt", udfSparseICB, 0x04),
+	)
+	testUDFEntry(image, udfRootICB, 261, 4, 0, 0o7777, 0, testUDFShortAD(root, udfRootDir), nil)
+
+	sub := testUDFDir(image, udfSubDir, testUDFID("", udfRootICB, 0x0A), testUDFID("inner.txt", udfInnerICB, 0))
+	testUDFEntry(image, udfSubICB, 266, 4, 0, 0o7777, 0, testUDFShortAD(sub, udfSubDir), nil)
+
+	// Owner rwx and group r-x, setgid, with the stream directory.
+	testUDFEntry(image, udfInnerICB, 266, 5, 0x80|3, 0x1C00|0xA0, udfStreamICB, nil, []byte("inner"))
+
+	streams := testUDFDir(image, udfStreamDir, testUDFID("", udfInnerICB, 0x0A), testUDFID("note", udfNoteICB, 0))
+	testUDFEntry(image, udfStreamICB, 266, 13, 0, 0, 0, testUDFShortAD(streams, udfStreamDir), nil)
+	testUDFEntry(image, udfNoteICB, 261, 5, 3, 0, 0, nil, []byte("streamdata"))
+
+	// A symlink to sub/inner.txt: two name components.
+	testUDFEntry(image, udfLinkICB, 261, 12, 3, 0o7777, 0, nil,
+		append([]byte{5, 4, 0, 0, 8, 's', 'u', 'b', 5, 10, 0, 0, 8}, "inner.txt"...))
+
+	ads := make([]byte, 48)
+	binary.LittleEndian.PutUint32(ads, testSector)
+	binary.LittleEndian.PutUint32(ads[4:], udfDataA)
+	binary.LittleEndian.PutUint32(ads[16:], 1<<30|testSector) // allocated, not recorded.
+	binary.LittleEndian.PutUint32(ads[32:], 5)
+	binary.LittleEndian.PutUint32(ads[36:], udfDataB)
+	testUDFEntry(image, udfSparseICB, 261, 5, 1, 0x1CE7, 0, ads, nil)
+	copy(image[(udfPartition+udfDataA)*testSector:], "first")
+	copy(image[(udfPartition+udfDataB)*testSector:], "third")
+
+	return image
+}
+
+// testUDFEntry writes a file entry (tag 261) or an extended file entry (tag 266).
+// Embedded data is written in place of allocation descriptors.
+func testUDFEntry(image []byte, block int, tag, fileType, flags uint16, perms, streams uint32, ads, embedded []byte) {
+	entry := image[(udfPartition+block)*testSector:]
+	clear(entry[:testSector])
+	binary.LittleEndian.PutUint16(entry, tag)
+	entry[27] = byte(fileType)
+	binary.LittleEndian.PutUint16(entry[34:], flags)
+	binary.LittleEndian.PutUint32(entry[36:], uint32(os.Getuid()))
+	binary.LittleEndian.PutUint32(entry[40:], uint32(os.Getgid()))
+	binary.LittleEndian.PutUint32(entry[44:], perms)
+	binary.LittleEndian.PutUint16(entry[48:], 1)
+
+	size := uint64(len(embedded))
+	for pos := 0; pos+8 <= len(ads); pos += 8 {
+		if flags&7 == 1 && pos%16 != 0 {
+			continue
+		}
+
+		size += uint64(binary.LittleEndian.Uint32(ads[pos:]) & 0x3FFFFFFF)
+	}
+
+	binary.LittleEndian.PutUint64(entry[56:], size)
+
+	mtime, base := entry[84:], 168
+	if tag == 266 {
+		mtime, base = entry[92:], 208
+		binary.LittleEndian.PutUint32(entry[152:], min(streams, 1)*testSector)
+		binary.LittleEndian.PutUint32(entry[156:], streams)
+	}
+
+	binary.LittleEndian.PutUint16(mtime[2:], 2020)
+	copy(mtime[4:], []byte{1, 2, 3, 4, 5})
+
+	if embedded != nil {
+		ads = embedded
+	}
+
+	binary.LittleEndian.PutUint32(entry[base+4:], uint32(len(ads)))
+	copy(entry[base+8:], ads)
+}
+
+func testUDFShortAD(length, block int) []byte {
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint32(ad, uint32(length))
+	binary.LittleEndian.PutUint32(ad[4:], uint32(block))
+
+	return ad
+}
+
+// testUDFDir writes file identifiers to a block and returns their length.
+func testUDFDir(image []byte, block int, ids ...[]byte) int {
+	var length int
+	for _, id := range ids {
+		length += copy(image[(udfPartition+block)*testSector+length:], id)
+	}
+
+	return length
+}
+
+func testUDFID(name string, icb uint32, characteristics byte) []byte {
+	ident := []byte{}
+	if name != "" {
+		ident = append([]byte{8}, name...)
+	}
+
+	fid := make([]byte, (38+len(ident)+3)&^3)
+	binary.LittleEndian.PutUint16(fid, 257)
+	fid[18], fid[19] = characteristics, byte(len(ident))
+	binary.LittleEndian.PutUint32(fid[20:], testSector)
+	binary.LittleEndian.PutUint32(fid[24:], icb)
+	copy(fid[38:], ident)
+
+	return fid
+}
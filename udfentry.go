@@ -0,0 +1,308 @@
+package xtractr
+
+/* UDF file entries, read from the image so extended file entries (UDF 2.x), long and
+   embedded allocation descriptors, sparse extents, symlinks and streams are handled. */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+	"unicode/utf16"
+
+	"golift.io/udf"
+)
+
+// UDF descriptor tags, ICB file types and flags (ECMA-167 part 4).
+const (
+	udfTagAllocExtent  = 258
+	udfTagFileEntry    = 261
+	udfTagExtFileEntry = 266
+	udfTypeDirectory   = 4
+	udfTypeSymlink     = 12
+	udfTypeStreamDir   = 13
+	udfADMask          = 0x7
+	udfADShort         = 0
+	udfADLong          = 1
+	udfADEmbedded      = 3
+	udfFlagSetuid      = 0x40
+	udfFlagSetgid      = 0x80
+	udfFlagSticky      = 0x100
+	udfExtentRecorded  = 0
+	udfExtentNext      = 3
+	udfMaxAllocExtents = 64
+	udfUnsetID         = 0xFFFFFFFF
+	maxXattrSize       = 64 * 1024 // the largest extended attribute value Linux accepts.
+	udfDeletedFile     = 0x04      // file characteristics bit in a file identifier.
+)
+
+// udfExtent is a run of a file's data. Extents that are not recorded read as zeros.
+type udfExtent struct {
+	length   uint32
+	location uint32
+	recorded bool
+}
+
+// udfNode is a file entry or an extended file entry.
+type udfNode struct {
+	fileType uint8
+	flags    uint16
+	uid      uint32
+	gid      uint32
+	perms    uint32
+	links    uint16
+	size     uint64
+	atime    time.Time
+	mtime    time.Time
+	extents  []udfExtent
+	embedded []byte
+	streams  uint32 // logical block of the stream directory's ICB, or 0.
+}
+
+// zeroReader reads zeros: the unrecorded extents of sparse files.
+type zeroReader struct{}
+
+func (zeroReader) Read(data []byte) (int, error) {
+	clear(data)
+	return len(data), nil
+}
+
+// readUDFNode reads the file entry at a logical block in the partition.
+func readUDFNode(udfImage *udf.Udf, icb uint32) (*udfNode, error) {
+	start, err := udfImage.PartitionStart()
+	if err != nil {
+		return nil, fmt.Errorf("reading UDF partition: %w", err)
+	}
+
+	buf, err := udfImage.ReadSector(start + uint64(icb))
+	if err != nil {
+		return nil, fmt.Errorf("reading UDF file entry: %w", err)
+	}
+
+	node := &udfNode{
+		fileType: buf[27],
+		flags:    binary.LittleEndian.Uint16(buf[34:]),
+		uid:      binary.LittleEndian.Uint32(buf[36:]),
+		gid:      binary.LittleEndian.Uint32(buf[40:]),
+		perms:    binary.LittleEndian.Uint32(buf[44:]),
+		links:    binary.LittleEndian.Uint16(buf[48:]),
+		size:     binary.LittleEndian.Uint64(buf[56:]),
+	}
+
+	var base int
+
+	switch tag := binary.LittleEndian.Uint16(buf); tag {
+	case udfTagFileEntry:
+		base = 168
+		node.atime, node.mtime = udfTime(buf[72:]), udfTime(buf[84:])
+	case udfTagExtFileEntry:
+		base = 208
+		node.atime, node.mtime = udfTime(buf[80:]), udfTime(buf[92:])
+
+		if binary.LittleEndian.Uint32(buf[152:]) != 0 {
+			node.streams = binary.LittleEndian.Uint32(buf[156:])
+		}
+	default:
+		return nil, fmt.Errorf("%w: tag %d at block %d", ErrCorruptUDF, tag, icb)
+	}
+
+	eaLen, adLen := binary.LittleEndian.Uint32(buf[base:]), binary.LittleEndian.Uint32(buf[base+4:])
+	if uint64(base)+8+uint64(eaLen)+uint64(adLen) > uint64(len(buf)) {
+		return nil, fmt.Errorf("%w: allocation descriptors overflow block %d", ErrCorruptUDF, icb)
+	}
+
+	ads := buf[base+8+int(eaLen) : base+8+int(eaLen)+int(adLen)]
+
+	if node.flags&udfADMask == udfADEmbedded {
+		node.embedded = ads[:min(uint64(len(ads)), node.size)]
+		return node, nil
+	}
+
+	return node, node.readExtents(udfImage, start, ads)
+}
+
+// readExtents parses short or long allocation descriptors,
+// following continuation extents to more descriptors.
+func (n *udfNode) readExtents(udfImage *udf.Udf, start uint64, ads []byte) error {
+	width := 8
+	if n.flags&udfADMask == udfADLong {
+		width = 16
+	} else if n.flags&udfADMask != udfADShort {
+		return fmt.Errorf("%w: unsupported allocation descriptor type %d", ErrCorruptUDF, n.flags&udfADMask)
+	}
+
+	for range udfMaxAllocExtents {
+		var next *udfExtent
+
+		for pos := 0; pos+width <= len(ads); pos += width {
+			length := binary.LittleEndian.Uint32(ads[pos:])
+			extent := udfExtent{
+				length:   length & 0x3FFFFFFF, //nolint:mnd // the top two bits are the extent type.
+				location: binary.LittleEndian.Uint32(ads[pos+4:]),
+				recorded: length>>30 == udfExtentRecorded,
+			}
+
+			if extent.length == 0 {
+				break
+			}
+
+			if length>>30 == udfExtentNext {
+				next = &extent
+				break
+			}
+
+			n.extents = append(n.extents, extent)
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		buf, err := udfImage.ReadSector(start + uint64(next.location))
+		if err != nil {
+			return fmt.Errorf("reading UDF allocation extent: %w", err)
+		}
+
+		adLen := binary.LittleEndian.Uint32(buf[20:])
+		if binary.LittleEndian.Uint16(buf) != udfTagAllocExtent || 24+uint64(adLen) > uint64(len(buf)) {
+			return fmt.Errorf("%w: bad allocation extent at block %d", ErrCorruptUDF, next.location)
+		}
+
+		ads = buf[24 : 24+adLen]
+	}
+
+	return fmt.Errorf("%w: too many allocation extents", ErrCorruptUDF)
+}
+
+// reader returns the file's data: embedded in the entry, or read from each extent in order.
+func (n *udfNode) reader(udfImage *udf.Udf) (io.Reader, error) {
+	if n.embedded != nil {
+		return bytes.NewReader(n.embedded), nil
+	}
+
+	start, err := udfImage.PartitionStart()
+	if err != nil {
+		return nil, fmt.Errorf("reading UDF partition: %w", err)
+	}
+
+	readers := make([]io.Reader, 0, len(n.extents))
+
+	for _, extent := range n.extents {
+		if extent.recorded {
+			offset := int64((start + uint64(extent.location)) * udf.SectorSize)
+			readers = append(readers, io.NewSectionReader(udfImage.GetReader(), offset, int64(extent.length)))
+		} else {
+			readers = append(readers, io.LimitReader(zeroReader{}, int64(extent.length)))
+		}
+	}
+
+	return io.LimitReader(io.MultiReader(readers...), int64(n.size)), nil
+}
+
+// dirEntry returns a file entry the udf library can read a directory from.
+// The library only reads the first extent of a directory.
+func (n *udfNode) dirEntry() *udf.FileEntry {
+	entry := &udf.FileEntry{InformationLength: n.size}
+	if len(n.extents) > 0 {
+		entry.AllocationDescriptors = []udf.Extent{{Length: n.extents[0].length, Location: n.extents[0].location}}
+	}
+
+	return entry
+}
+
+// mode returns the permission bits. With special set, setuid, setgid and sticky are included.
+func (n *udfNode) mode(special bool) os.FileMode {
+	// Each of other, group and owner has five bits: execute, write, read, chattr and delete.
+	mode := os.FileMode(n.perms&0o7 | (n.perms>>5&0o7)<<3 | (n.perms>>10&0o7)<<6) //nolint:mnd
+
+	if n.fileType == udfTypeDirectory {
+		mode |= os.ModeDir
+	}
+
+	if !special {
+		return mode
+	}
+
+	if n.flags&udfFlagSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+
+	if n.flags&udfFlagSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+
+	if n.flags&udfFlagSticky != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+// udfTime reads a 12 byte timestamp. The time zone is ignored, like the udf library does.
+func udfTime(data []byte) time.Time {
+	return time.Date(int(binary.LittleEndian.Uint16(data[2:])), time.Month(data[4]), int(data[5]),
+		int(data[6]), int(data[7]), int(data[8]), 0, time.UTC)
+}
+
+// udfSymlinkTarget decodes the path components (ECMA-167 4/14.16) in a symlink's data.
+func udfSymlinkTarget(data []byte) (string, error) {
+	var (
+		parts    []string
+		absolute bool
+	)
+
+	for pos := 0; pos < len(data); {
+		if pos+4 > len(data) || pos+4+int(data[pos+1]) > len(data) {
+			return "", fmt.Errorf("%w: truncated symlink path component", ErrCorruptUDF)
+		}
+
+		name := data[pos+4 : pos+4+int(data[pos+1])]
+
+		switch data[pos] {
+		case 1, 2: //nolint:mnd // the root of the volume, or the root directory.
+			parts, absolute = nil, true
+		case 3: //nolint:mnd
+			parts = append(parts, "..")
+		case 4: //nolint:mnd
+			parts = append(parts, ".")
+		case 5: //nolint:mnd
+			parts = append(parts, udfName(name))
+		default:
+			return "", fmt.Errorf("%w: symlink path component type %d", ErrCorruptUDF, data[pos])
+		}
+
+		pos += 4 + len(name)
+	}
+
+	if absolute {
+		return path.Join(append([]string{"/"}, parts...)...), nil
+	}
+
+	return path.Join(parts...), nil
+}
+
+// udfName decodes a CS0 name: a compression ID of 8 (one byte per character) or 16 (UTF-16BE).
+func udfName(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	if data[0] != 16 { //nolint:mnd
+		runes := make([]rune, 0, len(data)-1)
+		for _, char := range data[1:] {
+			runes = append(runes, rune(char))
+		}
+
+		return string(runes)
+	}
+
+	chars := make([]uint16, 0, len(data)/2) //nolint:mnd
+	for pos := 1; pos+1 < len(data); pos += 2 {
+		chars = append(chars, binary.BigEndian.Uint16(data[pos:]))
+	}
+
+	return string(utf16.Decode(chars))
+}
@@ -3,9 +3,14 @@ package xtractr_test
 // Shared utility functions/structs used in testing only.
 
 import (
+	"archive/tar"
+	"bytes"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -97,3 +102,70 @@ func safeCloser(t *testing.T, c io.Closer) {
 	err := c.Close()
 	require.NoError(t, err)
 }
+
+// testTarEntry is a member for testTar. Names ending in / are folders, and other
+// members are files holding data, unless header has another Typeflag. Set links,
+// devices, modes, times, owners and the format in header.
+type testTarEntry struct {
+	name   string
+	data   string
+	header tar.Header
+}
+
+// testTar returns a tarball holding entries, in order. Files get the size of their data,
+// and members without a Mode get 0o755 for folders and 0o644 for everything else.
+func testTar(t *testing.T, entries ...testTarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	writer := tar.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := entry.header
+		header.Name = entry.name
+
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+			if strings.HasSuffix(entry.name, "/") {
+				header.Typeflag = tar.TypeDir
+			}
+		}
+
+		if header.Mode == 0 {
+			header.Mode = map[bool]int64{true: 0o755, false: 0o644}[header.Typeflag == tar.TypeDir]
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.data))
+		}
+
+		require.NoError(t, writer.WriteHeader(&header))
+		_, err := writer.Write([]byte(entry.data[:header.Size]))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
+
+// testTarFiles returns testTar entries for files, by name.
+func testTarFiles(files map[string]string) []testTarEntry {
+	entries := []testTarEntry{}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		entries = append(entries, testTarEntry{name: name, data: files[name]})
+	}
+
+	return entries
+}
+
+// writeTestTar writes a tarball of entries into a temporary folder, and returns its path.
+func writeTestTar(t *testing.T, name string, entries ...testTarEntry) string {
+	t.Helper()
+
+	archive := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(archive, testTar(t, entries...), 0o600))
+
+	return archive
+}
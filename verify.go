@@ -0,0 +1,337 @@
+package xtractr
+
+/* Code to check downloaded files against the SFV, MD5, SHA and PAR2 files next to them. */
+
+import (
+	"bufio"
+	"crypto/md5"  //nolint:gosec // MD5 sidecar files are common.
+	"crypto/sha1" //nolint:gosec // SHA1 sidecar files are common.
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// VerifyPolicy says what to do with the checksum files found next to archives.
+type VerifyPolicy int
+
+// Verify policies for Xtract.Verify.
+const (
+	// VerifyOff ignores checksum files. This is the default.
+	VerifyOff VerifyPolicy = iota
+	// VerifyWarn checks the files listed in checksum files before extracting anything,
+	// and lists the files that are missing or do not match in Response.Warnings.
+	VerifyWarn
+	// VerifyFail checks the files listed in checksum files before extracting anything,
+	// and returns a *ChecksumError if any are missing or do not match.
+	VerifyFail
+)
+
+// Checksum is a file listed in a checksum file, and the result of checking it.
+type Checksum struct {
+	// Name is the file's name in the checksum file, and Path is where it is.
+	Name string
+	Path string
+	// Sidecar is the checksum file that listed it.
+	Sidecar string
+	// Algorithm is crc32, md5, sha1 or sha256.
+	Algorithm string
+	// Want is the hex encoded checksum from the sidecar, and Got is the file's.
+	Want string
+	Got  string
+	// Err is set when the file could not be read, like when it is missing.
+	Err error
+}
+
+// ChecksumError is returned by VerifyChecksums, and by the queue with VerifyFail,
+// when files are missing or do not match their checksums. It wraps ErrChecksumMismatch.
+type ChecksumError struct {
+	// Failed lists every file that is missing, unreadable or does not match.
+	Failed []*Checksum
+}
+
+// checksumSidecars are the file extensions VerifyChecksums reads.
+// The algorithm for md5sum-style files is picked by each line's checksum length.
+//
+//nolint:gochecknoglobals
+var checksumSidecars = []string{".sfv", ".md5", ".sha1", ".sha256", ".sha", ".par2"}
+
+// bsdChecksumLine matches the lines BSD md5 and `shasum --tag` write: MD5 (name) = hash.
+var bsdChecksumLine = regexp.MustCompile(`^(?i:MD5|SHA1|SHA256) ?\((.+)\) ?= ?([0-9A-Fa-f]+)$`) //nolint:gochecknoglobals
+
+// OK reports whether the file matches its checksum.
+func (c *Checksum) OK() bool {
+	return c.Err == nil && strings.EqualFold(c.Want, c.Got)
+}
+
+func (c *Checksum) String() string {
+	if c.Err != nil {
+		return fmt.Sprintf("%s (%v)", c.Name, c.Err)
+	}
+
+	return fmt.Sprintf("%s (%s %s, want %s, from %s)", c.Name, c.Algorithm, c.Got, c.Want, filepath.Base(c.Sidecar))
+}
+
+// Error satisfies the error interface.
+func (e *ChecksumError) Error() string {
+	names := make([]string, len(e.Failed))
+	for idx, sum := range e.Failed {
+		names[idx] = sum.String()
+	}
+
+	return fmt.Sprintf("%v: %s", ErrChecksumMismatch, strings.Join(names, ", "))
+}
+
+// Unwrap returns ErrChecksumMismatch, for errors.Is.
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// VerifyChecksums checks the files listed in the checksum files in a folder: .sfv,
+// .md5, .sha1, .sha256, .sha and .par2 files. Each file is read once, however many
+// checksums it has. It returns every checksum, and a *ChecksumError listing the
+// files that are missing or do not match. A nil progress is not called. Progress
+// counts the bytes read in Read and Compressed, and its XFile has dir in FilePath.
+func VerifyChecksums(dir string, progress func(Progress)) ([]*Checksum, error) {
+	sums, err := readChecksumSidecars(dir)
+	if err != nil {
+		return sums, err
+	}
+
+	tracker := newTracker(&XFile{FilePath: dir}, progress)
+	paths := map[string][]*Checksum{}
+	order := []string{}
+
+	for _, sum := range sums {
+		if paths[sum.Path] == nil {
+			order = append(order, sum.Path)
+		}
+
+		paths[sum.Path] = append(paths[sum.Path], sum)
+	}
+
+	for _, path := range order {
+		if info, err := os.Stat(path); err == nil {
+			tracker.Compressed += uint64(info.Size()) //nolint:gosec
+		}
+	}
+
+	tracker.Count = len(order)
+
+	for _, path := range order {
+		checkFile(path, paths[path], tracker)
+	}
+
+	tracker.done()
+
+	failed := &ChecksumError{}
+
+	for _, sum := range sums {
+		if !sum.OK() {
+			failed.Failed = append(failed.Failed, sum)
+		}
+	}
+
+	if len(failed.Failed) > 0 {
+		return sums, failed
+	}
+
+	return sums, nil
+}
+
+// checkFile hashes a file once with every algorithm its checksums use, and fills in Got or Err.
+func checkFile(path string, sums []*Checksum, tracker *progressTracker) {
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+
+	for _, sum := range sums {
+		if hashes[sum.Algorithm] == nil {
+			hashes[sum.Algorithm] = newChecksumHash(sum.Algorithm)
+			writers = append(writers, hashes[sum.Algorithm])
+		}
+	}
+
+	file, err := os.Open(path)
+	if err == nil {
+		defer file.Close()
+
+		_, err = io.Copy(io.MultiWriter(writers...), tracker.reader(file))
+	}
+
+	tracker.mu.Lock()
+	tracker.Files++
+	tracker.mu.Unlock()
+
+	for _, sum := range sums {
+		if err != nil {
+			sum.Err = err
+		} else {
+			sum.Got = hex.EncodeToString(hashes[sum.Algorithm].Sum(nil))
+		}
+	}
+}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "crc32":
+		return crc32.NewIEEE()
+	case "md5":
+		return md5.New() //nolint:gosec
+	case "sha1":
+		return sha1.New() //nolint:gosec
+	default:
+		return sha256.New()
+	}
+}
+
+// readChecksumSidecars returns the checksums in every checksum file in a folder.
+// A file listed with the same checksum by more than one sidecar is only listed once.
+func readChecksumSidecars(dir string) ([]*Checksum, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading checksum folder: %w", err)
+	}
+
+	sums := []*Checksum{}
+	seen := map[string]bool{}
+
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || !slices.Contains(checksumSidecars, ext) {
+			continue
+		}
+
+		sidecar := filepath.Join(dir, entry.Name())
+
+		found, err := readChecksumSidecar(sidecar, ext)
+		if err != nil {
+			return sums, fmt.Errorf("reading checksum file %s: %w", entry.Name(), err)
+		}
+
+		for _, sum := range found {
+			key := sum.Path + "\x00" + sum.Algorithm + "\x00" + strings.ToLower(sum.Want)
+			if !seen[key] {
+				seen[key] = true
+				sums = append(sums, sum)
+			}
+		}
+	}
+
+	return sums, nil
+}
+
+// readChecksumSidecar returns the checksums in one checksum file. Names that are
+// not local to the sidecar's folder are ignored.
+func readChecksumSidecar(sidecar, ext string) ([]*Checksum, error) {
+	dir := filepath.Dir(sidecar)
+	sums := []*Checksum{}
+	add := func(name, algorithm, want string) {
+		if name = filepath.FromSlash(name); filepath.IsLocal(name) {
+			sums = append(sums, &Checksum{
+				Name: name, Path: filepath.Join(dir, name), Sidecar: sidecar, Algorithm: algorithm, Want: want,
+			})
+		}
+	}
+
+	if ext == ".par2" {
+		files, err := readPar2Files(sidecar)
+		for _, file := range files {
+			add(file.name, "md5", hex.EncodeToString(file.md5[:]))
+		}
+
+		return sums, err
+	}
+
+	open, err := os.Open(sidecar)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer open.Close()
+
+	scanner := bufio.NewScanner(open)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		var name, algorithm, want string
+		if ext == ".sfv" {
+			name, want, algorithm = parseSFVLine(line)
+		} else {
+			name, want, algorithm = parseChecksumLine(line)
+		}
+
+		if algorithm != "" {
+			add(name, algorithm, want)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return sums, fmt.Errorf("reading: %w", err)
+	}
+
+	return sums, nil
+}
+
+// parseSFVLine parses a line in an SFV file: a name and a CRC32, separated by spaces.
+// SFV files are made on Windows, so backslashes separate folders.
+func parseSFVLine(line string) (name, want, algorithm string) {
+	idx := strings.LastIndexAny(line, " \t")
+	if idx < 0 || checksumAlgorithm(line[idx+1:]) != "crc32" {
+		return "", "", ""
+	}
+
+	return strings.ReplaceAll(strings.TrimSpace(line[:idx]), `\`, "/"), line[idx+1:], "crc32"
+}
+
+// parseChecksumLine parses a line written by md5sum, sha1sum or sha256sum (hash, space,
+// space or asterisk, name), or by their --tag option (MD5 (name) = hash).
+func parseChecksumLine(line string) (name, want, algorithm string) {
+	if match := bsdChecksumLine.FindStringSubmatch(line); match != nil {
+		return match[1], match[2], checksumAlgorithm(match[2])
+	}
+
+	escaped := line[0] == '\\' // names with backslashes or new lines are escaped.
+	if escaped {
+		line = line[1:]
+	}
+
+	want, name, ok := strings.Cut(line, " ")
+	if !ok || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+		return "", "", ""
+	}
+
+	if name = name[1:]; escaped {
+		name = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(name)
+	}
+
+	return name, want, checksumAlgorithm(want)
+}
+
+// checksumAlgorithm returns the algorithm with a hex encoded checksum's length, or "".
+func checksumAlgorithm(sum string) string {
+	if _, err := hex.DecodeString(sum); err != nil {
+		return ""
+	}
+
+	switch len(sum) {
+	case crc32.Size * 2: //nolint:mnd
+		return "crc32"
+	case md5.Size * 2: //nolint:mnd
+		return "md5"
+	case sha1.Size * 2: //nolint:mnd
+		return "sha1"
+	case sha256.Size * 2: //nolint:mnd
+		return "sha256"
+	default:
+		return ""
+	}
+}
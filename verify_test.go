@@ -0,0 +1,183 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"crypto/md5"  //nolint:gosec
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+// par2Packet returns a PAR2 packet with a valid MD5.
+func par2Packet(kind string, body []byte) []byte {
+	setID := bytes.Repeat([]byte{7}, 16)
+	hashed := append(append(append([]byte{}, setID...), kind...), body...)
+	sum := md5.Sum(hashed) //nolint:gosec
+
+	packet := []byte("PAR2\x00PKT")
+	packet = binary.LittleEndian.AppendUint64(packet, uint64(64+len(body)))
+	packet = append(packet, sum[:]...)
+
+	return append(packet, hashed...)
+}
+
+// par2FileDesc returns a PAR2 file description packet body.
+func par2FileDesc(name string, data []byte) []byte {
+	sum := md5.Sum(data) //nolint:gosec
+
+	body := bytes.Repeat([]byte{1}, 16) // file ID
+	body = append(body, sum[:]...)
+	body = append(body, make([]byte, 16)...) // MD5 of the first 16k, unused here.
+	body = binary.LittleEndian.AppendUint64(body, uint64(len(data)))
+	body = append(body, name...)
+
+	return append(body, make([]byte, (4-len(name)%4)%4)...)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"a.rar": []byte("first volume"),
+		"a.r00": []byte("second volume"),
+		"a.r01": []byte("third volume"),
+		"b.bin": []byte("fourth file"),
+	}
+
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+	}
+
+	md5Sum := md5.Sum(files["a.r00"])   //nolint:gosec
+	sha1Sum := sha1.Sum(files["a.r01"]) //nolint:gosec
+	sha256Sum := sha256.Sum256(files["b.bin"])
+	sfv := fmt.Sprintf("; made by hand\r\na.rar %08X\r\na.r00 DEADBEEF\r\nmissing.r02 00000000\r\n",
+		crc32.ChecksumIEEE(files["a.rar"]))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.sfv"), []byte(sfv), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.md5"),
+		[]byte(hex.EncodeToString(md5Sum[:])+" *a.r00\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.sha1"),
+		[]byte("SHA1 (a.r01) = "+hex.EncodeToString(sha1Sum[:])+"\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.sha256"),
+		[]byte(hex.EncodeToString(sha256Sum[:])+"  b.bin\n"+hex.EncodeToString(sha256Sum[:])+"  ../b.bin\n"), 0o600))
+
+	var updates []xtractr.Progress
+
+	sums, err := xtractr.VerifyChecksums(dir, func(p xtractr.Progress) {
+		updates = append(updates, p)
+		assert.Equal(t, dir, p.XFile.FilePath, "callbacks may read the XFile")
+	})
+	require.ErrorIs(t, err, xtractr.ErrChecksumMismatch)
+	assert.Len(t, sums, 6, "names outside the folder must be ignored")
+
+	var sumErr *xtractr.ChecksumError
+	require.ErrorAs(t, err, &sumErr)
+	require.Len(t, sumErr.Failed, 2)
+	assert.Equal(t, "a.r00", sumErr.Failed[0].Name)
+	assert.Equal(t, "crc32", sumErr.Failed[0].Algorithm)
+	assert.NoError(t, sumErr.Failed[0].Err)
+	assert.Equal(t, "missing.r02", sumErr.Failed[1].Name)
+	require.ErrorIs(t, sumErr.Failed[1].Err, os.ErrNotExist)
+
+	require.NotEmpty(t, updates)
+	last := updates[len(updates)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, last.Compressed, last.Read, "every byte of every file must be read")
+	assert.Equal(t, 5, last.Files, "a.r00 must only be read once for two checksums")
+}
+
+func TestVerifyChecksumsPAR2(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	good, bad := []byte("good volume"), []byte("bad volume")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "x.part1.rar"), good, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "x.part2.rar"), []byte("changed"), 0o600))
+
+	damaged := par2Packet("PAR 2.0\x00FileDesc", par2FileDesc("x.part3.rar", good))
+	damaged[len(damaged)-5] ^= 0xff
+
+	var par2 []byte
+	par2 = append(par2, par2Packet("PAR 2.0\x00Main\x00\x00\x00\x00", make([]byte, 12))...)
+	par2 = append(par2, par2Packet("PAR 2.0\x00FileDesc", par2FileDesc("x.part1.rar", good))...)
+	par2 = append(par2, damaged...)
+	par2 = append(par2, par2Packet("PAR 2.0\x00FileDesc", par2FileDesc("x.part2.rar", bad))...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "x.par2"), par2, 0o600))
+
+	sums, err := xtractr.VerifyChecksums(dir, nil)
+	require.Len(t, sums, 2, "the damaged packet must be skipped")
+
+	var sumErr *xtractr.ChecksumError
+	require.ErrorAs(t, err, &sumErr)
+	require.Len(t, sumErr.Failed, 1)
+	assert.Equal(t, "x.part2.rar", sumErr.Failed[0].Name)
+	assert.Equal(t, "md5", sumErr.Failed[0].Algorithm)
+	assert.True(t, sums[0].OK())
+}
+
+// verifyTestDir returns a folder with the test rar archive and an SFV file with the wrong CRC.
+func verifyTestDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	data, err := os.ReadFile(testFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "archive.rar"), data, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "archive.sfv"), []byte("archive.rar 12345678\n"), 0o600))
+
+	return dir
+}
+
+func TestQueueVerify(t *testing.T) {
+	t.Parallel()
+
+	queue := xtractr.NewQueue(&xtractr.Config{Logger: &testLogger{t: t}})
+	defer queue.Stop()
+
+	for _, policy := range []xtractr.VerifyPolicy{xtractr.VerifyFail, xtractr.VerifyWarn} {
+		xFile := &xtractr.Xtract{
+			Filter:     xtractr.Filter{Path: verifyTestDir(t)},
+			TempFolder: true,
+			Password:   "some_password",
+			Verify:     policy,
+			CBChannel:  make(chan *xtractr.Response),
+		}
+
+		_, err := queue.Extract(xFile)
+		require.NoError(t, err)
+
+		for resp := range xFile.CBChannel {
+			if !resp.Done {
+				continue
+			}
+
+			var sumErr *xtractr.ChecksumError
+			if policy == xtractr.VerifyFail {
+				require.ErrorAs(t, resp.Error, &sumErr)
+				assert.Equal(t, "archive.rar", sumErr.Failed[0].Name)
+				assert.Empty(t, resp.NewFiles, "nothing may be extracted when verification fails")
+			} else {
+				require.NoError(t, resp.Error)
+				assert.Len(t, resp.NewFiles, len(filesInTestArchive))
+				require.Len(t, resp.Warnings, 1)
+				assert.Contains(t, resp.Warnings[0], "archive.rar (crc32")
+			}
+
+			break
+		}
+
+		_ = os.RemoveAll(xFile.Path + xtractr.DefaultSuffix)
+	}
+}
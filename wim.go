@@ -0,0 +1,951 @@
+package xtractr
+
+/* How to extract a Windows Imaging Format file (.wim, or .esd with solid LZMS resources). */
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // WIM identifies blobs by SHA-1.
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// WIM on-disk layout constants.
+const (
+	wimHeaderSize        = 208
+	wimLookupEntrySize   = 50
+	wimSolidHeaderSize   = 16
+	wimDentryMinSize     = 102
+	wimStreamMinSize     = 38
+	wimDefaultChunkSize  = 32768
+	wimMaxChunkSize      = 1 << 30
+	wimMaxResourceInMem  = 1 << 30
+	wimMaxDirDepth       = 1024
+	wimSolidResourceSize = 0x100000000
+	wimFiletimeEpoch     = 116444736000000000 // 1601-01-01 to 1970-01-01 in 100ns units.
+)
+
+// Resource header flags.
+const (
+	wimResFree       = 0x01
+	wimResMetadata   = 0x02
+	wimResCompressed = 0x04
+	wimResSpanned    = 0x08
+	wimResSolid      = 0x10
+)
+
+// WIM header flags.
+const (
+	wimHdrCompression = 0x00000002
+	wimHdrRPFix       = 0x00000080
+	wimHdrXPRESS      = 0x00020000
+	wimHdrLZX         = 0x00040000
+	wimHdrLZMS        = 0x00080000
+)
+
+// Compression formats. These match the format field of a solid resource header.
+const (
+	wimCodecNone   = 0
+	wimCodecXPRESS = 1
+	wimCodecLZX    = 2
+	wimCodecLZMS   = 3
+)
+
+// File attributes and reparse points.
+const (
+	wimAttrDirectory   = 0x10
+	wimAttrReparse     = 0x400
+	wimTagSymlink      = 0xA000000C
+	wimTagMountPoint   = 0xA0000003
+	wimSymlinkRelative = 0x1
+	wimRPNotFixed      = 0x1
+)
+
+// wimResource is a stored resource: either a plain (possibly chunked) stream,
+// or a solid resource holding many blobs compressed together.
+type wimResource struct {
+	offset    uint64 // file offset of the stored data.
+	size      uint64 // stored (compressed) size.
+	usize     uint64 // uncompressed size.
+	flags     byte
+	chunkSize uint64
+	codec     uint32
+	chunks    []uint64 // file offset of each chunk, plus one for the end.
+	cacheIdx  uint64
+	cache     []byte
+}
+
+// wimBlob is a stream of file data (or metadata) inside a resource.
+type wimBlob struct {
+	res    *wimResource
+	offset uint64 // within the resource's uncompressed data.
+	size   uint64
+	hash   [sha1.Size]byte
+}
+
+type wimArchive struct {
+	ra         io.ReaderAt
+	flags      uint32
+	chunkSize  uint64
+	codec      uint32
+	imageCount int
+	blobs      map[[sha1.Size]byte]*wimBlob
+	metadata   []*wimBlob
+}
+
+// wimDentry is a directory entry from an image's metadata resource.
+type wimDentry struct {
+	name     string
+	attrs    uint32
+	subdir   uint64
+	atime    time.Time
+	mtime    time.Time
+	hash     [sha1.Size]byte // data stream, or reparse data for reparse points.
+	data     [sha1.Size]byte // unnamed data stream of a reparse point.
+	tag      uint32
+	rpFlags  uint16
+	linkID   uint64
+	children []*wimDentry
+}
+
+// wimPlan is everything found in the selected images, collected before writing
+// so files can be written in the order they are stored.
+type wimPlan struct {
+	dirs      []wimEntry
+	files     []wimEntry
+	symlinks  []wimEntry
+	hardlinks []wimEntry
+	total     uint64
+}
+
+type wimEntry struct {
+	path   string
+	member string // path in the image.
+	root   string // image root, for symlinks.
+	target string // first path of a hard link group.
+	dentry *wimDentry
+	blob   *wimBlob
+}
+
+// ExtractWIM extracts a Windows Imaging Format archive. XPRESS, LZX and LZMS
+// compression are supported, including solid resources as found in .esd files.
+// XFile.WIMImage selects one image; 0 extracts all images, each into a numbered
+// subfolder when the archive has more than one. Split (.swm) archives are not supported.
+func ExtractWIM(xFile *XFile) (size uint64, filesList []string, err error) {
+	wimFile, stat, err := openStatFile(xFile.FilePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer wimFile.Close()
+
+	arc, err := openWIM(wimFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	images, err := arc.selectImages(xFile.WIMImage)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	plan := &wimPlan{}
+
+	for _, image := range images {
+		prefix := ""
+		if len(images) > 1 {
+			prefix = strconv.Itoa(image)
+		}
+
+		if err = xFile.planWIMImage(arc, plan, image, prefix); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	defer xFile.newProgress(plan.total, uint64(stat.Size()), len(plan.files)).done()
+
+	arc.ra = xFile.prog.readAter(wimFile)
+
+	files, err := xFile.unWIM(arc, plan)
+	if err != nil {
+		return xFile.prog.Wrote, files, fmt.Errorf("%s: %w", xFile.FilePath, err)
+	}
+
+	return xFile.prog.Wrote, files, nil
+}
+
+// openWIM reads the header and lookup table of a WIM file.
+func openWIM(readerAt io.ReaderAt) (*wimArchive, error) {
+	header := make([]byte, wimHeaderSize)
+
+	_, err := readerAt.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading wim header: %w", err)
+	}
+
+	if !bytes.Equal(header[:8], []byte("MSWIM\x00\x00\x00")) {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorruptWIM)
+	}
+
+	if parts := binary.LittleEndian.Uint16(header[42:]); parts > 1 {
+		return nil, fmt.Errorf("%w: split wim with %d parts", ErrUnsupportedWIM, parts)
+	}
+
+	arc := &wimArchive{
+		ra:         readerAt,
+		flags:      binary.LittleEndian.Uint32(header[16:]),
+		chunkSize:  uint64(binary.LittleEndian.Uint32(header[20:])),
+		imageCount: int(binary.LittleEndian.Uint32(header[44:])),
+		blobs:      make(map[[sha1.Size]byte]*wimBlob),
+	}
+
+	if arc.chunkSize == 0 {
+		arc.chunkSize = wimDefaultChunkSize
+	}
+
+	if arc.flags&wimHdrCompression != 0 {
+		switch {
+		case arc.flags&wimHdrXPRESS != 0:
+			arc.codec = wimCodecXPRESS
+		case arc.flags&wimHdrLZX != 0:
+			arc.codec = wimCodecLZX
+		case arc.flags&wimHdrLZMS != 0:
+			arc.codec = wimCodecLZMS
+		default:
+			return nil, fmt.Errorf("%w: compression flags 0x%x", ErrUnsupportedWIM, arc.flags)
+		}
+	}
+
+	lookup := arc.reshdr(header[48:])
+
+	table, err := arc.readBlob(&wimBlob{res: lookup, size: lookup.usize})
+	if err != nil {
+		return nil, fmt.Errorf("reading wim lookup table: %w", err)
+	}
+
+	err = arc.parseLookupTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	if arc.imageCount != len(arc.metadata) {
+		return nil, fmt.Errorf("%w: header lists %d images, found %d",
+			ErrCorruptWIM, arc.imageCount, len(arc.metadata))
+	}
+
+	return arc, nil
+}
+
+// reshdr decodes a 24-byte resource header: 7-byte size, flags, offset, uncompressed size.
+func (a *wimArchive) reshdr(buf []byte) *wimResource {
+	res := &wimResource{
+		size:      binary.LittleEndian.Uint64(buf) & 0x00ffffffffffffff, //nolint:mnd
+		flags:     buf[7],
+		offset:    binary.LittleEndian.Uint64(buf[8:]),
+		usize:     binary.LittleEndian.Uint64(buf[16:]),
+		chunkSize: a.chunkSize,
+	}
+
+	if res.flags&wimResCompressed != 0 {
+		res.codec = a.codec
+	}
+
+	return res
+}
+
+// parseLookupTable indexes every blob by its SHA-1 and collects image metadata.
+// Solid blobs are listed first, followed by the solid resources that hold them;
+// their offsets address the concatenated uncompressed data of those resources.
+func (a *wimArchive) parseLookupTable(table []byte) error {
+	var (
+		solidBlobs []*wimBlob
+		solidRun   []*wimResource
+	)
+
+	for off := 0; off+wimLookupEntrySize <= len(table); off += wimLookupEntrySize {
+		res := a.reshdr(table[off:])
+		blob := &wimBlob{res: res, size: res.usize}
+		copy(blob.hash[:], table[off+30:off+wimLookupEntrySize])
+
+		switch {
+		case res.flags&wimResFree != 0:
+			continue
+		case res.flags&wimResSpanned != 0:
+			return fmt.Errorf("%w: spanned resource", ErrUnsupportedWIM)
+		case res.flags&wimResSolid != 0 && res.usize == wimSolidResourceSize:
+			if err := a.readSolidHeader(res); err != nil {
+				return err
+			}
+
+			solidRun = append(solidRun, res)
+
+			continue
+		case res.flags&wimResSolid != 0:
+			if len(solidRun) > 0 {
+				if err := assignSolidBlobs(solidBlobs, solidRun); err != nil {
+					return err
+				}
+
+				solidBlobs, solidRun = nil, nil
+			}
+
+			blob.res, blob.offset = nil, res.offset
+			solidBlobs = append(solidBlobs, blob)
+		}
+
+		if res.flags&wimResMetadata != 0 {
+			a.metadata = append(a.metadata, blob)
+		} else {
+			a.blobs[blob.hash] = blob
+		}
+	}
+
+	return assignSolidBlobs(solidBlobs, solidRun)
+}
+
+// assignSolidBlobs points each solid blob at the resource that holds it.
+func assignSolidBlobs(blobs []*wimBlob, run []*wimResource) error {
+	for _, blob := range blobs {
+		offset := blob.offset
+
+		for _, res := range run {
+			if offset < res.usize || (offset == res.usize && blob.size == 0) {
+				blob.res, blob.offset = res, offset
+				break
+			}
+
+			offset -= res.usize
+		}
+
+		if blob.res == nil || blob.offset+blob.size > blob.res.usize {
+			return fmt.Errorf("%w: solid blob outside its resources", ErrCorruptWIM)
+		}
+	}
+
+	return nil
+}
+
+// readSolidHeader reads the header of a solid resource: its real uncompressed
+// size, chunk size and compression format.
+func (a *wimArchive) readSolidHeader(res *wimResource) error {
+	header := make([]byte, wimSolidHeaderSize)
+
+	_, err := a.ra.ReadAt(header, int64(res.offset))
+	if err != nil {
+		return fmt.Errorf("reading wim solid resource header: %w", err)
+	}
+
+	res.usize = binary.LittleEndian.Uint64(header)
+	res.chunkSize = uint64(binary.LittleEndian.Uint32(header[8:]))
+	res.codec = binary.LittleEndian.Uint32(header[12:])
+
+	if res.codec > wimCodecLZMS {
+		return fmt.Errorf("%w: solid compression format %d", ErrUnsupportedWIM, res.codec)
+	}
+
+	return nil
+}
+
+func (r *wimResource) chunked() bool {
+	return r.flags&(wimResCompressed|wimResSolid) != 0
+}
+
+// loadChunks reads a resource's chunk table. Plain resources store the offset of
+// every chunk but the first; solid resources store the size of every chunk.
+func (a *wimArchive) loadChunks(res *wimResource) error {
+	if res.chunks != nil {
+		return nil
+	}
+
+	if res.chunkSize == 0 || res.chunkSize > wimMaxChunkSize {
+		return fmt.Errorf("%w: chunk size %d", ErrUnsupportedWIM, res.chunkSize)
+	}
+
+	numChunks := (res.usize + res.chunkSize - 1) / res.chunkSize
+	if numChunks > res.size {
+		return fmt.Errorf("%w: chunk table larger than resource", ErrCorruptWIM)
+	}
+
+	entrySize, count, start := uint64(4), numChunks-1, res.offset //nolint:mnd
+	if res.flags&wimResSolid != 0 {
+		count, start = numChunks, res.offset+wimSolidHeaderSize
+	} else if res.usize > 0xffffffff {
+		entrySize = 8
+	}
+
+	table := make([]byte, count*entrySize)
+	if _, err := a.ra.ReadAt(table, int64(start)); err != nil {
+		return fmt.Errorf("reading wim chunk table: %w", err)
+	}
+
+	res.chunks = make([]uint64, numChunks+1)
+	dataStart := start + uint64(len(table))
+	res.chunks[0] = dataStart
+
+	for idx := range count {
+		value := uint64(binary.LittleEndian.Uint32(table[idx*4:]))
+		if entrySize == 8 { //nolint:mnd
+			value = binary.LittleEndian.Uint64(table[idx*8:])
+		}
+
+		if res.flags&wimResSolid != 0 {
+			res.chunks[idx+1] = res.chunks[idx] + value
+		} else {
+			res.chunks[idx+1] = dataStart + value
+		}
+	}
+
+	if res.flags&wimResSolid == 0 {
+		res.chunks[numChunks] = res.offset + res.size
+	}
+
+	for idx := range numChunks {
+		if res.chunks[idx+1] < res.chunks[idx] || res.chunks[idx+1] > res.offset+res.size {
+			return fmt.Errorf("%w: bad chunk table", ErrCorruptWIM)
+		}
+	}
+
+	return nil
+}
+
+// chunk returns one decompressed chunk of a resource. The last chunk is cached
+// because consecutive blobs usually share it.
+func (a *wimArchive) chunk(res *wimResource, idx uint64) ([]byte, error) {
+	if res.cache != nil && res.cacheIdx == idx {
+		return res.cache, nil
+	}
+
+	if err := a.loadChunks(res); err != nil {
+		return nil, err
+	}
+
+	usize := min(res.chunkSize, res.usize-idx*res.chunkSize)
+	stored := make([]byte, res.chunks[idx+1]-res.chunks[idx])
+
+	if _, err := a.ra.ReadAt(stored, int64(res.chunks[idx])); err != nil {
+		return nil, fmt.Errorf("reading wim chunk: %w", err)
+	}
+
+	if uint64(cap(res.cache)) < usize {
+		res.cache = make([]byte, usize)
+	}
+
+	out := res.cache[:usize]
+	res.cache = nil // invalid until decompressed.
+
+	var err error
+
+	switch {
+	case uint64(len(stored)) == usize: // stored uncompressed.
+		copy(out, stored)
+	case res.codec == wimCodecXPRESS:
+		err = decompressXPRESS(stored, out)
+	case res.codec == wimCodecLZX:
+		err = decompressLZX(stored, out, uint32(res.chunkSize))
+	case res.codec == wimCodecLZMS:
+		err = decompressLZMS(stored, out)
+	default:
+		err = fmt.Errorf("%w: compressed chunk without a compression format", ErrCorruptWIM)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res.cache, res.cacheIdx = out, idx
+
+	return out, nil
+}
+
+// readAt reads uncompressed resource data at off into buf.
+func (a *wimArchive) readAt(res *wimResource, buf []byte, off uint64) (int, error) {
+	if !res.chunked() {
+		n, err := a.ra.ReadAt(buf, int64(res.offset+off))
+		if err != nil && !(errors.Is(err, io.EOF) && n == len(buf)) {
+			return n, fmt.Errorf("reading wim resource: %w", err)
+		}
+
+		return n, nil
+	}
+
+	read := 0
+
+	for read < len(buf) {
+		pos := off + uint64(read)
+
+		data, err := a.chunk(res, pos/res.chunkSize)
+		if err != nil {
+			return read, err
+		}
+
+		read += copy(buf[read:], data[pos%res.chunkSize:])
+	}
+
+	return read, nil
+}
+
+// readBlob reads a whole blob into memory. Used for the lookup table, metadata and reparse data.
+func (a *wimArchive) readBlob(blob *wimBlob) ([]byte, error) {
+	if blob.size > wimMaxResourceInMem || blob.offset+blob.size > blob.res.usize {
+		return nil, fmt.Errorf("%w: resource size %d", ErrCorruptWIM, blob.size)
+	}
+
+	data := make([]byte, blob.size)
+
+	_, err := a.readAt(blob.res, data, blob.offset)
+
+	return data, err
+}
+
+// wimBlobReader streams a blob and verifies its SHA-1 at the end.
+type wimBlobReader struct {
+	arc  *wimArchive
+	blob *wimBlob
+	pos  uint64
+	sum  hash.Hash
+}
+
+func (a *wimArchive) newBlobReader(blob *wimBlob) *wimBlobReader {
+	return &wimBlobReader{arc: a, blob: blob, sum: sha1.New()} //nolint:gosec
+}
+
+func (r *wimBlobReader) Read(buf []byte) (int, error) {
+	if r.pos >= r.blob.size {
+		if !bytes.Equal(r.sum.Sum(nil), r.blob.hash[:]) {
+			return 0, fmt.Errorf("%w: sha1 mismatch", ErrCorruptWIM)
+		}
+
+		return 0, io.EOF
+	}
+
+	buf = buf[:min(uint64(len(buf)), r.blob.size-r.pos)]
+	n, err := r.arc.readAt(r.blob.res, buf, r.blob.offset+r.pos)
+	r.pos += uint64(n)
+	r.sum.Write(buf[:n])
+
+	return n, err
+}
+
+func (a *wimArchive) selectImages(image int) ([]int, error) {
+	if image < 0 || image > a.imageCount {
+		return nil, fmt.Errorf("%w: %d (archive has %d)", ErrInvalidWIMImage, image, a.imageCount)
+	}
+
+	if image > 0 {
+		return []int{image}, nil
+	}
+
+	images := make([]int, a.imageCount)
+	for idx := range images {
+		images[idx] = idx + 1
+	}
+
+	return images, nil
+}
+
+// image reads the metadata resource of an image (1-based) and returns its root directory.
+func (a *wimArchive) image(image int) (*wimDentry, error) {
+	data, err := a.readBlob(a.metadata[image-1])
+	if err != nil {
+		return nil, fmt.Errorf("reading image %d metadata: %w", image, err)
+	}
+
+	if len(data) < 8 { //nolint:mnd
+		return nil, fmt.Errorf("%w: image %d metadata too short", ErrCorruptWIM, image)
+	}
+
+	// The root dentry follows the security data, aligned to 8 bytes.
+	securityLen := max(uint64(binary.LittleEndian.Uint32(data)), 8) //nolint:mnd
+
+	root, _, err := parseWIMDentry(data, wimAlign8(securityLen))
+	if err != nil {
+		return nil, err
+	} else if root == nil {
+		return nil, fmt.Errorf("%w: image %d has no root", ErrCorruptWIM, image)
+	}
+
+	return root, readWIMChildren(data, root, 0)
+}
+
+func wimAlign8(val uint64) uint64 {
+	return (val + 7) &^ 7 //nolint:mnd
+}
+
+func readWIMChildren(data []byte, parent *wimDentry, depth int) error {
+	if parent.subdir == 0 || parent.attrs&wimAttrDirectory == 0 {
+		return nil
+	}
+
+	if depth > wimMaxDirDepth {
+		return fmt.Errorf("%w: directories nested too deep", ErrCorruptWIM)
+	}
+
+	for off := parent.subdir; ; {
+		child, next, err := parseWIMDentry(data, off)
+		if err != nil {
+			return err
+		} else if child == nil {
+			return nil
+		}
+
+		if child.name == "" || child.name == "." || child.name == ".." || strings.ContainsAny(child.name, `/\`) {
+			return fmt.Errorf("%w: invalid file name %q", ErrCorruptWIM, child.name)
+		}
+
+		parent.children = append(parent.children, child)
+
+		if err = readWIMChildren(data, child, depth+1); err != nil {
+			return err
+		}
+
+		off = next
+	}
+}
+
+// parseWIMDentry decodes the dentry at off and its alternate data streams.
+// It returns nil at the end of a directory (a zero length entry), and the offset of the next sibling.
+func parseWIMDentry(data []byte, off uint64) (*wimDentry, uint64, error) {
+	if off+8 > uint64(len(data)) { //nolint:mnd
+		return nil, 0, fmt.Errorf("%w: dentry outside metadata", ErrCorruptWIM)
+	}
+
+	length := binary.LittleEndian.Uint64(data[off:])
+	if length == 0 {
+		return nil, 0, nil
+	}
+
+	if length < wimDentryMinSize || off+length > uint64(len(data)) {
+		return nil, 0, fmt.Errorf("%w: bad dentry length %d", ErrCorruptWIM, length)
+	}
+
+	raw := data[off : off+length]
+	dentry := &wimDentry{
+		attrs:  binary.LittleEndian.Uint32(raw[8:]),
+		subdir: binary.LittleEndian.Uint64(raw[16:]),
+		atime:  wimTime(binary.LittleEndian.Uint64(raw[48:])),
+		mtime:  wimTime(binary.LittleEndian.Uint64(raw[56:])),
+	}
+	copy(dentry.hash[:], raw[64:84])
+
+	if dentry.attrs&wimAttrReparse != 0 {
+		dentry.tag = binary.LittleEndian.Uint32(raw[88:])
+		dentry.rpFlags = binary.LittleEndian.Uint16(raw[94:])
+	} else {
+		dentry.linkID = binary.LittleEndian.Uint64(raw[88:])
+	}
+
+	nameLen := uint64(binary.LittleEndian.Uint16(raw[100:]))
+	if wimDentryMinSize+nameLen > length {
+		return nil, 0, fmt.Errorf("%w: dentry name too long", ErrCorruptWIM)
+	}
+
+	dentry.name = wimString(raw[wimDentryMinSize : wimDentryMinSize+nameLen])
+
+	next, err := dentry.parseStreams(data, wimAlign8(off+length), binary.LittleEndian.Uint16(raw[96:]))
+
+	return dentry, next, err
+}
+
+// parseStreams reads the extra stream entries that follow a dentry. An unnamed
+// extra stream holds the file data of a reparse point (whose dentry hash is the
+// reparse data); named streams are not extracted.
+func (d *wimDentry) parseStreams(data []byte, off uint64, count uint16) (uint64, error) {
+	for range count {
+		if off+wimStreamMinSize > uint64(len(data)) {
+			return 0, fmt.Errorf("%w: stream entry outside metadata", ErrCorruptWIM)
+		}
+
+		length := binary.LittleEndian.Uint64(data[off:])
+		if length < wimStreamMinSize || off+length > uint64(len(data)) {
+			return 0, fmt.Errorf("%w: bad stream entry length %d", ErrCorruptWIM, length)
+		}
+
+		if binary.LittleEndian.Uint16(data[off+36:]) == 0 {
+			if d.attrs&wimAttrReparse != 0 {
+				copy(d.data[:], data[off+16:off+36])
+			} else if d.hash == [sha1.Size]byte{} {
+				copy(d.hash[:], data[off+16:off+36])
+			}
+		}
+
+		off = wimAlign8(off + length)
+	}
+
+	return off, nil
+}
+
+func (d *wimDentry) isSymlink() bool {
+	return d.attrs&wimAttrReparse != 0 && (d.tag == wimTagSymlink || d.tag == wimTagMountPoint)
+}
+
+// dataHash returns the hash of the stream holding the file's contents.
+func (d *wimDentry) dataHash() [sha1.Size]byte {
+	if d.attrs&wimAttrReparse != 0 {
+		return d.data
+	}
+
+	return d.hash
+}
+
+func wimString(raw []byte) string {
+	units := make([]uint16, len(raw)/2) //nolint:mnd
+	for idx := range units {
+		units[idx] = binary.LittleEndian.Uint16(raw[idx*2:])
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func wimTime(filetime uint64) time.Time {
+	if filetime == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, (int64(filetime)-wimFiletimeEpoch)*100) //nolint:mnd
+}
+
+// planWIMImage walks an image and adds its directories, files and links to the plan.
+func (x *XFile) planWIMImage(arc *wimArchive, plan *wimPlan, image int, prefix string) error {
+	root, err := arc.image(image)
+	if err != nil {
+		return fmt.Errorf("%s: %w", x.FilePath, err)
+	}
+
+	return x.planWIMDir(arc, plan, root, prefix, x.clean(prefix), map[uint64]string{})
+}
+
+func (x *XFile) planWIMDir(arc *wimArchive, plan *wimPlan, dir *wimDentry, parent, root string,
+	links map[uint64]string,
+) error {
+	for _, child := range dir.children {
+		member := filepath.Join(parent, child.name)
+		entry := wimEntry{path: x.clean(member), member: member, root: root, dentry: child}
+
+		if !x.pathWithinOutput(entry.path) {
+			return fmt.Errorf("%s: %w: %s (from: %s)", x.FilePath, ErrInvalidPath, entry.path, child.name)
+		}
+
+		switch {
+		case child.isSymlink():
+			plan.symlinks = append(plan.symlinks, entry)
+		case child.attrs&wimAttrDirectory != 0:
+			plan.dirs = append(plan.dirs, entry)
+
+			err := x.planWIMDir(arc, plan, child, filepath.Join(parent, child.name), root, links)
+			if err != nil {
+				return err
+			}
+		case child.linkID != 0 && links[child.linkID] != "":
+			entry.target = links[child.linkID]
+			plan.hardlinks = append(plan.hardlinks, entry)
+		default:
+			if child.linkID != 0 {
+				links[child.linkID] = entry.path
+			}
+
+			if hash := child.dataHash(); hash != [sha1.Size]byte{} {
+				if entry.blob = arc.blobs[hash]; entry.blob == nil {
+					return fmt.Errorf("%s: %w: missing data for %s", x.FilePath, ErrCorruptWIM, entry.path)
+				}
+
+				plan.total += entry.blob.size
+			}
+
+			plan.files = append(plan.files, entry)
+		}
+	}
+
+	return nil
+}
+
+// unWIM writes a plan to disk. Files are written in the order their data is stored.
+func (x *XFile) unWIM(arc *wimArchive, plan *wimPlan) ([]string, error) {
+	files := []string{}
+
+	for _, dir := range plan.dirs {
+		x.Debugf("Writing archived directory: %s", dir.path)
+
+		if err := x.mkDirEntry(dir.path, 0, dir.dentry.mtime); err != nil {
+			return files, fmt.Errorf("making wim dir: %w", err)
+		}
+	}
+
+	slices.SortStableFunc(plan.files, compareWIMEntries)
+
+	for _, entry := range plan.files {
+		file := &file{
+			Path:    entry.path,
+			Member:  entry.member,
+			Data:    bytes.NewReader(nil),
+			DirMode: x.DirMode,
+			Mtime:   entry.dentry.mtime,
+			Atime:   entry.dentry.atime,
+		}
+
+		if entry.blob != nil {
+			file.Data = arc.newBlobReader(entry.blob)
+		}
+
+		x.Debugf("Writing archived file: %s", file.Path)
+
+		fSize, err := x.write(file)
+		if err != nil {
+			return files, err
+		}
+
+		files = append(files, file.Path)
+		x.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
+			file.Path, fSize, x.prog.Files, x.prog.Wrote)
+	}
+
+	links, err := x.writeWIMLinks(arc, plan)
+	files = append(files, links...)
+
+	if err != nil {
+		return files, err
+	}
+
+	return x.cleanup(files)
+}
+
+func compareWIMEntries(left, right wimEntry) int {
+	switch {
+	case left.blob == nil || right.blob == nil:
+		return boolCompare(left.blob != nil, right.blob != nil)
+	case left.blob.res.offset != right.blob.res.offset:
+		return compareUint64(left.blob.res.offset, right.blob.res.offset)
+	default:
+		return compareUint64(left.blob.offset, right.blob.offset)
+	}
+}
+
+func boolCompare(left, right bool) int {
+	switch {
+	case left == right:
+		return 0
+	case left:
+		return 1
+	default:
+		return -1
+	}
+}
+
+func compareUint64(left, right uint64) int {
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// writeWIMLinks creates symlinks and hard links after all files exist.
+func (x *XFile) writeWIMLinks(arc *wimArchive, plan *wimPlan) ([]string, error) {
+	files := []string{}
+
+	for _, entry := range plan.symlinks {
+		target, err := x.wimLinkTarget(arc, entry)
+		if errors.Is(err, errSkipEntry) {
+			continue
+		} else if err != nil {
+			return files, err
+		}
+
+		if err = x.mkDir(filepath.Dir(entry.path), 0, time.Time{}); err != nil {
+			return files, fmt.Errorf("making wim symlink parent dir: %w", err)
+		}
+
+		err = x.createSymlink(entry.path, target)
+		if errors.Is(err, errSkipEntry) {
+			continue
+		} else if err != nil {
+			return files, err
+		}
+
+		files = append(files, entry.path)
+	}
+
+	for _, entry := range plan.hardlinks {
+		target, err := filepath.Rel(x.OutputDir, entry.target)
+		if err != nil {
+			return files, fmt.Errorf("%s: %w: %s", x.FilePath, ErrInvalidPath, entry.target)
+		}
+
+		err = x.createHardLink(entry.path, target)
+		if errors.Is(err, errSkipEntry) {
+			continue
+		} else if err != nil {
+			return files, err
+		}
+
+		files = append(files, entry.path)
+	}
+
+	return files, nil
+}
+
+// wimLinkTarget reads a symlink or junction's reparse data and returns a link target.
+// Relative targets are used as-is. Absolute targets are only kept when the image
+// was captured with reparse point fixups, which makes them relative to the image root.
+func (x *XFile) wimLinkTarget(arc *wimArchive, entry wimEntry) (string, error) {
+	blob := arc.blobs[entry.dentry.hash]
+	if blob == nil || blob.size > maxSymlinkTarget {
+		return "", fmt.Errorf("%s: %w: missing reparse data for %s", x.FilePath, ErrCorruptWIM, entry.path)
+	}
+
+	data, err := arc.readBlob(blob)
+	if err != nil {
+		return "", fmt.Errorf("%s: reading reparse data: %w", x.FilePath, err)
+	}
+
+	// Reparse data is stored without its 8-byte header. Symlinks have a flags field
+	// before the path buffer; junctions (mount points) do not.
+	bufStart, relative := 8, false
+	if entry.dentry.tag == wimTagSymlink && len(data) >= 12 { //nolint:mnd
+		bufStart, relative = 12, binary.LittleEndian.Uint32(data[8:])&wimSymlinkRelative != 0 //nolint:mnd
+	}
+
+	if len(data) < bufStart {
+		return "", fmt.Errorf("%s: %w: short reparse data for %s", x.FilePath, ErrCorruptWIM, entry.path)
+	}
+
+	nameOff := bufStart + int(binary.LittleEndian.Uint16(data))
+	nameEnd := nameOff + int(binary.LittleEndian.Uint16(data[2:]))
+
+	if nameEnd > len(data) {
+		return "", fmt.Errorf("%s: %w: bad reparse data for %s", x.FilePath, ErrCorruptWIM, entry.path)
+	}
+
+	target := wimString(data[nameOff:nameEnd])
+	if relative {
+		return filepath.FromSlash(strings.ReplaceAll(target, `\`, "/")), nil
+	}
+
+	target = strings.TrimPrefix(target, `\??\`)
+	if len(target) >= 2 && target[1] == ':' {
+		target = target[2:] // drive letter.
+	}
+
+	if arc.flags&wimHdrRPFix == 0 || entry.dentry.rpFlags&wimRPNotFixed != 0 || !strings.HasPrefix(target, `\`) {
+		x.warn("skipping symlink with absolute target: %s -> %s", entry.path, target)
+		return "", errSkipEntry
+	}
+
+	abs := filepath.Join(entry.root, filepath.FromSlash(strings.ReplaceAll(target, `\`, "/")))
+
+	rel, err := filepath.Rel(filepath.Dir(entry.path), abs)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s -> %s", x.FilePath, ErrInvalidPath, entry.path, target)
+	}
+
+	return rel, nil
+}
@@ -0,0 +1,220 @@
+package xtractr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBitWriter produces the word stream read by wimBitReader. Words are reserved
+// at the same points the reader loads them, so raw bytes land where it expects them.
+type testBitWriter struct {
+	out      []byte
+	words    []int
+	word     int
+	filled   uint
+	bitsleft uint
+}
+
+func (w *testBitWriter) ensure(n uint) {
+	for w.bitsleft < n {
+		w.words = append(w.words, len(w.out))
+		w.out = append(w.out, 0, 0)
+		w.bitsleft += 16
+	}
+}
+
+func (w *testBitWriter) put(n uint, value uint32) {
+	w.bitsleft -= n
+
+	for bit := int(n) - 1; bit >= 0; bit-- {
+		if value>>bit&1 == 1 {
+			pos := w.words[w.word]
+			binary.LittleEndian.PutUint16(w.out[pos:], binary.LittleEndian.Uint16(w.out[pos:])|1<<(15-w.filled))
+		}
+
+		if w.filled++; w.filled == 16 {
+			w.word++
+			w.filled = 0
+		}
+	}
+}
+
+func (w *testBitWriter) bits(n uint, value uint32) {
+	if n > 0 {
+		w.ensure(n)
+		w.put(n, value)
+	}
+}
+
+// sym writes a codeword the way wimHuffman.decode reads it.
+func (w *testBitWriter) sym(maxLen uint, lens []uint8, sym int) {
+	w.ensure(maxLen)
+	w.put(uint(lens[sym]), testCodewords(lens)[sym])
+}
+
+func (w *testBitWriter) align() {
+	w.ensure(1)
+	w.bitsleft = 0
+	w.word = len(w.words)
+	w.filled = 0
+}
+
+// testCodewords assigns canonical codewords: by length, then symbol.
+func testCodewords(lens []uint8) []uint32 {
+	words := make([]uint32, len(lens))
+	code := uint32(0)
+
+	for length := uint8(1); length <= wimMaxCodeLen; length++ {
+		for sym, symLen := range lens {
+			if symLen == length {
+				words[sym] = code
+				code++
+			}
+		}
+
+		code <<= 1
+	}
+
+	return words
+}
+
+func testFilledLens(count int, length uint8) []uint8 {
+	return bytes.Repeat([]uint8{length}, count)
+}
+
+func TestWIMHuffman(t *testing.T) {
+	t.Parallel()
+
+	lens := []uint8{2, 1, 4, 4, 0, 12, 12} // incomplete, with codes longer than the table.
+
+	var code wimHuffman
+	require.NoError(t, code.build(lens, 16))
+
+	writer := &testBitWriter{}
+	message := []int{1, 0, 2, 3, 5, 6, 1}
+
+	for _, sym := range message {
+		writer.sym(16, lens, sym)
+	}
+
+	reader := &wimBitReader{data: writer.out}
+
+	for _, want := range message {
+		got, err := code.decode(reader)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(want), got)
+	}
+
+	require.ErrorIs(t, code.build([]uint8{1, 1, 1}, 16), ErrCorruptWIM, "oversubscribed code must fail")
+}
+
+func TestDecompressXPRESS(t *testing.T) {
+	t.Parallel()
+
+	lens := testFilledLens(xpressNumSymbols, 9)
+	writer := &testBitWriter{out: bytes.Repeat([]byte{0x99}, xpressNumSymbols/2)}
+	match := func(offsetBits uint, low uint32, lenField int) {
+		writer.sym(xpressMaxCodeLen, lens, xpressNumChars+int(offsetBits)<<4+lenField)
+		writer.ensure(16)
+		writer.put(offsetBits, low)
+	}
+
+	writer.sym(xpressMaxCodeLen, lens, 'a')
+	match(0, 0, xpressLongLength) // offset 1, length 15+5+3.
+	writer.out = append(writer.out, 5)
+	writer.sym(xpressMaxCodeLen, lens, 'b')
+	match(1, 0, 1) // offset 2, length 4.
+
+	out := make([]byte, 29)
+	require.NoError(t, decompressXPRESS(writer.out, out))
+	assert.Equal(t, bytes.Repeat([]byte("a"), 24), out[:24])
+	assert.Equal(t, "babab", string(out[24:]))
+
+	// A match before any output refers to data that does not exist.
+	writer = &testBitWriter{out: bytes.Repeat([]byte{0x99}, xpressNumSymbols/2)}
+	match(1, 0, 1)
+	require.ErrorIs(t, decompressXPRESS(writer.out, out), ErrCorruptWIM)
+}
+
+func TestDecompressLZX(t *testing.T) {
+	t.Parallel()
+
+	const numMainSyms = lzxNumChars + 30*(lzxNumPrimaryLens+1) // 32 KiB window.
+
+	// Complete codes, as a real encoder would send.
+	mainLens := append(testFilledLens(16, 8), testFilledLens(numMainSyms-16, 9)...)
+	lenLens := append(testFilledLens(7, 7), testFilledLens(lzxNumLenSyms-7, 8)...)
+	preLens := append(testFilledLens(12, 4), testFilledLens(lzxNumPrecodeSyms-12, 5)...)
+	writer := &testBitWriter{}
+	lengths := func(lens []uint8) {
+		for _, length := range preLens {
+			writer.bits(lzxPrecodeBits, uint32(length))
+		}
+
+		for _, length := range lens { // deltas from the previous (zero) lengths.
+			writer.sym(lzxMaxCodeLen, preLens, (17-int(length))%17)
+		}
+	}
+
+	writer.bits(3, lzxBlockVerbatim)
+	writer.bits(1, 0)
+	writer.bits(16, 17)
+	lengths(mainLens[:lzxNumChars])
+	lengths(mainLens[lzxNumChars:])
+	lengths(lenLens)
+
+	for _, literal := range "abc" {
+		writer.sym(lzxMaxCodeLen, mainLens, int(literal))
+	}
+
+	// Match: slot 4 (base 4, 1 extra bit) + 1 - 2 = offset 3, length header 3 = length 5.
+	writer.sym(lzxMaxCodeLen, mainLens, lzxNumChars+4<<3+3)
+	writer.bits(1, 1)
+	// Repeat offset R0, length header 7 + length symbol 0 = length 9.
+	writer.sym(lzxMaxCodeLen, mainLens, lzxNumChars+7)
+	writer.sym(lzxMaxCodeLen, lenLens, 0)
+
+	// Uncompressed block of 3 bytes: aligned recent offsets, data, padding.
+	writer.bits(3, lzxBlockUncompressed)
+	writer.bits(1, 0)
+	writer.bits(16, 3)
+	writer.align()
+	writer.out = binary.LittleEndian.AppendUint32(writer.out, 3)
+	writer.out = binary.LittleEndian.AppendUint32(writer.out, 1)
+	writer.out = binary.LittleEndian.AppendUint32(writer.out, 1)
+	writer.out = append(writer.out, 'X', 'Y', 'Z', 0)
+
+	out := make([]byte, 20)
+	require.NoError(t, decompressLZX(writer.out, out, wimDefaultChunkSize))
+	assert.Equal(t, "abcabcabcabcabcabXYZ", string(out))
+}
+
+func TestLZXUndoE8(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, 32)
+	data[4] = 0xE8
+	binary.LittleEndian.PutUint32(data[5:], 104) // absolute target 104 at position 4.
+	data[12] = 0xE8
+	binary.LittleEndian.PutUint32(data[13:], uint32(0xFFFFFFFF)) // -1: negative, within range.
+
+	lzxUndoE8(data, 0, lzxE8FileSize)
+	assert.Equal(t, uint32(100), binary.LittleEndian.Uint32(data[5:]))
+	assert.Equal(t, uint32(lzxE8FileSize-1), binary.LittleEndian.Uint32(data[13:]))
+}
+
+func TestLZMSCodeLens(t *testing.T) {
+	t.Parallel()
+
+	lens := make([]uint8, 6)
+	lzmsCodeLens([]uint32{1, 1, 2, 4, 8, 16}, lens, lzmsMaxCodeLen)
+	assert.Equal(t, []uint8{5, 5, 4, 3, 2, 1}, lens)
+
+	// Length limiting pushes the deepest leaves up.
+	lzmsCodeLens([]uint32{1, 1, 2, 4, 8, 16}, lens, 3)
+	assert.Equal(t, []uint8{3, 3, 3, 3, 2, 2}, lens)
+}
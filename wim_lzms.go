@@ -0,0 +1,599 @@
+package xtractr
+
+/* LZMS decompression, as used in solid WIM/ESD resources. */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+const (
+	lzmsNumLZReps          = 3
+	lzmsNumDeltaReps       = 3
+	lzmsNumMainProbs       = 16
+	lzmsNumMatchProbs      = 32
+	lzmsNumLZProbs         = 64
+	lzmsNumLZRepProbs      = 64
+	lzmsNumDeltaProbs      = 64
+	lzmsNumDeltaRepProbs   = 64
+	lzmsNumLiteralSyms     = 256
+	lzmsNumLengthSyms      = 54
+	lzmsNumDeltaPowerSyms  = 8
+	lzmsMaxCodeLen         = 15
+	lzmsProbBits           = 6
+	lzmsProbDenominator    = 1 << lzmsProbBits
+	lzmsInitialProb        = 48
+	lzmsInitialRecentBits  = 0x55555555
+	lzmsLiteralRebuild     = 1024
+	lzmsLZOffsetRebuild    = 1024
+	lzmsLengthRebuild      = 512
+	lzmsDeltaOffsetRebuild = 1024
+	lzmsDeltaPowerRebuild  = 512
+	lzmsX86MaxTranslation  = 1023
+	lzmsX86IDWindow        = 65535
+	lzmsX86TailBytes       = 16
+	lzmsSymBits            = 10
+	lzmsSymMask            = 1<<lzmsSymBits - 1
+)
+
+// The slot tables are run-length encoded: each entry is how many consecutive
+// slots share a number of extra bits, starting from 0 extra bits.
+//
+//nolint:gochecknoglobals,mnd
+var (
+	lzmsOffsetSlotRuns = []uint32{
+		9, 0, 9, 7, 10, 15, 15, 20, 20, 30, 33, 40, 42, 45, 60, 73, 80, 85, 95, 105, 6,
+	}
+	lzmsLengthSlotRuns = []uint32{27, 4, 6, 4, 5, 2, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 1}
+
+	lzmsOffsetBase, lzmsOffsetExtra = lzmsSlotTables(lzmsOffsetSlotRuns, 0x7fffffff)
+	lzmsLengthBase, lzmsLengthExtra = lzmsSlotTables(lzmsLengthSlotRuns, 0x400108ab)
+)
+
+// lzmsSlotTables expands run lengths into slot base values and extra bit counts.
+// The final base (one past the last slot) is the sentinel used for slot lookups.
+func lzmsSlotTables(runs []uint32, final uint32) ([]uint32, []uint) {
+	var (
+		base  []uint32
+		extra []uint
+		value uint32 = 1
+	)
+
+	for numBits, run := range runs {
+		for range run {
+			base = append(base, value)
+			extra = append(extra, uint(numBits))
+			value += 1 << numBits
+		}
+	}
+
+	return append(base, final), extra
+}
+
+// lzmsNumOffsetSlots returns the number of offset slots needed for a chunk size.
+func lzmsNumOffsetSlots(size int) int {
+	if size < 2 { //nolint:mnd
+		return 0
+	}
+
+	return 1 + lzmsSlot(lzmsOffsetBase, uint32(size-1))
+}
+
+func lzmsSlot(base []uint32, value uint32) int {
+	slot, _ := slices.BinarySearchFunc(base, value, func(b, v uint32) int {
+		if b > v {
+			return 1
+		}
+
+		return -1
+	})
+
+	return slot - 1
+}
+
+// lzmsProb is an adaptive probability: the count of zeros among the last 64 bits.
+type lzmsProb struct {
+	zeros  uint32
+	recent uint64
+}
+
+func newLZMSProbs(count int) []lzmsProb {
+	probs := make([]lzmsProb, count)
+	for idx := range probs {
+		probs[idx] = lzmsProb{zeros: lzmsInitialProb, recent: lzmsInitialRecentBits}
+	}
+
+	return probs
+}
+
+// probability returns the chance of a 0 bit, in 1/64ths, never 0 or 64.
+func (p *lzmsProb) probability() uint32 {
+	return min(max(p.zeros, 1), lzmsProbDenominator-1)
+}
+
+func (p *lzmsProb) update(bit uint32) {
+	p.zeros += uint32(p.recent>>(lzmsProbDenominator-1)) - bit
+	p.recent = p.recent<<1 | uint64(bit)
+}
+
+// lzmsRangeDecoder decodes the adaptive binary decisions, reading 16-bit words
+// from the front of the chunk.
+type lzmsRangeDecoder struct {
+	rng  uint32
+	code uint32
+	data []byte
+	pos  int
+}
+
+func (r *lzmsRangeDecoder) bit(state *uint32, numStates uint32, probs []lzmsProb) uint32 {
+	prob := &probs[*state]
+	*state = (*state << 1) & (numStates - 1)
+
+	if r.rng&0xffff0000 == 0 {
+		r.rng <<= 16
+		r.code <<= 16
+
+		if r.pos+2 <= len(r.data) {
+			r.code |= uint32(binary.LittleEndian.Uint16(r.data[r.pos:]))
+			r.pos += 2
+		}
+	}
+
+	bound := (r.rng >> lzmsProbBits) * prob.probability()
+	if r.code < bound {
+		r.rng = bound
+		prob.update(0)
+
+		return 0
+	}
+
+	r.rng -= bound
+	r.code -= bound
+	*state |= 1
+	prob.update(1)
+
+	return 1
+}
+
+// lzmsHuffman is an adaptive Huffman code. Symbol frequencies are counted as
+// symbols are decoded, and the code is rebuilt from them at a fixed interval.
+type lzmsHuffman struct {
+	wimHuffman
+	freqs   []uint32
+	lens    []uint8
+	rebuild int
+	left    int
+}
+
+func newLZMSHuffman(numSyms, rebuild int) (*lzmsHuffman, error) {
+	code := &lzmsHuffman{
+		freqs:   make([]uint32, numSyms),
+		lens:    make([]uint8, numSyms),
+		rebuild: rebuild,
+	}
+
+	for idx := range code.freqs {
+		code.freqs[idx] = 1
+	}
+
+	return code, code.rebuildCode()
+}
+
+func (h *lzmsHuffman) rebuildCode() error {
+	lzmsCodeLens(h.freqs, h.lens, lzmsMaxCodeLen)
+
+	for idx := range h.freqs {
+		h.freqs[idx] = h.freqs[idx]>>1 + 1
+	}
+
+	h.left = h.rebuild
+
+	return h.build(h.lens, lzmsMaxCodeLen)
+}
+
+func (h *lzmsHuffman) decode(bits *wimBitReader) (uint16, error) {
+	sym, err := h.wimHuffman.decode(bits)
+	if err != nil {
+		return 0, err
+	}
+
+	h.freqs[sym]++
+
+	if h.left--; h.left == 0 {
+		return sym, h.rebuildCode()
+	}
+
+	return sym, nil
+}
+
+// lzmsCodeLens computes length-limited Huffman codeword lengths from symbol
+// frequencies. The encoder and decoder must agree exactly, so this follows the
+// same tree construction and length limiting as the reference implementation.
+func lzmsCodeLens(freqs []uint32, lens []uint8, maxLen uint) {
+	nodes := make([]uint32, 0, len(freqs))
+
+	for sym, freq := range freqs {
+		lens[sym] = 0
+
+		if freq != 0 {
+			nodes = append(nodes, freq<<lzmsSymBits|uint32(sym))
+		}
+	}
+
+	slices.Sort(nodes)
+
+	switch len(nodes) {
+	case 0:
+		return
+	case 1:
+		// A single used symbol still gets a 1-bit codeword, paired with symbol 0 or 1.
+		lens[0] = 1
+		if sym := max(nodes[0]&lzmsSymMask, 1); int(sym) < len(lens) {
+			lens[sym] = 1
+		}
+
+		return
+	}
+
+	lzmsBuildTree(nodes)
+	counts := lzmsLengthCounts(nodes, len(nodes)-2, maxLen)
+
+	idx := 0
+
+	for length := maxLen; length >= 1; length-- {
+		for range counts[length] {
+			lens[nodes[idx]&lzmsSymMask] = uint8(length)
+			idx++
+		}
+	}
+}
+
+// lzmsBuildTree builds a Huffman tree in place over the sorted leaves. Internal
+// nodes overwrite the front of the slice and each node records its parent's index.
+func lzmsBuildTree(nodes []uint32) {
+	const freqMask = ^uint32(lzmsSymMask)
+
+	lastIdx := len(nodes) - 1
+	leaf, branch, end := 0, 0, 0
+
+	for {
+		var freq uint32
+
+		switch {
+		case leaf+1 <= lastIdx && (branch == end || nodes[leaf+1]&freqMask <= nodes[branch]&freqMask):
+			freq = nodes[leaf]&freqMask + nodes[leaf+1]&freqMask
+			leaf += 2
+		case branch+2 <= end && (leaf > lastIdx || nodes[branch+1]&freqMask < nodes[leaf]&freqMask):
+			freq = nodes[branch]&freqMask + nodes[branch+1]&freqMask
+			nodes[branch] = uint32(end)<<lzmsSymBits | nodes[branch]&lzmsSymMask
+			nodes[branch+1] = uint32(end)<<lzmsSymBits | nodes[branch+1]&lzmsSymMask
+			branch += 2
+		default:
+			freq = nodes[leaf]&freqMask + nodes[branch]&freqMask
+			nodes[branch] = uint32(end)<<lzmsSymBits | nodes[branch]&lzmsSymMask
+			leaf++
+			branch++
+		}
+
+		nodes[end] = freq | nodes[end]&lzmsSymMask
+
+		if end++; end >= lastIdx {
+			return
+		}
+	}
+}
+
+// lzmsLengthCounts walks the tree from the root and counts leaves per codeword
+// length, pushing leaves that would exceed maxLen up to the deepest free level.
+func lzmsLengthCounts(nodes []uint32, root int, maxLen uint) []uint32 {
+	counts := make([]uint32, maxLen+1)
+	counts[1] = 2
+	nodes[root] &= lzmsSymMask
+
+	for node := root - 1; node >= 0; node-- {
+		parent := nodes[node] >> lzmsSymBits
+		depth := uint(nodes[parent]>>lzmsSymBits) + 1
+		nodes[node] = nodes[node]&lzmsSymMask | uint32(depth)<<lzmsSymBits
+
+		if depth >= maxLen {
+			depth = maxLen
+			for depth--; counts[depth] == 0; depth-- {
+			}
+		}
+
+		counts[depth]--
+		counts[depth+1] += 2
+	}
+
+	return counts
+}
+
+// lzmsDecoder holds the state of one LZMS chunk.
+type lzmsDecoder struct {
+	rng  lzmsRangeDecoder
+	bits wimBitReader
+	out  []byte
+
+	mainState, matchState, lzState, deltaState uint32
+	lzRepStates, deltaRepStates                [lzmsNumLZReps - 1]uint32
+
+	mainProbs, matchProbs, lzProbs, deltaProbs []lzmsProb
+	lzRepProbs, deltaRepProbs                  [lzmsNumLZReps - 1][]lzmsProb
+
+	literal, lzOffset, length, deltaOffset, deltaPower *lzmsHuffman
+
+	recentLZ    [lzmsNumLZReps + 1]uint32
+	recentDelta [lzmsNumDeltaReps + 1]uint64
+	prevType    uint
+}
+
+func newLZMSDecoder(input, out []byte) (*lzmsDecoder, error) {
+	if len(input) < 4 || len(input)%2 != 0 { //nolint:mnd
+		return nil, fmt.Errorf("%w: lzms chunk size %d", ErrCorruptWIM, len(input))
+	}
+
+	dec := &lzmsDecoder{
+		rng: lzmsRangeDecoder{
+			rng:  0xffffffff,
+			code: uint32(binary.LittleEndian.Uint16(input))<<16 | uint32(binary.LittleEndian.Uint16(input[2:])),
+			data: input,
+			pos:  4, //nolint:mnd
+		},
+		bits:        wimBitReader{data: input, pos: len(input), backward: true},
+		out:         out,
+		mainProbs:   newLZMSProbs(lzmsNumMainProbs),
+		matchProbs:  newLZMSProbs(lzmsNumMatchProbs),
+		lzProbs:     newLZMSProbs(lzmsNumLZProbs),
+		deltaProbs:  newLZMSProbs(lzmsNumDeltaProbs),
+		recentLZ:    [lzmsNumLZReps + 1]uint32{1, 2, 3, 4},
+		recentDelta: [lzmsNumDeltaReps + 1]uint64{1, 2, 3, 4},
+	}
+
+	for idx := range dec.lzRepProbs {
+		dec.lzRepProbs[idx] = newLZMSProbs(lzmsNumLZRepProbs)
+		dec.deltaRepProbs[idx] = newLZMSProbs(lzmsNumDeltaRepProbs)
+	}
+
+	numOffsetSyms := lzmsNumOffsetSlots(len(out))
+
+	var err error
+
+	for _, code := range []struct {
+		dst     **lzmsHuffman
+		syms    int
+		rebuild int
+	}{
+		{&dec.literal, lzmsNumLiteralSyms, lzmsLiteralRebuild},
+		{&dec.lzOffset, numOffsetSyms, lzmsLZOffsetRebuild},
+		{&dec.length, lzmsNumLengthSyms, lzmsLengthRebuild},
+		{&dec.deltaOffset, numOffsetSyms, lzmsDeltaOffsetRebuild},
+		{&dec.deltaPower, lzmsNumDeltaPowerSyms, lzmsDeltaPowerRebuild},
+	} {
+		if *code.dst, err = newLZMSHuffman(code.syms, code.rebuild); err != nil {
+			return nil, err
+		}
+	}
+
+	return dec, nil
+}
+
+// decompressLZMS decompresses one LZMS chunk into out.
+func decompressLZMS(input, out []byte) error {
+	dec, err := newLZMSDecoder(input, out)
+	if err != nil {
+		return err
+	}
+
+	for pos := 0; pos < len(out); {
+		switch {
+		case dec.rng.bit(&dec.mainState, lzmsNumMainProbs, dec.mainProbs) == 0:
+			sym, err := dec.literal.decode(&dec.bits)
+			if err != nil {
+				return err
+			}
+
+			out[pos] = byte(sym)
+			pos++
+			dec.prevType = 0
+		case dec.rng.bit(&dec.matchState, lzmsNumMatchProbs, dec.matchProbs) == 0:
+			pos, err = dec.lzMatch(pos)
+		default:
+			pos, err = dec.deltaMatch(pos)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	lzmsUndoX86(out)
+
+	return nil
+}
+
+// slotValue decodes a slot with an adaptive code and adds its extra bits.
+func (d *lzmsDecoder) slotValue(code *lzmsHuffman, base []uint32, extra []uint) (uint32, error) {
+	slot, err := code.decode(&d.bits)
+	if err != nil {
+		return 0, err
+	}
+
+	if int(slot) >= len(extra) {
+		return 0, fmt.Errorf("%w: lzms slot %d", ErrCorruptWIM, slot)
+	}
+
+	return base[slot] + d.bits.read(extra[slot]), nil
+}
+
+// lzMatch decodes an LZ match. The recent offsets queue has one extra entry
+// because the previous item's offset is only inserted after the next item.
+func (d *lzmsDecoder) lzMatch(pos int) (int, error) {
+	var offset uint32
+
+	if d.rng.bit(&d.lzState, lzmsNumLZProbs, d.lzProbs) == 0 {
+		var err error
+		if offset, err = d.slotValue(d.lzOffset, lzmsOffsetBase, lzmsOffsetExtra); err != nil {
+			return pos, err
+		}
+
+		d.recentLZ[3], d.recentLZ[2], d.recentLZ[1] = d.recentLZ[2], d.recentLZ[1], d.recentLZ[0]
+	} else {
+		rep, skip := 0, int(d.prevType&1)
+		for rep < lzmsNumLZReps-1 && d.rng.bit(&d.lzRepStates[rep], lzmsNumLZRepProbs, d.lzRepProbs[rep]) == 1 {
+			rep++
+		}
+
+		offset = d.recentLZ[rep+skip]
+		d.recentLZ[rep+skip] = d.recentLZ[rep]
+		copy(d.recentLZ[1:rep+1], d.recentLZ[:rep])
+	}
+
+	d.recentLZ[0] = offset
+	d.prevType = 1
+
+	length, err := d.slotValue(d.length, lzmsLengthBase, lzmsLengthExtra)
+	if err != nil {
+		return pos, err
+	}
+
+	if int(offset) > pos || int(length) > len(d.out)-pos {
+		return pos, fmt.Errorf("%w: lzms match out of range", ErrCorruptWIM)
+	}
+
+	for end := pos + int(length); pos < end; pos++ {
+		d.out[pos] = d.out[pos-int(offset)]
+	}
+
+	return pos, nil
+}
+
+// deltaMatch decodes a delta match: each byte is predicted from two earlier
+// bytes span apart, which suits tables of fixed-size records.
+func (d *lzmsDecoder) deltaMatch(pos int) (int, error) {
+	var pair uint64
+
+	if d.rng.bit(&d.deltaState, lzmsNumDeltaProbs, d.deltaProbs) == 0 {
+		power, err := d.deltaPower.decode(&d.bits)
+		if err != nil {
+			return pos, err
+		}
+
+		raw, err := d.slotValue(d.deltaOffset, lzmsOffsetBase, lzmsOffsetExtra)
+		if err != nil {
+			return pos, err
+		}
+
+		pair = uint64(power)<<32 | uint64(raw)
+		d.recentDelta[3], d.recentDelta[2], d.recentDelta[1] = d.recentDelta[2], d.recentDelta[1], d.recentDelta[0]
+	} else {
+		rep, skip := 0, int(d.prevType>>1)
+		for rep < lzmsNumDeltaReps-1 &&
+			d.rng.bit(&d.deltaRepStates[rep], lzmsNumDeltaRepProbs, d.deltaRepProbs[rep]) == 1 {
+			rep++
+		}
+
+		pair = d.recentDelta[rep+skip]
+		d.recentDelta[rep+skip] = d.recentDelta[rep]
+		copy(d.recentDelta[1:rep+1], d.recentDelta[:rep])
+	}
+
+	d.recentDelta[0] = pair
+	d.prevType = 2
+
+	length, err := d.slotValue(d.length, lzmsLengthBase, lzmsLengthExtra)
+	if err != nil {
+		return pos, err
+	}
+
+	power, raw := pair>>32, pair&0xffffffff //nolint:mnd
+	if power >= 32 || raw<<power > 0xffffffff {
+		return pos, fmt.Errorf("%w: lzms delta offset", ErrCorruptWIM)
+	}
+
+	span, offset := 1<<power, int(raw<<power)
+	if offset+span > pos || int(length) > len(d.out)-pos {
+		return pos, fmt.Errorf("%w: lzms delta match out of range", ErrCorruptWIM)
+	}
+
+	for end := pos + int(length); pos < end; pos++ {
+		d.out[pos] = d.out[pos-offset] + d.out[pos-span] - d.out[pos-offset-span]
+	}
+
+	return pos, nil
+}
+
+// lzmsUndoX86 reverses the x86 machine code filter. The compressor rewrote the
+// relative addresses of some instructions to absolute ones, but only near other
+// instructions that referenced the same target; this retraces the same decisions.
+func lzmsUndoX86(data []byte) {
+	if len(data) <= lzmsX86TailBytes+1 {
+		return
+	}
+
+	lastTarget := make([]int, lzmsX86IDWindow+1)
+	for idx := range lastTarget {
+		lastTarget[idx] = -lzmsX86IDWindow - 1
+	}
+
+	closest := -lzmsX86MaxTranslation - 1
+
+	for idx := 1; idx < len(data)-lzmsX86TailBytes; idx++ {
+		opLen, maxTrans := lzmsX86Instruction(data[idx:])
+
+		switch {
+		case opLen == 0:
+			continue
+		case maxTrans == 0: // relative jump: skipped, never translated.
+			idx += opLen
+			continue
+		}
+
+		operand := idx + opLen
+		if idx-closest <= maxTrans {
+			abs := binary.LittleEndian.Uint32(data[operand:])
+			binary.LittleEndian.PutUint32(data[operand:], abs-uint32(idx))
+		}
+
+		target := uint16(idx) + binary.LittleEndian.Uint16(data[operand:])
+		end := operand + 4 - 1 //nolint:mnd
+
+		if end-lastTarget[target] <= lzmsX86IDWindow {
+			closest = end
+		}
+
+		lastTarget[target] = end
+		idx = end
+	}
+}
+
+// lzmsX86Instruction returns the opcode length of a filtered instruction at the
+// start of code and the distance within which it is translated. A relative jump
+// returns its operand length and 0; anything else returns 0, 0.
+func lzmsX86Instruction(code []byte) (int, int) {
+	switch code[0] {
+	case 0x48:
+		if code[1] == 0x8B && (code[2] == 0x5 || code[2] == 0xD) ||
+			code[1] == 0x8D && code[2]&0x7 == 0x5 {
+			return 3, lzmsX86MaxTranslation //nolint:mnd
+		}
+	case 0x4C:
+		if code[1] == 0x8D && code[2]&0x7 == 0x5 {
+			return 3, lzmsX86MaxTranslation //nolint:mnd
+		}
+	case 0xE8:
+		return 1, lzmsX86MaxTranslation / 2 //nolint:mnd
+	case 0xE9:
+		return 4, 0 //nolint:mnd
+	case 0xF0:
+		if code[1] == 0x83 && code[2] == 0x05 {
+			return 3, lzmsX86MaxTranslation //nolint:mnd
+		}
+	case 0xFF:
+		if code[1] == 0x15 {
+			return 2, lzmsX86MaxTranslation //nolint:mnd
+		}
+	}
+
+	return 0, 0
+}
@@ -0,0 +1,582 @@
+package xtractr_test
+
+import (
+	"encoding/binary"
+	"slices"
+	"sort"
+)
+
+/* An LZMS compressor for building test ESD files. It is written from the format
+ * (wimlib's lzms_compress.c and its documentation) and shares no tables or state
+ * with the decoder, so a misreading in one is not repeated in the other. */
+
+const (
+	testLZMSMaxCodeLen = 15
+	testLZMSMinMatch   = 3
+	testLZMSChainLen   = 32 // earlier positions tried per 3-byte prefix.
+)
+
+// Each run is the number of consecutive slots with 0, 1, 2... extra bits. Slot values start at 1.
+//
+//nolint:gochecknoglobals
+var (
+	testLZMSOffsetRuns = []int{9, 0, 9, 7, 10, 15, 15, 20, 20, 30, 33, 40, 42, 45, 60, 73, 80, 85, 95, 105, 6}
+	testLZMSLengthRuns = []int{27, 4, 6, 4, 5, 2, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 1}
+)
+
+// testLZMSSlots is a slot table: the first value and the extra bits of each slot.
+type testLZMSSlots struct {
+	base  []uint32
+	extra []int
+}
+
+func newTestLZMSSlots(runs []int) testLZMSSlots {
+	var slots testLZMSSlots
+
+	value := uint32(1)
+
+	for extra, run := range runs {
+		for range run {
+			slots.base = append(slots.base, value)
+			slots.extra = append(slots.extra, extra)
+			value += 1 << extra
+		}
+	}
+
+	return slots
+}
+
+// slot returns the last slot whose first value is at most value.
+func (s testLZMSSlots) slot(value uint32) int {
+	return sort.Search(len(s.base), func(slot int) bool { return s.base[slot] > value }) - 1
+}
+
+// testLZMSProb counts the zeros among the last 64 bits coded in one state.
+type testLZMSProb struct {
+	zeros  uint32
+	recent uint64
+}
+
+// testLZMSContext codes one kind of decision. The last decisions pick the probability.
+type testLZMSContext struct {
+	state uint32
+	probs []testLZMSProb
+}
+
+func newTestLZMSContext(states int) testLZMSContext {
+	probs := make([]testLZMSProb, states)
+	for idx := range probs {
+		probs[idx] = testLZMSProb{zeros: 48, recent: 0x55555555} // 48 of 64 bits are 0.
+	}
+
+	return testLZMSContext{probs: probs}
+}
+
+// testLZMSCode is an adaptive Huffman code, rebuilt from symbol counts every rebuild symbols.
+type testLZMSCode struct {
+	freqs   []uint32
+	lens    []uint8
+	words   []uint32
+	rebuild int
+	left    int
+}
+
+func newTestLZMSCode(numSyms, rebuild int) *testLZMSCode {
+	code := &testLZMSCode{freqs: make([]uint32, numSyms), rebuild: rebuild}
+	for sym := range code.freqs {
+		code.freqs[sym] = 1
+	}
+
+	code.build()
+
+	return code
+}
+
+// build makes the code from the counts, then halves them so recent symbols weigh more.
+func (c *testLZMSCode) build() {
+	c.lens = testLZMSCodeLens(c.freqs, testLZMSMaxCodeLen)
+	c.words = make([]uint32, len(c.lens))
+	word := uint32(0)
+
+	for length := uint8(1); length <= testLZMSMaxCodeLen; length++ {
+		for sym, symLen := range c.lens {
+			if symLen == length {
+				c.words[sym] = word
+				word++
+			}
+		}
+
+		word <<= 1
+	}
+
+	for sym := range c.freqs {
+		c.freqs[sym] = c.freqs[sym]/2 + 1
+	}
+
+	c.left = c.rebuild
+}
+
+// testLZMSCodeLens returns the codeword lengths of a Huffman tree built over the symbols
+// sorted by count then symbol, always joining the two lightest nodes and taking a leaf
+// before a joined node of the same weight. Nodes deeper than maxLen are moved up to the
+// deepest level that has room, and the rarest symbols get the longest codewords.
+func testLZMSCodeLens(freqs []uint32, maxLen int) []uint8 {
+	syms := make([]int, len(freqs))
+	for sym := range syms {
+		syms[sym] = sym
+	}
+
+	sort.SliceStable(syms, func(a, b int) bool { return freqs[syms[a]] < freqs[syms[b]] })
+
+	type joined struct {
+		weight uint32
+		parent int
+	}
+
+	var (
+		nodes       []joined
+		leaf, first int
+	)
+
+	lightest := func() (uint32, int) { // a joined node's index, or -1 for a leaf.
+		if leaf < len(syms) && (first == len(nodes) || freqs[syms[leaf]] <= nodes[first].weight) {
+			leaf++
+			return freqs[syms[leaf-1]], -1
+		}
+
+		first++
+
+		return nodes[first-1].weight, first - 1
+	}
+
+	for len(nodes) < len(syms)-1 {
+		weightA, nodeA := lightest()
+		weightB, nodeB := lightest()
+
+		for _, node := range []int{nodeA, nodeB} {
+			if node >= 0 {
+				nodes[node].parent = len(nodes)
+			}
+		}
+
+		nodes = append(nodes, joined{weight: weightA + weightB})
+	}
+
+	// Count the leaves at each depth: each joined node below the root turns one leaf into two.
+	counts := make([]int, maxLen+1)
+	depths := make([]int, len(nodes))
+	counts[1] = 2
+
+	for node := len(nodes) - 2; node >= 0; node-- {
+		depths[node] = depths[nodes[node].parent] + 1
+		depth := depths[node]
+
+		if depth >= maxLen {
+			for depth = maxLen - 1; counts[depth] == 0; depth-- {
+			}
+		}
+
+		counts[depth]--
+		counts[depth+1] += 2
+	}
+
+	lens := make([]uint8, len(freqs))
+	next := 0
+
+	for length := maxLen; length > 0; length-- {
+		for range counts[length] {
+			lens[syms[next]] = uint8(length)
+			next++
+		}
+	}
+
+	return lens
+}
+
+// testLZMSEncoder writes one chunk: range coded decisions as 16-bit words from the
+// front, and Huffman codes and extra bits as 16-bit words back from the end.
+type testLZMSEncoder struct {
+	low     uint64
+	rng     uint32
+	cache   uint16
+	pending int
+	started bool
+	front   []uint16
+	back    []uint16
+	bitbuf  uint32
+	nbits   int
+
+	main, match, lz, delta testLZMSContext
+	lzRep, deltaRep        [2]testLZMSContext
+
+	literal, lzOffset, length, deltaOffset, deltaPower *testLZMSCode
+	offsetSlots, lengthSlots                           testLZMSSlots
+
+	recentLZ    []uint32 // most recent first; the previous item's own offset can't be repeated.
+	recentDelta []uint64 // power<<32 | raw offset.
+	prev        string   // kind of the previous item: "literal", "lz" or "delta".
+	items       map[string]int
+}
+
+func newTestLZMSEncoder(size int, items map[string]int) *testLZMSEncoder {
+	offsets := newTestLZMSSlots(testLZMSOffsetRuns)
+	numOffsetSyms := 1 + offsets.slot(uint32(size-1))
+
+	return &testLZMSEncoder{
+		rng:         0xFFFFFFFF,
+		pending:     1,
+		main:        newTestLZMSContext(16),
+		match:       newTestLZMSContext(32),
+		lz:          newTestLZMSContext(64),
+		delta:       newTestLZMSContext(64),
+		lzRep:       [2]testLZMSContext{newTestLZMSContext(64), newTestLZMSContext(64)},
+		deltaRep:    [2]testLZMSContext{newTestLZMSContext(64), newTestLZMSContext(64)},
+		literal:     newTestLZMSCode(256, 1024),
+		lzOffset:    newTestLZMSCode(numOffsetSyms, 1024),
+		length:      newTestLZMSCode(54, 512),
+		deltaOffset: newTestLZMSCode(numOffsetSyms, 1024),
+		deltaPower:  newTestLZMSCode(8, 512),
+		offsetSlots: offsets,
+		lengthSlots: newTestLZMSSlots(testLZMSLengthRuns),
+		recentLZ:    []uint32{1, 2, 3, 4},
+		recentDelta: []uint64{1, 2, 3, 4},
+		prev:        "literal",
+		items:       items,
+	}
+}
+
+// shiftLow moves the top 16 bits of low out, holding back words a carry may still change.
+func (e *testLZMSEncoder) shiftLow() {
+	if uint32(e.low) < 0xFFFF0000 || e.low>>32 != 0 {
+		carry := uint16(e.low >> 32)
+		word := e.cache
+
+		for ; e.pending > 0; e.pending-- {
+			if e.started {
+				e.front = append(e.front, word+carry)
+			}
+
+			e.started = true
+			word = 0xFFFF
+		}
+
+		e.cache = uint16(e.low >> 16)
+	}
+
+	e.pending++
+	e.low = (e.low & 0xFFFF) << 16
+}
+
+func (e *testLZMSEncoder) decide(ctx *testLZMSContext, bit uint32) {
+	prob := &ctx.probs[ctx.state]
+	bound := (e.rng >> 6) * min(max(prob.zeros, 1), 63)
+
+	if bit == 0 {
+		e.rng = bound
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+	}
+
+	prob.zeros += uint32(prob.recent>>63) - bit
+	prob.recent = prob.recent<<1 | uint64(bit)
+	ctx.state = (ctx.state<<1 | bit) % uint32(len(ctx.probs))
+
+	if e.rng <= 0xFFFF {
+		e.rng <<= 16
+		e.shiftLow()
+	}
+}
+
+func (e *testLZMSEncoder) bits(count int, value uint32) {
+	for bit := count - 1; bit >= 0; bit-- {
+		e.bitbuf = e.bitbuf<<1 | value>>bit&1
+
+		if e.nbits++; e.nbits == 16 {
+			e.back = append(e.back, uint16(e.bitbuf))
+			e.bitbuf, e.nbits = 0, 0
+		}
+	}
+}
+
+func (e *testLZMSEncoder) sym(code *testLZMSCode, sym int) {
+	e.bits(int(code.lens[sym]), code.words[sym])
+	code.freqs[sym]++
+
+	if code.left--; code.left == 0 {
+		code.build()
+	}
+}
+
+func (e *testLZMSEncoder) value(code *testLZMSCode, slots testLZMSSlots, value uint32) {
+	slot := slots.slot(value)
+	e.sym(code, slot)
+	e.bits(slots.extra[slot], value-slots.base[slot])
+}
+
+// testLZMSRepeat returns which of the three usable recent values matches, or -1. After an
+// item of the same kind, the newest value is its own and is skipped.
+func testLZMSRepeat[T comparable](recent []T, value T, skip int) int {
+	if idx := slices.Index(recent[skip:skip+3], value); idx >= 0 {
+		return idx
+	}
+
+	return -1
+}
+
+// testLZMSUse moves the recent value at idx to the front; a new value pushes out the oldest.
+func testLZMSUse[T any](recent []T, idx int, value T) {
+	copy(recent[1:idx+1], recent[:idx])
+	recent[0] = value
+}
+
+// repeat codes the index of a repeated value: a 1 bit for each one passed over.
+func (e *testLZMSEncoder) repeat(ctxs *[2]testLZMSContext, rep int) {
+	for idx := range min(rep+1, 2) {
+		e.decide(&ctxs[idx], boolBit(idx < rep))
+	}
+}
+
+func boolBit(set bool) uint32 {
+	if set {
+		return 1
+	}
+
+	return 0
+}
+
+func (e *testLZMSEncoder) putLiteral(char byte) {
+	e.decide(&e.main, 0)
+	e.sym(e.literal, int(char))
+	e.prev = "literal"
+	e.items["literal"]++
+}
+
+func (e *testLZMSEncoder) putLZ(offset uint32, length int) {
+	e.decide(&e.main, 1)
+	e.decide(&e.match, 0)
+
+	skip := int(boolBit(e.prev == "lz"))
+	if rep := testLZMSRepeat(e.recentLZ, offset, skip); rep >= 0 {
+		e.decide(&e.lz, 1)
+		e.repeat(&e.lzRep, rep)
+		testLZMSUse(e.recentLZ, rep+skip, offset)
+		e.items["lz repeat"]++
+	} else {
+		e.decide(&e.lz, 0)
+		e.value(e.lzOffset, e.offsetSlots, offset)
+		testLZMSUse(e.recentLZ, len(e.recentLZ)-1, offset)
+		e.items["lz"]++
+	}
+
+	e.value(e.length, e.lengthSlots, uint32(length))
+	e.prev = "lz"
+}
+
+func (e *testLZMSEncoder) putDelta(power, raw uint32, length int) {
+	e.decide(&e.main, 1)
+	e.decide(&e.match, 1)
+
+	pair := uint64(power)<<32 | uint64(raw)
+	skip := int(boolBit(e.prev == "delta"))
+
+	if rep := testLZMSRepeat(e.recentDelta, pair, skip); rep >= 0 {
+		e.decide(&e.delta, 1)
+		e.repeat(&e.deltaRep, rep)
+		testLZMSUse(e.recentDelta, rep+skip, pair)
+		e.items["delta repeat"]++
+	} else {
+		e.decide(&e.delta, 0)
+		e.sym(e.deltaPower, int(power))
+		e.value(e.deltaOffset, e.offsetSlots, raw)
+		testLZMSUse(e.recentDelta, len(e.recentDelta)-1, pair)
+		e.items["delta"]++
+	}
+
+	e.value(e.length, e.lengthSlots, uint32(length))
+	e.prev = "delta"
+}
+
+// finish flushes the range coder and joins the two streams.
+func (e *testLZMSEncoder) finish() []byte {
+	for range 4 {
+		e.shiftLow()
+	}
+
+	if e.nbits > 0 {
+		e.bits(16-e.nbits, 0)
+	}
+
+	out := make([]byte, 0, 2*(len(e.front)+len(e.back)))
+	for _, word := range e.front {
+		out = binary.LittleEndian.AppendUint16(out, word)
+	}
+
+	for idx := len(e.back) - 1; idx >= 0; idx-- {
+		out = binary.LittleEndian.AppendUint16(out, e.back[idx])
+	}
+
+	return out
+}
+
+// testLZMSChunk compresses a chunk: the x86 filter, then a greedy parse taking the longest
+// LZ or delta match at each position, preferring recent offsets. It counts the kinds of
+// items in items. Chunks that do not shrink are stored as they are.
+func testLZMSChunk(chunk []byte, items map[string]int) []byte {
+	if len(chunk) < 64 { //nolint:mnd
+		return chunk
+	}
+
+	data := slices.Clone(chunk)
+	items["x86"] += testLZMSX86Filter(data)
+	enc := newTestLZMSEncoder(len(data), items)
+	chains := map[[3]byte][]int{}
+
+	for pos := 0; pos < len(data); {
+		kind, length, offset, power := enc.longest(data, pos, chains)
+
+		switch kind {
+		case "lz":
+			enc.putLZ(offset, length)
+		case "delta":
+			enc.putDelta(power, offset, length)
+		default:
+			enc.putLiteral(data[pos])
+			length = 1
+		}
+
+		for end := pos + length; pos < end; pos++ {
+			if pos+3 <= len(data) {
+				key := [3]byte(data[pos : pos+3])
+				chains[key] = append(chains[key], pos)
+			}
+		}
+	}
+
+	if out := enc.finish(); len(out) < len(chunk) {
+		return out
+	}
+
+	return chunk
+}
+
+// longest finds the longest match at pos of at least testLZMSMinMatch bytes.
+func (e *testLZMSEncoder) longest(data []byte, pos int, chains map[[3]byte][]int) (string, int, uint32, uint32) {
+	kind, best, bestOffset, bestPower := "literal", testLZMSMinMatch-1, uint32(0), uint32(0)
+	try := func(candidate string, length int, offset, power uint32) {
+		if length > best {
+			kind, best, bestOffset, bestPower = candidate, length, offset, power
+		}
+	}
+
+	lzLen := func(offset int) int {
+		length := 0
+		for pos+length < len(data) && data[pos+length] == data[pos+length-offset] {
+			length++
+		}
+
+		return length
+	}
+
+	deltaLen := func(power, raw uint32) int {
+		span, offset := 1<<power, int(raw<<power)
+		if offset+span > pos {
+			return 0
+		}
+
+		length := 0
+		for at := pos; at < len(data) && data[at] == data[at-offset]+data[at-span]-data[at-offset-span]; at++ {
+			length++
+		}
+
+		return length
+	}
+
+	skipLZ, skipDelta := int(boolBit(e.prev == "lz")), int(boolBit(e.prev == "delta"))
+
+	for _, offset := range e.recentLZ[skipLZ : skipLZ+3] {
+		if int(offset) <= pos {
+			try("lz", lzLen(int(offset)), offset, 0)
+		}
+	}
+
+	for _, pair := range e.recentDelta[skipDelta : skipDelta+3] {
+		try("delta", deltaLen(uint32(pair>>32), uint32(pair)), uint32(pair), uint32(pair>>32))
+	}
+
+	if pos+3 <= len(data) {
+		chain := chains[[3]byte(data[pos:pos+3])]
+		for idx := len(chain) - 1; idx >= max(0, len(chain)-testLZMSChainLen); idx-- {
+			try("lz", lzLen(pos-chain[idx]), uint32(pos-chain[idx]), 0)
+		}
+	}
+
+	for power := range uint32(4) {
+		for raw := uint32(1); raw <= 8; raw++ {
+			try("delta", deltaLen(power, raw), raw, power)
+		}
+	}
+
+	return kind, best, bestOffset, bestPower
+}
+
+// testLZMSX86Filter rewrites the relative addresses of x86 calls and RIP-relative loads
+// as absolute ones when another instruction used the same target shortly before, so
+// repeated calls to one function become repeated bytes. It returns the count rewritten.
+func testLZMSX86Filter(data []byte) int {
+	if len(data) <= 17 { //nolint:mnd
+		return 0
+	}
+
+	var (
+		lastEnd   = make([]int, 1<<16) // per low 16 bits of a target: where it was last used.
+		closest   = -1024              // end of the last instruction to reuse a target.
+		rewritten int
+	)
+
+	for idx := range lastEnd {
+		lastEnd[idx] = -1 << 16
+	}
+
+	for pos := 1; pos < len(data)-16; pos++ {
+		var opLen, within int
+
+		code := data[pos:]
+
+		switch {
+		case code[0] == 0xE8: // call rel32.
+			opLen, within = 1, 511
+		case code[0] == 0xE9: // jmp rel32: never rewritten, and its operand is skipped.
+			pos += 4
+			continue
+		case code[0] == 0xFF && code[1] == 0x15: // call [rip+disp32].
+			opLen, within = 2, 1023
+		case code[0] == 0x48 && code[1] == 0x8B && (code[2] == 0x05 || code[2] == 0x0D), // mov rax/rcx, [rip+disp32].
+			code[0] == 0x48 && code[1] == 0x8D && code[2]&7 == 5, // lea r64, [rip+disp32].
+			code[0] == 0x4C && code[1] == 0x8D && code[2]&7 == 5,
+			code[0] == 0xF0 && code[1] == 0x83 && code[2] == 0x05: // lock add [rip+disp32], imm8.
+			opLen, within = 3, 1023
+		default:
+			continue
+		}
+
+		operand := pos + opLen
+		relative := binary.LittleEndian.Uint32(data[operand:])
+		target := uint16(uint32(pos) + relative)
+
+		if pos-closest <= within {
+			binary.LittleEndian.PutUint32(data[operand:], relative+uint32(pos))
+			rewritten++
+		}
+
+		end := operand + 3
+		if end-lastEnd[target] < 1<<16 {
+			closest = end
+		}
+
+		lastEnd[target] = end
+		pos = end
+	}
+
+	return rewritten
+}
@@ -0,0 +1,361 @@
+package xtractr
+
+/* LZX decompression, as used in WIM resources (one independent LZX stream per chunk).
+ * Cabinet folders use the same codes with their own framing; see cab_lzx.go. */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	lzxNumChars         = 256
+	lzxNumPrimaryLens   = 7
+	lzxNumLenSyms       = 249
+	lzxMinMatchLen      = 2
+	lzxNumPrecodeSyms   = 20
+	lzxPrecodeBits      = 4
+	lzxNumAlignedSyms   = 8
+	lzxAlignedBits      = 3
+	lzxMaxCodeLen       = 16
+	lzxMaxAlignedLen    = 8
+	lzxNumRecentOffsets = 3
+	lzxDefaultBlockSize = 32768
+	lzxMinWindowOrder   = 15
+	lzxMaxWindowOrder   = 21
+	lzxMaxOffsetSlots   = 50
+	lzxMaxMainSyms      = lzxNumChars + lzxMaxOffsetSlots*(lzxNumPrimaryLens+1)
+	lzxE8FileSize       = 12000000
+	lzxE8MinTail        = 10
+)
+
+// LZX block types.
+const (
+	lzxBlockVerbatim     = 1
+	lzxBlockAligned      = 2
+	lzxBlockUncompressed = 3
+)
+
+// lzxDecoder holds the state of one LZX chunk. Code lengths carry over from
+// block to block (they are delta coded), and the recent offsets persist too.
+type lzxDecoder struct {
+	bits        *wimBitReader
+	out         []byte
+	windowOrder uint
+	numMainSyms int
+	mainLens    [lzxMaxMainSyms]uint8
+	lenLens     [lzxNumLenSyms]uint8
+	alignedLens [lzxNumAlignedSyms]uint8
+	main        wimHuffman
+	length      wimHuffman
+	aligned     wimHuffman
+	recent      [lzxNumRecentOffsets]uint32
+}
+
+// lzxWindowOrder returns the window order LZX uses for a given chunk size.
+func lzxWindowOrder(chunkSize uint32) (uint, error) {
+	order := max(uint(bits.Len32(chunkSize-1)), lzxMinWindowOrder)
+	if chunkSize == 0 || order > lzxMaxWindowOrder {
+		return 0, fmt.Errorf("%w: lzx chunk size %d", ErrUnsupportedWIM, chunkSize)
+	}
+
+	return order, nil
+}
+
+// lzxNumOffsetSlots returns how many offset slots a window of 2^order bytes uses.
+func lzxNumOffsetSlots(order uint) int {
+	if order >= 20 { //nolint:mnd
+		return 42 + int(order-20)*8 //nolint:mnd
+	}
+
+	return int(order) * 2 //nolint:mnd
+}
+
+// lzxOffsetSlot returns the base offset and number of extra bits of an offset slot.
+// The slot base includes the LZX_OFFSET_ADJUSTMENT of 2 (recent offsets use slots 0-2).
+func lzxOffsetSlot(slot uint32) (uint32, uint) {
+	switch {
+	case slot < 4: //nolint:mnd
+		return slot, 0
+	case slot < 38: //nolint:mnd
+		extra := uint(slot-2) / 2 //nolint:mnd
+
+		return (2 + slot&1) << extra, min(extra, 17) //nolint:mnd
+	default:
+		return 1<<19 + (slot-38)<<17, 17 //nolint:mnd
+	}
+}
+
+// decompressLZX decompresses one LZX chunk into out. chunkSize is the resource's
+// chunk size, which determines the window order and number of main symbols.
+func decompressLZX(input, out []byte, chunkSize uint32) error {
+	order, err := lzxWindowOrder(chunkSize)
+	if err != nil {
+		return err
+	}
+
+	dec := &lzxDecoder{
+		bits:        &wimBitReader{data: input},
+		out:         out,
+		windowOrder: order,
+		numMainSyms: lzxNumChars + lzxNumOffsetSlots(order)*(lzxNumPrimaryLens+1),
+		recent:      [lzxNumRecentOffsets]uint32{1, 1, 1},
+	}
+
+	for pos := 0; pos < len(out); {
+		blockType, size := dec.readBlockHeader()
+		if size < 1 || size > len(out)-pos {
+			return fmt.Errorf("%w: lzx block size %d", ErrCorruptWIM, size)
+		}
+
+		switch blockType {
+		case lzxBlockVerbatim, lzxBlockAligned:
+			err = dec.readCodes(blockType == lzxBlockAligned)
+			if err == nil {
+				_, err = dec.decodeBlock(pos, pos+size, pos+size, blockType == lzxBlockAligned)
+			}
+		case lzxBlockUncompressed:
+			err = dec.copyUncompressed(pos, size)
+		default:
+			err = fmt.Errorf("%w: lzx block type %d", ErrCorruptWIM, blockType)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		pos += size
+	}
+
+	lzxUndoE8(out, 0, lzxE8FileSize)
+
+	return nil
+}
+
+func (d *lzxDecoder) readBlockHeader() (uint32, int) {
+	blockType := d.bits.read(3) //nolint:mnd
+
+	if d.bits.read(1) == 1 {
+		return blockType, lzxDefaultBlockSize
+	}
+
+	size := int(d.bits.read(16)) //nolint:mnd
+	if d.windowOrder >= 16 {     //nolint:mnd
+		size = size<<8 | int(d.bits.read(8)) //nolint:mnd
+	}
+
+	return blockType, size
+}
+
+// readCodes reads the Huffman codes for a verbatim or aligned block.
+func (d *lzxDecoder) readCodes(aligned bool) error {
+	if aligned {
+		for idx := range d.alignedLens {
+			d.alignedLens[idx] = uint8(d.bits.read(lzxAlignedBits))
+		}
+
+		if err := d.aligned.build(d.alignedLens[:], lzxMaxAlignedLen); err != nil {
+			return err
+		}
+	}
+
+	// The main code lengths are sent in two parts: literals, then match headers.
+	if err := d.readLens(d.mainLens[:lzxNumChars]); err != nil {
+		return err
+	}
+
+	if err := d.readLens(d.mainLens[lzxNumChars:d.numMainSyms]); err != nil {
+		return err
+	}
+
+	if err := d.main.build(d.mainLens[:d.numMainSyms], lzxMaxCodeLen); err != nil {
+		return err
+	}
+
+	if err := d.readLens(d.lenLens[:]); err != nil {
+		return err
+	}
+
+	return d.length.build(d.lenLens[:], lzxMaxCodeLen)
+}
+
+// readLens reads a precode, then uses it to update a run of codeword lengths.
+// Lengths are coded as deltas (mod 17) from the previous block's lengths.
+func (d *lzxDecoder) readLens(lens []uint8) error {
+	var (
+		preLens [lzxNumPrecodeSyms]uint8
+		precode wimHuffman
+	)
+
+	for idx := range preLens {
+		preLens[idx] = uint8(d.bits.read(lzxPrecodeBits))
+	}
+
+	if err := precode.build(preLens[:], lzxMaxCodeLen); err != nil {
+		return err
+	}
+
+	for idx := 0; idx < len(lens); {
+		sym, err := precode.decode(d.bits)
+		if err != nil {
+			return err
+		}
+
+		run, value := 1, uint8(0)
+
+		switch sym {
+		case 17: //nolint:mnd // run of zeros
+			run = 4 + int(d.bits.read(4)) //nolint:mnd
+		case 18: //nolint:mnd // longer run of zeros
+			run = 20 + int(d.bits.read(5)) //nolint:mnd
+		case 19: //nolint:mnd // run of the same delta
+			run = 4 + int(d.bits.read(1)) //nolint:mnd
+
+			if sym, err = precode.decode(d.bits); err != nil {
+				return err
+			} else if sym > 17 { //nolint:mnd
+				return fmt.Errorf("%w: lzx precode", ErrCorruptWIM)
+			}
+
+			value = lzxDelta(lens[idx], sym)
+		default:
+			value = lzxDelta(lens[idx], sym)
+		}
+
+		for end := min(idx+run, len(lens)); idx < end; idx++ {
+			lens[idx] = value
+		}
+	}
+
+	return nil
+}
+
+func lzxDelta(prev uint8, sym uint16) uint8 {
+	return uint8((int(prev) - int(sym) + 17) % 17) //nolint:mnd
+}
+
+// decodeBlock decodes the symbols of a verbatim or aligned block into out from pos until
+// it reaches stop, and returns where it stopped. The last match may run past stop, up to
+// limit (the end of the block): cabinet blocks are decoded one 32 KiB frame at a time.
+func (d *lzxDecoder) decodeBlock(pos, stop, limit int, aligned bool) (int, error) {
+	for pos < stop {
+		sym, err := d.main.decode(d.bits)
+		if err != nil {
+			return pos, err
+		}
+
+		if sym < lzxNumChars {
+			d.out[pos] = byte(sym)
+			pos++
+
+			continue
+		}
+
+		sym -= lzxNumChars
+		length := int(sym&lzxNumPrimaryLens) + lzxMinMatchLen
+
+		if sym&lzxNumPrimaryLens == lzxNumPrimaryLens {
+			extra, err := d.length.decode(d.bits)
+			if err != nil {
+				return pos, err
+			}
+
+			length += int(extra)
+		}
+
+		offset, err := d.matchOffset(uint32(sym>>3), aligned) //nolint:mnd
+		if err != nil {
+			return pos, err
+		}
+
+		if int(offset) > pos || length > limit-pos {
+			return pos, fmt.Errorf("%w: lzx match out of range", ErrCorruptWIM)
+		}
+
+		for end := pos + length; pos < end; pos++ {
+			d.out[pos] = d.out[pos-int(offset)]
+		}
+	}
+
+	return pos, nil
+}
+
+// matchOffset decodes a match offset from its slot and updates the recent offsets queue.
+func (d *lzxDecoder) matchOffset(slot uint32, aligned bool) (uint32, error) {
+	if slot < lzxNumRecentOffsets {
+		offset := d.recent[slot]
+		d.recent[slot] = d.recent[0]
+		d.recent[0] = offset
+
+		return offset, nil
+	}
+
+	base, extra := lzxOffsetSlot(slot)
+	offset := base
+
+	if aligned && extra >= lzxAlignedBits {
+		offset += d.bits.read(extra-lzxAlignedBits) << lzxAlignedBits
+
+		sym, err := d.aligned.decode(d.bits)
+		if err != nil {
+			return 0, err
+		}
+
+		offset += uint32(sym)
+	} else {
+		offset += d.bits.read(extra)
+	}
+
+	offset -= lzxNumRecentOffsets - 1
+	d.recent[2] = d.recent[1]
+	d.recent[1] = d.recent[0]
+	d.recent[0] = offset
+
+	return offset, nil
+}
+
+// copyUncompressed handles an uncompressed block: the recent offsets and raw
+// bytes follow, aligned to the next 16-bit word, and are padded to an even size.
+func (d *lzxDecoder) copyUncompressed(pos, size int) error {
+	d.bits.align()
+
+	for idx := range d.recent {
+		val, err := d.bits.readUint32()
+		if err != nil {
+			return err
+		}
+
+		d.recent[idx] = val
+	}
+
+	if d.bits.pos+size > len(d.bits.data) {
+		return fmt.Errorf("%w: lzx uncompressed block truncated", ErrCorruptWIM)
+	}
+
+	copy(d.out[pos:pos+size], d.bits.data[d.bits.pos:])
+	d.bits.pos += size + size&1
+
+	return nil
+}
+
+// lzxUndoE8 reverses the x86 call-instruction translation applied by the compressor.
+// start is the stream position of data[0], and fileSize the translation size.
+func lzxUndoE8(data []byte, start, fileSize int32) {
+	for idx := 0; idx < len(data)-lzxE8MinTail; idx++ {
+		if data[idx] != 0xE8 {
+			continue
+		}
+
+		abs, pos := int32(binary.LittleEndian.Uint32(data[idx+1:])), start+int32(idx)
+
+		switch {
+		case abs >= 0 && abs < fileSize:
+			binary.LittleEndian.PutUint32(data[idx+1:], uint32(abs-pos))
+		case abs < 0 && abs >= -pos:
+			binary.LittleEndian.PutUint32(data[idx+1:], uint32(abs+fileSize))
+		}
+
+		idx += 4
+	}
+}
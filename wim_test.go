@@ -0,0 +1,540 @@
+package xtractr_test
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golift.io/xtractr"
+)
+
+func TestWIM(t *testing.T) {
+	t.Parallel()
+
+	testFilesInfo := createTestFiles(t)
+	archive := filepath.Join(testFilesInfo.dstFilesDir, "archive.wim")
+	writeTestWIM(t, archive, testFilesInfo.srcFilesDir)
+
+	extractDir := filepath.Join(testFilesInfo.dstFilesDir, "wim")
+	size, files, archives, err := xtractr.ExtractFile(&xtractr.XFile{
+		FilePath:  archive,
+		OutputDir: extractDir,
+		FileMode:  0o600,
+		DirMode:   0o700,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, testFilesInfo.dataSize, size)
+	assert.Len(t, files, testFilesInfo.fileCount)
+	assert.Len(t, archives, testFilesInfo.archiveCount)
+
+	want, err := os.ReadFile(filepath.Join(testFilesInfo.srcFilesDir, "level1", "level2", "level2.bin"))
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(filepath.Join(extractDir, "level1", "level2", "level2.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestWIMImages(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	first := filepath.Join(tmp, "first")
+	second := filepath.Join(tmp, "second")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(first, "sub"), 0o700))
+	require.NoError(t, os.MkdirAll(second, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(first, "sub", "one.txt"), []byte("image one"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(second, "two.txt"), []byte("image two"), 0o600))
+
+	archive := filepath.Join(tmp, "images.wim")
+	writeTestWIM(t, archive, first, second)
+
+	t.Run("all", func(t *testing.T) {
+		t.Parallel()
+
+		out := filepath.Join(tmp, "all")
+		_, files, err := xtractr.ExtractWIM(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{
+			filepath.Join(out, "1", "sub", "one.txt"),
+			filepath.Join(out, "2", "two.txt"),
+		}, files)
+	})
+
+	t.Run("second", func(t *testing.T) {
+		t.Parallel()
+
+		out := filepath.Join(tmp, "second-only")
+		_, files, err := xtractr.ExtractWIM(&xtractr.XFile{
+			FilePath: archive, OutputDir: out, DirMode: 0o700, WIMImage: 2,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(out, "two.txt")}, files)
+
+		data, err := os.ReadFile(filepath.Join(out, "two.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "image two", string(data))
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		t.Parallel()
+
+		queued := filepath.Join(tmp, "queued")
+		require.NoError(t, os.MkdirAll(queued, 0o700))
+		writeTestWIM(t, filepath.Join(queued, "images.wim"), first, second)
+
+		queue := xtractr.NewQueue(&xtractr.Config{Logger: &testLogger{t: t}})
+		defer queue.Stop()
+
+		xFile := &xtractr.Xtract{
+			Filter:     xtractr.Filter{Path: queued},
+			WIMImage:   2,
+			TempFolder: true,
+			CBChannel:  make(chan *xtractr.Response),
+		}
+
+		_, err := queue.Extract(xFile)
+		require.NoError(t, err)
+
+		for resp := range xFile.CBChannel {
+			if !resp.Done {
+				continue
+			}
+
+			require.NoError(t, resp.Error)
+			require.Len(t, resp.NewFiles, 1, "only the second image is extracted")
+			assert.Equal(t, "two.txt", filepath.Base(resp.NewFiles[0]))
+
+			break
+		}
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := xtractr.ExtractWIM(&xtractr.XFile{
+			FilePath: archive, OutputDir: filepath.Join(tmp, "bad"), WIMImage: 3,
+		})
+		require.ErrorIs(t, err, xtractr.ErrInvalidWIMImage)
+	})
+}
+
+func TestWIMSymlinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	err := os.Symlink("target", filepath.Join(tmp, "symlink-probe"))
+	if err != nil {
+		t.Skipf("symlinks unavailable on this platform: %v", err)
+	}
+
+	src := filepath.Join(tmp, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "dir"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "file.txt"), []byte("data"), 0o600))
+	require.NoError(t, os.Symlink(filepath.Join("dir", "file.txt"), filepath.Join(src, "link")))
+	require.NoError(t, os.Symlink(filepath.Join("..", "..", "escape"), filepath.Join(src, "dir", "evil")))
+
+	archive := filepath.Join(tmp, "links.wim")
+	writeTestWIM(t, archive, src)
+
+	out := filepath.Join(tmp, "out")
+	_, _, err = xtractr.ExtractWIM(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+	require.ErrorIs(t, err, xtractr.ErrInvalidPath, "a symlink leaving the output folder must be rejected")
+
+	require.NoError(t, os.Remove(filepath.Join(src, "dir", "evil")))
+	writeTestWIM(t, archive, src)
+
+	out = filepath.Join(tmp, "out2")
+	_, files, err := xtractr.ExtractWIM(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+	require.NoError(t, err)
+	assert.Contains(t, files, filepath.Join(out, "link"))
+
+	target, err := os.Readlink(filepath.Join(out, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("dir", "file.txt"), target)
+
+	data, err := os.ReadFile(filepath.Join(out, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestWIMCompressed(t *testing.T) {
+	t.Parallel()
+
+	var text bytes.Buffer
+	for idx := range 5000 { // hex digits: 16 byte values, so the chunks compress.
+		fmt.Fprintf(&text, "%08x", uint32(idx*2654435761))
+	}
+
+	// 17 byte values: these chunks are stored, and the small file is too short to compress.
+	stored := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, 3000)
+	files := map[string][]byte{
+		"large.txt":       text.Bytes(),
+		"sub/small.txt":   []byte("0123abcd"),
+		"sub/binary.bin":  stored,
+		"sub/records.bin": testWIMRecords(),
+		"sub/code.bin":    testWIMCode(),
+	}
+
+	total := 0
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+
+	for name, data := range files {
+		total += len(data)
+		require.NoError(t, os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(src, name), data, 0o600))
+	}
+
+	for name, wim := range map[string]*testWIM{
+		"xpress": {codec: testWIMXPRESS},
+		"lzms":   {codec: testWIMLZMS, items: map[string]int{}},
+		"esd":    {codec: testWIMLZMS, items: map[string]int{}, solid: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			archive := filepath.Join(tmp, name+".wim")
+			wim.write(t, archive, src)
+
+			stat, err := os.Stat(archive)
+			require.NoError(t, err)
+			assert.Less(t, stat.Size(), int64(total-text.Len()/3), "the text is compressed")
+
+			if wim.codec == testWIMLZMS {
+				assert.Less(t, stat.Size(), int64(total/4), "everything is compressed")
+
+				for _, item := range []string{"literal", "lz", "lz repeat", "delta", "delta repeat", "x86"} {
+					assert.Positive(t, wim.items[item], "LZMS items of kind %s", item)
+				}
+
+				assert.Greater(t, wim.items["literal"], 1024, "the literal code is rebuilt")
+			}
+
+			out := filepath.Join(tmp, name)
+			size, written, err := xtractr.ExtractWIM(&xtractr.XFile{FilePath: archive, OutputDir: out, DirMode: 0o700})
+			require.NoError(t, err)
+			assert.Len(t, written, len(files))
+			assert.Equal(t, uint64(total), size)
+
+			for name, want := range files {
+				got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+				require.NoError(t, err)
+				assert.Equal(t, sha1.Sum(want), sha1.Sum(got), name) //nolint:gosec
+				assert.Equal(t, want, got, name)
+			}
+		})
+	}
+}
+
+// testWIMRecords returns a table of 12-byte records whose fields step by a fixed amount:
+// each byte is predicted by the same byte of the two records before it, as delta matches
+// do. A few records break the pattern, so a delta match resumes after them.
+func testWIMRecords() []byte {
+	var out []byte
+
+	for idx := range 3000 {
+		record := []byte{byte(idx), byte(idx * 3), 0x40, byte(idx * 7), 1, 2, byte(idx * 11), byte(255 - idx), 0, 0, 9, byte(idx * 5)}
+		if idx%250 == 249 {
+			record[3] ^= 0x5A
+		}
+
+		out = append(out, record...)
+	}
+
+	return out
+}
+
+// testWIMCode returns x86 code that calls a few functions over and over. Each call's
+// relative address differs, until the x86 filter makes it absolute.
+func testWIMCode() []byte {
+	var out []byte
+
+	for idx := range 4000 {
+		target := 0x100 + uint32(idx%5)*0x40                 // a function at one of five addresses.
+		out = append(out, 0x8B, 0x45, byte(idx), 0x50, 0xE8) // mov eax, [ebp+n]; push eax; call.
+		out = binary.LittleEndian.AppendUint32(out, target-uint32(len(out)+4))
+		out = append(out, 0x83, 0xC4, 0x04) // add esp, 4.
+	}
+
+	return out
+}
+
+// testWIM builds a minimal WIM file: one image per source folder. Resources are
+// stored uncompressed unless codec is set. With solid, file data goes into one
+// solid resource after the lookup entries of its blobs, as in .esd files.
+type testWIM struct {
+	body     bytes.Buffer
+	lookup   bytes.Buffer
+	codec    uint32 // testWIMXPRESS or testWIMLZMS.
+	solid    bool
+	blobs    bytes.Buffer   // uncompressed data of the solid resource.
+	blobList bytes.Buffer   // lookup entries of the solid blobs.
+	items    map[string]int // kinds of LZMS items written.
+}
+
+const (
+	testWIMHeaderSize = 208
+	testWIMChunkSize  = 32768
+	testWIMXPRESS     = 1
+	testWIMLZMS       = 3
+)
+
+// writeTestWIM writes an uncompressed WIM with one image for each source folder.
+// Symlinks are stored as relative symlink reparse points.
+func writeTestWIM(t *testing.T, path string, sources ...string) {
+	t.Helper()
+
+	(&testWIM{}).write(t, path, sources...)
+}
+
+func (w *testWIM) write(t *testing.T, path string, sources ...string) {
+	t.Helper()
+
+	for _, src := range sources {
+		metadata := w.image(t, src)
+		w.addResource(metadata, 0x02) //nolint:mnd // metadata resource flag.
+	}
+
+	if w.solid {
+		// The solid resource header: uncompressed size, chunk size and format.
+		res := binary.LittleEndian.AppendUint64(nil, uint64(w.blobs.Len()))
+		res = binary.LittleEndian.AppendUint32(res, testWIMChunkSize)
+		res = binary.LittleEndian.AppendUint32(res, w.codec)
+		res = append(res, w.compressResource(w.blobs.Bytes(), true)...)
+
+		entry := make([]byte, 50)
+		putTestReshdr(entry, uint64(len(res)), 0x10, uint64(testWIMHeaderSize+w.body.Len()), 0x100000000)
+		w.body.Write(res)
+		w.lookup.Write(w.blobList.Bytes())
+		w.lookup.Write(entry)
+	}
+
+	header := make([]byte, testWIMHeaderSize)
+	copy(header, "MSWIM\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[8:], testWIMHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], 0x10d00)
+	binary.LittleEndian.PutUint32(header[20:], testWIMChunkSize)
+
+	switch w.codec {
+	case testWIMXPRESS:
+		binary.LittleEndian.PutUint32(header[16:], 0x20002) // compressed, XPRESS.
+	case testWIMLZMS:
+		binary.LittleEndian.PutUint32(header[16:], 0x80002) // compressed, LZMS.
+	}
+
+	binary.LittleEndian.PutUint16(header[40:], 1)
+	binary.LittleEndian.PutUint16(header[42:], 1)
+	binary.LittleEndian.PutUint32(header[44:], uint32(len(sources)))
+	putTestReshdr(header[48:], uint64(w.lookup.Len()), 0,
+		uint64(testWIMHeaderSize+w.body.Len()), uint64(w.lookup.Len()))
+
+	data := append(header, w.body.Bytes()...)
+	require.NoError(t, os.WriteFile(path, append(data, w.lookup.Bytes()...), 0o600))
+}
+
+func putTestReshdr(buf []byte, size uint64, flags byte, offset, usize uint64) {
+	binary.LittleEndian.PutUint64(buf, size)
+	buf[7] = flags
+	binary.LittleEndian.PutUint64(buf[8:], offset)
+	binary.LittleEndian.PutUint64(buf[16:], usize)
+}
+
+// addResource stores data and adds it to the lookup table.
+func (w *testWIM) addResource(data []byte, flags byte) [sha1.Size]byte {
+	hash := sha1.Sum(data) //nolint:gosec
+	entry := make([]byte, 50)
+	binary.LittleEndian.PutUint16(entry[24:], 1)
+	binary.LittleEndian.PutUint32(entry[26:], 1)
+	copy(entry[30:], hash[:])
+
+	switch {
+	case w.solid && flags == 0: // the offset is in the solid resource's data.
+		putTestReshdr(entry, uint64(len(data)), 0x10, uint64(w.blobs.Len()), uint64(len(data)))
+		w.blobList.Write(entry)
+		w.blobs.Write(data)
+	case w.codec != 0:
+		stored := w.compressResource(data, false)
+		putTestReshdr(entry, uint64(len(stored)), flags|0x04, uint64(testWIMHeaderSize+w.body.Len()), uint64(len(data)))
+		w.lookup.Write(entry)
+		w.body.Write(stored)
+	default:
+		putTestReshdr(entry, uint64(len(data)), flags, uint64(testWIMHeaderSize+w.body.Len()), uint64(len(data)))
+		w.lookup.Write(entry)
+		w.body.Write(data)
+	}
+
+	return hash
+}
+
+// compressResource splits data into compressed chunks behind a chunk table: the offsets
+// of all chunks but the first for plain resources, the size of every chunk for solid ones.
+func (w *testWIM) compressResource(data []byte, solid bool) []byte {
+	var table, chunks bytes.Buffer
+
+	for pos := 0; pos < len(data); pos += testWIMChunkSize {
+		chunk := data[pos:min(pos+testWIMChunkSize, len(data))]
+		if w.codec == testWIMLZMS {
+			chunk = testLZMSChunk(chunk, w.items)
+		} else {
+			chunk = testXPRESSChunk(chunk)
+		}
+
+		if solid {
+			table.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(chunk))))
+		} else if pos > 0 {
+			table.Write(binary.LittleEndian.AppendUint32(nil, uint32(chunks.Len())))
+		}
+
+		chunks.Write(chunk)
+	}
+
+	return append(table.Bytes(), chunks.Bytes()...)
+}
+
+// testXPRESSChunk compresses a chunk using 16 byte values or fewer with 4-bit literal codes.
+// Other chunks, and those that would not shrink, are stored as they are.
+func testXPRESSChunk(chunk []byte) []byte {
+	var (
+		codes [256]uint16
+		used  [256]bool
+	)
+
+	for _, val := range chunk {
+		used[val] = true
+	}
+
+	out, count := make([]byte, 256), uint16(0) // 4-bit lengths of the 512 symbols.
+
+	for val := range used {
+		if used[val] {
+			codes[val], count = count, count+1 // canonical: one length, in symbol order.
+			out[val/2] |= 4 << (4 * (val % 2))
+		}
+	}
+
+	if count > 16 || 256+(len(chunk)+3)/4*2 >= len(chunk) {
+		return chunk
+	}
+
+	for pos := 0; pos < len(chunk); pos += 4 {
+		word := uint16(0)
+
+		for idx := range 4 {
+			word <<= 4
+
+			if pos+idx < len(chunk) {
+				word |= codes[chunk[pos+idx]]
+			}
+		}
+
+		out = binary.LittleEndian.AppendUint16(out, word)
+	}
+
+	return out
+}
+
+// image builds a metadata resource: empty security data, a root dentry, then
+// each directory's children followed by an end-of-directory marker.
+func (w *testWIM) image(t *testing.T, src string) []byte {
+	t.Helper()
+
+	meta := make([]byte, 8) //nolint:mnd
+	binary.LittleEndian.PutUint32(meta, 8)
+
+	root := len(meta)
+	meta = append(meta, testDentry("", 0x10, [sha1.Size]byte{}, 0)...)
+	meta = append(meta, make([]byte, 8)...)
+
+	return w.dir(t, src, meta, root)
+}
+
+func (w *testWIM) dir(t *testing.T, src string, meta []byte, parent int) []byte {
+	t.Helper()
+
+	entries, err := os.ReadDir(src)
+	require.NoError(t, err)
+
+	binary.LittleEndian.PutUint64(meta[parent+16:], uint64(len(meta)))
+
+	subdirs := map[int]string{}
+
+	for _, entry := range entries {
+		path := filepath.Join(src, entry.Name())
+		offset := len(meta)
+
+		switch {
+		case entry.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			require.NoError(t, err)
+
+			hash := w.addResource(testReparseData(target), 0)
+			meta = append(meta, testDentry(entry.Name(), 0x400, hash, 0xA000000C)...)
+		case entry.IsDir():
+			subdirs[offset] = path
+			meta = append(meta, testDentry(entry.Name(), 0x10, [sha1.Size]byte{}, 0)...)
+		default:
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			meta = append(meta, testDentry(entry.Name(), 0x80, w.addResource(data, 0), 0)...)
+		}
+	}
+
+	meta = append(meta, make([]byte, 8)...)
+
+	for offset, path := range subdirs {
+		meta = w.dir(t, path, meta, offset)
+	}
+
+	return meta
+}
+
+func testUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, len(units)*2)
+
+	for idx, unit := range units {
+		binary.LittleEndian.PutUint16(out[idx*2:], unit)
+	}
+
+	return out
+}
+
+func testDentry(name string, attrs uint32, hash [sha1.Size]byte, tag uint32) []byte {
+	encoded := testUTF16(name)
+	length := 102 + len(encoded) + 2
+	dentry := make([]byte, (length+7)&^7)
+
+	binary.LittleEndian.PutUint64(dentry, uint64(length))
+	binary.LittleEndian.PutUint32(dentry[8:], attrs)
+	binary.LittleEndian.PutUint64(dentry[56:], 133000000000000000) // 2022-06-18, as a FILETIME.
+	copy(dentry[64:], hash[:])
+	binary.LittleEndian.PutUint32(dentry[88:], tag)
+	binary.LittleEndian.PutUint16(dentry[100:], uint16(len(encoded)))
+	copy(dentry[102:], encoded)
+
+	return dentry
+}
+
+// testReparseData encodes a relative symlink reparse buffer, minus its 8-byte header.
+func testReparseData(target string) []byte {
+	name := testUTF16(strings.ReplaceAll(target, "/", `\`))
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint16(data[2:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(data[4:], uint16(len(name)))
+	binary.LittleEndian.PutUint16(data[6:], uint16(len(name)))
+	binary.LittleEndian.PutUint32(data[8:], 1)
+
+	return append(append(data, name...), name...)
+}
@@ -0,0 +1,321 @@
+package xtractr
+
+/* Shared bit reader and Huffman decoder for the WIM codecs, plus XPRESS Huffman. */
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// wimBitReader reads a stream of 16-bit little-endian words, most significant bit first.
+// XPRESS and LZX read forward and interleave raw bytes with the bits; LZMS reads its
+// Huffman-coded bits backward from the end of the chunk. Words are loaded lazily (only
+// when a read needs them) because the raw-byte position depends on it.
+type wimBitReader struct {
+	data     []byte
+	pos      int
+	bitbuf   uint64
+	bitsleft uint
+	over     uint // zero bits fed in past the end of the data.
+	backward bool
+}
+
+// ensure loads words until at least n (<= 32) bits are buffered. Past the end of
+// the data, zeros are fed in; corrupt chunks are caught by the callers' bounds checks.
+func (b *wimBitReader) ensure(n uint) {
+	for b.bitsleft < n {
+		var word uint64
+
+		switch {
+		case b.backward && b.pos >= 2: //nolint:mnd
+			b.pos -= 2
+			word = uint64(binary.LittleEndian.Uint16(b.data[b.pos:]))
+		case !b.backward && b.pos+2 <= len(b.data):
+			word = uint64(binary.LittleEndian.Uint16(b.data[b.pos:]))
+			b.pos += 2
+		default:
+			b.over += 16
+		}
+
+		b.bitbuf |= word << (48 - b.bitsleft) //nolint:mnd
+		b.bitsleft += 16
+	}
+}
+
+// peek returns the next n bits without consuming them. ensure(n) must be called first.
+func (b *wimBitReader) peek(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+
+	return uint32(b.bitbuf >> (64 - n))
+}
+
+func (b *wimBitReader) remove(n uint) {
+	b.bitbuf <<= n
+	b.bitsleft -= n
+}
+
+// read consumes and returns the next n (<= 32) bits.
+func (b *wimBitReader) read(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+
+	b.ensure(n)
+	val := b.peek(n)
+	b.remove(n)
+
+	return val
+}
+
+// align discards the buffered bits so raw bytes can be read from the next word.
+// If nothing is buffered, one word is loaded and discarded (LZX requires this).
+func (b *wimBitReader) align() {
+	b.ensure(1)
+	b.bitbuf = 0
+	b.bitsleft = 0
+}
+
+func (b *wimBitReader) readByte() (byte, error) {
+	if b.pos >= len(b.data) {
+		return 0, ErrCorruptWIM
+	}
+
+	b.pos++
+
+	return b.data[b.pos-1], nil
+}
+
+func (b *wimBitReader) readUint16() (uint16, error) {
+	if b.pos+2 > len(b.data) {
+		return 0, ErrCorruptWIM
+	}
+
+	b.pos += 2
+
+	return binary.LittleEndian.Uint16(b.data[b.pos-2:]), nil
+}
+
+func (b *wimBitReader) readUint32() (uint32, error) {
+	if b.pos+4 > len(b.data) {
+		return 0, ErrCorruptWIM
+	}
+
+	b.pos += 4
+
+	return binary.LittleEndian.Uint32(b.data[b.pos-4:]), nil
+}
+
+// wimHuffTableBits is the size of the direct lookup table. Longer codes are
+// resolved with the canonical first-code search in wimHuffman.decodeLong.
+const (
+	wimHuffTableBits = 10
+	wimMaxCodeLen    = 16
+)
+
+// wimHuffman decodes a canonical Huffman code built from codeword lengths.
+// Codewords are assigned in order of length, then symbol value. Incomplete
+// codes are accepted; an unassigned codeword is reported as corrupt data.
+type wimHuffman struct {
+	maxLen    uint
+	tableBits uint
+	table     []uint32 // symbol<<8 | length, 0 when the codeword is longer than tableBits.
+	count     [wimMaxCodeLen + 1]uint32
+	first     [wimMaxCodeLen + 1]uint32
+	offset    [wimMaxCodeLen + 1]uint32
+	symbols   []uint16
+}
+
+// build (re)initializes the decoder from a list of codeword lengths (0 = unused symbol).
+func (h *wimHuffman) build(lens []uint8, maxLen uint) error {
+	h.maxLen = maxLen
+	h.tableBits = min(maxLen, wimHuffTableBits)
+	h.count = [wimMaxCodeLen + 1]uint32{}
+
+	for _, length := range lens {
+		if uint(length) > maxLen {
+			return fmt.Errorf("%w: huffman codeword too long", ErrCorruptWIM)
+		}
+
+		h.count[length]++
+	}
+
+	h.count[0] = 0
+	left := 1
+
+	for length := uint(1); length <= maxLen; length++ {
+		left = left<<1 - int(h.count[length])
+		if left < 0 {
+			return fmt.Errorf("%w: oversubscribed huffman code", ErrCorruptWIM)
+		}
+	}
+
+	var code, total uint32
+
+	for length := uint(1); length <= maxLen; length++ {
+		code = (code + h.count[length-1]) << 1
+		h.first[length] = code
+		h.offset[length] = total
+		total += h.count[length]
+	}
+
+	if cap(h.symbols) < int(total) {
+		h.symbols = make([]uint16, total)
+	}
+
+	h.symbols = h.symbols[:total]
+	next := h.offset
+
+	for sym, length := range lens {
+		if length != 0 {
+			h.symbols[next[length]] = uint16(sym)
+			next[length]++
+		}
+	}
+
+	h.fillTable()
+
+	return nil
+}
+
+func (h *wimHuffman) fillTable() {
+	size := 1 << h.tableBits
+	if cap(h.table) < size {
+		h.table = make([]uint32, size)
+	}
+
+	h.table = h.table[:size]
+	clear(h.table)
+
+	for length := uint(1); length <= h.tableBits; length++ {
+		for idx := range h.count[length] {
+			code := h.first[length] + idx
+			entry := uint32(h.symbols[h.offset[length]+idx])<<8 | uint32(length)
+			start := code << (h.tableBits - length)
+
+			for fill := range uint32(1) << (h.tableBits - length) {
+				h.table[start+fill] = entry
+			}
+		}
+	}
+}
+
+// decode reads one symbol from the bit reader.
+func (h *wimHuffman) decode(bits *wimBitReader) (uint16, error) {
+	bits.ensure(h.maxLen)
+	peek := bits.peek(h.maxLen)
+
+	if entry := h.table[peek>>(h.maxLen-h.tableBits)]; entry != 0 {
+		bits.remove(uint(entry & 0xff))
+		return uint16(entry >> 8), nil
+	}
+
+	return h.decodeLong(bits, peek)
+}
+
+func (h *wimHuffman) decodeLong(bits *wimBitReader, peek uint32) (uint16, error) {
+	for length := h.tableBits + 1; length <= h.maxLen; length++ {
+		code := peek >> (h.maxLen - length)
+		if code >= h.first[length] && code-h.first[length] < h.count[length] {
+			bits.remove(length)
+			return h.symbols[h.offset[length]+code-h.first[length]], nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: invalid huffman codeword", ErrCorruptWIM)
+}
+
+// XPRESS Huffman, as used in WIM resources. Each chunk starts with 512 4-bit
+// codeword lengths, followed by the Huffman bit stream with raw match-length bytes
+// interleaved where the encoder flushed them.
+const (
+	xpressNumChars    = 256
+	xpressNumSymbols  = 512
+	xpressMaxCodeLen  = 15
+	xpressMinMatchLen = 3
+	xpressLongLength  = 0xf
+	xpressLongerLen   = 0xf + 0xff
+)
+
+// decompressXPRESS decompresses one XPRESS Huffman chunk into out, which must be
+// exactly the uncompressed chunk size.
+func decompressXPRESS(input, out []byte) error {
+	if len(input) < xpressNumSymbols/2 {
+		return fmt.Errorf("%w: xpress chunk too short", ErrCorruptWIM)
+	}
+
+	lens := make([]uint8, xpressNumSymbols)
+	for idx, val := range input[:xpressNumSymbols/2] {
+		lens[idx*2] = val & 0xf
+		lens[idx*2+1] = val >> 4
+	}
+
+	var code wimHuffman
+
+	err := code.build(lens, xpressMaxCodeLen)
+	if err != nil {
+		return err
+	}
+
+	bits := &wimBitReader{data: input, pos: xpressNumSymbols / 2}
+
+	for pos := 0; pos < len(out); {
+		sym, err := code.decode(bits)
+		if err != nil {
+			return err
+		}
+
+		if sym < xpressNumChars {
+			out[pos] = byte(sym)
+			pos++
+
+			continue
+		}
+
+		length, offset, err := xpressMatch(bits, sym-xpressNumChars)
+		if err != nil {
+			return err
+		}
+
+		if offset > pos || length > len(out)-pos {
+			return fmt.Errorf("%w: xpress match out of range", ErrCorruptWIM)
+		}
+
+		for end := pos + length; pos < end; pos++ {
+			out[pos] = out[pos-offset]
+		}
+	}
+
+	return nil
+}
+
+// xpressMatch decodes the length and offset of a match symbol (already minus 256).
+func xpressMatch(bits *wimBitReader, sym uint16) (int, int, error) {
+	length := int(sym & 0xf)
+	offsetBits := uint(sym>>4) & 0xf //nolint:mnd
+
+	bits.ensure(16) //nolint:mnd
+	offset := 1<<offsetBits | int(bits.peek(offsetBits))
+	bits.remove(offsetBits)
+
+	if length == xpressLongLength {
+		extra, err := bits.readByte()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		length += int(extra)
+
+		if length == xpressLongerLen {
+			long, err := bits.readUint16()
+			if err != nil {
+				return 0, 0, err
+			}
+
+			length = int(long)
+		}
+	}
+
+	return length + xpressMinMatchLen, offset, nil
+}
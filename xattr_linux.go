@@ -0,0 +1,8 @@
+package xtractr
+
+import "syscall"
+
+// setXattr writes an extended attribute on a file.
+func setXattr(path, name string, data []byte) error {
+	return syscall.Setxattr(path, name, data, 0) //nolint:wrapcheck
+}
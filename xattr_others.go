@@ -0,0 +1,8 @@
+//go:build !linux
+
+package xtractr
+
+// setXattr writes an extended attribute on a file. Only Linux is supported.
+func setXattr(_, _ string, _ []byte) error {
+	return ErrXattrsUnsupported
+}
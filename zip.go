@@ -3,7 +3,6 @@ package xtractr
 import (
 	"archive/zip"
 	"fmt"
-	"path/filepath"
 	"time"
 )
 
@@ -36,7 +35,7 @@ func ExtractZIP(xFile *XFile) (size uint64, filesList []string, err error) {
 			return xFile.prog.Wrote, files, fmt.Errorf("%s: %w", xFile.FilePath, err)
 		}
 
-		files = append(files, filepath.Join(xFile.OutputDir, decodedName))
+		files = append(files, xFile.clean(decodedName))
 		xFile.Debugf("Wrote archived file: %s (%d bytes), total: %d files and %d bytes",
 			wfile, fSize, xFile.prog.Files, xFile.prog.Wrote)
 	}
@@ -67,7 +66,7 @@ type zipFileEntry struct {
 // Pass 2 (parallel): dispatch file writes to workers.
 func (x *XFile) extractZIPParallel(
 	zipReader *zip.ReadCloser,
-	decoder *zipNameDecoders,
+	decoder *nameDecoders,
 ) (uint64, []string, error) {
 	fileEntries, files, err := x.zipPrepareEntries(zipReader, decoder)
 	if err != nil {
@@ -88,7 +87,7 @@ func (x *XFile) extractZIPParallel(
 // and returns the list of file entries to extract in parallel.
 func (x *XFile) zipPrepareEntries(
 	zipReader *zip.ReadCloser,
-	decoder *zipNameDecoders,
+	decoder *nameDecoders,
 ) ([]zipFileEntry, []string, error) {
 	entries := make([]zipFileEntry, 0, len(zipReader.File))
 	files := make([]string, 0, len(zipReader.File))
@@ -102,10 +101,12 @@ func (x *XFile) zipPrepareEntries(
 				x.FilePath, zipFile.FileInfo().Name(), ErrInvalidPath, cleanPath, decodedName)
 		}
 
-		files = append(files, filepath.Join(x.OutputDir, decodedName))
+		files = append(files, cleanPath)
 
 		if zipFile.FileInfo().IsDir() {
-			err := x.mkDir(cleanPath, zipFile.Mode(), zipFile.Modified)
+			err := x.mkDirFile(&file{
+				Path: cleanPath, FileMode: zipFile.Mode(), Mtime: zipFile.Modified, Owner: zipOwner(zipFile.Extra),
+			})
 			if err != nil {
 				return nil, files, fmt.Errorf("%s: making zipFile dir: %w", x.FilePath, err)
 			}
@@ -129,11 +130,13 @@ func (x *XFile) extractZIPEntry(entry zipFileEntry) error {
 
 	fileInfo := &file{
 		Path:     x.clean(entry.decodedName),
+		Member:   entry.decodedName,
 		Data:     zFile,
 		FileMode: entry.zipFile.Mode(),
 		DirMode:  x.DirMode,
 		Mtime:    entry.zipFile.Modified,
 		Atime:    time.Now(),
+		Owner:    zipOwner(entry.zipFile.Extra),
 	}
 
 	_, err = x.writeParallel(fileInfo)
@@ -154,11 +157,13 @@ func (x *XFile) unzipWithName(zipFile *zip.File, name string) (uint64, string, e
 
 	file := &file{
 		Path:     x.clean(name),
+		Member:   name,
 		Data:     zFile,
 		FileMode: zipFile.Mode(),
 		DirMode:  x.DirMode,
 		Mtime:    zipFile.Modified,
 		Atime:    time.Now(),
+		Owner:    zipOwner(zipFile.Extra),
 	}
 
 	if !x.pathWithinOutput(file.Path) {
@@ -170,7 +175,7 @@ func (x *XFile) unzipWithName(zipFile *zip.File, name string) (uint64, string, e
 	if zipFile.FileInfo().IsDir() {
 		x.Debugf("Writing archived directory: %s", file.Path)
 
-		err := x.mkDir(file.Path, zipFile.Mode(), zipFile.Modified)
+		err := x.mkDirFile(file)
 		if err != nil {
 			return 0, file.Path, fmt.Errorf("making zipFile dir: %w", err)
 		}